@@ -11,9 +11,11 @@ import (
 	"strings"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/ca"
 	"github.com/smallstep/cli/command"
 	"github.com/smallstep/cli/command/version"
+	"github.com/smallstep/cli/completion"
 	"github.com/smallstep/cli/config"
 	"github.com/smallstep/cli/errs"
 	"github.com/smallstep/cli/usage"
@@ -81,6 +83,36 @@ func main() {
 		Usage: "path to the config file to use for CLI flags",
 	})
 
+	// Flag to print errors in a machine readable format
+	errorFormat := "text"
+	app.Flags = append(app.Flags, cli.StringFlag{
+		Name:   "error-format",
+		Usage:  "the <format> of the errors, text or json",
+		EnvVar: "STEP_ERROR_FORMAT",
+		Value:  "text",
+	})
+	// Hidden flag to print the shell completion scripts, e.g.
+	// step --generate-completion fish > ~/.config/fish/completions/step.fish
+	app.Flags = append(app.Flags, cli.StringFlag{
+		Name:   "generate-completion",
+		Usage:  "print the completion script for the <shell>, bash, zsh or fish",
+		Hidden: true,
+	})
+	app.Action = appAction
+
+	app.Before = func(ctx *cli.Context) error {
+		switch f := ctx.GlobalString("error-format"); f {
+		case "text", "json":
+			errorFormat = f
+			return nil
+		default:
+			return errs.InvalidFlagValue(ctx, "error-format", f, "text, json")
+		}
+	}
+
+	// Errors are printed below, with the exit code of their class
+	app.ExitErrHandler = func(*cli.Context, error) {}
+
 	// All non-successful output should be written to stderr
 	app.Writer = os.Stdout
 	app.ErrWriter = os.Stderr
@@ -95,7 +127,18 @@ func main() {
 	}
 
 	if err := app.Run(os.Args); err != nil {
-		if fe, ok := err.(errs.FriendlyError); ok {
+		var fe errs.FriendlyError
+		if errorFormat == "json" {
+			message := err.Error()
+			if errors.As(err, &fe) {
+				message = fe.Message()
+			}
+			if b, jerr := errs.MarshalError(err, message); jerr == nil {
+				fmt.Fprintln(os.Stderr, string(b))
+			} else {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		} else if errors.As(err, &fe) {
 			if os.Getenv("STEPDEBUG") == "1" {
 				fmt.Fprintf(os.Stderr, "%+v\n\n%s", err, fe.Message())
 			} else {
@@ -109,8 +152,26 @@ func main() {
 				fmt.Fprintln(os.Stderr, err)
 			}
 		}
-		os.Exit(1)
+		os.Exit(errs.ExitCode(err))
+	}
+}
+
+// appAction prints the completion script if --generate-completion is set.
+// Otherwise it behaves like the default action of the app, it prints the help
+// of the command in the first argument, or the app help if there are none.
+func appAction(ctx *cli.Context) error {
+	if shell := ctx.GlobalString("generate-completion"); shell != "" {
+		script, err := completion.Script(shell)
+		if err != nil {
+			return errs.InvalidFlagValue(ctx, "generate-completion", shell, "bash, zsh, fish")
+		}
+		fmt.Fprint(ctx.App.Writer, script)
+		return nil
 	}
+	if args := ctx.Args(); args.Present() {
+		return cli.ShowCommandHelp(ctx, args.First())
+	}
+	return cli.ShowAppHelp(ctx)
 }
 
 func panicHandler() {
@@ -144,8 +205,13 @@ func stringifyFlag(f cli.Flag) string {
 	usage := fv.FieldByName("Usage").String()
 	placeholder := placeholderString.FindString(usage)
 	if placeholder == "" {
-		switch f.(type) {
+		switch v := f.(type) {
 		case cli.BoolFlag, cli.BoolTFlag:
+		case cli.GenericFlag:
+			// Generic flags can behave like a boolean, e.g. a counter
+			if b, ok := v.Value.(interface{ IsBoolFlag() bool }); !ok || !b.IsBoolFlag() {
+				placeholder = "<value>"
+			}
 		default:
 			placeholder = "<value>"
 		}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/smallstep/cli/errs"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli"
+)
+
+func newTestApp(w *bytes.Buffer) *cli.App {
+	app := cli.NewApp()
+	app.Name = "step"
+	app.Commands = []cli.Command{{Name: "ssh", Usage: "create and manage ssh certificates"}}
+	app.Flags = []cli.Flag{cli.StringFlag{Name: "generate-completion"}}
+	app.Action = appAction
+	app.ExitErrHandler = func(*cli.Context, error) {}
+	app.Writer = w
+	app.ErrWriter = w
+	return app
+}
+
+func TestAppAction(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, newTestApp(&buf).Run([]string{"step"}))
+	require.Contains(t, buf.String(), "ssh")
+
+	buf.Reset()
+	require.NoError(t, newTestApp(&buf).Run([]string{"step", "ssh"}))
+	require.Contains(t, buf.String(), "create and manage ssh certificates")
+
+	buf.Reset()
+	require.NoError(t, newTestApp(&buf).Run([]string{"step", "--generate-completion", "bash"}))
+	require.Contains(t, buf.String(), "--generate-bash-completion")
+
+	err := newTestApp(&buf).Run([]string{"step", "--generate-completion", "ksh"})
+	require.EqualError(t, err, "invalid value 'ksh' for flag '--generate-completion'; options are bash, zsh, fish")
+	require.Equal(t, 3, errs.ExitCode(err))
+
+	// Unknown commands keep the default exit code
+	err = newTestApp(&buf).Run([]string{"step", "nosuchcmd"})
+	require.EqualError(t, err, "No help topic for 'nosuchcmd'")
+	require.Equal(t, 3, errs.ExitCode(err))
+}
@@ -21,6 +21,7 @@ func certificateCommand() cli.Command {
 		Usage:  "generate a new private key and certificate signed by the root certificate",
 		UsageText: `**step ca certificate** <subject> <crt-file> <key-file>
 [**--token**=<token>]  [**--issuer**=<name>] [**--ca-url**=<uri>] [**--root**=<file>]
+[**--ca-timeout**=<duration>] [**--ca-retries**=<n>]
 [**--not-before**=<time|duration>] [**--not-after**=<time|duration>]
 [**--san**=<SAN>] [**--set**=<key=value>] [**--set-file**=<path>]
 [**--acme**=<path>] [**--standalone**] [**--webroot**=<path>]
@@ -145,10 +146,13 @@ multiple SANs. The '--san' flag and the '--token' flag are mutually exclusive.`,
 			flags.TemplateSetFile,
 			flags.CaConfig,
 			flags.CaURL,
+			flags.CaTimeout,
+			flags.CaRetries,
 			flags.Root,
 			flags.Token,
 			flags.Provisioner,
 			flags.ProvisionerPasswordFile,
+			flags.ProvisionerPasswordStdin,
 			flags.KTY,
 			flags.Curve,
 			flags.Size,
@@ -156,7 +160,7 @@ multiple SANs. The '--san' flag and the '--token' flag are mutually exclusive.`,
 			flags.NotBefore,
 			flags.Force,
 			flags.Offline,
-			consoleFlag,
+			flags.Console,
 			flags.X5cCert,
 			flags.X5cKey,
 			acmeFlag,
@@ -40,6 +40,7 @@ func renewCertificateCommand() cli.Command {
 		Usage:  "renew a valid certificate",
 		UsageText: `**step ca renew** <crt-file> <key-file>
 [**--ca-url**=<uri>] [**--root**=<path>] [**--password-file**=<path>]
+[**--ca-timeout**=<duration>] [**--ca-retries**=<n>]
 [**--out**=<path>] [**--expires-in**=<duration>] [**--force**]
 [**--expires-in**=<duration>] [**--pid**=<int>] [**--pid-file**=<path>]
 [**--signal**=<int>] [**--exec**=<string>] [**--daemon**]
@@ -133,6 +134,8 @@ $ step ca renew --offline internal.crt internal.key
 		Flags: []cli.Flag{
 			flags.CaConfig,
 			flags.CaURL,
+			flags.CaTimeout,
+			flags.CaRetries,
 			flags.Force,
 			flags.Offline,
 			flags.PasswordFile,
@@ -403,10 +406,13 @@ func newRenewer(ctx *cli.Context, caURL string, cert tls.Certificate, rootFile s
 			return nil, err
 		}
 	} else {
-		client, err = ca.NewClient(caURL, ca.WithTransport(tr))
+		caClient, err := ca.NewClient(caURL, ca.WithTransport(tr))
 		if err != nil {
 			return nil, err
 		}
+		if client, err = cautils.WithRetries(ctx, caClient); err != nil {
+			return nil, err
+		}
 	}
 
 	return &renewer{
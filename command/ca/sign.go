@@ -24,7 +24,8 @@ func signCertificateCommand() cli.Command {
 		UsageText: `**step ca sign** <csr-file> <crt-file>
 [**--token**=<token>] [**--issuer**=<name>] [**--provisioner-password-file=<file>]
 [**--not-before**=<time|duration>] [**--not-after**=<time|duration>]
-[**--ca-url**=<uri>] [**--root**=<path>]
+[**--ca-url**=<uri>] [**--root**=<path>] [**--ca-timeout**=<duration>]
+[**--ca-retries**=<n>]
 [**--set**=<key=value>] [**--set-file**=<path>]
 [**--acme**=<uri>] [**--standalone**] [**--webroot**=<path>]
 [**--contact**=<email>] [**--http-listen**=<address>] [**--console**]
@@ -110,6 +111,8 @@ $ step ca sign foo.csr foo.crt \
 		Flags: []cli.Flag{
 			flags.CaConfig,
 			flags.CaURL,
+			flags.CaTimeout,
+			flags.CaRetries,
 			flags.Root,
 			flags.Token,
 			flags.Provisioner,
@@ -120,7 +123,7 @@ $ step ca sign foo.csr foo.crt \
 			flags.TemplateSetFile,
 			flags.Force,
 			flags.Offline,
-			consoleFlag,
+			flags.Console,
 			flags.X5cCert,
 			flags.X5cKey,
 			acmeFlag,
@@ -166,6 +166,7 @@ multiple principals.`,
 			flags.Root,
 			flags.Provisioner,
 			flags.ProvisionerPasswordFileWithAlias,
+			flags.ProvisionerPasswordStdin,
 			flags.X5cCert,
 			flags.X5cKey,
 			flags.SSHPOPCert,
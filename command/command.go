@@ -11,6 +11,7 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/cli/config"
+	"github.com/smallstep/cli/errs"
 	"github.com/smallstep/cli/usage"
 	"github.com/urfave/cli"
 )
@@ -41,11 +42,12 @@ func Retrieve() []cli.Command {
 	return cmds
 }
 
-// ActionFunc returns a cli.ActionFunc that stores the context.
+// ActionFunc returns a cli.ActionFunc that stores the context. Errors with a
+// class are returned as an errs.ClassError, so they define the exit code.
 func ActionFunc(fn cli.ActionFunc) cli.ActionFunc {
 	return func(ctx *cli.Context) error {
 		currentContext = ctx
-		return fn(ctx)
+		return errs.WithClass(fn(ctx))
 	}
 }
 
@@ -143,7 +143,8 @@ $ step oauth --client-id my-client-id --client-secret my-client-secret \
 			},
 			cli.BoolFlag{
 				Name:  "console, c",
-				Usage: "Complete the flow while remaining only inside the terminal",
+				Usage: `Complete the flow while remaining only inside the terminal. This is the
+default if the BROWSER environment variable is set to "none".`,
 			},
 			cli.StringFlag{
 				Name:  "client-id",
@@ -242,7 +243,7 @@ func oauthCmd(c *cli.Context) error {
 	opts := &options{
 		Provider:         c.String("provider"),
 		Email:            c.String("email"),
-		Console:          c.Bool("console"),
+		Console:          c.Bool("console") || exec.IsBrowserDisabled(),
 		Implicit:         c.Bool("implicit"),
 		CallbackListener: c.String("listen"),
 		TerminalRedirect: c.String("redirect-url"),
@@ -509,7 +510,7 @@ func disco(provider string) (map[string]interface{}, error) {
 	}
 	resp, err := http.Get(url.String())
 	if err != nil {
-		return nil, errors.Wrapf(err, "error retrieving %s", url.String())
+		return nil, errors.Wrapf(err, "error connecting to the identity provider: check that %s is reachable", url.String())
 	}
 	defer resp.Body.Close()
 	b, err := ioutil.ReadAll(resp.Body)
@@ -2,21 +2,22 @@ package ssh
 
 import (
 	"bytes"
+	"context"
 	"crypto"
-	"crypto/rand"
-	"crypto/x509"
+	"fmt"
 	"io/ioutil"
-	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
-	"github.com/smallstep/certificates/api"
 	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/certificates/ca"
 	"github.com/smallstep/certificates/ca/identity"
 	"github.com/smallstep/cli/command"
-	"github.com/smallstep/cli/crypto/keys"
+	"github.com/smallstep/cli/crypto/kms"
 	"github.com/smallstep/cli/crypto/pemutil"
 	"github.com/smallstep/cli/crypto/sshutil"
 	"github.com/smallstep/cli/errs"
@@ -29,18 +30,34 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+// certificateLockTimeout is the maximum time to wait for other step processes
+// writing the same files.
+const certificateLockTimeout = time.Minute
+
 func certificateCommand() cli.Command {
 	return cli.Command{
-		Name:   "certificate",
-		Action: command.ActionFunc(certificateAction),
-		Usage:  "sign a SSH certificate using the the SSH CA",
+		Name:         "certificate",
+		Action:       command.ActionFunc(certificateAction),
+		BashComplete: certificateComplete,
+		Usage:        "sign a SSH certificate using the the SSH CA",
 		UsageText: `**step ssh certificate** <key-id> <key-file>
-[**--host**] [--**host-id**] [**--sign**] [**--principal**=<string>] [**--password-file**=<path>]
-[**--provisioner-password-file**=<path>] [**--add-user**]
+[**--host**] [--**host-id**] [**--sign**] [**--identity**=<key-file>]
+[**--principal**=<string>] [**--principals-from-host**] [**--exclude-principal**=<string>]
+[**--password-file**=<path>]
+[**--provisioner-password-file**=<path>] [**--provisioner-password-stdin**] [**--add-user**]
+[**--add-user-principal**=<name>] [**--add-user-out**=<file>]
 [**--not-before**=<time|duration>] [**--not-after**=<time|duration>]
-[**--token**=<token>] [**--issuer**=<name>] [**--ca-url**=<uri>]
-[**--root**=<path>] [**--no-password**] [**--insecure**] [**--force**]
-[**--x5c-cert**=<path>] [**--x5c-key**=<path>] [**--k8ssa-token-path=<path>]`,
+[**--ttl**=<duration>] [**--token**=<token>] [**--issuer**=<name>] [**--ca-url**=<uri>]
+[**--root**=<path>] [**--fingerprint**=<fingerprint>] [**--ca-timeout**=<duration>]
+[**--ca-retries**=<n>] [**--no-password**]
+[**--key-out**=<file>] [**--pub-out**=<file>] [**--crt-out**=<file>] [**--kms**=<uri>]
+[**--insecure**] [**--force**] [**--x5c-cert**=<path>] [**--x5c-key**=<path>] [**--k8ssa-token-path**=<path>]
+[**--no-pty**] [**--no-port-forwarding**] [**--no-agent-forwarding**]
+[**--no-x11-forwarding**] [**--no-user-rc**]
+[**--agent-socket**=<path>] [**--key-id**=<string>] [**--strict**]
+[**--ssh-config**=<file>] [**--host-pattern**=<pattern>] [**--remove-ssh-config**]
+[**--split-principals**] [**--backdate**=<duration>] [**--clock-skew**=<duration>]
+[**--console**] [**--quiet**] [**--json**] [**--verbose**]`,
 		Description: `**step ssh certificate** command generates an SSH key pair and creates a
 certificate using [step certificates](https://github.com/smallstep/certificates).
 
@@ -66,6 +83,58 @@ HostCertificate /etc/ssh/ssh_host_ecdsa_key-cert.pub
 
 Make sure to restart the sshd daemon to refresh its configuration.
 
+After the certificate has been issued, the command prints a summary with the
+key id, serial, principals, validity, critical options and extensions of the
+certificate returned by the CA, as the CA might have modified the requested
+values. Use **--quiet** to skip it or **--json** to print it in JSON format.
+
+Before generating a one-time token, the command prints the subject, type,
+principals and validity of the certificate and asks for confirmation. The
+confirmation is skipped if **--force** is used, if a **--token** is given or if
+the standard input is not a terminal. Host principals must be valid hostnames or
+IP addresses. Hostnames are converted to lowercase and the trailing dot is
+removed, as ssh compares them with the lowercase name used by the client.
+Wildcards are not allowed in host principals, OpenSSH does not expand them and
+"*.example.com" would only match a host with that literal name; use
+**--insecure** to request them anyway. User principals passed with
+**--principal** must be valid POSIX user names, optionally with the format
+user@domain; use **--insecure** to only print a warning.
+
+With **--ssh-config** and **--host-pattern** the command adds a Host block to the
+given ssh client configuration, like <~/.ssh/config>, with the IdentityFile and
+CertificateFile of the new certificate. With **--add-user** the block also
+contains a ProxyCommand that uses the add user certificate to create the user
+in the server. The block is surrounded by BEGIN and END step markers; running
+the command again for the same host pattern updates it in place, and
+**--remove-ssh-config** removes it. The previous configuration is kept in
+"<file>.bak".
+
+With **--add-user** the command also writes an add user certificate, used to
+create the user in the server before the first login. The CA creates the user of
+the first principal, use **--add-user-principal** to set it. The files are
+"<key-file>-provisioner", "<key-file>-provisioner.pub" and
+"<key-file>-provisioner-cert.pub", or the base name given with **--add-user-out**.
+The certificate is for the login user configured in the CA, "provisioner" by
+default, and the command prints it. For example, to create the user with a
+default CA:
+'''
+$ ssh -i id_ecdsa-provisioner -o CertificateFile=id_ecdsa-provisioner-cert.pub \
+  -o IdentitiesOnly=yes provisioner@internal.example.com
+'''
+
+The key id requested to the CA is <key-id>, unless **--key-id** is used. The
+token is always generated for <key-id>. If the CA issues the certificate with a
+different key id the command prints a warning, and the summary includes the
+requested one. With **--strict** the command fails instead, and no file is
+written.
+
+The flags **--no-pty**, **--no-port-forwarding**, **--no-agent-forwarding**,
+**--no-x11-forwarding** and **--no-user-rc** request a user certificate without
+the corresponding OpenSSH extensions. The requested extensions are sent in the
+template data, and the provisioner template must use them with
+'{{ toJson .Insecure.User.extensions }}'. The command will fail if the
+certificate returned by the CA has any of the removed extensions.
+
 To configure clients to accept host certificates you need to add the host CA public
 key in <~/.ssh/known_hosts> with the following format:
 '''
@@ -75,6 +144,30 @@ key in <~/.ssh/known_hosts> with the following format:
 Where <*.example.com> is a pattern that matches the hosts and
 <ecdsa-sha2-nistp256 AAAAE...=> should be the contents of the host CA public key.
 
+With **--kms** the private key is kept in a key management system, like a
+PKCS #11 module. The key is created in the KMS if it does not exist, and only
+its public key is sent to the CA. The command writes only the certificate, no
+private or public key files are written and the certificate is not added to the
+SSH agent. Use **ssh-keygen -D** or the agent of the token to use the key.
+
+With **--split-principals** the command requests one certificate for each
+**--principal** instead of one certificate with all of them. All the
+certificates are for the same key, and they are written to
+"<key-file>-cert.<principal>.pub". Each certificate uses its own token, the
+provisioner and its password are only asked once. User certificates are added
+to the agent as different identities, with the comment "<key-id> (<principal>)".
+
+The CA uses its own clock for the default validity of the certificate, so a
+certificate might not be valid yet in a host with a clock behind the CA. The
+command prints a warning if the certificate is not valid yet, or it has already
+expired, by more than **--clock-skew**. Use **--backdate** to request a
+certificate that starts to be valid some time before the current time of the
+CA, so it can be used immediately across a fleet with skewed clocks.
+
+Concurrent invocations writing the same files, like a cron job and a login
+script, are serialized with a lock file in <$STEPPATH/locks>. The command waits
+up to a minute for the other process to finish and fails if it does not.
+
 ## POSITIONAL ARGUMENTS
 
 <key-id>
@@ -84,7 +177,40 @@ be abc.
 
 <key-file>
 :  The private key name when generating a new key pair, or the public
-key path when we are just signing it.
+key path when we are just signing it. It must not be passed when the
+**--identity** flag is used. With **--kms** it is only used to name the
+certificate file "<key-file>-cert.pub". A leading "~" or "~user" and environment variables
+are expanded in <key-file> and in the paths of the flags, even if the shell does
+not expand them.
+
+## EXIT CODES
+
+This command returns 0 on success and \>0 if any error occurs:
+
+**1**
+:  An unclassified error.
+
+**3**
+:  Invalid positional arguments or flags.
+
+**4**
+:  The token could not be generated or the provisioner authentication failed.
+
+**5**
+:  The CA rejected the request.
+
+**6**
+:  The CA is unavailable, it cannot be reached or it returned a server error.
+
+**7**
+:  A local file could not be read or written.
+
+Use the global flag **--error-format json** to print the error in STDERR as a
+JSON object with the exit code, its class and the error message:
+'''
+$ step --error-format json ssh certificate mariano@work id_ecdsa
+{"code":5,"class":"ca-rejected","message":"The request lacked necessary authorization to be completed."}
+'''
 
 ## EXAMPLES
 
@@ -98,6 +224,11 @@ Generate a new SSH key pair and user certificate and set the lifetime to 2hrs:
 $ step ssh certificate mariano@work id_ecdsa --not-after 2h
 '''
 
+Generate a new SSH key pair and user certificate valid for 7 days:
+'''
+$ step ssh certificate mariano@work id_ecdsa --ttl 7d
+'''
+
 Generate a new SSH key pair and user certificate and set the lifetime to begin
 2hrs from now and last for 8hrs:
 '''
@@ -133,6 +264,29 @@ $ step ssh certificate --host --host-id machine --sign \
 	internal.example.com ssh_host_ecdsa_key.pub
 '''
 
+Generate a new SSH key pair and host certificate, writing the private key in
+tmpfs and the public key and certificate in a persistent disk:
+'''
+$ step ssh certificate --host --key-out /run/ssh/ssh_host_ecdsa_key \
+	--pub-out /etc/ssh/ssh_host_ecdsa_key.pub \
+	--crt-out /etc/ssh/ssh_host_ecdsa_key-cert.pub \
+	internal.example.com ssh_host_ecdsa_key
+'''
+
+Generate a host certificate for a key in a PKCS #11 module, the key is created
+if it does not exist and only the certificate is written:
+'''
+$ step ssh certificate --host \
+	--kms 'pkcs11:module-path=/usr/local/lib/softhsm/libsofthsm2.so;token=smallstep;id=%01?pin-source=/etc/ssh/pin.txt' \
+	internal.example.com /etc/ssh/ssh_host_ecdsa_key
+'''
+
+Sign an SSH public key and write the certificate to a custom path:
+'''
+$ step ssh certificate --host --sign --crt-out /etc/ssh/ssh_host_ecdsa_cert.pub \
+	internal.example.com /etc/ssh/ssh_host_ecdsa_key.pub
+'''
+
 Generate an ssh certificate with custom principals from an existing key pair and
 add the certificate to the ssh agent:
 '''
@@ -140,65 +294,280 @@ $ step ssh certificate --principal max --principal mariano --sign \
 	ops@work id_ecdsa.pub --private-key id_ecdsa_key
 '''
 
+Generate a host certificate with an explicit key id, failing if the CA does not
+use it:
+'''
+$ step ssh certificate --host --key-id host-1234 --strict \
+	internal.example.com ssh_host_ecdsa_key
+'''
+
+Generate a new user certificate and configure ssh to use it for the hosts in
+example.com:
+'''
+$ step ssh certificate --ssh-config ~/.ssh/config --host-pattern '*.example.com' \
+	mariano@work ~/.ssh/id_ecdsa
+'''
+
+Remove the Host block added for the hosts in example.com:
+'''
+$ step ssh certificate --remove-ssh-config --ssh-config ~/.ssh/config \
+	--host-pattern '*.example.com'
+'''
+
+Sign an SSH public key and print the certificate details in JSON format:
+'''
+$ step ssh certificate --sign --json mariano@work id_ecdsa.pub
+'''
+
+Create a certificate for an existing private key and add it to the agent:
+'''
+$ step ssh certificate --identity ~/.ssh/id_ecdsa mariano@work
+'''
+
+Generate a new SSH key pair and user certificate without a root file, the root
+certificate of the CA is downloaded and verified using its fingerprint:
+'''
+$ step ssh certificate --ca-url https://ca.smallstep.com \
+	--fingerprint d9d0978692f1c7cc791f5c343ce98771900721405e834cd27b9502cc719f5097 \
+	mariano@work id_ecdsa
+'''
+
+Generate a new host certificate on a flaky network, each request to the CA
+times out after 10 seconds, and connection errors and 5xx responses are
+retried up to 3 times:
+'''
+$ step ssh certificate --host --ca-timeout 10s --ca-retries 3 \
+	--token $TOKEN internal.example.com ssh_host_ecdsa_key
+'''
+
+Generate a new key pair and a certificate using an OIDC provisioner without
+opening a browser, useful in remote sessions:
+'''
+$ step ssh certificate --console --provisioner Google mariano@work id_ecdsa
+'''
+
+Generate a host certificate with the names and addresses of the current host,
+except the address 10.0.0.10:
+'''
+$ step ssh certificate --host --principals-from-host --exclude-principal 10.0.0.10 \
+  internal.example.com ssh_host_ecdsa_key
+'''
+
+Generate a restricted user certificate for an automation account without pty
+or port forwarding:
+'''
+$ step ssh certificate --no-pty --no-port-forwarding deploy@example.com id_deploy
+'''
+
+Sign the public key of a FIDO/U2F security key, like an sk-ssh-ed25519 key
+generated with 'ssh-keygen -t ed25519-sk':
+'''
+$ step ssh certificate --sign mariano@work id_ed25519_sk.pub
+'''
+
+Generate a key pair and a certificate for each principal, written to
+id_ecdsa-cert.acme.pub and id_ecdsa-cert.globex.pub:
+'''
+$ step ssh certificate --split-principals \
+  --principal acme --principal globex mariano@work id_ecdsa
+'''
+
 Generate a new key pair and a certificate using a given token:
 '''
 $ step ssh certificate --token $TOKEN mariano@work id_ecdsa
+'''
+
+Print each step of the request, including the JSON sent to the CA and its
+response, while generating a new key pair and a certificate:
+'''
+$ step ssh certificate -vv mariano@work id_ecdsa
 '''`,
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			flags.CaConfig,
 			flags.CaURL,
+			flags.CaTimeout,
+			flags.CaRetries,
+			flags.Console,
 			flags.Force,
 			flags.Insecure,
 			flags.Root,
+			flags.Fingerprint,
 			flags.NoPassword,
 			flags.NotBefore,
 			flags.NotAfter,
+			flags.TTL,
 			flags.Offline,
 			flags.Provisioner,
 			flags.Token,
 			flags.TemplateSet,
 			flags.TemplateSetFile,
 			sshAddUserFlag,
+			sshAgentSocketFlag,
 			sshHostFlag,
 			sshHostIDFlag,
+			sshIdentityFlag,
 			sshPasswordFileFlag,
 			sshPrincipalFlag,
+			sshPrincipalsFromHostFlag,
+			sshExcludePrincipalFlag,
 			sshPrivateKeyFlag,
 			sshProvisionerPasswordFlag,
+			flags.ProvisionerPasswordStdin,
 			sshSignFlag,
+			sshNoPtyFlag,
+			sshNoPortForwardingFlag,
+			sshNoAgentForwardingFlag,
+			sshNoX11ForwardingFlag,
+			sshNoUserRCFlag,
 			flags.X5cCert,
 			flags.X5cKey,
 			flags.K8sSATokenPathFlag,
-		},
+			cli.StringFlag{
+				Name: "add-user-principal",
+				Usage: `The <name> of the user created with the add user certificate. It is the only
+principal of the certificate, by default it is derived from <key-id>. It
+requires **--add-user**.`,
+			},
+			cli.StringFlag{
+				Name: "add-user-out",
+				Usage: `The base <file> of the add user files, instead of "<key-file>-provisioner". The
+files are <file>, "<file>.pub" and "<file>-cert.pub". It requires **--add-user**.`,
+			},
+			cli.StringFlag{
+				Name: "key-out",
+				Usage: `The <file> to write the private key to, instead of <key-file>. The add user
+files will use it as their base name. It cannot be used with **--sign** or
+**--identity**.`,
+			},
+			cli.StringFlag{
+				Name: "pub-out",
+				Usage: `The <file> to write the public key to, instead of "<key-file>.pub". It
+cannot be used with **--sign**.`,
+			},
+			cli.StringFlag{
+				Name:  "crt-out",
+				Usage: `The <file> to write the certificate to, instead of "<key-file>-cert.pub".`,
+			},
+			cli.StringFlag{
+				Name: "kms",
+				Usage: `The <uri> of the key in a key management system, the key is created if it does
+not exist. Only the certificate is written. Use "pkcs11:" uris for a PKCS #11
+module, they require a build with the pkcs11 tag and the PIN is asked if the uri
+does not contain it. It cannot be used with **--sign**, **--identity**,
+**--private-key**, **--key-out**, **--pub-out** or **--add-user**.`,
+			},
+			cli.StringFlag{
+				Name: "key-id",
+				Usage: `The key id requested to the CA, instead of <key-id>. The token is still
+generated for <key-id>.`,
+			},
+			cli.BoolFlag{
+				Name:  "strict",
+				Usage: `Fail if the CA issues the certificate with a key id different than the requested.`,
+			},
+			cli.StringFlag{
+				Name: "ssh-config",
+				Usage: `The ssh client configuration <file>, like ~/.ssh/config, where a Host block for
+the new certificate is added. It requires **--host-pattern**.`,
+			},
+			cli.StringFlag{
+				Name:  "host-pattern",
+				Usage: `The <pattern> of the Host block added with **--ssh-config**, e.g. "*.example.com".`,
+			},
+			cli.BoolFlag{
+				Name: "remove-ssh-config",
+				Usage: `Remove the Host block for **--host-pattern** from the **--ssh-config** file
+without requesting a certificate.`,
+			},
+			cli.BoolFlag{
+				Name: "split-principals",
+				Usage: `Request a certificate for each **--principal**, all of them for the same key,
+and write them to "<key-file>-cert.<principal>.pub".`,
+			},
+			cli.DurationFlag{
+				Name: "backdate",
+				Usage: `Request a certificate valid since <duration> before the current time of the CA,
+e.g. "5m". It cannot be used with **--not-before**.`,
+			},
+			cli.DurationFlag{
+				Name: "clock-skew",
+				Usage: `The <duration> tolerated between the local clock and the validity of the
+certificate issued by the CA before printing a warning.`,
+				Value: time.Minute,
+			},
+			cli.BoolFlag{
+				Name:  "quiet",
+				Usage: `Do not print the summary of the certificate issued by the CA.`,
+			},
+			cli.BoolFlag{
+				Name: "json",
+				Usage: `Print the summary of the certificate issued by the CA in JSON format to
+STDOUT.`,
+			},
+		}, newVerbosityFlags()...),
 	}
 }
 
 func certificateAction(ctx *cli.Context) error {
-	if err := errs.NumberOfArguments(ctx, 2); err != nil {
+	if err := validateCertificateFlags(ctx); err != nil {
 		return err
 	}
+	log := newCertificateLogger(ctx)
+	logFlags(log, ctx)
+
+	// Expand ~ and environment variables in the paths, they are not always
+	// expanded by the shell.
+	if err := flags.ExpandPathFlags(ctx, "identity", "private-key", "password-file",
+		"provisioner-password-file", "key-out", "pub-out", "crt-out", "root",
+		"ca-config", "x5c-cert", "x5c-key", "k8ssa-token-path", "ssh-config", "add-user-out"); err != nil {
+		return err
+	}
+
+	sshConfig := ctx.String("ssh-config")
+	hostPattern := ctx.String("host-pattern")
+	if ctx.Bool("remove-ssh-config") {
+		ok, err := removeSSHConfig(sshConfig, hostPattern)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.Errorf("%s does not have a Host block for %s", sshConfig, hostPattern)
+		}
+		ui.PrintSelected("SSH Config", sshConfig)
+		return nil
+	}
 
 	args := ctx.Args()
 	subject := args.Get(0)
-	keyFile := args.Get(1)
-	baseName := keyFile
-	// SSH uses fixed suffixes for public keys and certificates
-	pubFile := baseName + ".pub"
-	crtFile := baseName + "-cert.pub"
+	keyFile, err := utils.ExpandPath(args.Get(1))
+	if err != nil {
+		return errs.InvalidFlagValueMsg(ctx, "key-file", args.Get(1), err.Error())
+	}
+	// With --identity the key file is the value of the flag
+	identityFile := ctx.String("identity")
+	if identityFile != "" {
+		keyFile = identityFile
+	}
+	baseName, keyOut, pubFile, crtFile := certificateFiles(ctx, keyFile)
 
 	// Flags
 	token := ctx.String("token")
 	isHost := ctx.Bool("host")
-	hostID := ctx.String("host-id")
 	isSign := ctx.Bool("sign")
-	isAddUser := ctx.Bool("add-user")
 	principals := ctx.StringSlice("principal")
+	// The CA creates the first principal of the certificate in the server
+	addUserPrincipal := ctx.String("add-user-principal")
+	if addUserPrincipal != "" {
+		principals = []string{addUserPrincipal}
+	}
 	passwordFile := ctx.String("password-file")
-	provisionerPasswordFile := ctx.String("provisioner-password-file")
 	noPassword := ctx.Bool("no-password")
-	insecure := ctx.Bool("insecure")
 	sshPrivKeyFile := ctx.String("private-key")
-	validAfter, validBefore, err := flags.ParseTimeDuration(ctx)
+	kmsURI := ctx.String("kms")
+	isQuiet := ctx.Bool("quiet")
+	isJSON := ctx.Bool("json")
+	splitPrincipals := ctx.Bool("split-principals")
+	validAfter, validBefore, err := parseCertificateValidity(ctx)
 	if err != nil {
 		return err
 	}
@@ -206,283 +575,638 @@ func certificateAction(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	extensions, _ := parseExtensions(ctx)
+	if extensions != nil {
+		if templateData, err = setTemplateExtensions(templateData, extensions); err != nil {
+			return err
+		}
+	}
 
-	// Hack to make the flag "password-file" the content of
-	// "provisioner-password-file" so the token command works as expected
-	ctx.Set("password-file", provisionerPasswordFile)
+	// Read the provisioner password before any other use of STDIN, like
+	// reading the public key with --sign. The password is passed to the token
+	// flow, so --password-file is only used for the private key.
+	provisionerPassword, err := flags.ParseProvisionerPassword(ctx)
+	if err != nil {
+		return err
+	}
 
-	// Validation
-	switch {
-	case noPassword && !insecure:
-		return errs.RequiredInsecureFlag(ctx, "no-password")
-	case noPassword && passwordFile != "":
-		return errs.IncompatibleFlagWithFlag(ctx, "no-password", "password-file")
-	case token != "" && provisionerPasswordFile != "":
-		return errs.IncompatibleFlagWithFlag(ctx, "token", "provisioner-password-file")
-	case isHost && isAddUser:
-		return errs.IncompatibleFlagWithFlag(ctx, "host", "add-user")
-	case !isHost && hostID != "":
-		return errs.RequiredWithFlag(ctx, sshHostIDFlag.Name, sshHostFlag.Name)
-	case isAddUser && len(principals) > 1:
-		return errors.New("flag '--add-user' is incompatible with more than one principal")
+	opts := SignOptions{
+		Subject:          subject,
+		KeyID:            ctx.String("key-id"),
+		StrictKeyID:      ctx.Bool("strict"),
+		Token:            token,
+		CertType:         provisioner.SSHUserCert,
+		ValidAfter:       validAfter,
+		ValidBefore:      validBefore,
+		TemplateData:     templateData,
+		Extensions:       extensions,
+		HostID:           ctx.String("host-id"),
+		AddUser:          ctx.Bool("add-user"),
+		AddUserPrincipal: addUserPrincipal,
+		AddUserBase:      ctx.String("add-user-out"),
+		BaseName:         baseName,
+		KeyFile:          keyOut,
+		PubFile:          pubFile,
+		CrtFile:          crtFile,
+		Logger:           log,
+	}
+	if !noPassword {
+		opts.KeyPassword = certificateKeyPassword(passwordFile)
 	}
 
-	// If we are signing a public key, get the proper name for the certificate
-	if isSign && strings.HasSuffix(keyFile, ".pub") {
-		baseName = keyFile[:len(keyFile)-4]
-		crtFile = baseName + "-cert.pub"
+	switch {
+	case kmsURI != "":
+		// The private key never leaves the KMS
+		if opts.PublicKey, err = loadKMSKey(kmsURI); err != nil {
+			return err
+		}
+	case identityFile != "":
+		// Load the identity key before generating a token, so a wrong password
+		// or a mismatched public key does not waste it.
+		if opts.PrivateKey, opts.PublicKey, opts.WritePublicKey, err = loadIdentityKey(identityFile, pubFile, passwordFile); err != nil {
+			return err
+		}
+	case isSign:
+		// Use public key supplied as input.
+		in, err := utils.ReadFile(keyFile)
+		if err != nil {
+			return err
+		}
+		if opts.PublicKey, _, _, _, err = ssh.ParseAuthorizedKey(in); err != nil {
+			return errors.Wrap(err, "error parsing ssh public key")
+		}
+		// The private key of a security key lives on the token, the file
+		// only contains a handle to it.
+		if len(sshPrivKeyFile) > 0 && !sshutil.IsSecurityKey(opts.PublicKey) {
+			if opts.PrivateKey, err = pemutil.Read(sshPrivKeyFile); err != nil {
+				return errors.Wrap(err, "error parsing private key")
+			}
+		}
 	}
 
-	var (
-		certType string
-		tokType  int
-	)
+	// Check the directories of the output files before generating a token.
+	// The split certificates are written next to the key.
+	outputs := []string{opts.CrtFile}
+	if splitPrincipals {
+		outputs = []string{opts.BaseName}
+	}
+	if !isSign && kmsURI == "" {
+		outputs = append(outputs, opts.PubFile)
+		if identityFile == "" {
+			outputs = append(outputs, opts.KeyFile)
+		}
+	}
+	if opts.AddUser {
+		addUserKey, _, _ := opts.AddUserFiles()
+		outputs = append(outputs, addUserKey)
+	}
+	if err := createOutputDirs(ctx, outputs...); err != nil {
+		return err
+	}
 
+	var tokType int
 	if isHost {
-		certType = provisioner.SSHHostCert
+		opts.CertType = provisioner.SSHHostCert
 		tokType = cautils.SSHHostSignType
 	} else {
-		certType = provisioner.SSHUserCert
 		tokType = cautils.SSHUserSignType
 	}
 
+	// Validate the principals passed by the user, the default user principals
+	// are derived from the subject and they can be an email. Host principals
+	// are normalized, the same list is used in the token and the request.
+	if principals, err = normalizePrincipals(principals, isHost, ctx.Bool("insecure")); err != nil {
+		return err
+	}
+
 	// By default use the first part of the subject as a principal
 	if len(principals) == 0 {
 		if isHost {
-			principals = append(principals, subject)
+			if principals, err = normalizePrincipals([]string{subject}, true, ctx.Bool("insecure")); err != nil {
+				return err
+			}
 		} else {
 			principals = createPrincipalsFromSubject(subject)
 		}
 	}
 
-	flow, err := cautils.NewCertificateFlow(ctx)
-	if err != nil {
-		return err
+	// Add the names and addresses of the host
+	if ctx.Bool("principals-from-host") {
+		hostNames, err := hostPrincipals()
+		if err != nil {
+			return err
+		}
+		if hostNames, err = normalizePrincipals(hostNames, true, false); err != nil {
+			return err
+		}
+		principals = filterPrincipals(append(principals, hostNames...), ctx.StringSlice("exclude-principal"))
+		if len(principals) == 0 {
+			return errors.New("all the principals have been excluded using '--exclude-principal'")
+		}
 	}
-	if len(token) == 0 {
-		if token, err = flow.GenerateSSHToken(ctx, subject, tokType, principals, validAfter, validBefore); err != nil {
+	opts.Principals = principals
+
+	// One-time tokens are wasted if the request is wrong, so confirm it
+	// before generating one. The principals found in the host are always
+	// confirmed.
+	if !ctx.Bool("force") && (ctx.Bool("principals-from-host") || (opts.Token == "" && stdinIsTerminal())) {
+		if err := confirmSignRequest(opts); err != nil {
 			return err
 		}
 	}
 
-	caClient, err := flow.GetClient(ctx, token)
+	// Concurrent invocations writing the same files would corrupt them, the
+	// lock is acquired before generating the token and held until the files
+	// are written and the certificate is added to the agent.
+	lock, err := utils.Lock(opts.BaseName, certificateLockTimeout)
 	if err != nil {
 		return err
 	}
+	defer lock.Unlock()
 
-	version, err := caClient.Version()
+	// With --fingerprint the root certificate is downloaded and verified
+	// here, before the token is generated and sent.
+	flow, err := cautils.NewCertificateFlow(ctx)
 	if err != nil {
 		return err
 	}
+	defer flow.Close()
 
-	// Generate identity certificate (x509) if necessary
-	var identityCSR api.CertificateRequest
-	var identityKey crypto.PrivateKey
-	if version.RequireClientAuthentication {
-		csr, key, err := ca.CreateIdentityRequest(subject)
+	// With --split-principals each certificate needs its own token, they are
+	// generated with the provisioner and password used in the first one.
+	tokenCache := new(cautils.TokenCache)
+	newToken := func(principals []string) (string, error) {
+		tok, err := flow.GenerateSSHToken(ctx, subject, tokType, principals, validAfter, validBefore,
+			withProvisionerPassword(provisionerPassword), cautils.WithTokenCache(tokenCache))
 		if err != nil {
+			log.Debugf("token", "error generating the token: %v", err)
+			return "", errs.Classify(flow.RootError(ctx, err), errs.TokenError)
+		}
+		logToken(log, tok)
+		return tok, nil
+	}
+	if len(opts.Token) == 0 {
+		tokenPrincipals := principals
+		if splitPrincipals {
+			tokenPrincipals = principals[:1]
+		}
+		log.Debugf("token", "generating a %s token for %s with principals [%s]", opts.CertType, subject, strings.Join(tokenPrincipals, ", "))
+		if opts.Token, err = newToken(tokenPrincipals); err != nil {
 			return err
 		}
+	} else {
+		logToken(log, opts.Token)
+	}
 
-		// All host identity certs need a URI SAN to work with our ssh API.
-		if isHost {
-			var u = uuid.Nil
-			switch hostID {
-			case "":
-				// If there is an old identity cert lying around, by default use the host ID so that running
-				// this command twice doesn't clobber your old host ID.
-				u, err = readExistingUUID()
-				if err != nil {
-					u, err = uuid.NewRandom()
-					if err != nil {
-						return errs.Wrap(err, "Unable to generate a host-id.")
-					}
-				}
-			case "machine":
-				u, err = deriveMachineID()
-				if err != nil {
-					return errs.Wrap(err, "Unable to derive a host-id. Make sure /etc/machine-id exists.")
-				}
-			default:
-				u, err = uuid.Parse(hostID)
-				if err != nil {
-					return errs.InvalidFlagValue(ctx, sshHostIDFlag.Name, hostID, "[ machine | <UUID> ]")
-				}
-			}
-			uri, err := url.Parse(u.URN())
-			if err != nil {
-				return errs.Wrap(err, "failed parsing uuid urn")
-			}
+	caClient, err := flow.GetClient(ctx, opts.Token)
+	if err != nil {
+		return err
+	}
 
-			template := &x509.CertificateRequest{
-				Subject:        csr.Subject,
-				DNSNames:       csr.DNSNames,
-				IPAddresses:    csr.IPAddresses,
-				EmailAddresses: csr.EmailAddresses,
-				// Prepend the generated uri. There is code that expects the
-				// uuid URI to be the first one.
-				URIs: append([]*url.URL{uri}, csr.URIs...),
-			}
-			csrBytes, err := x509.CreateCertificateRequest(rand.Reader, template, key)
-			if err != nil {
-				return errs.Wrap(err, "failed creating certificate request")
-			}
-			newCSR, err := x509.ParseCertificateRequest(csrBytes)
-			if err != nil {
-				return errs.Wrap(err, "failed parsing certificate request bytes")
-			}
-			if err := newCSR.CheckSignature(); err != nil {
-				return errs.Wrap(err, "failed signature check on new csr")
-			}
-			csr.CertificateRequest = newCSR
+	// Connect to the agent if the private key of a user certificate is known,
+	// because it is generated or read from a file. Security keys cannot be
+	// added, the private key is on the token.
+	var agent AgentClient
+	var agentErr error
+	skipAgent := !isHost && isSign && sshutil.IsSecurityKey(opts.PublicKey) && sshPrivKeyFile != ""
+	if !isHost && (opts.PublicKey == nil || opts.PrivateKey != nil) {
+		if a, err := dialAgent(ctx); err != nil {
+			log.Debugf("agent", "error connecting to the agent: %v", err)
+			agentErr = err
+		} else {
+			defer a.Close()
+			agent = a
 		}
-
-		identityCSR = *csr
-		identityKey = key
 	}
 
-	var sshPub ssh.PublicKey
-	var pub, priv interface{}
+	var results []*Result
+	crtFiles := []string{opts.CrtFile}
+	if splitPrincipals {
+		results, err = signPrincipals(opts, caClient, func(principal string) (string, error) {
+			return newToken([]string{principal})
+		}, fileWriter{}, agent)
+		crtFiles = make([]string, len(principals))
+		for i, p := range principals {
+			crtFiles[i] = splitCertificateFile(opts.BaseName, p)
+		}
+	} else {
+		var res *Result
+		if res, err = sign(opts, caClient, fileWriter{}, agent); err == nil {
+			results = []*Result{res}
+		}
+	}
+	if err != nil {
+		return flow.RootError(ctx, err)
+	}
+	res := results[0]
 
-	if isSign {
-		// Use public key supplied as input.
-		in, err := utils.ReadFile(keyFile)
-		if err != nil {
+	// Write x509 identity certificate
+	if res.RequireIdentity() {
+		if err := ca.WriteDefaultIdentity(res.IdentityCertificate, res.IdentityKey); err != nil {
 			return err
 		}
+		log.Debugf("files", "wrote the identity configuration %s", identity.IdentityFile)
+	}
 
-		sshPub, _, _, _, err = ssh.ParseAuthorizedKey(in)
-		if err != nil {
-			return errors.Wrap(err, "error parsing ssh public key")
-		}
-		if len(sshPrivKeyFile) > 0 {
-			if priv, err = pemutil.Read(sshPrivKeyFile); err != nil {
-				return errors.Wrap(err, "error parsing private key")
-			}
+	switch {
+	case kmsURI != "":
+		// Only the certificate is written
+	case identityFile != "":
+		if opts.WritePublicKey {
+			ui.PrintSelected("Public Key", pubFile)
 		}
-	} else {
-		// Generate keypair
-		pub, priv, err = keys.GenerateDefaultKeyPair()
-		if err != nil {
-			return err
+	case !isSign:
+		ui.PrintSelected("Private Key", opts.KeyFile)
+		ui.PrintSelected("Public Key", pubFile)
+	}
+	now := time.Now()
+	for i, r := range results {
+		ui.PrintSelected("Certificate", crtFiles[i])
+		if r.Certificate.KeyId != r.RequestedKeyID {
+			ui.Printf(`{{ "%s" | yellow }} {{ "Key ID:" | bold }} the CA rewrote the requested key id '%s' to '%s'`+"\n", ui.IconWarn, r.RequestedKeyID, r.Certificate.KeyId)
 		}
-
-		sshPub, err = ssh.NewPublicKey(pub)
-		if err != nil {
-			return errors.Wrap(err, "error creating public key")
+		for _, w := range checkClockSkew(r.Certificate, now, ctx.Duration("clock-skew")) {
+			ui.Printf(`{{ "%s" | yellow }} {{ "Clock:" | bold }} %s`+"\n", ui.IconWarn, w)
 		}
 	}
 
-	var sshAuPub ssh.PublicKey
-	var sshAuPubBytes []byte
-	var auPub, auPriv interface{}
-	if isAddUser {
-		auPub, auPriv, err = keys.GenerateDefaultKeyPair()
-		if err != nil {
-			return err
-		}
-		sshAuPub, err = ssh.NewPublicKey(auPub)
-		if err != nil {
-			return errors.Wrap(err, "error creating public key")
+	switch {
+	case skipAgent:
+		ui.Printf(`{{ "%s" | yellow }} {{ "SSH Agent:" | bold }} skipped, use ssh-add to add a security key`+"\n", ui.IconWarn)
+	case !isHost && kmsURI != "":
+		ui.Printf(`{{ "%s" | yellow }} {{ "SSH Agent:" | bold }} skipped, the private key is in the KMS`+"\n", ui.IconWarn)
+	case agentErr == sshutil.ErrAgentNotRunning:
+		ui.Printf(`%s {{ "SSH Agent:" | bold }} skipped, no agent is running`+"\n", ui.IconSelect)
+	case agentErr != nil:
+		printAgentResult("SSH Agent", agentErr)
+	case agent != nil && splitPrincipals:
+		for i, r := range results {
+			printAgentResult(fmt.Sprintf("SSH Agent (%s)", principals[i]), r.AgentError)
 		}
-		sshAuPubBytes = sshAuPub.Marshal()
+	case agent != nil:
+		printAgentResult("SSH Agent", res.AgentError)
 	}
 
-	resp, err := caClient.SSHSign(&api.SSHSignRequest{
-		PublicKey:        sshPub.Marshal(),
-		OTT:              token,
-		Principals:       principals,
-		CertType:         certType,
-		KeyID:            subject,
-		ValidAfter:       validAfter,
-		ValidBefore:      validBefore,
-		AddUserPublicKey: sshAuPubBytes,
-		IdentityCSR:      identityCSR,
-		TemplateData:     templateData,
-	})
-	if err != nil {
-		return err
+	addUserKey, addUserPub, addUserCrt := opts.AddUserFiles()
+	if res.AddUserCertificate != nil {
+		ui.PrintSelected("Add User Private Key", addUserKey)
+		ui.PrintSelected("Add User Public Key", addUserPub)
+		ui.PrintSelected("Add User Certificate", addUserCrt)
+		ui.PrintSelected("Add User Login", addUserLogin(res.AddUserCertificate))
 	}
 
-	// Write files
-	if !isSign {
-		// Private key (with password unless --no-password --insecure)
-		opts := []pemutil.Options{
-			pemutil.WithOpenSSH(true),
-			pemutil.ToFile(keyFile, 0600),
+	// Configure ssh to use the new certificate
+	if sshConfig != "" {
+		id := sshConfigIdentity{
+			HostPattern:     hostPattern,
+			CertificateFile: opts.CrtFile,
 		}
 		switch {
-		case noPassword && insecure:
-		case passwordFile != "":
-			opts = append(opts, pemutil.WithPasswordFile(passwordFile))
-		default:
-			opts = append(opts, pemutil.WithPasswordPrompt("Please enter the password to encrypt the private key"))
+		case kmsURI != "":
+		case identityFile != "":
+			id.IdentityFile = identityFile
+		case isSign && sshPrivKeyFile != "":
+			id.IdentityFile = sshPrivKeyFile
+		case isSign && opts.BaseName != keyFile:
+			// The public key has the .pub suffix
+			id.IdentityFile = opts.BaseName
+		case !isSign:
+			id.IdentityFile = opts.KeyFile
 		}
-		_, err = pemutil.Serialize(priv, opts...)
-		if err != nil {
+		if res.AddUserCertificate != nil {
+			id.AddUserKey = addUserKey
+			id.AddUserLogin = addUserLogin(res.AddUserCertificate)
+		}
+		if err := addSSHConfig(sshConfig, id); err != nil {
 			return err
 		}
+		log.Debugf("files", "updated the Host block %s in %s", hostPattern, sshConfig)
+		ui.PrintSelected("SSH Config", sshConfig)
+	}
 
-		if err := utils.WriteFile(pubFile, marshalPublicKey(sshPub, subject), 0644); err != nil {
-			return err
+	// Print the summary of the certificates returned by the CA
+	summaries := make([]*certificateSummary, len(results))
+	for i, r := range results {
+		summary := newCertificateSummary(r.Certificate)
+		summary.SetRequestedKeyID(r.RequestedKeyID)
+		switch {
+		case kmsURI != "":
+		case identityFile != "":
+			if opts.WritePublicKey {
+				summary.AddFile("publicKey", pubFile)
+			}
+		case !isSign:
+			summary.AddFile("privateKey", opts.KeyFile)
+			summary.AddFile("publicKey", pubFile)
+		}
+		summary.AddFile("certificate", crtFiles[i])
+		if r.AddUserCertificate != nil {
+			summary.AddFile("addUserPrivateKey", addUserKey)
+			summary.AddFile("addUserPublicKey", addUserPub)
+			summary.AddFile("addUserCertificate", addUserCrt)
+		}
+		if sshConfig != "" {
+			summary.AddFile("sshConfig", sshConfig)
+		}
+		summaries[i] = summary
+	}
+	switch {
+	case isJSON && splitPrincipals:
+		return printJSON(summaries)
+	case isJSON:
+		return printJSON(summaries[0])
+	case !isQuiet:
+		for i, summary := range summaries {
+			if splitPrincipals {
+				ui.Println()
+				ui.PrintSelected("Certificate", crtFiles[i])
+			}
+			summary.Print()
 		}
 	}
 
-	// Write certificate
-	if err := utils.WriteFile(crtFile, marshalPublicKey(resp.Certificate, subject), 0644); err != nil {
-		return err
+	return nil
+}
+
+// validateCertificateFlags validates the number of arguments and the
+// combination of flags used in step ssh certificate.
+func validateCertificateFlags(ctx *cli.Context) error {
+	sshConfig := ctx.String("ssh-config")
+	hostPattern := ctx.String("host-pattern")
+	switch {
+	case sshConfig != "" && hostPattern == "":
+		return errs.RequiredWithFlag(ctx, "ssh-config", "host-pattern")
+	case sshConfig == "" && hostPattern != "":
+		return errs.RequiredWithFlag(ctx, "host-pattern", "ssh-config")
+	case ctx.Bool("remove-ssh-config") && sshConfig == "":
+		return errs.RequiredWithFlag(ctx, "remove-ssh-config", "ssh-config")
+	case strings.ContainsAny(hostPattern, "\r\n"):
+		return errs.InvalidFlagValue(ctx, "host-pattern", hostPattern, "")
+	case ctx.Bool("remove-ssh-config"):
+		return errs.NumberOfArguments(ctx, 0)
+	case sshConfig != "" && ctx.Bool("host"):
+		return errs.IncompatibleFlagWithFlag(ctx, "ssh-config", "host")
 	}
 
-	// Write Add User keys and certs
-	if isAddUser && resp.AddUserCertificate != nil {
-		id := provisioner.SanitizeSSHUserPrincipal(subject) + "-provisioner"
-		if _, err := pemutil.Serialize(auPriv, pemutil.WithOpenSSH(true), pemutil.ToFile(baseName+"-provisioner", 0600)); err != nil {
-			return err
+	switch {
+	case ctx.Duration("backdate") < 0:
+		return errs.InvalidFlagValueMsg(ctx, "backdate", ctx.String("backdate"), "must be a positive duration")
+	case ctx.Duration("clock-skew") < 0:
+		return errs.InvalidFlagValueMsg(ctx, "clock-skew", ctx.String("clock-skew"), "must be a positive duration")
+	case ctx.IsSet("backdate") && ctx.String("not-before") != "":
+		return errs.IncompatibleFlagWithFlag(ctx, "backdate", "not-before")
+	}
+
+	// With --split-principals each certificate requires its own token and file
+	if ctx.Bool("split-principals") {
+		if len(ctx.StringSlice("principal")) == 0 {
+			return errs.RequiredWithFlag(ctx, "split-principals", "principal")
 		}
-		if err := utils.WriteFile(baseName+"-provisioner.pub", marshalPublicKey(sshAuPub, id), 0644); err != nil {
-			return err
+		for _, name := range []string{"host", "token", "add-user", "crt-out", "ssh-config"} {
+			if ctx.IsSet(name) {
+				return errs.IncompatibleFlagWithFlag(ctx, "split-principals", name)
+			}
 		}
-		if err := utils.WriteFile(baseName+"-provisioner-cert.pub", marshalPublicKey(resp.AddUserCertificate, id), 0644); err != nil {
-			return err
+		for _, p := range ctx.StringSlice("principal") {
+			if p == "" || p == "." || p == ".." || strings.ContainsAny(p, `/\`) {
+				return errs.InvalidFlagValueMsg(ctx, "principal", p, "principals used with '--split-principals' cannot contain path separators")
+			}
 		}
 	}
 
-	// Write x509 identity certificate
-	if version.RequireClientAuthentication {
-		if err := ca.WriteDefaultIdentity(resp.IdentityCertificate, identityKey); err != nil {
+	// With --identity the key file is the value of the flag
+	identityFile := ctx.String("identity")
+	if identityFile != "" {
+		if err := errs.NumberOfArguments(ctx, 1); err != nil {
 			return err
 		}
+	} else if err := errs.NumberOfArguments(ctx, 2); err != nil {
+		return err
 	}
 
-	if !isSign {
-		ui.PrintSelected("Private Key", keyFile)
-		ui.PrintSelected("Public Key", pubFile)
+	token := ctx.String("token")
+	isHost := ctx.Bool("host")
+	hostID := ctx.String("host-id")
+	isSign := ctx.Bool("sign")
+	isAddUser := ctx.Bool("add-user")
+	principals := ctx.StringSlice("principal")
+	principalsFromHost := ctx.Bool("principals-from-host")
+	noPassword := ctx.Bool("no-password")
+	insecure := ctx.Bool("insecure")
+	if _, extensionFlags := parseExtensions(ctx); len(extensionFlags) > 0 && isHost {
+		return errs.IncompatibleFlagWithFlag(ctx, extensionFlags[0], "host")
 	}
-	ui.PrintSelected("Certificate", crtFile)
 
-	// Attempt to add key to agent if private key defined.
-	if priv != nil && certType == provisioner.SSHUserCert {
-		if agent, err := sshutil.DialAgent(); err != nil {
-			ui.Printf(`{{ "%s" | red }} {{ "SSH Agent:" | bold }} %v`+"\n", ui.IconBad, err)
-		} else {
-			defer agent.Close()
-			if err := agent.AddCertificate(subject, resp.Certificate.Certificate, priv); err != nil {
-				ui.Printf(`{{ "%s" | red }} {{ "SSH Agent:" | bold }} %v`+"\n", ui.IconBad, err)
-			} else {
-				ui.PrintSelected("SSH Agent", "yes")
+	switch {
+	case noPassword && !insecure:
+		return errs.RequiredInsecureFlag(ctx, "no-password")
+	case noPassword && ctx.String("password-file") != "":
+		return errs.IncompatibleFlagWithFlag(ctx, "no-password", "password-file")
+	case token != "" && ctx.String("provisioner-password-file") != "":
+		return errs.IncompatibleFlagWithFlag(ctx, "token", "provisioner-password-file")
+	case token != "" && ctx.Bool("provisioner-password-stdin"):
+		return errs.IncompatibleFlagWithFlag(ctx, "token", "provisioner-password-stdin")
+	case isHost && isAddUser:
+		return errs.IncompatibleFlagWithFlag(ctx, "host", "add-user")
+	case !isHost && hostID != "":
+		return errs.RequiredWithFlag(ctx, sshHostIDFlag.Name, sshHostFlag.Name)
+	case !isAddUser && ctx.String("add-user-principal") != "":
+		return errs.RequiredWithFlag(ctx, "add-user-principal", "add-user")
+	case !isAddUser && ctx.String("add-user-out") != "":
+		return errs.RequiredWithFlag(ctx, "add-user-out", "add-user")
+	case isAddUser && len(addUserPrincipals(ctx.String("add-user-principal"), principals)) > 1:
+		return errs.NewClassError(errs.UsageError, errors.New("flag '--add-user' is incompatible with more than one principal"))
+	case !isHost && principalsFromHost:
+		return errs.RequiredWithFlag(ctx, sshPrincipalsFromHostFlag.Name, sshHostFlag.Name)
+	case !principalsFromHost && len(ctx.StringSlice("exclude-principal")) > 0:
+		return errs.RequiredWithFlag(ctx, sshExcludePrincipalFlag.Name, sshPrincipalsFromHostFlag.Name)
+	case identityFile != "" && isSign:
+		return errs.IncompatibleFlagWithFlag(ctx, "identity", "sign")
+	case identityFile != "" && ctx.String("private-key") != "":
+		return errs.IncompatibleFlagWithFlag(ctx, "identity", "private-key")
+	case identityFile != "" && noPassword:
+		return errs.IncompatibleFlagWithFlag(ctx, "identity", "no-password")
+	case identityFile != "" && ctx.String("key-out") != "":
+		return errs.IncompatibleFlagWithFlag(ctx, "identity", "key-out")
+	case isSign && ctx.String("key-out") != "":
+		return errs.IncompatibleFlagWithFlag(ctx, "sign", "key-out")
+	case isSign && ctx.String("pub-out") != "":
+		return errs.IncompatibleFlagWithFlag(ctx, "sign", "pub-out")
+	}
+
+	// With --kms only the certificate is written
+	if ctx.String("kms") != "" {
+		for _, name := range []string{"sign", "identity", "private-key", "key-out", "pub-out", "add-user"} {
+			if ctx.IsSet(name) {
+				return errs.IncompatibleFlagWithFlag(ctx, "kms", name)
 			}
 		}
 	}
 
-	if isAddUser && resp.AddUserCertificate != nil {
-		ui.PrintSelected("Add User Private Key", baseName+"-provisioner")
-		ui.PrintSelected("Add User Public Key", baseName+"-provisioner.pub")
-		ui.PrintSelected("Add User Certificate", baseName+"-provisioner-cert.pub")
+	if hostID != "" && hostID != "machine" {
+		if _, err := uuid.Parse(hostID); err != nil {
+			return errs.InvalidFlagValue(ctx, sshHostIDFlag.Name, hostID, "[ machine | <UUID> ]")
+		}
+	}
+	return nil
+}
+
+// addUserPrincipals returns the principals of a certificate with an add user
+// certificate. With --add-user-principal, the principals passed must be the
+// same value.
+func addUserPrincipals(addUserPrincipal string, principals []string) []string {
+	if addUserPrincipal == "" {
+		return principals
 	}
+	ret := []string{addUserPrincipal}
+	for _, p := range principals {
+		if p != addUserPrincipal {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
 
+// parseCertificateValidity returns the validity requested with the flags
+// --not-before, --not-after, --ttl and --backdate. The backdate is sent as a
+// negative duration, so the CA applies it to its own clock.
+func parseCertificateValidity(ctx *cli.Context) (provisioner.TimeDuration, provisioner.TimeDuration, error) {
+	validAfter, validBefore, err := flags.ParseTimeDuration(ctx)
+	if err != nil {
+		return validAfter, validBefore, err
+	}
+	if backdate := ctx.Duration("backdate"); backdate > 0 {
+		validAfter.SetDuration(-backdate)
+	}
+	return validAfter, validBefore, nil
+}
+
+// certificateFiles returns the base name of the add user files and the files
+// to write the private key, public key and certificate to. By default they are
+// derived from keyFile using the suffixes used by SSH, the flags --key-out,
+// --pub-out and --crt-out override each of them. With --sign, keyFile is the
+// public key, and the certificate is named after it.
+func certificateFiles(ctx *cli.Context, keyFile string) (baseName, keyOut, pubOut, crtOut string) {
+	baseName, keyOut, pubOut = keyFile, keyFile, keyFile+".pub"
+	if ctx.Bool("sign") {
+		pubOut = keyFile
+		if strings.HasSuffix(keyFile, ".pub") {
+			baseName = keyFile[:len(keyFile)-4]
+		}
+	}
+	crtOut = baseName + "-cert.pub"
+	if v := ctx.String("key-out"); v != "" {
+		baseName, keyOut = v, v
+	}
+	if v := ctx.String("pub-out"); v != "" {
+		pubOut = v
+	}
+	if v := ctx.String("crt-out"); v != "" {
+		crtOut = v
+	}
+	return
+}
+
+// createOutputDirs checks that the directories of the given files exist. With
+// --force the missing directories are created.
+func createOutputDirs(ctx *cli.Context, files ...string) error {
+	for _, f := range files {
+		dir := filepath.Dir(f)
+		fi, err := os.Stat(dir)
+		switch {
+		case os.IsNotExist(err):
+			if !ctx.Bool("force") {
+				return errors.Errorf("cannot write %s: directory %s does not exist, use '--force' to create it", f, dir)
+			}
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				return errs.FileError(err, dir)
+			}
+		case err != nil:
+			return errs.FileError(err, dir)
+		case !fi.IsDir():
+			return errors.Errorf("cannot write %s: %s is not a directory", f, dir)
+		}
+	}
 	return nil
 }
 
+// withProvisionerPassword is the token option used to pass the provisioner
+// password to the token flow. It is a variable so the tests can check the
+// password used.
+var withProvisionerPassword = cautils.WithProvisionerPassword
+
+// certificateKeyPassword returns the function used to get the password of the
+// generated private key. It reads passwordFile, or asks for the password if
+// it is empty. The provisioner password is never used for the key.
+func certificateKeyPassword(passwordFile string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		if passwordFile != "" {
+			return utils.ReadPasswordFromFile(passwordFile)
+		}
+		return ui.PromptPassword("Please enter the password to encrypt the private key", ui.WithValidateNotEmpty())
+	}
+}
+
+// loadIdentityKey reads the private key in keyFile, decrypting it with the
+// password in passwordFile or asking for it, and returns it with its SSH public
+// key. If pubFile exists, its key must match the private key, and the returned
+// boolean is true only if pubFile does not exist and it should be written.
+func loadIdentityKey(keyFile, pubFile, passwordFile string) (interface{}, ssh.PublicKey, bool, error) {
+	var opts []pemutil.Options
+	if passwordFile != "" {
+		opts = append(opts, pemutil.WithPasswordFile(passwordFile))
+	}
+	priv, err := pemutil.Read(keyFile, opts...)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, nil, false, errors.Errorf("error reading %s: %T is not a private key", keyFile, priv)
+	}
+	sshPub, err := ssh.NewPublicKey(signer.Public())
+	if err != nil {
+		return nil, nil, false, errors.Wrap(err, "error creating public key")
+	}
+
+	b, err := ioutil.ReadFile(pubFile)
+	switch {
+	case os.IsNotExist(err):
+		return priv, sshPub, true, nil
+	case err != nil:
+		return nil, nil, false, errs.FileError(err, pubFile)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil, nil, false, errors.Wrapf(err, "error parsing %s", pubFile)
+	}
+	if !bytes.Equal(pub.Marshal(), sshPub.Marshal()) {
+		ui.Printf(`{{ "%s" | yellow }} {{ "Public Key:" | bold }} %s does not match the private key in %s`+"\n", ui.IconWarn, pubFile, keyFile)
+		return nil, nil, false, errors.Errorf("refusing to overwrite %s: the public key does not match the private key in %s", pubFile, keyFile)
+	}
+	return priv, sshPub, false, nil
+}
+
+// loadKMSKey returns the SSH public key of the key with the given uri in a
+// KMS, creating it if it does not exist.
+func loadKMSKey(rawuri string) (ssh.PublicKey, error) {
+	km, err := kms.New(context.Background(), rawuri)
+	if err != nil {
+		return nil, err
+	}
+	defer km.Close()
+
+	pub, err := kms.GetOrCreateKey(km, rawuri)
+	if err != nil {
+		return nil, err
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating public key")
+	}
+	return sshPub, nil
+}
+
 func marshalPublicKey(key ssh.PublicKey, subject string) []byte {
 	b := ssh.MarshalAuthorizedKey(key)
 	if i := bytes.LastIndex(b, []byte("\n")); i >= 0 {
@@ -0,0 +1,130 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/cli/crypto/pemutil"
+	"github.com/smallstep/cli/utils/cautils"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestLoadIdentityKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "step-ssh-identity")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	keyFile := filepath.Join(dir, "id_ed25519")
+	_, err = pemutil.Serialize(priv, pemutil.WithOpenSSH(true), pemutil.ToFile(keyFile, 0600))
+	require.NoError(t, err)
+	pubFile := keyFile + ".pub"
+
+	// Missing public key
+	key, pub, write, err := loadIdentityKey(keyFile, pubFile, "")
+	require.NoError(t, err)
+	require.True(t, write)
+	require.Equal(t, priv, key)
+	require.Equal(t, ssh.KeyAlgoED25519, pub.Type())
+
+	// Matching public key
+	require.NoError(t, ioutil.WriteFile(pubFile, ssh.MarshalAuthorizedKey(pub), 0644))
+	_, _, write, err = loadIdentityKey(keyFile, pubFile, "")
+	require.NoError(t, err)
+	require.False(t, write)
+
+	// Mismatched public key
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	other, err := ssh.NewPublicKey(otherPub)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(pubFile, ssh.MarshalAuthorizedKey(other), 0644))
+	_, _, _, err = loadIdentityKey(keyFile, pubFile, "")
+	require.Error(t, err)
+
+	// Missing private key
+	_, _, _, err = loadIdentityKey(filepath.Join(dir, "missing"), pubFile, "")
+	require.Error(t, err)
+}
+
+func TestCertificatePasswordFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "step-ssh-passwords")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyPasswordFile := filepath.Join(dir, "key.pass")
+	provisionerPasswordFile := filepath.Join(dir, "prov.pass")
+	require.NoError(t, ioutil.WriteFile(keyPasswordFile, []byte("key-password\n"), 0600))
+	require.NoError(t, ioutil.WriteFile(provisionerPasswordFile, []byte("provisioner-password\n"), 0600))
+
+	ctx := newCertificateContext(t,
+		"--password-file", keyPasswordFile,
+		"--provisioner-password-file", provisionerPasswordFile,
+		"--root", filepath.Join(dir, "missing.crt"),
+		"--ca-url", "https://127.0.0.1:1",
+		"jane@example.com", filepath.Join(dir, "id_ed25519"),
+	)
+
+	// The token flow gets the password in --provisioner-password-file
+	var tokenPasswords [][]byte
+	defer func(fn func([]byte) cautils.TokenOption) { withProvisionerPassword = fn }(withProvisionerPassword)
+	withProvisionerPassword = func(password []byte) cautils.TokenOption {
+		tokenPasswords = append(tokenPasswords, password)
+		return cautils.WithProvisionerPassword(password)
+	}
+
+	// The command fails without a CA, but it must not modify the flags.
+	require.Error(t, certificateAction(ctx))
+	require.Equal(t, keyPasswordFile, ctx.String("password-file"))
+	require.Equal(t, provisionerPasswordFile, ctx.String("provisioner-password-file"))
+	require.Equal(t, [][]byte{[]byte("provisioner-password")}, tokenPasswords)
+
+	// The generated private key is encrypted with the password in
+	// --password-file.
+	opts := newSignOptions(provisioner.SSHUserCert)
+	opts.KeyPassword = certificateKeyPassword(ctx.String("password-file"))
+	fs := new(memFS)
+	_, err = sign(opts, newFakeCAClient(t), fs, nil)
+	require.NoError(t, err)
+	_, err = pemutil.ParseKey(fs.files["id_ed25519"].data, pemutil.WithPassword([]byte("key-password")))
+	require.NoError(t, err)
+	_, err = pemutil.ParseKey(fs.files["id_ed25519"].data, pemutil.WithPassword([]byte("provisioner-password")))
+	require.Error(t, err)
+}
+
+func TestLoadKMSKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "step-ssh-kms")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The key is created on the first call
+	rawuri := "softkms:path=" + filepath.Join(dir, "ssh_host_ecdsa_key")
+	pub, err := loadKMSKey(rawuri)
+	require.NoError(t, err)
+	require.Equal(t, ssh.KeyAlgoECDSA256, pub.Type())
+	got, err := loadKMSKey(rawuri)
+	require.NoError(t, err)
+	require.Equal(t, pub.Marshal(), got.Marshal())
+
+	// Only the certificate is written
+	fs := new(memFS)
+	agent := new(fakeAgent)
+	opts := newSignOptions(provisioner.SSHUserCert)
+	opts.PublicKey = pub
+	res, err := sign(opts, newFakeCAClient(t), fs, agent)
+	require.NoError(t, err)
+	require.False(t, res.Agent)
+	require.Len(t, fs.files, 1)
+	require.Equal(t, marshalPublicKey(res.Certificate, "jane@example.com"), fs.files["id_ed25519-cert.pub"].data)
+	require.Equal(t, pub.Marshal(), res.Certificate.Key.Marshal())
+
+	_, err = loadKMSKey("foo:id=%01")
+	require.EqualError(t, err, "unsupported kms type 'foo'")
+}
@@ -23,7 +23,8 @@ func checkHostCommand() cli.Command {
 		Name:   "check-host",
 		Action: command.ActionFunc(checkHostAction),
 		Usage:  "checks if a certificate has been issued for a host",
-		UsageText: `**step ssh check-host** <hostname>
+		UsageText: `**step ssh check-host** <hostname[:port]>
+[**--verify**] [**--ca-key**=<file>] [**--timeout**=<duration>]
 [**--ca-url**=<uri>] [**--root**=<file>]
 [**--offline**] [**--ca-config**=<path>] [**--verbose,-v**]`,
 		Description: `**step ssh check-host** checks if a certificate has been issued for a host.
@@ -31,22 +32,57 @@ func checkHostCommand() cli.Command {
 This command returns a zero exit status if the host has a certificate.
 Otherwise, it returns 1.
 
+With the **--verify** flag, the command connects to the SSH server and checks
+the host certificate presented by it. The certificate must be signed by one of
+the host CA keys of the CA, or the ones in the **--ca-key** file, it must be
+valid at the current time and the hostname must be one of its principals. The
+command prints the result of each check, and returns a non-zero exit status if
+the server presents a plain host key or an invalid certificate, so it can be
+used for monitoring.
+
 ## POSITIONAL ARGUMENTS
 
-<hostname>
-:  The hostname of the server to check.
+<hostname[:port]>
+:  The hostname of the server to check. With **--verify** it can include the
+port of the SSH server, 22 by default.
 
 ## EXAMPLES
 
 Check that internal.example.com exists:
 '''
 $ step ssh check-host internal.smallstep.com
+'''
+
+Check that the SSH server at internal.example.com presents a valid host
+certificate:
+'''
+$ step ssh check-host --verify internal.smallstep.com
+'''
+
+Check the host certificate of a server in a custom port using a local host CA
+public key:
+'''
+$ step ssh check-host --verify --ca-key ssh_host_ca_key.pub internal.smallstep.com:2222
 '''`,
 		Flags: []cli.Flag{
 			flags.CaURL,
 			flags.Root,
 			flags.Offline,
 			flags.CaConfig,
+			cli.BoolFlag{
+				Name:  "verify",
+				Usage: `Connect to the SSH server and verify the host certificate presented by it.`,
+			},
+			cli.StringFlag{
+				Name: "ca-key",
+				Usage: `The <file>, in the authorized_keys format, with the host CA keys used with
+**--verify**. By default the host CA keys are retrieved from the CA.`,
+			},
+			cli.DurationFlag{
+				Name:  "timeout",
+				Usage: `The <duration> to wait for the SSH server with **--verify**.`,
+				Value: 10 * time.Second,
+			},
 			cli.BoolFlag{
 				Name:  "verbose, v",
 				Usage: `Return "true" or "false" in the terminal.`,
@@ -61,6 +97,12 @@ func checkHostAction(ctx *cli.Context) error {
 	if err := errs.NumberOfArguments(ctx, 1); err != nil {
 		return err
 	}
+	if ctx.Bool("verify") {
+		return verifyHostAction(ctx)
+	}
+	if ctx.IsSet("ca-key") {
+		return errs.RequiredWithFlag(ctx, "ca-key", "verify")
+	}
 
 	client, err := cautils.NewClient(ctx)
 	if err != nil {
@@ -0,0 +1,82 @@
+package ssh
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/smallstep/certificates/pki"
+	"github.com/smallstep/cli/completion"
+	"github.com/smallstep/cli/utils/cautils"
+	"github.com/urfave/cli"
+)
+
+// completionTimeout is the maximum time to wait for the CA when completing a
+// provisioner, the shell is blocked until the suggestions are printed.
+const completionTimeout = 2 * time.Second
+
+// certificateFileFlags are the flags of step ssh certificate that take a file,
+// the shell completes them.
+var certificateFileFlags = []string{
+	"identity", "private-key", "password-file", "provisioner-password-file",
+	"key-out", "pub-out", "crt-out", "root", "ca-config", "x5c-cert", "x5c-key",
+	"k8ssa-token-path", "ssh-config", "add-user-out", "agent-socket",
+}
+
+// certificateComplete is the BashComplete function of step ssh certificate. It
+// completes the provisioners of the CA and the values of enum-like flags, the
+// shell completes the files. Other arguments use the default completion of
+// urfave/cli. It never fails, without a CA there are no suggestions.
+func certificateComplete(ctx *cli.Context) {
+	completeCertificateArg(ctx, completion.PreviousArg(os.Args))
+}
+
+func completeCertificateArg(ctx *cli.Context, prev string) {
+	w := ctx.App.Writer
+	name := strings.TrimLeft(prev, "-")
+	if !strings.HasPrefix(prev, "-") {
+		name = ""
+	}
+	switch {
+	case name == "provisioner" || name == "issuer":
+		completion.Print(w, provisionerSuggestions(ctx)...)
+	case name == "host-id":
+		completion.Print(w, completion.Suggestion{Value: "machine", Description: "derive the UUID from the machine id"})
+	case name == "kms":
+		completion.Print(w,
+			completion.Suggestion{Value: "pkcs11:", Description: "a key in a PKCS #11 module"},
+			completion.Suggestion{Value: "softkms:path=", Description: "a key in a PEM file"})
+	case containsString(certificateFileFlags, name):
+		// The shell completes files if there are no suggestions
+	default:
+		cmd := ctx.Command
+		cli.DefaultCompleteWithFlags(&cmd)(ctx)
+	}
+}
+
+// provisionerSuggestions returns the provisioners of the CA configured with
+// the flags or in $STEPPATH/config/defaults.json.
+func provisionerSuggestions(ctx *cli.Context) []completion.Suggestion {
+	// The defaults are loaded in the Before function, it does not run when
+	// completing.
+	if ctx.Command.Before != nil {
+		_ = ctx.Command.Before(ctx)
+	}
+	caURL := ctx.String("ca-url")
+	if caURL == "" {
+		return nil
+	}
+	root := ctx.String("root")
+	if root == "" {
+		root = pki.GetRootCAPath()
+	}
+	provisioners, err := cautils.GetCachedProvisioners(caURL, root, completionTimeout)
+	if err != nil {
+		return nil
+	}
+	suggestions := make([]completion.Suggestion, len(provisioners))
+	for i, p := range provisioners {
+		suggestions[i] = completion.Suggestion{Value: p.Name, Description: p.Type}
+	}
+	return suggestions
+}
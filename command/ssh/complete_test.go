@@ -0,0 +1,32 @@
+package ssh
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompleteCertificateArg(t *testing.T) {
+	tests := []struct {
+		name string
+		prev string
+		want string
+	}{
+		{"host-id", "--host-id", "machine\n"},
+		{"kms", "--kms", "pkcs11:\nsoftkms:path=\n"},
+		{"file", "--identity", ""},
+		{"file-short", "-ssh-config", ""},
+		{"provisioner-without-ca", "--provisioner", ""},
+		{"issuer-without-ca", "--issuer", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			ctx := newCertificateContext(t)
+			ctx.App.Writer = &buf
+			completeCertificateArg(ctx, tt.prev)
+			require.Equal(t, tt.want, buf.String())
+		})
+	}
+}
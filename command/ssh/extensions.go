@@ -0,0 +1,114 @@
+package ssh
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	sshNoPtyFlag = cli.BoolFlag{
+		Name:  "no-pty",
+		Usage: `Request a user certificate without the permit-pty extension.`,
+	}
+
+	sshNoPortForwardingFlag = cli.BoolFlag{
+		Name:  "no-port-forwarding",
+		Usage: `Request a user certificate without the permit-port-forwarding extension.`,
+	}
+
+	sshNoAgentForwardingFlag = cli.BoolFlag{
+		Name:  "no-agent-forwarding",
+		Usage: `Request a user certificate without the permit-agent-forwarding extension.`,
+	}
+
+	sshNoX11ForwardingFlag = cli.BoolFlag{
+		Name:  "no-x11-forwarding",
+		Usage: `Request a user certificate without the permit-X11-forwarding extension.`,
+	}
+
+	sshNoUserRCFlag = cli.BoolFlag{
+		Name:  "no-user-rc",
+		Usage: `Request a user certificate without the permit-user-rc extension.`,
+	}
+)
+
+// sshExtensions maps the flags that remove a permission to the default
+// extensions of an OpenSSH user certificate.
+var sshExtensions = []struct {
+	flag      string
+	extension string
+}{
+	{sshNoPtyFlag.Name, "permit-pty"},
+	{sshNoPortForwardingFlag.Name, "permit-port-forwarding"},
+	{sshNoAgentForwardingFlag.Name, "permit-agent-forwarding"},
+	{sshNoX11ForwardingFlag.Name, "permit-X11-forwarding"},
+	{sshNoUserRCFlag.Name, "permit-user-rc"},
+}
+
+// parseExtensions returns the extensions requested using the --no-* flags, and
+// the names of the flags used. If no flag is used it returns a nil map, and the
+// CA will use its default extensions.
+func parseExtensions(ctx *cli.Context) (map[string]string, []string) {
+	var used []string
+	for _, e := range sshExtensions {
+		if ctx.Bool(e.flag) {
+			used = append(used, e.flag)
+		}
+	}
+	if len(used) == 0 {
+		return nil, nil
+	}
+
+	// OpenSSH extensions are flags, their presence grants the permission and
+	// their value is always empty.
+	extensions := make(map[string]string)
+	for _, e := range sshExtensions {
+		if !ctx.Bool(e.flag) {
+			extensions[e.extension] = ""
+		}
+	}
+	return extensions, used
+}
+
+// setTemplateExtensions adds the requested extensions to the template data,
+// so a provisioner template can use them with
+// '{{ toJson .Insecure.User.extensions }}'.
+func setTemplateExtensions(data json.RawMessage, extensions map[string]string) (json.RawMessage, error) {
+	m := make(map[string]interface{})
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, errors.Wrap(err, "error unmarshaling template data")
+		}
+	}
+	m["extensions"] = extensions
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, errors.Wrap(err, "error marshaling template data")
+	}
+	return b, nil
+}
+
+// checkExtensions verifies that the certificate does not contain any of the
+// default extensions that was not requested.
+func checkExtensions(cert *ssh.Certificate, extensions map[string]string) error {
+	var unexpected []string
+	for _, e := range sshExtensions {
+		if _, ok := cert.Extensions[e.extension]; ok {
+			if _, ok := extensions[e.extension]; !ok {
+				unexpected = append(unexpected, e.extension)
+			}
+		}
+	}
+	if len(unexpected) > 0 {
+		sort.Strings(unexpected)
+		return errors.Errorf("the certificate returned by the CA has the extensions %s: "+
+			"the provisioner template must use the requested extensions",
+			strings.Join(unexpected, ", "))
+	}
+	return nil
+}
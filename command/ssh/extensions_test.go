@@ -0,0 +1,78 @@
+package ssh
+
+import (
+	"encoding/json"
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
+)
+
+func newExtensionsContext(t *testing.T, args ...string) *cli.Context {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	for _, f := range []cli.BoolFlag{sshNoPtyFlag, sshNoPortForwardingFlag, sshNoAgentForwardingFlag, sshNoX11ForwardingFlag, sshNoUserRCFlag} {
+		f.Apply(set)
+	}
+	require.NoError(t, set.Parse(args))
+	return cli.NewContext(nil, set, nil)
+}
+
+func TestParseExtensions(t *testing.T) {
+	extensions, used := parseExtensions(newExtensionsContext(t))
+	require.Nil(t, extensions)
+	require.Nil(t, used)
+
+	extensions, used = parseExtensions(newExtensionsContext(t, "--no-pty", "--no-port-forwarding"))
+	require.Equal(t, []string{"no-pty", "no-port-forwarding"}, used)
+	require.Equal(t, map[string]string{
+		"permit-agent-forwarding": "",
+		"permit-X11-forwarding":   "",
+		"permit-user-rc":          "",
+	}, extensions)
+
+	extensions, _ = parseExtensions(newExtensionsContext(t, "--no-pty", "--no-port-forwarding",
+		"--no-agent-forwarding", "--no-x11-forwarding", "--no-user-rc"))
+	require.Equal(t, map[string]string{}, extensions)
+}
+
+func TestSetTemplateExtensions(t *testing.T) {
+	extensions := map[string]string{"permit-pty": ""}
+	b, err := setTemplateExtensions(nil, extensions)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"extensions":{"permit-pty":""}}`, string(b))
+
+	b, err = setTemplateExtensions(json.RawMessage(`{"foo":"bar"}`), extensions)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"foo":"bar","extensions":{"permit-pty":""}}`, string(b))
+
+	_, err = setTemplateExtensions(json.RawMessage(`{`), extensions)
+	require.Error(t, err)
+}
+
+func TestCheckExtensions(t *testing.T) {
+	extensions, _ := parseExtensions(newExtensionsContext(t, "--no-pty", "--no-port-forwarding"))
+
+	// The CA applied the requested extensions
+	cert := &ssh.Certificate{
+		CertType: ssh.UserCert,
+		Permissions: ssh.Permissions{
+			Extensions: map[string]string{
+				"permit-agent-forwarding": "",
+				"permit-X11-forwarding":   "",
+				"permit-user-rc":          "",
+			},
+		},
+	}
+	require.NoError(t, checkExtensions(cert, extensions))
+	require.Equal(t, "permit-X11-forwarding, permit-agent-forwarding, permit-user-rc",
+		formatMap(newCertificateSummary(cert).Extensions))
+
+	// The CA used the default extensions
+	cert.Extensions["permit-pty"] = ""
+	cert.Extensions["permit-port-forwarding"] = ""
+	err := checkExtensions(cert, extensions)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "permit-port-forwarding, permit-pty")
+}
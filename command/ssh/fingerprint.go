@@ -2,27 +2,37 @@ package ssh
 
 import (
 	"fmt"
+	"strings"
 
+	"github.com/pkg/errors"
 	"github.com/smallstep/cli/command"
 	"github.com/smallstep/cli/crypto/sshutil"
 	"github.com/smallstep/cli/errs"
 	"github.com/smallstep/cli/utils"
 	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
 )
 
 func fingerPrintCommand() cli.Command {
 	return cli.Command{
-		Name:      "fingerprint",
-		Action:    command.ActionFunc(fingerprint),
-		Usage:     "print the fingerprint of an SSH public key or certificate",
-		UsageText: `**step ssh fingerprint** <file>`,
+		Name:   "fingerprint",
+		Action: command.ActionFunc(fingerprint),
+		Usage:  "print the fingerprint of an SSH public key or certificate",
+		UsageText: `**step ssh fingerprint** <file>
+[**--format**=<format>] [**--match**=<file>]`,
 		Description: `**step ssh fingerprint** prints the fingerprint of an ssh public key or
-certificate.
+certificate. If the file is a certificate it also prints the fingerprint of the
+certificate authority key that signed it. The sha256 and md5 formats are the
+ones printed by 'ssh-keygen -l', the emoji format is specific to step.
+
+With the **--match** flag, the command will exit with a non-zero status if the
+certificate has not been signed by one of the keys in the given file.
 
 ## POSITIONAL ARGUMENTS
 
 <file>
-:  The path to an SSH public key or certificate.
+:  The path to an SSH public key or certificate. Use '-' or no argument to read
+it from STDIN.
 
 ## EXAMPLES
 
@@ -34,7 +44,47 @@ $ step ssh fingerprint id_ecdsa-cert.pub
 Print the fingerprint for an SSH public key:
 '''
 $ step ssh fingerprint id_ecdsa.pub
+'''
+
+Print the MD5 fingerprint for an SSH public key:
+'''
+$ step ssh fingerprint --format md5 id_ecdsa.pub
+'''
+
+Print the fingerprint of a certificate in the agent:
+'''
+$ step ssh list --raw joe@example.com | step ssh fingerprint
+'''
+
+Check that a certificate was signed by one of the keys in ssh_user_ca.pub:
+'''
+$ step ssh fingerprint --match ssh_user_ca.pub id_ecdsa-cert.pub
 '''`,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name: "format",
+				Usage: `The <format> of the fingerprint.
+
+: <format> is a case-insensitive string and must be one of:
+
+    **sha256**
+    :  The base64 encoded SHA-256 of the key (default)
+
+    **md5**
+    :  The colon-separated hex encoded MD5 of the key
+
+    **emoji**
+    :  The SHA-256 of the key with an emoji per byte. This is not a standard
+    format, ssh-keygen and other tools cannot print or check it, it is only
+    useful to compare visually two outputs of this command`,
+			},
+			cli.StringFlag{
+				Name: "match",
+				Usage: `The <file>, in the authorized_keys format, with the certificate authority keys
+that should have signed the certificate. The command will fail if the certificate
+signature key is not in the file.`,
+			},
+		},
 	}
 }
 
@@ -48,15 +98,64 @@ func fingerprint(ctx *cli.Context) error {
 		name = "-"
 	}
 
+	encoding, err := getFingerprintFormat(ctx.String("format"))
+	if err != nil {
+		return errs.InvalidFlagValue(ctx, "format", ctx.String("format"), "sha256, md5, emoji")
+	}
+
 	b, err := utils.ReadFile(name)
 	if err != nil {
 		return err
 	}
 
-	s, err := sshutil.Fingerprint(b)
+	s, err := sshutil.FormatFingerprint(b, encoding)
 	if err != nil {
 		return err
 	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return errors.Wrap(err, "error parsing public key")
+	}
+	cert, isCert := key.(*ssh.Certificate)
+
 	fmt.Println(s)
+	if isCert {
+		ca, err := sshutil.FormatKeyFingerprint(cert.SignatureKey, encoding)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Signing CA:", ca)
+	}
+
+	if matchFile := ctx.String("match"); matchFile != "" {
+		if !isCert {
+			return errors.Errorf("flag '--match' requires a certificate, but %s is a public key", name)
+		}
+		b, err := utils.ReadFile(matchFile)
+		if err != nil {
+			return err
+		}
+		keys, err := sshutil.ParseAuthorizedKeys(b)
+		if err != nil {
+			return errors.Wrapf(err, "error parsing %s", matchFile)
+		}
+		if !sshutil.IsSignedBy(cert, keys) {
+			return errors.Errorf("certificate is not signed by any of the keys in %s", matchFile)
+		}
+	}
+
 	return nil
 }
+
+func getFingerprintFormat(format string) (sshutil.FingerprintEncoding, error) {
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "sha256", "":
+		return sshutil.SHA256Fingerprint, nil
+	case "md5":
+		return sshutil.MD5Fingerprint, nil
+	case "emoji":
+		return sshutil.EmojiFingerprint, nil
+	}
+	return sshutil.SHA256Fingerprint, errors.Errorf("error parsing fingerprint format: '%s' is not a valid ssh fingerprint format", format)
+}
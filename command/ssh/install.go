@@ -0,0 +1,886 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/cli/command"
+	"github.com/smallstep/cli/crypto/pemutil"
+	"github.com/smallstep/cli/errs"
+	"github.com/smallstep/cli/flags"
+	"github.com/smallstep/cli/ui"
+	"github.com/smallstep/cli/utils"
+	"github.com/smallstep/cli/utils/cautils"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// defaultHostKeys are the host keys loaded by sshd if the configuration does
+// not have any HostKey.
+var defaultHostKeys = []string{
+	"/etc/ssh/ssh_host_rsa_key",
+	"/etc/ssh/ssh_host_ecdsa_key",
+	"/etc/ssh/ssh_host_ed25519_key",
+}
+
+func installCommand() cli.Command {
+	return cli.Command{
+		Name:   "install",
+		Action: command.ActionFunc(installAction),
+		Usage:  "install a host certificate in a remote SSH server",
+		UsageText: `**step ssh install** <hostname[:port]> [<key-file>]
+[**--user**=<name>] [**--remote-key**=<path>] [**--remote-cert**=<path>]
+[**--remote-user-ca**=<path>] [**--sshd-config**=<path>] [**--reload**=<command>]
+[**--known-hosts**=<file>] [**--agent-socket**=<path>] [**--ca-key**=<file>]
+[**--timeout**=<duration>] [**--force**]
+[**--principal**=<string>] [**--token**=<token>] [**--provisioner**=<name>]
+[**--provisioner-password-file**=<path>] [**--not-before**=<time|duration>]
+[**--not-after**=<time|duration>] [**--ttl**=<duration>]
+[**--ca-url**=<uri>] [**--root**=<file>] [**--offline**] [**--ca-config**=<path>]`,
+		Description: `**step ssh install** installs a host key and certificate in a remote SSH
+server.
+
+The command connects to the server using the keys in the SSH agent and the
+known hosts file, uploads the private key and certificate using SFTP, uploads
+the user CA keys of the CA, adds the **HostKey**, **HostCertificate** and
+**TrustedUserCAKeys** options to the sshd configuration if they are missing,
+and runs the reload command. Finally, it connects again to verify that the
+server presents the new certificate and that it is valid.
+
+If the sshd configuration already has a **TrustedUserCAKeys** file, the user CA
+keys are appended to that file, instead of <remote-user-ca>, if it does not
+have them.
+
+Every file that is replaced, including the host key and the sshd
+configuration, is saved first in "<file>.bak". If an upload or the reload
+command fails, the previous files are restored and the new ones are removed.
+The options in the files of an **Include** directive are not checked, the
+command prints a warning as they can override the changes.
+
+The host key and certificate are read from <key-file> and
+"<key-file>-cert.pub". Without <key-file> a new key pair is generated and a
+host certificate for <hostname> is requested to the CA, the private key is only
+kept in memory.
+
+By default the command does not make any change, it only reads the sshd
+configuration and prints what it would do. Use **--force** to apply the
+changes.
+
+## POSITIONAL ARGUMENTS
+
+<hostname[:port]>
+:  The hostname of the SSH server, it can include the port, 22 by default.
+
+<key-file>
+:  The private key of an existing host certificate. The certificate is read from
+"<key-file>-cert.pub".
+
+## EXAMPLES
+
+Print the changes required to install a new host certificate:
+'''
+$ step ssh install internal.example.com
+'''
+
+Install a new host certificate:
+'''
+$ step ssh install --force internal.example.com
+'''
+
+Install an existing host key and certificate, reloading the ssh service of a
+Debian server:
+'''
+$ step ssh install --force --reload 'sshd -t && systemctl reload ssh' \
+	internal.example.com ssh_host_ecdsa_key
+'''
+
+Install a host certificate using a custom user and port, and non-default paths:
+'''
+$ step ssh install --force --user admin \
+	--remote-key /usr/local/etc/ssh/ssh_host_ecdsa_key \
+	--remote-cert /usr/local/etc/ssh/ssh_host_ecdsa_key-cert.pub \
+	--sshd-config /usr/local/etc/ssh/sshd_config \
+	internal.example.com:2222
+'''`,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "user",
+				Usage: `The <name> of the user used to connect to the SSH server.`,
+				Value: "root",
+			},
+			cli.StringFlag{
+				Name:  "remote-key",
+				Usage: `The <path> of the host private key in the SSH server.`,
+				Value: "/etc/ssh/ssh_host_ecdsa_key",
+			},
+			cli.StringFlag{
+				Name: "remote-cert",
+				Usage: `The <path> of the host certificate in the SSH server. Defaults to
+"<remote-key>-cert.pub".`,
+			},
+			cli.StringFlag{
+				Name: "remote-user-ca",
+				Usage: `The <path> of the user CA keys in the SSH server. It is not used if the sshd
+configuration already has a TrustedUserCAKeys file.`,
+				Value: "/etc/ssh/ssh_user_ca_key.pub",
+			},
+			cli.StringFlag{
+				Name:  "sshd-config",
+				Usage: `The <path> of the sshd configuration in the SSH server.`,
+				Value: "/etc/ssh/sshd_config",
+			},
+			cli.StringFlag{
+				Name: "reload",
+				Usage: `The <command> run in the SSH server to reload sshd after installing the
+certificate.`,
+				Value: "sshd -t && systemctl reload sshd",
+			},
+			cli.StringFlag{
+				Name: "known-hosts",
+				Usage: `The known hosts <file> used to verify the SSH server. Defaults to
+"~/.ssh/known_hosts".`,
+			},
+			cli.StringFlag{
+				Name: "ca-key",
+				Usage: `The <file>, in the authorized_keys format, with the host CA keys used to
+verify the installed certificate. By default the host CA keys are retrieved from
+the CA.`,
+			},
+			cli.DurationFlag{
+				Name:  "timeout",
+				Usage: `The <duration> to wait for the SSH server.`,
+				Value: 10 * time.Second,
+			},
+			cli.BoolFlag{
+				Name:  "force",
+				Usage: `Apply the changes in the SSH server, by default they are only printed.`,
+			},
+			sshAgentSocketFlag,
+			sshPrincipalFlag,
+			sshProvisionerPasswordFlag,
+			flags.Token,
+			flags.Provisioner,
+			flags.NotBefore,
+			flags.NotAfter,
+			flags.TTL,
+			flags.CaURL,
+			flags.Root,
+			flags.Offline,
+			flags.CaConfig,
+		},
+	}
+}
+
+// installFile is a file uploaded to the remote host.
+type installFile struct {
+	Path string
+	Data []byte
+	Perm os.FileMode
+	// Appended is the number of keys appended to an existing file.
+	Appended int
+	// Exists is true if the file is in the remote host, Previous and
+	// PreviousPerm are its content and permissions. It is saved in
+	// "<Path>.bak" before it is replaced.
+	Exists       bool
+	Previous     []byte
+	PreviousPerm os.FileMode
+}
+
+// backupPath returns the path where the previous version of a remote file is
+// saved.
+func backupPath(name string) string {
+	return name + ".bak"
+}
+
+// installPlan contains the changes made in the remote host.
+type installPlan struct {
+	User       string
+	Addr       string
+	Host       string
+	Files      []installFile
+	SSHDConfig string
+	Options    []sshdOption
+	Reload     string
+	// Config is the updated sshd configuration, PreviousConfig the current one,
+	// and Added the options added to it. ConfigErr is the error updating the
+	// configuration, if it is set the plan cannot be applied. Includes are the
+	// files included in the configuration, their options are not checked.
+	Config         []byte
+	PreviousConfig []byte
+	ConfigPerm     os.FileMode
+	Added          []sshdOption
+	ConfigErr      error
+	Includes       []string
+	// Certificate is the host certificate that the server must present.
+	Certificate *ssh.Certificate
+}
+
+// Print prints the list of changes.
+func (p *installPlan) Print(generate bool) {
+	ui.Printf("Changes in %s@%s:\n", p.User, p.Addr)
+	if generate {
+		ui.Printf("  - generate a new key pair and a host certificate for %s\n", p.Host)
+	}
+	for _, f := range p.Files {
+		switch {
+		case f.Appended > 0:
+			ui.Printf("  - append %d user CA keys to %s, the current file is saved in %s\n", f.Appended, f.Path, backupPath(f.Path))
+		case f.Exists:
+			ui.Printf("  - replace %s with mode %04o, the current file is saved in %s\n", f.Path, f.Perm, backupPath(f.Path))
+		default:
+			ui.Printf("  - upload %s with mode %04o\n", f.Path, f.Perm)
+		}
+	}
+	switch {
+	case p.ConfigErr != nil:
+		ui.Printf("  - cannot update %s: %v\n", p.SSHDConfig, p.ConfigErr)
+	case len(p.Added) == 0:
+		ui.Printf("  - keep %s, it has all the options\n", p.SSHDConfig)
+	default:
+		ui.Printf("  - save the current %s in %s\n", p.SSHDConfig, backupPath(p.SSHDConfig))
+	}
+	for _, o := range p.Added {
+		ui.Printf("  - add '%s' to %s\n", o, p.SSHDConfig)
+	}
+	for _, name := range p.Includes {
+		ui.Printf(`  - {{ "%s" | yellow }} %s includes '%s', its options are not checked and can override the changes`+"\n", ui.IconWarn, p.SSHDConfig, name)
+	}
+	if p.Reload != "" {
+		ui.Printf("  - run '%s'\n", p.Reload)
+	}
+	ui.Printf("  - verify the host certificate presented by %s\n", p.Addr)
+}
+
+// remoteHost is the interface used to make the changes in the remote host. It
+// is implemented by sftpHost.
+type remoteHost interface {
+	ReadFile(name string) ([]byte, os.FileMode, error)
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	Remove(name string) error
+	Run(cmd string) error
+}
+
+func installAction(ctx *cli.Context) error {
+	if err := errs.MinMaxNumberOfArguments(ctx, 1, 2); err != nil {
+		return err
+	}
+
+	args := ctx.Args()
+	host, addr, err := splitHostPort(args.Get(0))
+	if err != nil {
+		return errs.NewClassError(errs.UsageError, errors.Wrap(err, "invalid positional argument <hostname[:port]>"))
+	}
+	keyFile, err := utils.ExpandPath(args.Get(1))
+	if err != nil {
+		return errs.InvalidFlagValueMsg(ctx, "key-file", args.Get(1), err.Error())
+	}
+	if err := flags.ExpandPathFlags(ctx, "known-hosts", "ca-key", "provisioner-password-file",
+		"root", "ca-config"); err != nil {
+		return err
+	}
+
+	remoteKey := ctx.String("remote-key")
+	remoteCert := ctx.String("remote-cert")
+	if remoteCert == "" {
+		remoteCert = remoteKey + "-cert.pub"
+	}
+	plan := &installPlan{
+		User:       ctx.String("user"),
+		Addr:       addr,
+		Host:       host,
+		SSHDConfig: ctx.String("sshd-config"),
+		Reload:     ctx.String("reload"),
+		Files: []installFile{
+			{Path: remoteKey, Perm: 0600},
+			{Path: remoteCert, Perm: 0644},
+		},
+		Options: []sshdOption{
+			{"HostKey", remoteKey},
+			{"HostCertificate", remoteCert},
+		},
+	}
+
+	// Read and check the existing key and certificate
+	if keyFile != "" {
+		if plan.Files[0].Data, plan.Files[1].Data, plan.Certificate, err = readHostIdentity(keyFile); err != nil {
+			return err
+		}
+	}
+
+	// Get all the CA keys before making any change
+	userKeys, err := getUserCAKeys(ctx)
+	if err != nil {
+		return err
+	}
+	caKeys, err := getHostCAKeys(ctx)
+	if err != nil {
+		return err
+	}
+	if len(userKeys) == 0 {
+		ui.Printf(`{{ "%s" | yellow }} {{ "User CA Keys:" | bold }} the CA does not have user CA keys, TrustedUserCAKeys will not be configured`+"\n", ui.IconWarn)
+	}
+
+	// Connect before generating the certificate, so a connection error does
+	// not waste a token. The sshd configuration is always read, so conflicts
+	// are reported before making any change.
+	client, err := dialInstallHost(ctx, plan.User, addr)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	remote, err := newSFTPHost(client)
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	if err := planInstall(remote, plan, userKeys, ctx.String("remote-user-ca")); err != nil {
+		return err
+	}
+	plan.Print(keyFile == "")
+	if plan.ConfigErr != nil {
+		return errors.Wrapf(plan.ConfigErr, "error updating %s", plan.SSHDConfig)
+	}
+	if !ctx.Bool("force") {
+		ui.Println("No changes have been made, use '--force' to apply them.")
+		return nil
+	}
+
+	if keyFile == "" {
+		if err := generateHostIdentity(ctx, plan); err != nil {
+			return err
+		}
+	}
+
+	if err := applyInstallPlan(remote, plan); err != nil {
+		return err
+	}
+	return verifyInstalledCertificate(plan, caKeys, ctx.Duration("timeout"))
+}
+
+// readHostIdentity reads the private key in keyFile and the certificate in
+// "<keyFile>-cert.pub", and checks that the certificate is a host certificate
+// for the private key.
+func readHostIdentity(keyFile string) (keyData, crtData []byte, cert *ssh.Certificate, err error) {
+	crtFile := keyFile + "-cert.pub"
+	if keyData, err = utils.ReadFile(keyFile); err != nil {
+		return
+	}
+	if crtData, err = utils.ReadFile(crtFile); err != nil {
+		return
+	}
+
+	priv, err := pemutil.ParseKey(keyData, pemutil.WithFilename(keyFile))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, nil, nil, errors.Wrapf(err, "error reading %s", keyFile)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(crtData)
+	if err != nil {
+		return nil, nil, nil, errors.Wrapf(err, "error parsing %s", crtFile)
+	}
+	var ok bool
+	if cert, ok = pub.(*ssh.Certificate); !ok || cert.CertType != ssh.HostCert {
+		return nil, nil, nil, errors.Errorf("error reading %s: file is not a host certificate", crtFile)
+	}
+	if !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+		return nil, nil, nil, errors.Errorf("the certificate in %s does not match the private key in %s", crtFile, keyFile)
+	}
+	return keyData, crtData, cert, nil
+}
+
+// generateHostIdentity generates a new key pair and signs a host certificate
+// for the host in the plan. The files are kept in memory and added to the
+// plan.
+func generateHostIdentity(ctx *cli.Context, plan *installPlan) error {
+	validAfter, validBefore, err := flags.ParseTimeDuration(ctx)
+	if err != nil {
+		return err
+	}
+	provisionerPassword, err := flags.ParseProvisionerPassword(ctx)
+	if err != nil {
+		return err
+	}
+	principals := ctx.StringSlice("principal")
+	if len(principals) == 0 {
+		principals = []string{plan.Host}
+	}
+
+	flow, err := cautils.NewCertificateFlow(ctx)
+	if err != nil {
+		return err
+	}
+	defer flow.Close()
+	token := ctx.String("token")
+	if token == "" {
+		if token, err = flow.GenerateSSHToken(ctx, plan.Host, cautils.SSHHostSignType, principals, validAfter, validBefore, cautils.WithProvisionerPassword(provisionerPassword)); err != nil {
+			return errs.Classify(flow.RootError(ctx, err), errs.TokenError)
+		}
+	}
+	caClient, err := flow.GetClient(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	// A host key cannot be encrypted, sshd cannot ask for a password
+	fs := new(memFileWriter)
+	res, err := sign(SignOptions{
+		Subject:     plan.Host,
+		Token:       token,
+		CertType:    provisioner.SSHHostCert,
+		Principals:  principals,
+		ValidAfter:  validAfter,
+		ValidBefore: validBefore,
+		KeyFile:     plan.Files[0].Path,
+		PubFile:     plan.Files[0].Path + ".pub",
+		CrtFile:     plan.Files[1].Path,
+	}, caClient, fs, nil)
+	if err != nil {
+		return flow.RootError(ctx, err)
+	}
+
+	plan.Files[0].Data = fs.files[plan.Files[0].Path]
+	plan.Files[1].Data = fs.files[plan.Files[1].Path]
+	plan.Certificate = res.Certificate
+	return nil
+}
+
+// planInstall reads the files in the plan and the sshd configuration in the
+// remote host, and adds the changes to make in them to the plan. The user CA
+// keys are uploaded to the TrustedUserCAKeys file of the configuration, or to
+// userCAFile if it does not have one, and they are appended if the file exists.
+func planInstall(remote remoteHost, plan *installPlan, userKeys []ssh.PublicKey, userCAFile string) error {
+	for i := range plan.Files {
+		f := &plan.Files[i]
+		data, mode, err := remote.ReadFile(f.Path)
+		switch {
+		case err == nil:
+			f.Exists, f.Previous, f.PreviousPerm = true, data, mode
+		case !os.IsNotExist(err):
+			return errors.Wrapf(err, "error reading %s", f.Path)
+		}
+	}
+
+	config, perm, err := remote.ReadFile(plan.SSHDConfig)
+	if err != nil {
+		return errors.Wrapf(err, "error reading %s", plan.SSHDConfig)
+	}
+	plan.PreviousConfig = config
+	plan.Includes = sshdConfigValues(config, "Include")
+
+	if len(userKeys) > 0 {
+		if values := sshdConfigValues(config, "TrustedUserCAKeys"); len(values) > 0 {
+			userCAFile = values[0]
+		}
+		data, mode, err := remote.ReadFile(userCAFile)
+		exists := err == nil
+		switch {
+		case os.IsNotExist(err):
+			data, mode = nil, 0644
+		case err != nil:
+			return errors.Wrapf(err, "error reading %s", userCAFile)
+		}
+		if updated, n := appendPublicKeys(data, userKeys); n > 0 {
+			f := installFile{Path: userCAFile, Data: updated, Perm: mode}
+			if exists {
+				f.Exists, f.Previous, f.PreviousPerm = true, data, mode
+			}
+			if len(data) > 0 {
+				f.Appended = n
+			}
+			plan.Files = append(plan.Files, f)
+		}
+		plan.Options = append(plan.Options, sshdOption{"TrustedUserCAKeys", userCAFile})
+	}
+
+	plan.ConfigPerm = perm
+	plan.Config, plan.Added, plan.ConfigErr = updateSSHDConfig(config, plan.Options)
+	return nil
+}
+
+// applyInstallPlan saves the files to replace, uploads the new ones, updates
+// the sshd configuration and runs the reload command in the remote host. If
+// any of them fails the previous files are restored. The plan must be computed
+// with planInstall.
+func applyInstallPlan(remote remoteHost, plan *installPlan) error {
+	if plan.ConfigErr != nil {
+		return errors.Wrapf(plan.ConfigErr, "error updating %s", plan.SSHDConfig)
+	}
+
+	files := append([]installFile{}, plan.Files...)
+	if len(plan.Added) > 0 {
+		files = append(files, installFile{
+			Path:         plan.SSHDConfig,
+			Data:         plan.Config,
+			Perm:         plan.ConfigPerm,
+			Exists:       true,
+			Previous:     plan.PreviousConfig,
+			PreviousPerm: plan.ConfigPerm,
+		})
+	}
+
+	for _, f := range files {
+		if f.Exists {
+			if err := remote.WriteFile(backupPath(f.Path), f.Previous, f.PreviousPerm); err != nil {
+				return errors.Wrapf(err, "error saving %s", backupPath(f.Path))
+			}
+			ui.PrintSelected("Saved", backupPath(f.Path))
+		}
+	}
+
+	for i, f := range files {
+		if err := remote.WriteFile(f.Path, f.Data, f.Perm); err != nil {
+			restoreInstallFiles(remote, files[:i])
+			return errors.Wrapf(err, "error uploading %s", f.Path)
+		}
+		if f.Path == plan.SSHDConfig {
+			for _, o := range plan.Added {
+				ui.PrintSelected("Added", fmt.Sprintf("%s to %s", o, plan.SSHDConfig))
+			}
+		} else {
+			ui.PrintSelected("Uploaded", f.Path)
+		}
+	}
+
+	if plan.Reload != "" {
+		if err := remote.Run(plan.Reload); err != nil {
+			restoreInstallFiles(remote, files)
+			return errors.Wrapf(err, "error running '%s'", plan.Reload)
+		}
+		ui.PrintSelected("Reloaded", plan.Reload)
+	}
+	return nil
+}
+
+// restoreInstallFiles restores the previous content of the given files, and
+// removes the ones that did not exist. The files that cannot be restored are
+// reported, they are still saved in "<file>.bak".
+func restoreInstallFiles(remote remoteHost, files []installFile) {
+	for i := len(files) - 1; i >= 0; i-- {
+		f := files[i]
+		var err error
+		if f.Exists {
+			err = remote.WriteFile(f.Path, f.Previous, f.PreviousPerm)
+		} else {
+			err = remote.Remove(f.Path)
+		}
+		if err != nil {
+			ui.Printf(`{{ "%s" | red }} error restoring %s: %v`+"\n", ui.IconBad, f.Path, err)
+			continue
+		}
+		ui.PrintSelected("Restored", f.Path)
+	}
+}
+
+// verifyInstalledCertificate connects to the server and checks that it
+// presents the installed certificate and it is valid. The reload of sshd might
+// not be immediate, so it is retried until the timeout.
+func verifyInstalledCertificate(plan *installPlan, caKeys []ssh.PublicKey, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := checkInstalledCertificate(plan, caKeys, timeout)
+		if err == nil {
+			ui.PrintSelected("Verified", fmt.Sprintf("%s presents the new host certificate", plan.Addr))
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.Wrapf(err, "host %s failed verification", plan.Addr)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// checkInstalledCertificate only offers the algorithm of the installed
+// certificate, otherwise a server with other host certificates might present
+// one of them.
+func checkInstalledCertificate(plan *installPlan, caKeys []ssh.PublicKey, timeout time.Duration) error {
+	key, err := dialHostKey(plan.Addr, []string{plan.Certificate.Type()}, timeout)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(key.Marshal(), plan.Certificate.Marshal()) {
+		return errors.Errorf("the server does not present the installed certificate (%s)", ssh.FingerprintSHA256(key))
+	}
+	_, err = verifyHostCertificate(key, plan.Host, caKeys, time.Now())
+	return err
+}
+
+// dialInstallHost connects to the SSH server using the keys in the agent and
+// verifying the server with the known hosts file.
+func dialInstallHost(ctx *cli.Context, user, addr string) (*ssh.Client, error) {
+	knownHostsFile := ctx.String("known-hosts")
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, errors.Wrap(err, "error getting the home directory")
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, errs.FileError(err, knownHostsFile)
+	}
+
+	agent, err := dialAgent(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer agent.Close()
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{agent.AuthMethod()},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         ctx.Duration("timeout"),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error connecting to %s@%s", user, addr)
+	}
+	return client, nil
+}
+
+// sftpHost is the remoteHost that uses SFTP to read and write files.
+type sftpHost struct {
+	client *ssh.Client
+	sftp   *sftp.Client
+}
+
+func newSFTPHost(client *ssh.Client) (*sftpHost, error) {
+	c, err := sftp.NewClient(client)
+	if err != nil {
+		return nil, errors.Wrap(err, "error starting sftp session")
+	}
+	return &sftpHost{client: client, sftp: c}, nil
+}
+
+// ReadFile implements the remoteHost interface.
+func (h *sftpHost) ReadFile(name string) ([]byte, os.FileMode, error) {
+	f, err := h.sftp.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	return b, fi.Mode().Perm(), nil
+}
+
+// WriteFile implements the remoteHost interface. The file is written in a
+// temporary file with the given permissions, and then renamed, so the
+// private key is never readable by other users and sshd never reads a
+// partial file.
+func (h *sftpHost) WriteFile(name string, data []byte, perm os.FileMode) error {
+	tmp := name + ".step-tmp"
+	f, err := h.sftp.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		h.sftp.Remove(tmp)
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		h.sftp.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		h.sftp.Remove(tmp)
+		return err
+	}
+	if err := h.sftp.PosixRename(tmp, name); err != nil {
+		h.sftp.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Remove implements the remoteHost interface.
+func (h *sftpHost) Remove(name string) error {
+	return h.sftp.Remove(name)
+}
+
+// Run implements the remoteHost interface.
+func (h *sftpHost) Run(cmd string) error {
+	session, err := h.client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	out, err := session.CombinedOutput(cmd)
+	if err != nil && len(out) > 0 {
+		return errors.Wrap(err, strings.TrimSpace(string(out)))
+	}
+	return err
+}
+
+// Close closes the SFTP session.
+func (h *sftpHost) Close() error {
+	return h.sftp.Close()
+}
+
+// memFileWriter is a FileWriter that keeps the files in memory.
+type memFileWriter struct {
+	files map[string][]byte
+}
+
+// WriteFile implements the FileWriter interface.
+func (w *memFileWriter) WriteFile(filename string, data []byte, perm os.FileMode) error {
+	if w.files == nil {
+		w.files = make(map[string][]byte)
+	}
+	w.files[filename] = data
+	return nil
+}
+
+// sshdOption is a keyword and value in the sshd configuration.
+type sshdOption struct {
+	Keyword string
+	Value   string
+}
+
+func (o sshdOption) String() string {
+	return o.Keyword + " " + o.Value
+}
+
+// updateSSHDConfig adds the given options to the sshd configuration if they
+// are missing, and returns the new configuration and the added options. The
+// options are added before the first Match block, so they apply to all the
+// connections. A HostKey is not added if the configuration does not have
+// any and the key is one of the default ones, sshd would stop loading the
+// other default keys. It fails if the configuration has a different
+// TrustedUserCAKeys, sshd only uses the first one.
+func updateSSHDConfig(config []byte, options []sshdOption) ([]byte, []sshdOption, error) {
+	lines, insertAt, existing := parseSSHDConfig(config)
+
+	var added []sshdOption
+	for _, o := range options {
+		keyword := strings.ToLower(o.Keyword)
+		values := existing[keyword]
+		if containsString(values, o.Value) {
+			continue
+		}
+		switch keyword {
+		case "hostkey":
+			if len(values) == 0 && containsString(defaultHostKeys, o.Value) {
+				continue
+			}
+		case "trustedusercakeys":
+			if len(values) > 0 {
+				return nil, nil, errors.Errorf("TrustedUserCAKeys is already set to %s", values[0])
+			}
+		}
+		existing[keyword] = append(values, o.Value)
+		added = append(added, o)
+	}
+	if len(added) == 0 {
+		return config, nil, nil
+	}
+
+	var buf bytes.Buffer
+	for _, line := range lines[:insertAt] {
+		buf.WriteString(line)
+	}
+	if insertAt > 0 && !strings.HasSuffix(lines[insertAt-1], "\n") {
+		buf.WriteString("\n")
+	}
+	for _, o := range added {
+		buf.WriteString(o.String() + "\n")
+	}
+	for _, line := range lines[insertAt:] {
+		buf.WriteString(line)
+	}
+	return buf.Bytes(), added, nil
+}
+
+// parseSSHDConfig returns the lines of the sshd configuration, the index of
+// the first Match block, and the values of the global options by lowercase
+// keyword.
+func parseSSHDConfig(config []byte) ([]string, int, map[string][]string) {
+	lines := strings.SplitAfter(string(config), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	matchAt := len(lines)
+	values := make(map[string][]string)
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		keyword := strings.ToLower(fields[0])
+		if keyword == "match" {
+			matchAt = i
+			break
+		}
+		if len(fields) > 1 {
+			values[keyword] = append(values[keyword], fields[1])
+		}
+	}
+	return lines, matchAt, values
+}
+
+// sshdConfigValues returns the values of the given global option in the sshd
+// configuration.
+func sshdConfigValues(config []byte, keyword string) []string {
+	_, _, values := parseSSHDConfig(config)
+	return values[strings.ToLower(keyword)]
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// appendPublicKeys appends to data, in the authorized_keys format, the keys
+// that are not already in it. It returns the new data and the number of keys
+// appended.
+func appendPublicKeys(data []byte, keys []ssh.PublicKey) ([]byte, int) {
+	existing := make(map[string]bool)
+	for rest := data; len(rest) > 0; {
+		pub, _, _, r, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			break
+		}
+		existing[string(pub.Marshal())] = true
+		rest = r
+	}
+
+	var n int
+	out := append([]byte{}, data...)
+	if len(out) > 0 && !bytes.HasSuffix(out, []byte("\n")) {
+		out = append(out, '\n')
+	}
+	for _, k := range keys {
+		if !existing[string(k.Marshal())] {
+			existing[string(k.Marshal())] = true
+			out = append(out, ssh.MarshalAuthorizedKey(k)...)
+			n++
+		}
+	}
+	return out, n
+}
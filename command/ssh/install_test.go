@@ -0,0 +1,297 @@
+package ssh
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+type fakeRemoteHost struct {
+	files    map[string]memFile
+	commands []string
+	err      error
+	// writeErr is returned when writing the file with the given name.
+	writeErr map[string]error
+}
+
+func (h *fakeRemoteHost) ReadFile(name string) ([]byte, os.FileMode, error) {
+	f, ok := h.files[name]
+	if !ok {
+		return nil, 0, os.ErrNotExist
+	}
+	return f.data, f.perm, nil
+}
+
+func (h *fakeRemoteHost) WriteFile(name string, data []byte, perm os.FileMode) error {
+	if err := h.writeErr[name]; err != nil {
+		return err
+	}
+	h.files[name] = memFile{data, perm}
+	return nil
+}
+
+func (h *fakeRemoteHost) Remove(name string) error {
+	delete(h.files, name)
+	return nil
+}
+
+func (h *fakeRemoteHost) Run(cmd string) error {
+	h.commands = append(h.commands, cmd)
+	return h.err
+}
+
+func TestUpdateSSHDConfig(t *testing.T) {
+	options := []sshdOption{
+		{"HostKey", "/etc/ssh/ssh_host_ecdsa_key"},
+		{"HostCertificate", "/etc/ssh/ssh_host_ecdsa_key-cert.pub"},
+		{"TrustedUserCAKeys", "/etc/ssh/ssh_user_ca_key.pub"},
+	}
+	tests := []struct {
+		name    string
+		config  string
+		want    string
+		added   int
+		wantErr string
+	}{
+		{"ok/empty", "", "HostCertificate /etc/ssh/ssh_host_ecdsa_key-cert.pub\nTrustedUserCAKeys /etc/ssh/ssh_user_ca_key.pub\n", 2, ""},
+		{"ok/default-keys", "# HostKey /etc/ssh/ssh_host_rsa_key\nPermitRootLogin no",
+			"# HostKey /etc/ssh/ssh_host_rsa_key\nPermitRootLogin no\nHostCertificate /etc/ssh/ssh_host_ecdsa_key-cert.pub\nTrustedUserCAKeys /etc/ssh/ssh_user_ca_key.pub\n", 2, ""},
+		{"ok/host-keys", "HostKey /etc/ssh/ssh_host_ed25519_key\n",
+			"HostKey /etc/ssh/ssh_host_ed25519_key\nHostKey /etc/ssh/ssh_host_ecdsa_key\nHostCertificate /etc/ssh/ssh_host_ecdsa_key-cert.pub\nTrustedUserCAKeys /etc/ssh/ssh_user_ca_key.pub\n", 3, ""},
+		{"ok/match", "PermitRootLogin no\nMatch User jane\n\tHostCertificate /tmp/cert.pub\n",
+			"PermitRootLogin no\nHostCertificate /etc/ssh/ssh_host_ecdsa_key-cert.pub\nTrustedUserCAKeys /etc/ssh/ssh_user_ca_key.pub\nMatch User jane\n\tHostCertificate /tmp/cert.pub\n", 2, ""},
+		{"ok/installed", "hostcertificate /etc/ssh/ssh_host_ecdsa_key-cert.pub\nTrustedUserCAKeys /etc/ssh/ssh_user_ca_key.pub\n",
+			"hostcertificate /etc/ssh/ssh_host_ecdsa_key-cert.pub\nTrustedUserCAKeys /etc/ssh/ssh_user_ca_key.pub\n", 0, ""},
+		{"fail/trusted-user-ca-keys", "TrustedUserCAKeys /etc/ssh/ca.pub\n", "", 0, "TrustedUserCAKeys is already set to /etc/ssh/ca.pub"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, added, err := updateSSHDConfig([]byte(tt.config), options)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, string(got))
+			require.Len(t, added, tt.added)
+		})
+	}
+}
+
+func newTestInstallPlan() *installPlan {
+	return &installPlan{
+		SSHDConfig: "/etc/ssh/sshd_config",
+		Reload:     "systemctl reload sshd",
+		Files: []installFile{
+			{Path: "/etc/ssh/ssh_host_ecdsa_key", Data: []byte("key"), Perm: 0600},
+			{Path: "/etc/ssh/ssh_host_ecdsa_key-cert.pub", Data: []byte("cert"), Perm: 0644},
+		},
+		Options: []sshdOption{{"HostCertificate", "/etc/ssh/ssh_host_ecdsa_key-cert.pub"}},
+	}
+}
+
+func TestApplyInstallPlan(t *testing.T) {
+	remote := &fakeRemoteHost{files: map[string]memFile{
+		"/etc/ssh/sshd_config": {[]byte("PermitRootLogin no\n"), 0600},
+	}}
+	plan := newTestInstallPlan()
+	require.NoError(t, planInstall(remote, plan, nil, "/etc/ssh/ssh_user_ca_key.pub"))
+	require.NoError(t, applyInstallPlan(remote, plan))
+	require.Equal(t, memFile{[]byte("key"), 0600}, remote.files["/etc/ssh/ssh_host_ecdsa_key"])
+	require.Equal(t, memFile{[]byte("cert"), 0644}, remote.files["/etc/ssh/ssh_host_ecdsa_key-cert.pub"])
+	require.Equal(t, memFile{[]byte("PermitRootLogin no\nHostCertificate /etc/ssh/ssh_host_ecdsa_key-cert.pub\n"), 0600}, remote.files["/etc/ssh/sshd_config"])
+	require.Equal(t, []string{"systemctl reload sshd"}, remote.commands)
+	require.Equal(t, memFile{[]byte("PermitRootLogin no\n"), 0600}, remote.files["/etc/ssh/sshd_config.bak"])
+	require.Len(t, remote.files, 4)
+
+	// The installed files are saved before they are replaced, and restored
+	// if the reload fails
+	plan = newTestInstallPlan()
+	plan.Files[0].Data = []byte("new key")
+	require.NoError(t, planInstall(remote, plan, nil, "/etc/ssh/ssh_user_ca_key.pub"))
+	require.Empty(t, plan.Added)
+	require.True(t, plan.Files[0].Exists)
+	require.Equal(t, []byte("key"), plan.Files[0].Previous)
+	remote.err = errors.New("command failed")
+	require.EqualError(t, applyInstallPlan(remote, plan), "error running 'systemctl reload sshd': command failed")
+	require.Equal(t, memFile{[]byte("key"), 0600}, remote.files["/etc/ssh/ssh_host_ecdsa_key"])
+	require.Equal(t, memFile{[]byte("key"), 0600}, remote.files["/etc/ssh/ssh_host_ecdsa_key.bak"])
+	require.Equal(t, memFile{[]byte("cert"), 0644}, remote.files["/etc/ssh/ssh_host_ecdsa_key-cert.pub.bak"])
+
+	plan.SSHDConfig = "/usr/local/etc/ssh/sshd_config"
+	require.Error(t, planInstall(remote, plan, nil, "/etc/ssh/ssh_user_ca_key.pub"))
+}
+
+func TestApplyInstallPlan_restore(t *testing.T) {
+	config := memFile{[]byte("PermitRootLogin no\n"), 0600}
+	remote := &fakeRemoteHost{
+		files: map[string]memFile{
+			"/etc/ssh/sshd_config":        config,
+			"/etc/ssh/ssh_host_ecdsa_key": {[]byte("old key"), 0600},
+		},
+		writeErr: map[string]error{"/etc/ssh/sshd_config.bak": errors.New("permission denied")},
+	}
+
+	// Nothing is replaced if a file cannot be saved
+	plan := newTestInstallPlan()
+	require.NoError(t, planInstall(remote, plan, nil, "/etc/ssh/ssh_user_ca_key.pub"))
+	require.EqualError(t, applyInstallPlan(remote, plan), "error saving /etc/ssh/sshd_config.bak: permission denied")
+	require.Equal(t, memFile{[]byte("old key"), 0600}, remote.files["/etc/ssh/ssh_host_ecdsa_key"])
+	require.Len(t, remote.files, 3)
+
+	// The new certificate is removed and the previous key restored
+	delete(remote.files, "/etc/ssh/ssh_host_ecdsa_key.bak")
+	remote.writeErr = map[string]error{"/etc/ssh/sshd_config": errors.New("read-only file system")}
+	require.EqualError(t, applyInstallPlan(remote, plan), "error uploading /etc/ssh/sshd_config: read-only file system")
+	require.Equal(t, map[string]memFile{
+		"/etc/ssh/sshd_config":            config,
+		"/etc/ssh/sshd_config.bak":        config,
+		"/etc/ssh/ssh_host_ecdsa_key":     {[]byte("old key"), 0600},
+		"/etc/ssh/ssh_host_ecdsa_key.bak": {[]byte("old key"), 0600},
+	}, remote.files)
+	require.Empty(t, remote.commands)
+}
+
+func TestPlanInstall(t *testing.T) {
+	_, userKey := mustReadIdentity(t)
+	otherKey := newFakeCAClient(t).signer.PublicKey()
+	userKeys := []ssh.PublicKey{userKey}
+
+	// New TrustedUserCAKeys file
+	remote := &fakeRemoteHost{files: map[string]memFile{
+		"/etc/ssh/sshd_config": {[]byte("PermitRootLogin no\n"), 0600},
+	}}
+	plan := newTestInstallPlan()
+	require.NoError(t, planInstall(remote, plan, userKeys, "/etc/ssh/ssh_user_ca_key.pub"))
+	require.NoError(t, plan.ConfigErr)
+	require.Equal(t, installFile{Path: "/etc/ssh/ssh_user_ca_key.pub", Data: ssh.MarshalAuthorizedKey(userKey), Perm: 0644}, plan.Files[2])
+	require.Equal(t, []sshdOption{
+		{"HostCertificate", "/etc/ssh/ssh_host_ecdsa_key-cert.pub"},
+		{"TrustedUserCAKeys", "/etc/ssh/ssh_user_ca_key.pub"},
+	}, plan.Added)
+
+	// The keys are appended to the configured file
+	existing := ssh.MarshalAuthorizedKey(otherKey)
+	remote = &fakeRemoteHost{files: map[string]memFile{
+		"/etc/ssh/sshd_config": {[]byte("TrustedUserCAKeys /etc/ssh/ca.pub\n"), 0600},
+		"/etc/ssh/ca.pub":      {existing, 0640},
+	}}
+	plan = newTestInstallPlan()
+	require.NoError(t, planInstall(remote, plan, userKeys, "/etc/ssh/ssh_user_ca_key.pub"))
+	require.NoError(t, plan.ConfigErr)
+	require.Equal(t, installFile{Path: "/etc/ssh/ca.pub", Data: append(existing, ssh.MarshalAuthorizedKey(userKey)...), Perm: 0640, Appended: 1,
+		Exists: true, Previous: existing, PreviousPerm: 0640}, plan.Files[2])
+	require.Equal(t, []sshdOption{{"HostCertificate", "/etc/ssh/ssh_host_ecdsa_key-cert.pub"}}, plan.Added)
+	require.NoError(t, applyInstallPlan(remote, plan))
+	require.Equal(t, memFile{append(existing, ssh.MarshalAuthorizedKey(userKey)...), 0640}, remote.files["/etc/ssh/ca.pub"])
+
+	// The file already has the keys
+	plan = newTestInstallPlan()
+	require.NoError(t, planInstall(remote, plan, userKeys, "/etc/ssh/ssh_user_ca_key.pub"))
+	require.Len(t, plan.Files, 2)
+
+	// The options of the included files are not checked
+	remote = &fakeRemoteHost{files: map[string]memFile{
+		"/etc/ssh/sshd_config": {[]byte("Include /etc/ssh/sshd_config.d/*.conf\n"), 0600},
+	}}
+	plan = newTestInstallPlan()
+	require.NoError(t, planInstall(remote, plan, nil, "/etc/ssh/ssh_user_ca_key.pub"))
+	require.Equal(t, []string{"/etc/ssh/sshd_config.d/*.conf"}, plan.Includes)
+
+	// A conflict does not upload any file
+	remote = &fakeRemoteHost{files: map[string]memFile{
+		"/etc/ssh/sshd_config": {[]byte("TrustedUserCAKeys /etc/ssh/ca.pub\n"), 0600},
+	}}
+	plan = newTestInstallPlan()
+	plan.Options = append(plan.Options, sshdOption{"TrustedUserCAKeys", "/etc/ssh/other.pub"})
+	require.NoError(t, planInstall(remote, plan, nil, "/etc/ssh/ssh_user_ca_key.pub"))
+	require.EqualError(t, plan.ConfigErr, "TrustedUserCAKeys is already set to /etc/ssh/ca.pub")
+	require.EqualError(t, applyInstallPlan(remote, plan), "error updating /etc/ssh/sshd_config: TrustedUserCAKeys is already set to /etc/ssh/ca.pub")
+	require.Len(t, remote.files, 1)
+}
+
+func TestAppendPublicKeys(t *testing.T) {
+	_, key := mustReadIdentity(t)
+	data, n := appendPublicKeys(nil, []ssh.PublicKey{key, key})
+	require.Equal(t, 1, n)
+	require.Equal(t, ssh.MarshalAuthorizedKey(key), data)
+
+	data, n = appendPublicKeys([]byte("# comment"), []ssh.PublicKey{key})
+	require.Equal(t, 1, n)
+	require.Equal(t, append([]byte("# comment\n"), ssh.MarshalAuthorizedKey(key)...), data)
+
+	_, n = appendPublicKeys(data, []ssh.PublicKey{key})
+	require.Equal(t, 0, n)
+}
+
+func TestReadHostIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "step-ssh-install")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fs := new(memFS)
+	_, err = sign(newSignOptions(provisioner.SSHHostCert), newFakeCAClient(t), fs, nil)
+	require.NoError(t, err)
+	keyFile := filepath.Join(dir, "ssh_host_ed25519_key")
+	require.NoError(t, ioutil.WriteFile(keyFile, fs.files["id_ed25519"].data, 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile+"-cert.pub", fs.files["id_ed25519-cert.pub"].data, 0644))
+
+	keyData, crtData, cert, err := readHostIdentity(keyFile)
+	require.NoError(t, err)
+	require.Equal(t, fs.files["id_ed25519"].data, keyData)
+	require.Equal(t, fs.files["id_ed25519-cert.pub"].data, crtData)
+	require.Equal(t, uint32(2), cert.CertType)
+
+	// User certificates are not valid
+	fs = new(memFS)
+	_, err = sign(newSignOptions(provisioner.SSHUserCert), newFakeCAClient(t), fs, nil)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(keyFile+"-cert.pub", fs.files["id_ed25519-cert.pub"].data, 0644))
+	_, _, _, err = readHostIdentity(keyFile)
+	require.EqualError(t, err, "error reading "+keyFile+"-cert.pub: file is not a host certificate")
+
+	_, _, _, err = readHostIdentity(filepath.Join(dir, "missing"))
+	require.Error(t, err)
+}
+
+func TestCheckInstalledCertificate(t *testing.T) {
+	now := time.Now()
+	ca := mustHostSigner(t)
+	edKey := mustHostSigner(t)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ecSigner, err := ssh.NewSignerFromKey(ecKey)
+	require.NoError(t, err)
+
+	edCert := mustHostCertificate(t, edKey.PublicKey(), ca, ssh.HostCert, []string{"127.0.0.1"}, now.Add(-time.Hour), now.Add(time.Hour))
+	ecCert := mustHostCertificate(t, ecSigner.PublicKey(), ca, ssh.HostCert, []string{"127.0.0.1"}, now.Add(-time.Hour), now.Add(time.Hour))
+	edCertSigner, err := ssh.NewCertSigner(edCert, edKey)
+	require.NoError(t, err)
+	ecCertSigner, err := ssh.NewCertSigner(ecCert, ecSigner)
+	require.NoError(t, err)
+
+	// The server has another host certificate preferred by the client
+	addr, closer := serveHostKey(t, edCertSigner, ecCertSigner)
+	defer closer()
+	caKeys := []ssh.PublicKey{ca.PublicKey()}
+	plan := &installPlan{Addr: addr, Host: "127.0.0.1", Certificate: ecCert}
+	require.NoError(t, checkInstalledCertificate(plan, caKeys, 5*time.Second))
+	plan.Certificate = edCert
+	require.NoError(t, checkInstalledCertificate(plan, caKeys, 5*time.Second))
+
+	// The server does not have the installed certificate
+	addr, closer = serveHostKey(t, edCertSigner)
+	defer closer()
+	plan = &installPlan{Addr: addr, Host: "127.0.0.1", Certificate: ecCert}
+	require.Error(t, checkInstalledCertificate(plan, caKeys, 5*time.Second))
+}
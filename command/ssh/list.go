@@ -15,7 +15,7 @@ func listCommand() cli.Command {
 		Name:      "list",
 		Action:    command.ActionFunc(listAction),
 		Usage:     "list public keys known to the ssh agent",
-		UsageText: `**step ssh list** [<subject>] [**--raw**]`,
+		UsageText: `**step ssh list** [<subject>] [**--raw**] [**--agent-socket**=<path>]`,
 		Description: `**step ssh list** list public key identities known to the ssh agent.
 
 By default it prints key fingerprints, to list the raw key use the flag **--raw**.
@@ -51,6 +51,7 @@ $ step ssh list --raw joe@work
 				Name:  "raw",
 				Usage: "List public keys instead of fingerprints.",
 			},
+			sshAgentSocketFlag,
 		},
 	}
 }
@@ -65,7 +66,7 @@ func listAction(ctx *cli.Context) error {
 		subject = ctx.Args().First()
 	}
 
-	agent, err := sshutil.DialAgent()
+	agent, err := dialAgent(ctx)
 	if err != nil {
 		return err
 	}
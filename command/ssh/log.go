@@ -0,0 +1,327 @@
+package ssh
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
+)
+
+// verbosity is the value of the --verbose flag. It behaves like a boolean
+// flag, but each use increases the level by one, so "-v -v" is level 2. A
+// number sets the level, e.g. STEP_VERBOSE=2.
+type verbosity struct {
+	level *int
+	step  int
+}
+
+// newVerbosityFlags returns the flags --verbose, -v and -vv. All of them
+// update the same level, -vv increases it by two.
+func newVerbosityFlags() []cli.Flag {
+	level := new(int)
+	return []cli.Flag{
+		cli.GenericFlag{
+			Name: "verbose, v",
+			Usage: `Print the steps of the issuance flow to STDERR: the resolved flags, the
+provisioner, the token claims, the request sent to the CA and its response, and
+the files written. Use it twice, or **-vv**, to also print the raw JSON of the
+request and the response with the key material elided.`,
+			Value: &verbosity{level: level, step: 1},
+		},
+		cli.GenericFlag{
+			Name:   "vv",
+			Hidden: true,
+			Value:  &verbosity{level: level, step: 2},
+		},
+	}
+}
+
+// IsBoolFlag allows to use the flag without a value.
+func (v *verbosity) IsBoolFlag() bool { return true }
+
+// Set implements the flag.Value interface.
+func (v *verbosity) Set(s string) error {
+	switch s {
+	case "true":
+		*v.level += v.step
+	case "false":
+		*v.level = 0
+	default:
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return errors.Errorf("invalid verbosity level '%s'", s)
+		}
+		*v.level = n
+	}
+	return nil
+}
+
+// String implements the flag.Value interface.
+func (v *verbosity) String() string {
+	if v == nil || v.level == nil {
+		return "0"
+	}
+	return strconv.Itoa(*v.level)
+}
+
+// verbosityLevel returns the level set with the --verbose flags.
+func verbosityLevel(ctx *cli.Context) int {
+	if v, ok := ctx.Generic("verbose").(*verbosity); ok && v.level != nil {
+		return *v.level
+	}
+	return 0
+}
+
+// Logger writes the messages of the issuance flow enabled with --verbose.
+// Messages at level 1 describe each phase, messages at level 2 include the raw
+// request and response. All the methods of a nil Logger are no-ops.
+type Logger struct {
+	w     io.Writer
+	level int
+}
+
+// newLogger returns a Logger writing to w, or nil if the level is 0.
+func newLogger(w io.Writer, level int) *Logger {
+	if level <= 0 {
+		return nil
+	}
+	return &Logger{w: w, level: level}
+}
+
+// newCertificateLogger returns the logger of step ssh certificate, it writes
+// to STDERR so the output of --json is not modified.
+func newCertificateLogger(ctx *cli.Context) *Logger {
+	return newLogger(os.Stderr, verbosityLevel(ctx))
+}
+
+// Enabled returns true if the messages of the given level are written.
+func (l *Logger) Enabled(level int) bool {
+	return l != nil && l.level >= level
+}
+
+// Debugf writes a level 1 message of the given phase.
+func (l *Logger) Debugf(phase, format string, args ...interface{}) {
+	l.logf(1, phase, format, args...)
+}
+
+// Tracef writes a level 2 message of the given phase.
+func (l *Logger) Tracef(phase, format string, args ...interface{}) {
+	l.logf(2, phase, format, args...)
+}
+
+// TraceJSON writes a level 2 message with the JSON encoding of v. The values
+// of the fields with key material are elided.
+func (l *Logger) TraceJSON(phase, name string, v interface{}) {
+	if !l.Enabled(2) {
+		return
+	}
+	b, err := marshalElided(v)
+	if err != nil {
+		l.Tracef(phase, "%s: error encoding JSON: %v", name, err)
+		return
+	}
+	l.Tracef(phase, "%s: %s", name, b)
+}
+
+func (l *Logger) logf(level int, phase, format string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	prefix := "DEBUG"
+	if level > 1 {
+		prefix = "TRACE"
+	}
+	fmt.Fprintf(l.w, "%s [%s] %s\n", prefix, phase, fmt.Sprintf(format, args...))
+}
+
+// elidedFields are the JSON fields replaced by the logger. They contain keys,
+// certificates, CSRs and tokens.
+var elidedFields = map[string]bool{
+	"publicKey":        true,
+	"addUserPublicKey": true,
+	"identityCSR":      true,
+	"ott":              true,
+	"crt":              true,
+	"addUserCrt":       true,
+	"identityCrt":      true,
+}
+
+// marshalElided returns the JSON encoding of v with the values of the
+// elidedFields replaced with "<elided>".
+func marshalElided(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var m interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(elide(m)); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func elide(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			if elidedFields[k] && val != nil {
+				v[k] = "<elided>"
+			} else {
+				v[k] = elide(val)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = elide(v[i])
+		}
+	}
+	return v
+}
+
+// logFlags writes the flags set in the command line, in the environment or in
+// the defaults file, using the long name of each flag. The value of --token is
+// redacted.
+func logFlags(l *Logger, ctx *cli.Context) {
+	if !l.Enabled(1) {
+		return
+	}
+	var flags []string
+	for _, f := range ctx.Command.Flags {
+		var name string
+		for _, s := range strings.Split(f.GetName(), ",") {
+			if s = strings.TrimSpace(s); len(s) > len(name) {
+				name = s
+			}
+		}
+		if name == "vv" || !ctx.IsSet(name) {
+			continue
+		}
+		value := "<redacted>"
+		if name != "token" {
+			if v, ok := ctx.Generic(name).(fmt.Stringer); ok {
+				value = v.String()
+			}
+		}
+		flags = append(flags, "--"+name+"="+value)
+	}
+	sort.Strings(flags)
+	l.Debugf("flags", "%s", strings.Join(flags, " "))
+	l.Debugf("flags", "arguments: %s", strings.Join(ctx.Args(), " "))
+}
+
+// logToken writes the provisioner and the claims of the given token. The token
+// is not validated, and the signature is never written.
+func logToken(l *Logger, tok string) {
+	if !l.Enabled(1) {
+		return
+	}
+	parts := strings.Split(tok, ".")
+	if len(parts) != 3 {
+		l.Debugf("token", "the token is not a JWT")
+		return
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		l.Debugf("token", "error decoding the token header: %v", err)
+		return
+	}
+	claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		l.Debugf("token", "error decoding the token claims: %v", err)
+		return
+	}
+	var payload struct {
+		Issuer string `json:"iss"`
+	}
+	var hdr struct {
+		KeyID string `json:"kid"`
+	}
+	_ = json.Unmarshal(claims, &payload)
+	_ = json.Unmarshal(header, &hdr)
+	l.Debugf("token", "provisioner: %s (kid %s)", payload.Issuer, hdr.KeyID)
+	l.Debugf("token", "header: %s", header)
+	l.Debugf("token", "claims: %s", claims)
+	l.Debugf("token", "signature: <redacted>")
+}
+
+// logCertificate writes the summary of a certificate returned by the CA.
+func logCertificate(l *Logger, name string, cert *ssh.Certificate) {
+	if !l.Enabled(1) || cert == nil {
+		return
+	}
+	l.Debugf("sign", "%s: serial %d, key id %q, principals [%s], key %s %s, valid after %d, valid before %d",
+		name, cert.Serial, cert.KeyId, strings.Join(cert.ValidPrincipals, ", "), cert.Key.Type(),
+		ssh.FingerprintSHA256(cert.Key), cert.ValidAfter, cert.ValidBefore)
+}
+
+// logSignError writes the HTTP status and the message of an error returned by
+// the CA, or the error if the request could not be sent.
+func logSignError(l *Logger, err error) {
+	if !l.Enabled(1) {
+		return
+	}
+	// The errors of the CA have a cause, errors.Cause cannot be used
+	var sc interface{ StatusCode() int }
+	for e := err; e != nil && sc == nil; {
+		if v, ok := e.(interface{ StatusCode() int }); ok {
+			sc = v
+		} else if c, ok := e.(interface{ Cause() error }); ok {
+			e = c.Cause()
+		} else {
+			e = nil
+		}
+	}
+	if sc == nil {
+		l.Debugf("sign", "error sending the request: %v", err)
+		return
+	}
+	msg := err.Error()
+	if m, ok := sc.(interface{ Message() string }); ok {
+		msg = m.Message()
+	}
+	l.Debugf("sign", "the CA responded with HTTP status %d: %s", sc.StatusCode(), msg)
+	l.TraceJSON("sign", "error response", map[string]interface{}{
+		"status":  sc.StatusCode(),
+		"message": msg,
+	})
+}
+
+// loggingFileWriter is a FileWriter that logs the files written.
+type loggingFileWriter struct {
+	FileWriter
+	log *Logger
+}
+
+// logFileWriter returns fs or, if the logger is enabled, a FileWriter that logs
+// the files written with fs.
+func logFileWriter(fs FileWriter, l *Logger) FileWriter {
+	if !l.Enabled(1) {
+		return fs
+	}
+	return loggingFileWriter{FileWriter: fs, log: l}
+}
+
+// WriteFile implements the FileWriter interface.
+func (w loggingFileWriter) WriteFile(filename string, data []byte, perm os.FileMode) error {
+	if err := w.FileWriter.WriteFile(filename, data, perm); err != nil {
+		w.log.Debugf("files", "error writing %s: %v", filename, err)
+		return err
+	}
+	w.log.Debugf("files", "wrote %s (%d bytes, mode %04o)", filename, len(data), perm)
+	return nil
+}
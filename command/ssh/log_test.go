@@ -0,0 +1,136 @@
+package ssh
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/authority/provisioner"
+	cerrs "github.com/smallstep/certificates/errs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerbosityLevel(t *testing.T) {
+	tests := []struct {
+		args []string
+		want int
+	}{
+		{nil, 0},
+		{[]string{"-v"}, 1},
+		{[]string{"--verbose"}, 1},
+		{[]string{"-v", "-v"}, 2},
+		{[]string{"-vv"}, 2},
+		{[]string{"-vv", "-v"}, 3},
+		{[]string{"--verbose=2"}, 2},
+		{[]string{"-v", "--verbose=false"}, 0},
+	}
+	for _, tt := range tests {
+		ctx := newCertificateContext(t, append(tt.args, "jane@example.com", "id_ecdsa")...)
+		require.Equal(t, tt.want, verbosityLevel(ctx), "%v", tt.args)
+		require.Equal(t, []string{"jane@example.com", "id_ecdsa"}, []string(ctx.Args()))
+	}
+
+	require.Error(t, new(verbosity).Set("debug"))
+}
+
+func TestLogger(t *testing.T) {
+	var l *Logger
+	require.False(t, l.Enabled(1))
+	l.Debugf("sign", "not written")
+	l.TraceJSON("sign", "request", nil)
+	require.Nil(t, newLogger(new(bytes.Buffer), 0))
+
+	var buf bytes.Buffer
+	l = newLogger(&buf, 1)
+	l.Debugf("sign", "requesting %s", "certificate")
+	l.Tracef("sign", "not written")
+	l.TraceJSON("sign", "request", nil)
+	require.Equal(t, "DEBUG [sign] requesting certificate\n", buf.String())
+
+	buf.Reset()
+	l = newLogger(&buf, 2)
+	l.TraceJSON("sign", "request", &api.SSHSignRequest{
+		PublicKey:  []byte("key"),
+		OTT:        "the-token",
+		CertType:   "user",
+		Principals: []string{"jane"},
+	})
+	require.Equal(t, `TRACE [sign] request: {"certType":"user","identityCSR":null,"ott":"<elided>","principals":["jane"],"publicKey":"<elided>","validAfter":"","validBefore":""}`+"\n", buf.String())
+}
+
+func TestLogToken(t *testing.T) {
+	enc := base64.RawURLEncoding.EncodeToString
+	tok := enc([]byte(`{"alg":"ES256","kid":"the-kid"}`)) + "." + enc([]byte(`{"iss":"admin","sub":"jane@example.com"}`)) + ".c2VjcmV0LXNpZ25hdHVyZQ"
+
+	var buf bytes.Buffer
+	logToken(newLogger(&buf, 1), tok)
+	require.Equal(t, `DEBUG [token] provisioner: admin (kid the-kid)
+DEBUG [token] header: {"alg":"ES256","kid":"the-kid"}
+DEBUG [token] claims: {"iss":"admin","sub":"jane@example.com"}
+DEBUG [token] signature: <redacted>
+`, buf.String())
+
+	buf.Reset()
+	logToken(newLogger(&buf, 1), "the-token")
+	require.Equal(t, "DEBUG [token] the token is not a JWT\n", buf.String())
+}
+
+func TestLogFlags(t *testing.T) {
+	var buf bytes.Buffer
+	ctx := newCertificateContext(t, "--force", "-v", "--token", "the-token", "--principal", "jane", "jane@example.com", "id_ecdsa")
+	logFlags(newLogger(&buf, 1), ctx)
+	require.Equal(t, `DEBUG [flags] --force=true --principal=jane --token=<redacted> --verbose=1
+DEBUG [flags] arguments: jane@example.com id_ecdsa
+`, buf.String())
+}
+
+func TestSign_logger(t *testing.T) {
+	var buf bytes.Buffer
+	opts := newSignOptions(provisioner.SSHUserCert)
+	opts.Logger = newLogger(&buf, 2)
+	fs, agent := new(memFS), new(fakeAgent)
+	_, err := sign(opts, newFakeCAClient(t), fs, agent)
+	require.NoError(t, err)
+
+	out := buf.String()
+	for _, s := range []string{
+		"DEBUG [sign] CA version 0.15.14, client authentication required: false\n",
+		`DEBUG [sign] requesting user certificate: key ecdsa-sha2-nistp256 SHA256:`,
+		`key id "jane@example.com", principals [jane, jane@example.com], valid after "2020-11-01T`,
+		"add user false, identity CSR false, template data 0 bytes\n",
+		`TRACE [sign] request: {"certType":"user","identityCSR":null,"keyID":"jane@example.com","ott":"<elided>","principals":["jane","jane@example.com"],"publicKey":"<elided>",`,
+		`TRACE [sign] response: {"crt":"<elided>"}` + "\n",
+		`DEBUG [sign] certificate: serial 1234, key id "jane@example.com", principals [jane, jane@example.com], key ecdsa-sha2-nistp256 SHA256:`,
+		"DEBUG [files] wrote id_ed25519 (",
+		"DEBUG [files] wrote id_ed25519.pub (",
+		"bytes, mode 0644)\n",
+		"DEBUG [files] wrote id_ed25519-cert.pub (",
+		`DEBUG [agent] added the certificate with comment "jane@example.com"` + "\n",
+	} {
+		require.Contains(t, out, s)
+	}
+	require.NotContains(t, out, "the-token")
+
+	// Errors returned by the CA
+	buf.Reset()
+	client := newFakeCAClient(t)
+	client.err = errors.Wrap(&cerrs.Error{Status: 401, Err: errors.New("the token is not valid"), Msg: "not authorized"}, "error signing")
+	_, err = sign(opts, client, new(memFS), nil)
+	require.Error(t, err)
+	require.Contains(t, buf.String(), "DEBUG [sign] the CA responded with HTTP status 401: not authorized\n")
+	require.Contains(t, buf.String(), `TRACE [sign] error response: {"message":"not authorized","status":401}`+"\n")
+
+	buf.Reset()
+	client.err = errors.New("connection refused")
+	_, err = sign(opts, client, new(memFS), nil)
+	require.Error(t, err)
+	require.Contains(t, buf.String(), "DEBUG [sign] error sending the request: connection refused\n")
+
+	buf.Reset()
+	fs.err = errors.New("permission denied")
+	_, err = sign(opts, newFakeCAClient(t), fs, nil)
+	require.Error(t, err)
+	require.Contains(t, buf.String(), "DEBUG [files] error writing id_ed25519: permission denied\n")
+}
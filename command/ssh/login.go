@@ -1,20 +1,25 @@
 package ssh
 
 import (
-	"crypto"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
-	"github.com/smallstep/certificates/api"
 	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/certificates/ca"
 	"github.com/smallstep/cli/command"
-	"github.com/smallstep/cli/crypto/keys"
+	"github.com/smallstep/cli/config"
+	"github.com/smallstep/cli/crypto/pemutil"
 	"github.com/smallstep/cli/crypto/sshutil"
 	"github.com/smallstep/cli/errs"
 	"github.com/smallstep/cli/flags"
 	"github.com/smallstep/cli/ui"
+	"github.com/smallstep/cli/utils"
 	"github.com/smallstep/cli/utils/cautils"
+	"github.com/smallstep/cli/utils/sysutils"
 	"github.com/urfave/cli"
 	"golang.org/x/crypto/ssh"
 )
@@ -26,10 +31,11 @@ func loginCommand() cli.Command {
 		Usage:  "adds a SSH certificate into the authentication agent",
 		UsageText: `**step ssh login** <identity>
 [**--token**=<token>] [**--provisioner**=<name>] [**--provisioner-password-file**=<file>]
+[**--provisioner-password-stdin**]
 [**--not-before**=<time|duration>] [**--not-after**=<time|duration>]
 [**--set**=<key=value>] [**--set-file**=<path>]
 [**--force**] [**--ca-url**=<uri>] [**--root**=<file>]
-[**--offline**] [**--ca-config**=<path>]`,
+[**--offline**] [**--ca-config**=<path>] [**--agent-socket**=<path>] [**--console**]`,
 		Description: `**step ssh login** generates a new SSH key pair and send a request to [step
 certificates](https://github.com/smallstep/certificates) to sign a user
 certificate. This certificate will be automatically added to the SSH agent.
@@ -37,6 +43,15 @@ certificate. This certificate will be automatically added to the SSH agent.
 With a certificate servers may trust only the CA key and verify its signature on
 a certificate rather than trusting many user keys.
 
+The private key, public key and certificate are also stored in
+'$STEPPATH/ssh/id_<identity>', '$STEPPATH/ssh/id_<identity>.pub' and
+'$STEPPATH/ssh/id_<identity>-cert.pub', and the add user files in
+'$STEPPATH/ssh/id_<identity>-provisioner'. If a matching certificate is already
+in the SSH agent, or a stored certificate is still valid, the command does not
+request a new one and only adds the stored key and certificate to the agent.
+Use **--force** to always request a new certificate. Use **step ssh logout**
+to remove the identity from the agent and delete the stored files.
+
 ## POSITIONAL ARGUMENTS
 
 <identity>
@@ -54,6 +69,11 @@ $ step ssh login joe@example.com
 Request a new SSH certificate valid only for 1h:
 '''
 $ step ssh login --not-after 1h joe@smallstep.com
+'''
+
+Request a new SSH certificate even if a valid one is stored:
+'''
+$ step ssh login --force joe@smallstep.com
 '''`,
 		Flags: []cli.Flag{
 			flags.Token,
@@ -61,15 +81,18 @@ $ step ssh login --not-after 1h joe@smallstep.com
 			flags.Identity,
 			flags.Provisioner,
 			flags.ProvisionerPasswordFileWithAlias,
+			flags.ProvisionerPasswordStdin,
 			flags.NotBefore,
 			flags.NotAfter,
 			flags.TemplateSet,
 			flags.TemplateSetFile,
 			flags.CaURL,
+			flags.Console,
 			flags.Root,
 			flags.Offline,
 			flags.CaConfig,
 			flags.Force,
+			sshAgentSocketFlag,
 		},
 	}
 }
@@ -87,6 +110,7 @@ func loginAction(ctx *cli.Context) error {
 		}
 	}
 	principals := createPrincipalsFromSubject(subject)
+	keyFile, pubFile, crtFile := loginFiles(subject)
 
 	// Flags
 	token := ctx.String("token")
@@ -103,25 +127,30 @@ func loginAction(ctx *cli.Context) error {
 
 	// Connect to the SSH agent.
 	// step ssh login requires an ssh agent.
-	agent, err := sshutil.DialAgent()
+	agent, err := dialAgent(ctx)
+	if err != nil {
+		return err
+	}
+	defer agent.Close()
+
+	// Concurrent logins of the same identity would overwrite the stored files
+	// and request more than one certificate.
+	lock, err := utils.Lock(keyFile, certificateLockTimeout)
 	if err != nil {
 		return err
 	}
+	defer lock.Unlock()
 
 	// Check for a previous key signed by the CA.
 	if !force {
-		client, err := cautils.NewClient(ctx)
+		userKeys, err := getUserCAKeys(ctx)
 		if err != nil {
 			return err
 		}
 		opts := []sshutil.AgentOption{
 			sshutil.WithRemoveExpiredCerts(time.Now()),
 		}
-		if roots, err := client.SSHRoots(); err == nil && len(roots.UserKeys) > 0 {
-			userKeys := make([]ssh.PublicKey, len(roots.UserKeys))
-			for i, uk := range roots.UserKeys {
-				userKeys[i] = uk.PublicKey
-			}
+		if len(userKeys) > 0 {
 			opts = append(opts, sshutil.WithSignatureKey(userKeys))
 		}
 
@@ -130,6 +159,15 @@ func loginAction(ctx *cli.Context) error {
 			ui.Printf("The key %s is already present in the SSH agent.\n", subject)
 			return nil
 		}
+
+		// Add the stored certificate if it is still valid
+		if cert, priv, err := readLoginIdentity(keyFile, crtFile, userKeys, time.Now()); err == nil {
+			ui.PrintSelected("Certificate", crtFile)
+			if !addCertificateToAgent(agent, "SSH Agent", cert.KeyId, cert, priv) {
+				return errors.New("error adding the stored certificate to the SSH agent")
+			}
+			return nil
+		}
 	}
 
 	// Do step-certificates flow
@@ -137,6 +175,7 @@ func loginAction(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	defer flow.Close()
 	if len(token) == 0 {
 		// Make sure the validAfter is in the past. It avoids `Certificate
 		// invalid: not yet valid` errors if the times are not in sync
@@ -146,7 +185,7 @@ func loginAction(ctx *cli.Context) error {
 		}
 
 		if token, err = flow.GenerateSSHToken(ctx, subject, cautils.SSHUserSignType, principals, validAfter, validBefore); err != nil {
-			return err
+			return errs.Classify(err, errs.TokenError)
 		}
 	}
 
@@ -155,94 +194,145 @@ func loginAction(ctx *cli.Context) error {
 		return err
 	}
 
-	// Generate keypair
-	pub, priv, err := keys.GenerateDefaultKeyPair()
-	if err != nil {
-		return err
+	// NOTE: For OIDC token the principals should be completely empty. The OIDC
+	// provisioner is responsible for setting default principals by using an
+	// identity function.
+	keyID := subject
+	if email, ok := tokenHasEmail(token); ok {
+		keyID = email
 	}
 
-	sshPub, err := ssh.NewPublicKey(pub)
+	// The stored private key is not encrypted, like the default x509 identity,
+	// and the files are always overwritten.
+	if err := os.MkdirAll(filepath.Dir(keyFile), 0700); err != nil {
+		return errs.FileError(err, filepath.Dir(keyFile))
+	}
+	res, err := sign(SignOptions{
+		Subject:      subject,
+		KeyID:        keyID,
+		Comment:      keyID,
+		Token:        token,
+		CertType:     provisioner.SSHUserCert,
+		Principals:   principals,
+		ValidAfter:   validAfter,
+		ValidBefore:  validBefore,
+		TemplateData: templateData,
+		AddUser:      isAddUser,
+		BaseName:     keyFile,
+		KeyFile:      keyFile,
+		PubFile:      pubFile,
+		CrtFile:      crtFile,
+	}, caClient, loginFileWriter{}, agent)
 	if err != nil {
-		return errors.Wrap(err, "error creating public key")
+		return flow.RootError(ctx, err)
 	}
 
-	var sshAuPub ssh.PublicKey
-	var sshAuPubBytes []byte
-	var auPub, auPriv interface{}
-	if isAddUser {
-		auPub, auPriv, err = keys.GenerateDefaultKeyPair()
-		if err != nil {
+	// Write x509 identity certificate
+	if res.RequireIdentity() {
+		if err := ca.WriteDefaultIdentity(res.IdentityCertificate, res.IdentityKey); err != nil {
 			return err
 		}
-		sshAuPub, err = ssh.NewPublicKey(auPub)
-		if err != nil {
-			return errors.Wrap(err, "error creating public key")
+	}
+
+	ui.PrintSelected("Private Key", keyFile)
+	ui.PrintSelected("Certificate", crtFile)
+	printAgentResult("SSH Agent", res.AgentError)
+	if isAddUser {
+		if res.AddUserCertificate == nil {
+			ui.Printf(`{{ "%s" | red }} {{ "Add User Certificate:" | bold }} failed to create a provisioner certificate`+"\n", ui.IconBad)
+		} else {
+			addCertificateToAgent(agent, "Add User Certificate", keyID, res.AddUserCertificate, res.AddUserKey)
 		}
-		sshAuPubBytes = sshAuPub.Marshal()
 	}
 
-	version, err := caClient.Version()
-	if err != nil {
-		return err
+	return nil
+}
+
+// loginFileWriter is the FileWriter used by step ssh login. The stored files
+// are always overwritten, without asking.
+type loginFileWriter struct{}
+
+// WriteFile implements the FileWriter interface.
+func (loginFileWriter) WriteFile(filename string, data []byte, perm os.FileMode) error {
+	if err := sysutils.WriteFile(filename, data, perm); err != nil {
+		return errs.FileError(err, filename)
 	}
+	return nil
+}
 
-	// Generate identity certificate (x509) if necessary
-	var identityCSR api.CertificateRequest
-	var identityKey crypto.PrivateKey
-	if version.RequireClientAuthentication {
-		csr, key, err := ca.CreateIdentityRequest(subject)
-		if err != nil {
-			return err
+// loginFiles returns the names of the private key, public key and certificate
+// stored by step ssh login for the given identity.
+func loginFiles(subject string) (keyFile, pubFile, crtFile string) {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '@', r == '.', r == '-', r == '_', r == '+':
+			return r
+		default:
+			return '_'
 		}
-		identityCSR = *csr
-		identityKey = key
-	}
+	}, subject)
+	keyFile = filepath.Join(config.StepPath(), "ssh", "id_"+name)
+	return keyFile, keyFile + ".pub", keyFile + "-cert.pub"
+}
 
-	// NOTE: For OIDC token the principals should be completely empty. The OIDC
-	// provisioner is responsible for setting default principals by using an
-	// identity function.
-	if email, ok := tokenHasEmail(token); ok {
-		subject = email
-	}
-
-	resp, err := caClient.SSHSign(&api.SSHSignRequest{
-		PublicKey:        sshPub.Marshal(),
-		OTT:              token,
-		Principals:       principals,
-		CertType:         provisioner.SSHUserCert,
-		KeyID:            subject,
-		ValidAfter:       validAfter,
-		ValidBefore:      validBefore,
-		AddUserPublicKey: sshAuPubBytes,
-		IdentityCSR:      identityCSR,
-		TemplateData:     templateData,
-	})
+// readLoginIdentity reads the certificate and private key stored by step ssh
+// login. It fails if the certificate is not valid at the given time, if it does
+// not match the private key, or if caKeys are given and the certificate is not
+// signed by one of them.
+func readLoginIdentity(keyFile, crtFile string, caKeys []ssh.PublicKey, now time.Time) (*ssh.Certificate, interface{}, error) {
+	b, err := ioutil.ReadFile(crtFile)
 	if err != nil {
-		return err
+		return nil, nil, errs.FileError(err, crtFile)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error parsing %s", crtFile)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, nil, errors.Errorf("error parsing %s: file is not an SSH certificate", crtFile)
 	}
 
-	// Write x509 identity certificate
-	if version.RequireClientAuthentication {
-		if err := ca.WriteDefaultIdentity(resp.IdentityCertificate, identityKey); err != nil {
-			return err
-		}
+	unixNow := uint64(now.Unix())
+	switch {
+	case cert.CertType != ssh.UserCert:
+		return nil, nil, errors.Errorf("%s is not a user certificate", crtFile)
+	case unixNow < cert.ValidAfter:
+		return nil, nil, errors.Errorf("%s is not yet valid", crtFile)
+	case cert.ValidBefore != ssh.CertTimeInfinity && unixNow >= cert.ValidBefore:
+		return nil, nil, errors.Errorf("%s is expired", crtFile)
+	case len(caKeys) > 0 && !sshutil.IsSignedBy(cert, caKeys):
+		return nil, nil, errors.Errorf("%s is not signed by the CA", crtFile)
 	}
 
-	// Attempt to add key to agent if private key defined.
-	if err := agent.AddCertificate(subject, resp.Certificate.Certificate, priv); err != nil {
-		ui.Printf(`{{ "%s" | red }} {{ "SSH Agent:" | bold }} %v`+"\n", ui.IconBad, err)
-	} else {
-		ui.PrintSelected("SSH Agent", "yes")
+	priv, err := pemutil.Read(keyFile)
+	if err != nil {
+		return nil, nil, err
 	}
-	if isAddUser {
-		if resp.AddUserCertificate == nil {
-			ui.Printf(`{{ "%s" | red }} {{ "Add User Certificate:" | bold }} failed to create a provisioner certificate`+"\n", ui.IconBad)
-		} else if err := agent.AddCertificate(subject, resp.AddUserCertificate.Certificate, auPriv); err != nil {
-			ui.Printf(`{{ "%s" | red }} {{ "Add User Certificate:" | bold }} %v`+"\n", ui.IconBad, err)
-		} else {
-			ui.PrintSelected("Add User Certificate", "yes")
-		}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error parsing %s", keyFile)
+	}
+	if err := sshutil.CheckCertificateKey(cert, signer.PublicKey()); err != nil {
+		return nil, nil, err
 	}
+	return cert, priv, nil
+}
 
-	return nil
+// removeLoginIdentity deletes the files stored by step ssh login, including
+// the add user files. It returns whether any file was deleted.
+func removeLoginIdentity(keyFile, pubFile, crtFile string) (bool, error) {
+	var removed bool
+	addUserKey, addUserPub, addUserCrt := SignOptions{BaseName: keyFile}.AddUserFiles()
+	for _, name := range []string{keyFile, pubFile, crtFile, addUserKey, addUserPub, addUserCrt} {
+		switch err := os.Remove(name); {
+		case err == nil:
+			removed = true
+		case !os.IsNotExist(err):
+			return removed, errs.FileError(err, name)
+		}
+	}
+	return removed, nil
 }
@@ -0,0 +1,113 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/smallstep/cli/config"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestLoginFiles(t *testing.T) {
+	base := filepath.Join(config.StepPath(), "ssh")
+	keyFile, pubFile, crtFile := loginFiles("jane+test@example.com")
+	require.Equal(t, filepath.Join(base, "id_jane+test@example.com"), keyFile)
+	require.Equal(t, keyFile+".pub", pubFile)
+	require.Equal(t, keyFile+"-cert.pub", crtFile)
+
+	keyFile, _, _ = loginFiles("../jane doe")
+	require.Equal(t, filepath.Join(base, "id_.._jane_doe"), keyFile)
+}
+
+func TestLoginIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "step-ssh-login")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ca, err := ssh.NewSignerFromKey(caKey)
+	require.NoError(t, err)
+	sshPub, priv, err := generateSSHKeyPair()
+	require.NoError(t, err)
+
+	newCertificate := func(certType uint32, key ssh.PublicKey, validAfter, validBefore time.Time) *ssh.Certificate {
+		cert := &ssh.Certificate{
+			Key:             key,
+			CertType:        certType,
+			KeyId:           "jane@example.com",
+			ValidPrincipals: []string{"jane"},
+			ValidAfter:      uint64(validAfter.Unix()),
+			ValidBefore:     uint64(validBefore.Unix()),
+		}
+		require.NoError(t, cert.SignCert(rand.Reader, ca))
+		return cert
+	}
+
+	keyFile := filepath.Join(dir, "ssh", "id_jane@example.com")
+	pubFile, crtFile := keyFile+".pub", keyFile+"-cert.pub"
+	require.NoError(t, os.MkdirAll(filepath.Dir(keyFile), 0700))
+	write := func(cert *ssh.Certificate) {
+		fs := loginFileWriter{}
+		require.NoError(t, writePrivateKey(fs, keyFile, priv, nil))
+		require.NoError(t, fs.WriteFile(pubFile, marshalPublicKey(sshPub, "jane@example.com"), 0644))
+		require.NoError(t, fs.WriteFile(crtFile, marshalPublicKey(cert, "jane@example.com"), 0644))
+	}
+
+	// Valid certificate
+	valid := newCertificate(ssh.UserCert, sshPub, now.Add(-time.Minute), now.Add(time.Hour))
+	write(valid)
+	st, err := os.Stat(keyFile)
+	require.NoError(t, err)
+	if os.PathSeparator == '/' {
+		require.Equal(t, os.FileMode(0600), st.Mode().Perm())
+	}
+	cert, key, err := readLoginIdentity(keyFile, crtFile, []ssh.PublicKey{ca.PublicKey()}, now)
+	require.NoError(t, err)
+	require.Equal(t, valid.Marshal(), cert.Marshal())
+	require.Equal(t, priv, key)
+	_, _, err = readLoginIdentity(keyFile, crtFile, nil, now)
+	require.NoError(t, err)
+
+	// Invalid certificates
+	otherPub, _, err := generateSSHKeyPair()
+	require.NoError(t, err)
+	tests := []struct {
+		name   string
+		cert   *ssh.Certificate
+		caKeys []ssh.PublicKey
+	}{
+		{"expired", newCertificate(ssh.UserCert, sshPub, now.Add(-time.Hour), now.Add(-time.Minute)), nil},
+		{"not yet valid", newCertificate(ssh.UserCert, sshPub, now.Add(time.Minute), now.Add(time.Hour)), nil},
+		{"host", newCertificate(ssh.HostCert, sshPub, now.Add(-time.Minute), now.Add(time.Hour)), nil},
+		{"other key", newCertificate(ssh.UserCert, otherPub, now.Add(-time.Minute), now.Add(time.Hour)), nil},
+		{"other ca", valid, []ssh.PublicKey{otherPub}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			write(tt.cert)
+			_, _, err := readLoginIdentity(keyFile, crtFile, tt.caKeys, now)
+			require.Error(t, err)
+		})
+	}
+
+	// Remove files, including the add user files
+	require.NoError(t, ioutil.WriteFile(keyFile+"-provisioner", []byte("key"), 0600))
+	removed, err := removeLoginIdentity(keyFile, pubFile, crtFile)
+	require.NoError(t, err)
+	require.True(t, removed)
+	_, err = os.Stat(keyFile + "-provisioner")
+	require.True(t, os.IsNotExist(err))
+	_, _, err = readLoginIdentity(keyFile, crtFile, nil, now)
+	require.Error(t, err)
+	removed, err = removeLoginIdentity(keyFile, pubFile, crtFile)
+	require.NoError(t, err)
+	require.False(t, removed)
+}
@@ -8,9 +8,7 @@ import (
 	"github.com/smallstep/cli/crypto/sshutil"
 	"github.com/smallstep/cli/errs"
 	"github.com/smallstep/cli/flags"
-	"github.com/smallstep/cli/utils/cautils"
 	"github.com/urfave/cli"
-	"golang.org/x/crypto/ssh"
 )
 
 func logoutCommand() cli.Command {
@@ -20,12 +18,15 @@ func logoutCommand() cli.Command {
 		Usage:  "removes a private key from the ssh-agent",
 		UsageText: `**step ssh logout** <identity>
 		[**--all**] [**--ca-url**=<uri>] [**--root**=<file>]
-		[**--offline**] [**--ca-config**=<path>]`,
+		[**--offline**] [**--ca-config**=<path>] [**--agent-socket**=<path>]`,
 		Description: `**step ssh logout** commands removes a key from the ssh-agent.
 
 By default it only removes certificate keys signed by step-certificates, but the
 flag **--all** can be used to remove all keys with a given subject or all keys.
 
+The private key, public key and certificate stored by **step ssh login** for
+the given identity are also deleted.
+
 ## POSITIONAL ARGUMENTS
 
 <identity>
@@ -62,6 +63,7 @@ $ step ssh logout --all
 			flags.Root,
 			flags.Offline,
 			flags.CaConfig,
+			sshAgentSocketFlag,
 		},
 	}
 }
@@ -80,7 +82,7 @@ func logoutAction(ctx *cli.Context) error {
 		}
 	}
 
-	agent, err := sshutil.DialAgent()
+	agent, err := dialAgent(ctx)
 	if err != nil {
 		return err
 	}
@@ -98,15 +100,11 @@ func logoutAction(ctx *cli.Context) error {
 	var opts []sshutil.AgentOption
 	if !all {
 		// Remove only keys signed by the CA
-		client, err := cautils.NewClient(ctx)
+		userKeys, err := getUserCAKeys(ctx)
 		if err != nil {
 			return err
 		}
-		if roots, err := client.SSHRoots(); err == nil && len(roots.UserKeys) > 0 {
-			userKeys := make([]ssh.PublicKey, len(roots.UserKeys))
-			for i, uk := range roots.UserKeys {
-				userKeys[i] = uk.PublicKey
-			}
+		if len(userKeys) > 0 {
 			opts = append(opts, sshutil.WithSignatureKey(userKeys))
 		}
 	}
@@ -117,6 +115,13 @@ func logoutAction(ctx *cli.Context) error {
 		return err
 	}
 
+	// Remove the files stored by step ssh login
+	removed, err := removeLoginIdentity(loginFiles(subject))
+	if err != nil {
+		return err
+	}
+	found = found || removed
+
 	switch {
 	case !found:
 		fmt.Printf("Identity not found: %s\n", subject)
@@ -0,0 +1,110 @@
+package ssh
+
+import (
+	"net"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The functions used to get the names and addresses of the current host, they
+// are replaced in the tests.
+var (
+	osHostname      = os.Hostname
+	lookupHost      = net.LookupHost
+	lookupAddr      = net.LookupAddr
+	getInterfaceIPs = interfaceIPs
+)
+
+// hostPrincipals returns the candidate principals of the current host: the
+// hostname, the fully qualified domain names found using reverse lookups, and
+// the IP addresses of the network interfaces, excluding loopback and IPv6
+// link-local addresses.
+func hostPrincipals() ([]string, error) {
+	hostname, err := osHostname()
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting the hostname")
+	}
+
+	ips, err := getInterfaceIPs()
+	if err != nil {
+		return nil, err
+	}
+
+	// Resolve the hostname and the interface addresses looking for the FQDN.
+	// Lookups are best effort, a host without DNS is still valid.
+	addrs, _ := lookupHost(hostname)
+	for _, ip := range ips {
+		addrs = append(addrs, ip.String())
+	}
+	names := []string{hostname}
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip == nil || !isHostIP(ip) {
+			continue
+		}
+		fqdns, _ := lookupAddr(addr)
+		for _, fqdn := range fqdns {
+			names = append(names, strings.TrimSuffix(fqdn, "."))
+		}
+	}
+
+	for _, ip := range ips {
+		names = append(names, ip.String())
+	}
+	return names, nil
+}
+
+// interfaceIPs returns the IP addresses of the network interfaces that are up.
+func interfaceIPs() ([]net.IP, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting the network interfaces")
+	}
+	var ips []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, errors.Wrapf(err, "error getting the addresses of %s", iface.Name)
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && isHostIP(ipnet.IP) {
+				ips = append(ips, ipnet.IP)
+			}
+		}
+	}
+	return ips, nil
+}
+
+// isHostIP returns true if the given IP can be used as a host principal.
+func isHostIP(ip net.IP) bool {
+	switch {
+	case ip.IsLoopback(), ip.IsUnspecified(), ip.IsMulticast():
+		return false
+	case ip.To4() == nil && ip.IsLinkLocalUnicast():
+		return false
+	default:
+		return true
+	}
+}
+
+// filterPrincipals returns the given principals in order without duplicates
+// and without the excluded ones. Comparisons are case-insensitive.
+func filterPrincipals(principals, exclude []string) []string {
+	seen := make(map[string]bool, len(principals)+len(exclude))
+	for _, p := range exclude {
+		seen[strings.ToLower(p)] = true
+	}
+	result := make([]string, 0, len(principals))
+	for _, p := range principals {
+		if p == "" || seen[strings.ToLower(p)] {
+			continue
+		}
+		seen[strings.ToLower(p)] = true
+		result = append(result, p)
+	}
+	return result
+}
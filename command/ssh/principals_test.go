@@ -0,0 +1,83 @@
+package ssh
+
+import (
+	"net"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsHostIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.0.0.1", true},
+		{"192.168.1.10", true},
+		{"2001:db8::1", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"ff02::1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			require.Equal(t, tt.want, isHostIP(net.ParseIP(tt.ip)))
+		})
+	}
+}
+
+func TestFilterPrincipals(t *testing.T) {
+	principals := []string{"host", "host.example.com", "HOST", "", "10.0.0.1", "host.example.com", "2001:db8::1"}
+	require.Equal(t, []string{"host", "host.example.com", "10.0.0.1", "2001:db8::1"}, filterPrincipals(principals, nil))
+	require.Equal(t, []string{"host.example.com", "2001:db8::1"}, filterPrincipals(principals, []string{"Host", "10.0.0.1"}))
+	require.Equal(t, []string{}, filterPrincipals(nil, nil))
+}
+
+func TestHostPrincipals(t *testing.T) {
+	defer func(hostname func() (string, error), host, addr func(string) ([]string, error), ips func() ([]net.IP, error)) {
+		osHostname, lookupHost, lookupAddr, getInterfaceIPs = hostname, host, addr, ips
+	}(osHostname, lookupHost, lookupAddr, getInterfaceIPs)
+
+	osHostname = func() (string, error) { return "web", nil }
+	getInterfaceIPs = func() ([]net.IP, error) {
+		return []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("2001:db8::1")}, nil
+	}
+	lookupHost = func(host string) ([]string, error) {
+		require.Equal(t, "web", host)
+		return []string{"127.0.1.1", "192.168.1.10"}, nil
+	}
+	lookupAddr = func(addr string) ([]string, error) {
+		switch addr {
+		case "192.168.1.10":
+			return []string{"web.lan."}, nil
+		case "10.0.0.1":
+			return []string{"web.example.com."}, nil
+		case "127.0.1.1":
+			t.Errorf("loopback address %s resolved", addr)
+		}
+		return nil, errors.New("no such host")
+	}
+
+	principals, err := hostPrincipals()
+	require.NoError(t, err)
+	require.Equal(t, []string{"web", "web.lan", "web.example.com", "10.0.0.1", "2001:db8::1"}, principals)
+
+	// Lookups are best effort
+	lookupHost = func(string) ([]string, error) { return nil, errors.New("no such host") }
+	lookupAddr = func(string) ([]string, error) { return nil, errors.New("no such host") }
+	principals, err = hostPrincipals()
+	require.NoError(t, err)
+	require.Equal(t, []string{"web", "10.0.0.1", "2001:db8::1"}, principals)
+
+	osHostname = func() (string, error) { return "", errors.New("hostname failed") }
+	_, err = hostPrincipals()
+	require.EqualError(t, err, "error getting the hostname: hostname failed")
+
+	osHostname = func() (string, error) { return "web", nil }
+	getInterfaceIPs = func() ([]net.IP, error) { return nil, errors.New("error getting the network interfaces") }
+	_, err = hostPrincipals()
+	require.EqualError(t, err, "error getting the network interfaces")
+}
@@ -2,13 +2,20 @@ package ssh
 
 import (
 	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
 	"strconv"
-
-	"github.com/smallstep/certificates/ca/identity"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/api"
 	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/ca/identity"
 	"github.com/smallstep/cli/command"
 	"github.com/smallstep/cli/errs"
 	"github.com/smallstep/cli/flags"
@@ -27,12 +34,20 @@ func renewCommand() cli.Command {
 		UsageText: `**step ssh renew** <ssh-cert> <ssh-key>
 [**--out**=<file>] [**--issuer**=<name>] [**--password-file**=<path>]
 [**--force**] [**--ca-url**=<uri>] [**--root**=<path>]
-[**--offline**] [**--ca-config**=<path>]`,
+[**--offline**] [**--ca-config**=<path>] [**--daemon**] [**--exec**=<command>]`,
 		Description: `**step ssh renew** command renews an SSH Cerfificate
 using [step certificates](https://github.com/smallstep/certificates). 
 It writes the new certificate to disk - either overwriting <ssh-cert> or
 using a new file when the **--out**=<file> flag is used.
 
+With the **--daemon** flag the command will keep running and renew the
+certificate after roughly two thirds of its lifetime, with a random jitter. The
+certificate is written atomically, and the one written is used for the next
+renewal. If the renewal fails, for example because the CA is unreachable, it is
+retried with an exponential backoff until the certificate expires. The daemon
+exits if the CA rejects the renewal, and it refuses to start with an expired
+certificate. It stops on SIGINT or SIGTERM, and SIGHUP forces a renewal.
+
 ## POSITIONAL ARGUMENTS
 
 <ssh-cert>
@@ -51,6 +66,12 @@ $ step ssh renew -f id_ecdsa-cert.pub id_ecdsa
 Renew an ssh certificate with a custom out file:
 '''
 $ step ssh renew -out new-id_ecdsa-cer.pub id_ecdsa-cert.pub id_ecdsa
+'''
+
+Keep a host certificate renewed and reload sshd after each renewal:
+'''
+$ step ssh renew --daemon --exec "systemctl reload sshd" \
+	/etc/ssh/ssh_host_ecdsa_key-cert.pub /etc/ssh/ssh_host_ecdsa_key
 '''`,
 		Flags: []cli.Flag{
 			cli.StringFlag{
@@ -66,6 +87,17 @@ $ step ssh renew -out new-id_ecdsa-cer.pub id_ecdsa-cert.pub id_ecdsa
 			flags.CaConfig,
 			flags.SSHPOPCert,
 			flags.SSHPOPKey,
+			cli.BoolFlag{
+				Name: "daemon",
+				Usage: `Run the renew command as a daemon, renewing and overwriting the certificate
+after two thirds of its lifetime.`,
+			},
+			cli.StringFlag{
+				Name: "exec",
+				Usage: `The <command> to run after the certificate has been renewed. The command
+runs with "sh -c" or with "cmd /C" on Windows, so it can use quotes, pipes and
+other shell features.`,
+			},
 		},
 	}
 }
@@ -84,59 +116,235 @@ func renewAction(ctx *cli.Context) error {
 	if outFile == "" {
 		outFile = certFile
 	}
+	isDaemon := ctx.Bool("daemon")
+	execCmd := ctx.String("exec")
+
+	// Load the cert, because we need the serial number.
+	cert, err := readCertificate(certFile)
+	if err != nil {
+		return err
+	}
+
+	// Renewal using the certificate is not accepted once it has expired.
+	if isDaemon {
+		switch now := time.Now(); {
+		case cert.ValidBefore == ssh.CertTimeInfinity:
+			return errors.Errorf("cannot renew %s: the certificate does not expire", certFile)
+		case !now.Before(time.Unix(int64(cert.ValidBefore), 0)):
+			return errors.Errorf("cannot renew %s: the certificate expired at %s", certFile, time.Unix(int64(cert.ValidBefore), 0).Format(time.RFC3339))
+		}
+	}
 
 	flow, err := cautils.NewCertificateFlow(ctx)
 	if err != nil {
 		return err
 	}
+	defer flow.Close()
 
-	// Load the cert, because we need the serial number.
+	if isDaemon {
+		// The certificate written in outFile is used for the next renewal.
+		d := &renewDaemon{
+			cert: cert,
+			renew: func(c *ssh.Certificate) (*ssh.Certificate, error) {
+				newCert, err := renewCertificate(ctx, flow, c, certFile, keyFile, outFile, utils.WriteFileAtomic)
+				if err == nil {
+					certFile = outFile
+				}
+				return newCert, err
+			},
+			afterRenew: func() error {
+				return runExecCmd(execCmd)
+			},
+			after: time.After,
+			now:   time.Now,
+		}
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		defer signal.Stop(signals)
+		return d.Run(signals)
+	}
+
+	if _, err := renewCertificate(ctx, flow, cert, certFile, keyFile, outFile, utils.WriteFile); err != nil {
+		return err
+	}
+	ui.PrintSelected("Certificate", outFile)
+
+	return runExecCmd(execCmd)
+}
+
+// readCertificate reads the SSH certificate in the given file.
+func readCertificate(certFile string) (*ssh.Certificate, error) {
 	certBytes, err := ioutil.ReadFile(certFile)
 	if err != nil {
-		return errors.Wrapf(err, "error reading ssh certificate from %s", certFile)
+		return nil, errors.Wrapf(err, "error reading ssh certificate from %s", certFile)
 	}
 	sshpub, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
 	if err != nil {
-		return errors.Wrapf(err, "error parsing ssh public key from %s", certFile)
+		return nil, errors.Wrapf(err, "error parsing ssh public key from %s", certFile)
 	}
 	cert, ok := sshpub.(*ssh.Certificate)
 	if !ok {
-		return errors.New("error casting ssh public key to ssh certificate")
+		return nil, errors.New("error casting ssh public key to ssh certificate")
 	}
-	serial := strconv.FormatUint(cert.Serial, 10)
+	return cert, nil
+}
 
+// renewCertificate renews the given certificate, stored in certFile, and
+// writes the new one in outFile using the given function.
+func renewCertificate(ctx *cli.Context, flow *cautils.CertificateFlow, cert *ssh.Certificate, certFile, keyFile, outFile string, writeFile func(string, []byte, os.FileMode) error) (*ssh.Certificate, error) {
+	serial := strconv.FormatUint(cert.Serial, 10)
 	ctx.Set("sshpop-cert", certFile)
 	ctx.Set("sshpop-key", keyFile)
 	token, err := flow.GenerateSSHToken(ctx, serial, cautils.SSHRenewType, nil, provisioner.TimeDuration{}, provisioner.TimeDuration{})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	caClient, err := flow.GetClient(ctx, token)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	resp, err := caClient.SSHRenew(&api.SSHRenewRequest{
 		OTT: token,
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Write certificate
-	if err := utils.WriteFile(outFile, marshalPublicKey(resp.Certificate, cert.KeyId), 0644); err != nil {
-		return err
+	if err := writeFile(outFile, marshalPublicKey(resp.Certificate, cert.KeyId), 0644); err != nil {
+		return nil, err
 	}
 
 	// Write renewed identity
 	if len(resp.IdentityCertificate) > 0 {
 		if err := identity.WriteIdentityCertificate(resp.IdentityCertificate); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	ui.PrintSelected("Certificate", outFile)
+	return resp.Certificate.Certificate, nil
+}
+
+// runExecCmd runs the given command, if any, after a renewal. The command runs
+// in a shell, so quoted arguments are kept.
+func runExecCmd(execCmd string) error {
+	if strings.TrimSpace(execCmd) == "" {
+		return nil
+	}
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", execCmd)
+	} else {
+		cmd = exec.Command("sh", "-c", execCmd)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return errors.Wrapf(cmd.Run(), "error running '%s'", execCmd)
+}
+
+const (
+	// renewMinBackoff is the wait after the first failed renewal, it is
+	// doubled on every failure.
+	renewMinBackoff = 1 * time.Minute
+	// renewMaxBackoff is the maximum wait after a failed renewal.
+	renewMaxBackoff = 1 * time.Hour
+)
+
+// renewDaemon renews a certificate after two thirds of its lifetime, and
+// retries with an exponential backoff if the renewal fails.
+type renewDaemon struct {
+	cert       *ssh.Certificate
+	renew      func(*ssh.Certificate) (*ssh.Certificate, error)
+	afterRenew func() error
+	after      func(time.Duration) <-chan time.Time
+	now        func() time.Time
+}
+
+// Run runs the daemon until SIGINT or SIGTERM is received. SIGHUP forces a
+// renewal. It returns an error if the CA rejects the renewal or if the
+// certificate expires, as it cannot be renewed anymore.
+func (d *renewDaemon) Run(signals <-chan os.Signal) error {
+	next := nextRenewDuration(d.cert, d.now())
+	ui.Printf("first renewal in %s\n", next.Round(time.Second))
 
-	return nil
+	var failures int
+	for {
+		select {
+		case sig := <-signals:
+			if sig != syscall.SIGHUP {
+				ui.Printf("received %s, exiting\n", sig)
+				return nil
+			}
+		case <-d.after(next):
+		}
+
+		cert, err := d.renew(d.cert)
+		if err != nil {
+			if errs.GetClass(err) == errs.CARejectedError {
+				return errors.Wrap(err, "error renewing certificate")
+			}
+			expiresAt := time.Unix(int64(d.cert.ValidBefore), 0)
+			left := expiresAt.Sub(d.now())
+			if left <= 0 {
+				return errors.Wrapf(err, "error renewing certificate: the certificate expired at %s", expiresAt.Format(time.RFC3339))
+			}
+			failures++
+			next = renewBackoff(failures)
+			// Retry before the certificate expires, but do not retry in a
+			// busy loop as the expiration gets closer.
+			if next > left {
+				next = left / 2
+				if next < renewMinBackoff {
+					next = renewMinBackoff
+				}
+				if next > left {
+					next = left
+				}
+			}
+			ui.Printf("error renewing certificate: %v; retrying in %s\n", err, next.Round(time.Second))
+			continue
+		}
+
+		failures = 0
+		d.cert = cert
+		next = nextRenewDuration(cert, d.now())
+		ui.Printf("certificate renewed, next in %s\n", next.Round(time.Second))
+		if err := d.afterRenew(); err != nil {
+			ui.Printf("%v\n", err)
+		}
+	}
+}
+
+// nextRenewDuration returns the time to wait until two thirds of the lifetime
+// of the certificate have elapsed, minus a random jitter of up to 1/20 of the
+// lifetime.
+func nextRenewDuration(cert *ssh.Certificate, now time.Time) time.Duration {
+	validAfter := time.Unix(int64(cert.ValidAfter), 0)
+	validBefore := time.Unix(int64(cert.ValidBefore), 0)
+	lifetime := validBefore.Sub(validAfter)
+	if lifetime <= 0 {
+		return 0
+	}
+	d := validAfter.Add(lifetime * 2 / 3).Sub(now)
+	if n := int64(lifetime / 20); n > 0 {
+		d -= time.Duration(rand.Int63n(n))
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// renewBackoff returns the time to wait after the given number of failed
+// renewals, with a random jitter of up to half of the wait.
+func renewBackoff(failures int) time.Duration {
+	d := renewMaxBackoff
+	if failures < 32 {
+		if b := renewMinBackoff << uint(failures-1); b > 0 && b < d {
+			d = b
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
 }
@@ -0,0 +1,145 @@
+package ssh
+
+import (
+	"net/http"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/errs"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func newValidityCertificate(validAfter time.Time, lifetime time.Duration) *ssh.Certificate {
+	return &ssh.Certificate{
+		ValidAfter:  uint64(validAfter.Unix()),
+		ValidBefore: uint64(validAfter.Add(lifetime).Unix()),
+	}
+}
+
+func TestNextRenewDuration(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	tests := []struct {
+		name     string
+		cert     *ssh.Certificate
+		min, max time.Duration
+	}{
+		{"new", newValidityCertificate(now, 24*time.Hour), 16*time.Hour - 72*time.Minute, 16 * time.Hour},
+		{"half", newValidityCertificate(now.Add(-12*time.Hour), 24*time.Hour), 4*time.Hour - 72*time.Minute, 4 * time.Hour},
+		{"late", newValidityCertificate(now.Add(-20*time.Hour), 24*time.Hour), 0, 0},
+		{"expired", newValidityCertificate(now.Add(-48*time.Hour), 24*time.Hour), 0, 0},
+		{"empty", newValidityCertificate(now, 0), 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := nextRenewDuration(tt.cert, now)
+			require.True(t, got >= tt.min && got <= tt.max, "nextRenewDuration() = %s, want [%s, %s]", got, tt.min, tt.max)
+		})
+	}
+}
+
+func TestRenewBackoff(t *testing.T) {
+	for failures, want := range map[int]time.Duration{
+		1:  time.Minute,
+		2:  2 * time.Minute,
+		4:  8 * time.Minute,
+		7:  renewMaxBackoff,
+		64: renewMaxBackoff,
+	} {
+		d := renewBackoff(failures)
+		require.True(t, d >= want/2 && d <= want, "renewBackoff(%d) = %s", failures, d)
+	}
+}
+
+// newTestDaemon returns a daemon that renews using the given results and
+// stops once all have been used.
+func newTestDaemon(cert *ssh.Certificate, results []error, now time.Time) (*renewDaemon, chan os.Signal, *[]time.Duration, *int) {
+	signals := make(chan os.Signal, 1)
+	var waits []time.Duration
+	var hooks int
+	d := &renewDaemon{
+		cert: cert,
+		renew: func(c *ssh.Certificate) (*ssh.Certificate, error) {
+			err := results[0]
+			results = results[1:]
+			if err != nil {
+				return nil, err
+			}
+			return newValidityCertificate(now, 24*time.Hour), nil
+		},
+		afterRenew: func() error {
+			hooks++
+			return nil
+		},
+		after: func(d time.Duration) <-chan time.Time {
+			waits = append(waits, d)
+			if len(results) == 0 {
+				signals <- syscall.SIGTERM
+				return nil
+			}
+			ch := make(chan time.Time, 1)
+			ch <- now.Add(d)
+			return ch
+		},
+		now: func() time.Time { return now },
+	}
+	return d, signals, &waits, &hooks
+}
+
+func TestRenewDaemon(t *testing.T) {
+	now := time.Unix(time.Now().Unix(), 0)
+	unavailable := errors.Wrap(errs.NewErr(http.StatusServiceUnavailable, errors.New("service unavailable")), "client POST failed")
+	rejected := errs.NewErr(http.StatusUnauthorized, errors.New("unauthorized"))
+
+	t.Run("ok", func(t *testing.T) {
+		d, signals, waits, hooks := newTestDaemon(newValidityCertificate(now.Add(-20*time.Hour), 24*time.Hour), []error{unavailable, unavailable, nil}, now)
+		require.NoError(t, d.Run(signals))
+		require.Len(t, *waits, 4)
+		require.Equal(t, time.Duration(0), (*waits)[0])
+		require.True(t, (*waits)[1] >= 30*time.Second && (*waits)[1] <= time.Minute)
+		require.True(t, (*waits)[2] >= time.Minute && (*waits)[2] <= 2*time.Minute)
+		require.True(t, (*waits)[3] > 14*time.Hour)
+		require.Equal(t, 1, *hooks)
+		require.Equal(t, uint64(now.Add(24*time.Hour).Unix()), d.cert.ValidBefore)
+	})
+
+	t.Run("ok/backoff-before-expiration", func(t *testing.T) {
+		d, signals, waits, _ := newTestDaemon(newValidityCertificate(now.Add(-24*time.Hour+20*time.Second), 24*time.Hour), []error{unavailable, nil}, now)
+		require.NoError(t, d.Run(signals))
+		require.Equal(t, 20*time.Second, (*waits)[1])
+	})
+
+	t.Run("ok/backoff-floor", func(t *testing.T) {
+		d, signals, waits, _ := newTestDaemon(newValidityCertificate(now.Add(-24*time.Hour+90*time.Second), 24*time.Hour), []error{unavailable, unavailable, nil}, now)
+		require.NoError(t, d.Run(signals))
+		require.True(t, (*waits)[1] >= 30*time.Second && (*waits)[1] <= time.Minute)
+		require.True(t, (*waits)[2] >= time.Minute && (*waits)[2] <= 90*time.Second)
+	})
+
+	t.Run("fail/rejected", func(t *testing.T) {
+		d, signals, _, hooks := newTestDaemon(newValidityCertificate(now.Add(-20*time.Hour), 24*time.Hour), []error{unavailable, rejected, nil}, now)
+		err := d.Run(signals)
+		require.EqualError(t, err, "error renewing certificate: unauthorized")
+		require.Equal(t, 0, *hooks)
+	})
+
+	t.Run("fail/expired", func(t *testing.T) {
+		d, signals, _, _ := newTestDaemon(newValidityCertificate(now.Add(-48*time.Hour), 24*time.Hour), []error{unavailable, nil}, now)
+		err := d.Run(signals)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "the certificate expired at")
+	})
+}
+
+func TestRunExecCmd(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test commands use sh")
+	}
+	require.NoError(t, runExecCmd(""))
+	require.NoError(t, runExecCmd(`test "a b" = 'a b' && true`))
+	require.EqualError(t, runExecCmd("exit 3"), "error running 'exit 3': exit status 3")
+}
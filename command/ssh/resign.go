@@ -0,0 +1,399 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/ca"
+	"github.com/smallstep/cli/command"
+	"github.com/smallstep/cli/crypto/pemutil"
+	"github.com/smallstep/cli/errs"
+	"github.com/smallstep/cli/flags"
+	"github.com/smallstep/cli/ui"
+	"github.com/smallstep/cli/utils"
+	"github.com/smallstep/cli/utils/cautils"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
+)
+
+// resignValidityTolerance is the difference allowed between the requested
+// start of the validity and the one in the new certificate, the CA uses its
+// own clock for certificates valid from now.
+const resignValidityTolerance = time.Minute
+
+func resignCommand() cli.Command {
+	return cli.Command{
+		Name:   "resign",
+		Action: command.ActionFunc(resignAction),
+		Usage:  "sign an existing SSH certificate again using the configured SSH CA",
+		UsageText: `**step ssh resign** <crt-file> <key-file>
+[**--out**=<file>] [**--token**=<token>] [**--issuer**=<name>]
+[**--provisioner-password-file**=<path>] [**--provisioner-password-stdin**]
+[**--password-file**=<path>] [**--force**] [**--ca-url**=<uri>] [**--root**=<path>]
+[**--fingerprint**=<fingerprint>] [**--ca-timeout**=<duration>] [**--ca-retries**=<n>]
+[**--offline**] [**--ca-config**=<path>]`,
+		Description: `**step ssh resign** command requests a new certificate for the public key of
+an existing certificate, using the SSH CA currently configured. It is meant for
+the rotation of the key of an SSH CA: hosts and users can hold certificates
+from the old and the new CA during the transition.
+
+The key id, type, principals, critical options and extensions are copied from
+<crt-file>, and the new certificate is valid until the old one expires. The
+critical options and extensions are sent in the template data, and the
+provisioner template must use them with
+'{{ toJson .Insecure.User.criticalOptions }}' and
+'{{ toJson .Insecure.User.extensions }}'.
+
+The private key in <key-file> must match the public key of <crt-file>, this is
+checked before contacting the CA. Unlike **step ssh rekey**, the key is not
+replaced, and unlike **step ssh renew**, the request is authorized with a
+provisioner of the CA, as the new CA might not trust the old certificate.
+
+The new certificate is written to "<key-file>-cert.pub.new", or to **--out** if
+it is used. With **--force** <crt-file> is overwritten instead. After writing
+the certificate, the command prints the differences between the old and the
+new certificate, any value changed by the new CA is prefixed with '+'.
+
+## POSITIONAL ARGUMENTS
+
+<crt-file>
+:  The ssh certificate to sign again.
+
+<key-file>
+:  The private key of the ssh certificate.
+
+## EXAMPLES
+
+Sign a host certificate with the new CA, writing it to
+ssh_host_ecdsa_key-cert.pub.new:
+'''
+$ step ssh resign /etc/ssh/ssh_host_ecdsa_key-cert.pub /etc/ssh/ssh_host_ecdsa_key
+'''
+
+Replace a user certificate with one signed by the new CA:
+'''
+$ step ssh resign --force id_ecdsa-cert.pub id_ecdsa
+'''`,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "out",
+				Usage: `The <file> to write the new certificate to, instead of "<key-file>-cert.pub.new".`,
+			},
+			flags.Token,
+			flags.Provisioner,
+			sshProvisionerPasswordFlag,
+			flags.ProvisionerPasswordStdin,
+			sshPasswordFileFlag,
+			flags.Force,
+			flags.CaURL,
+			flags.Root,
+			flags.Fingerprint,
+			flags.Offline,
+			flags.CaConfig,
+			flags.CaTimeout,
+			flags.CaRetries,
+		},
+	}
+}
+
+func resignAction(ctx *cli.Context) error {
+	if err := errs.NumberOfArguments(ctx, 2); err != nil {
+		return err
+	}
+	if ctx.Bool("force") && ctx.String("out") != "" {
+		return errs.IncompatibleFlagWithFlag(ctx, "force", "out")
+	}
+	if err := flags.ExpandPathFlags(ctx, "out", "password-file", "provisioner-password-file", "root", "ca-config"); err != nil {
+		return err
+	}
+
+	args := ctx.Args()
+	crtFile, err := utils.ExpandPath(args.Get(0))
+	if err != nil {
+		return errs.InvalidFlagValueMsg(ctx, "crt-file", args.Get(0), err.Error())
+	}
+	keyFile, err := utils.ExpandPath(args.Get(1))
+	if err != nil {
+		return errs.InvalidFlagValueMsg(ctx, "key-file", args.Get(1), err.Error())
+	}
+	outFile := resignOutputFile(keyFile, crtFile, ctx.String("out"), ctx.Bool("force"))
+
+	provisionerPassword, err := flags.ParseProvisionerPassword(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Check the certificate and the key before generating a token
+	old, err := readCertificate(crtFile)
+	if err != nil {
+		return err
+	}
+	priv, err := loadResignKey(keyFile, ctx.String("password-file"), old)
+	if err != nil {
+		return err
+	}
+	opts, err := resignOptions(old, priv, outFile, time.Now())
+	if err != nil {
+		return errors.Wrapf(err, "error reading %s", crtFile)
+	}
+	opts.BaseName = keyFile
+	opts.Token = ctx.String("token")
+
+	lock, err := utils.Lock(keyFile, certificateLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	flow, err := cautils.NewCertificateFlow(ctx)
+	if err != nil {
+		return err
+	}
+	defer flow.Close()
+
+	if opts.Token == "" {
+		tokType := cautils.SSHUserSignType
+		if opts.CertType == provisioner.SSHHostCert {
+			tokType = cautils.SSHHostSignType
+		}
+		if opts.Token, err = flow.GenerateSSHToken(ctx, opts.Subject, tokType, opts.Principals, opts.ValidAfter, opts.ValidBefore,
+			cautils.WithProvisionerPassword(provisionerPassword)); err != nil {
+			return errs.Classify(flow.RootError(ctx, err), errs.TokenError)
+		}
+	}
+
+	caClient, err := flow.GetClient(ctx, opts.Token)
+	if err != nil {
+		return err
+	}
+	res, err := sign(opts, caClient, fileWriter{}, nil)
+	if err != nil {
+		return flow.RootError(ctx, err)
+	}
+
+	// Write x509 identity certificate
+	if res.RequireIdentity() {
+		if err := ca.WriteDefaultIdentity(res.IdentityCertificate, res.IdentityKey); err != nil {
+			return err
+		}
+	}
+
+	ui.PrintSelected("Certificate", outFile)
+	printCertificateChanges(certificateChanges(old, res.Certificate, opts.ValidAfter.Time()))
+	return nil
+}
+
+// resignOutputFile returns the file of the new certificate, out if it is set,
+// crtFile with force, or "<keyFile>-cert.pub.new".
+func resignOutputFile(keyFile, crtFile, out string, force bool) string {
+	switch {
+	case out != "":
+		return out
+	case force:
+		return crtFile
+	default:
+		return keyFile + "-cert.pub.new"
+	}
+}
+
+// loadResignKey reads the private key in keyFile and checks that it is the
+// private key of the given certificate.
+func loadResignKey(keyFile, passwordFile string, cert *ssh.Certificate) (interface{}, error) {
+	var opts []pemutil.Options
+	if passwordFile != "" {
+		opts = append(opts, pemutil.WithPasswordFile(passwordFile))
+	}
+	priv, err := pemutil.Read(keyFile, opts...)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, errors.Errorf("error reading %s: %T is not a private key", keyFile, priv)
+	}
+	pub, err := ssh.NewPublicKey(signer.Public())
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating public key")
+	}
+	if !bytes.Equal(pub.Marshal(), cert.Key.Marshal()) {
+		return nil, errors.Errorf("the private key in %s does not match the public key of the certificate", keyFile)
+	}
+	return priv, nil
+}
+
+// resignOptions returns the options to sign the public key of the given
+// certificate with the same key id, type, principals, critical options and
+// extensions. The new certificate is valid from now, or from the start of the
+// old one if it is in the future, until the old one expires. The certificate is
+// written in crtFile.
+func resignOptions(cert *ssh.Certificate, priv interface{}, crtFile string, now time.Time) (SignOptions, error) {
+	var certType string
+	switch cert.CertType {
+	case ssh.UserCert:
+		certType = provisioner.SSHUserCert
+	case ssh.HostCert:
+		certType = provisioner.SSHHostCert
+	default:
+		return SignOptions{}, errors.Errorf("unknown certificate type %d", cert.CertType)
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		return SignOptions{}, errors.New("the certificate does not have principals")
+	}
+
+	var validAfter, validBefore provisioner.TimeDuration
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		t := time.Unix(int64(cert.ValidBefore), 0)
+		if !t.After(now) {
+			return SignOptions{}, errors.Errorf("the certificate expired at %s", t.Format(time.RFC3339))
+		}
+		validBefore = provisioner.NewTimeDuration(t)
+	}
+	if t := time.Unix(int64(cert.ValidAfter), 0); t.After(now) {
+		validAfter = provisioner.NewTimeDuration(t)
+	}
+
+	data := make(map[string]interface{})
+	if len(cert.CriticalOptions) > 0 {
+		data["criticalOptions"] = cert.CriticalOptions
+	}
+	if len(cert.Extensions) > 0 {
+		data["extensions"] = cert.Extensions
+	}
+	var templateData json.RawMessage
+	if len(data) > 0 {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return SignOptions{}, errors.Wrap(err, "error marshaling template data")
+		}
+		templateData = b
+	}
+
+	return SignOptions{
+		Subject:      cert.KeyId,
+		KeyID:        cert.KeyId,
+		CertType:     certType,
+		Principals:   cert.ValidPrincipals,
+		ValidAfter:   validAfter,
+		ValidBefore:  validBefore,
+		TemplateData: templateData,
+		PublicKey:    cert.Key,
+		PrivateKey:   priv,
+		CrtFile:      crtFile,
+	}, nil
+}
+
+// certificateChanges returns the differences between the old certificate and
+// the new one, in a diff format. Changes in the serial, nonce and signature are
+// not included. validAfter is the requested start of the validity, if it is
+// zero the new certificate is expected to be valid from the time it was
+// signed.
+func certificateChanges(old, cert *ssh.Certificate, validAfter time.Time) []string {
+	var lines []string
+	diff := func(name, a, b string) {
+		if a != b {
+			lines = append(lines, "- "+name+": "+a, "+ "+name+": "+b)
+		}
+	}
+
+	diff("key id", old.KeyId, cert.KeyId)
+	diff("type", certTypeName(old.CertType), certTypeName(cert.CertType))
+	diff("principals", strings.Join(old.ValidPrincipals, ", "), strings.Join(cert.ValidPrincipals, ", "))
+
+	// A certificate valid from now starts when it is signed
+	start := uint64(validAfter.Unix())
+	if validAfter.IsZero() {
+		start = cert.ValidAfter
+	}
+	if d := int64(cert.ValidAfter) - int64(start); d > int64(resignValidityTolerance/time.Second) || d < -int64(resignValidityTolerance/time.Second) {
+		lines = append(lines, "- valid after: "+formatCertTime(start), "+ valid after: "+formatCertTime(cert.ValidAfter))
+	}
+	diff("valid before", formatCertTime(old.ValidBefore), formatCertTime(cert.ValidBefore))
+
+	lines = append(lines, mapChanges("critical option", old.CriticalOptions, cert.CriticalOptions)...)
+	lines = append(lines, mapChanges("extension", old.Extensions, cert.Extensions)...)
+
+	if old.SignatureKey != nil && cert.SignatureKey != nil {
+		diff("signing key", ssh.FingerprintSHA256(old.SignatureKey), ssh.FingerprintSHA256(cert.SignatureKey))
+	}
+	return lines
+}
+
+// mapChanges returns the entries removed and added in b, sorted by name.
+func mapChanges(name string, a, b map[string]string) []string {
+	var names []string
+	for k := range a {
+		names = append(names, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	entry := func(k, v string) string {
+		if v == "" {
+			return name + " " + k
+		}
+		return name + " " + k + "=" + v
+	}
+	var lines []string
+	for _, k := range names {
+		va, okA := a[k]
+		vb, okB := b[k]
+		switch {
+		case okA && okB && va == vb:
+		case okA && okB:
+			lines = append(lines, "- "+entry(k, va), "+ "+entry(k, vb))
+		case okA:
+			lines = append(lines, "- "+entry(k, va))
+		default:
+			lines = append(lines, "+ "+entry(k, vb))
+		}
+	}
+	return lines
+}
+
+// certTypeName returns the name of an ssh certificate type.
+func certTypeName(t uint32) string {
+	switch t {
+	case ssh.UserCert:
+		return "user"
+	case ssh.HostCert:
+		return "host"
+	default:
+		return fmt.Sprintf("unknown (%d)", t)
+	}
+}
+
+// formatCertTime formats a time of an ssh certificate.
+func formatCertTime(t uint64) string {
+	if t == ssh.CertTimeInfinity {
+		return "forever"
+	}
+	return time.Unix(int64(t), 0).UTC().Format(time.RFC3339)
+}
+
+// printCertificateChanges prints the differences returned by
+// certificateChanges.
+func printCertificateChanges(lines []string) {
+	if len(lines) == 0 {
+		ui.Printf(`{{ "%s" | green }} {{ "Changes:" | bold }} none`+"\n", ui.IconGood)
+		return
+	}
+	ui.Printf(`{{ "%s" | yellow }} {{ "Changes:" | bold }}`+"\n", ui.IconWarn)
+	for _, l := range lines {
+		color := "green"
+		if strings.HasPrefix(l, "-") {
+			color = "red"
+		}
+		ui.Printf(`{{ "%s" | %s }} %s`+"\n", l[:1], color, l[2:])
+	}
+}
@@ -0,0 +1,198 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestResignOutputFile(t *testing.T) {
+	require.Equal(t, "id_ecdsa-cert.pub.new", resignOutputFile("id_ecdsa", "id_ecdsa-cert.pub", "", false))
+	require.Equal(t, "id_ecdsa-cert.pub", resignOutputFile("id_ecdsa", "id_ecdsa-cert.pub", "", true))
+	require.Equal(t, "new-cert.pub", resignOutputFile("id_ecdsa", "id_ecdsa-cert.pub", "new-cert.pub", false))
+}
+
+func TestLoadResignKey(t *testing.T) {
+	_, pub := mustReadIdentity(t)
+	cert := &ssh.Certificate{Key: pub}
+	priv, err := loadResignKey("testdata/id_ed25519", "", cert)
+	require.NoError(t, err)
+	require.NotNil(t, priv)
+
+	other, err := ssh.NewPublicKey(ed25519.NewKeyFromSeed(bytes.Repeat([]byte{2}, ed25519.SeedSize)).Public())
+	require.NoError(t, err)
+	_, err = loadResignKey("testdata/id_ed25519", "", &ssh.Certificate{Key: other})
+	require.EqualError(t, err, "the private key in testdata/id_ed25519 does not match the public key of the certificate")
+
+	_, err = loadResignKey("testdata/missing", "", cert)
+	require.Error(t, err)
+}
+
+func TestResignOptions(t *testing.T) {
+	_, pub := mustReadIdentity(t)
+	now := time.Now().Truncate(time.Second)
+	unix := func(d time.Duration) uint64 {
+		return uint64(now.Add(d).Unix())
+	}
+
+	cert := &ssh.Certificate{
+		Key:             pub,
+		CertType:        ssh.HostCert,
+		KeyId:           "internal.example.com",
+		ValidPrincipals: []string{"internal.example.com", "10.0.0.1"},
+		ValidAfter:      unix(-time.Hour),
+		ValidBefore:     unix(time.Hour),
+		Permissions: ssh.Permissions{
+			CriticalOptions: map[string]string{"source-address": "10.0.0.0/8"},
+		},
+	}
+	opts, err := resignOptions(cert, "priv", "ssh_host_key-cert.pub.new", now)
+	require.NoError(t, err)
+	require.Equal(t, "internal.example.com", opts.Subject)
+	require.Equal(t, "internal.example.com", opts.KeyID)
+	require.Equal(t, provisioner.SSHHostCert, opts.CertType)
+	require.Equal(t, []string{"internal.example.com", "10.0.0.1"}, opts.Principals)
+	require.True(t, opts.ValidAfter.IsZero())
+	require.Equal(t, now.Add(time.Hour).UTC(), opts.ValidBefore.Time())
+	require.Equal(t, `{"criticalOptions":{"source-address":"10.0.0.0/8"}}`, string(opts.TemplateData))
+	require.Equal(t, pub, opts.PublicKey)
+	require.Equal(t, "priv", opts.PrivateKey)
+	require.Equal(t, "ssh_host_key-cert.pub.new", opts.CrtFile)
+
+	// User certificate not valid yet and without expiration
+	cert = &ssh.Certificate{
+		Key:             pub,
+		CertType:        ssh.UserCert,
+		KeyId:           "jane@example.com",
+		ValidPrincipals: []string{"jane"},
+		ValidAfter:      unix(time.Hour),
+		ValidBefore:     ssh.CertTimeInfinity,
+		Permissions: ssh.Permissions{
+			Extensions: map[string]string{"permit-pty": ""},
+		},
+	}
+	opts, err = resignOptions(cert, nil, "id_ecdsa-cert.pub", now)
+	require.NoError(t, err)
+	require.Equal(t, provisioner.SSHUserCert, opts.CertType)
+	require.Equal(t, now.Add(time.Hour).UTC(), opts.ValidAfter.Time())
+	require.True(t, opts.ValidBefore.IsZero())
+	require.Equal(t, `{"extensions":{"permit-pty":""}}`, string(opts.TemplateData))
+
+	cert.CertType = 3
+	_, err = resignOptions(cert, nil, "id_ecdsa-cert.pub", now)
+	require.EqualError(t, err, "unknown certificate type 3")
+
+	cert.CertType, cert.ValidPrincipals = ssh.UserCert, nil
+	_, err = resignOptions(cert, nil, "id_ecdsa-cert.pub", now)
+	require.EqualError(t, err, "the certificate does not have principals")
+
+	cert.ValidPrincipals, cert.ValidBefore = []string{"jane"}, unix(0)
+	_, err = resignOptions(cert, nil, "id_ecdsa-cert.pub", now)
+	require.EqualError(t, err, "the certificate expired at "+now.Format(time.RFC3339))
+}
+
+func TestResign(t *testing.T) {
+	priv, pub := mustReadIdentity(t)
+	oldCA := newFakeCAClient(t)
+	opts := newSignOptions(provisioner.SSHUserCert)
+	opts.PublicKey, opts.PrivateKey = pub, priv
+	opts.ValidAfter = provisioner.TimeDuration{}
+	opts.ValidBefore = provisioner.NewTimeDuration(time.Now().Add(time.Hour).Truncate(time.Second))
+	oldCA.skew = time.Nanosecond
+	res, err := sign(opts, oldCA, new(memFS), nil)
+	require.NoError(t, err)
+	old := res.Certificate
+
+	// The new CA uses a different key and removes an extension
+	newCA := newFakeCAClient(t)
+	signer, err := ssh.NewSignerFromKey(ed25519.NewKeyFromSeed(bytes.Repeat([]byte{3}, ed25519.SeedSize)))
+	require.NoError(t, err)
+	newCA.signer, newCA.skew = signer, time.Nanosecond
+
+	opts, err = resignOptions(old, priv, "id_ed25519-cert.pub.new", time.Now())
+	require.NoError(t, err)
+	fs := new(memFS)
+	res, err = sign(opts, newCA, fs, nil)
+	require.NoError(t, err)
+	require.Len(t, fs.files, 1)
+	require.Contains(t, fs.files, "id_ed25519-cert.pub.new")
+	require.Equal(t, pub.Marshal(), res.Certificate.Key.Marshal())
+	require.Equal(t, old.KeyId, newCA.requests[0].KeyID)
+	require.Equal(t, old.ValidPrincipals, newCA.requests[0].Principals)
+	require.JSONEq(t, `{"extensions":{"permit-X11-forwarding":"","permit-agent-forwarding":"","permit-port-forwarding":"","permit-pty":"","permit-user-rc":""}}`, string(newCA.requests[0].TemplateData))
+
+	require.Equal(t, []string{
+		"- signing key: " + ssh.FingerprintSHA256(oldCA.signer.PublicKey()),
+		"+ signing key: " + ssh.FingerprintSHA256(signer.PublicKey()),
+	}, certificateChanges(old, res.Certificate, opts.ValidAfter.Time()))
+}
+
+func TestCertificateChanges(t *testing.T) {
+	base := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	old := &ssh.Certificate{
+		CertType:        ssh.HostCert,
+		KeyId:           "internal.example.com",
+		ValidPrincipals: []string{"internal.example.com", "10.0.0.1"},
+		ValidAfter:      uint64(base.Unix()),
+		ValidBefore:     uint64(base.Add(24 * time.Hour).Unix()),
+		Permissions: ssh.Permissions{
+			CriticalOptions: map[string]string{"source-address": "10.0.0.0/8", "force-command": "/bin/true"},
+			Extensions:      map[string]string{"permit-pty": ""},
+		},
+	}
+	cert := &ssh.Certificate{
+		CertType:        ssh.HostCert,
+		KeyId:           "internal.example.com",
+		ValidPrincipals: []string{"internal.example.com"},
+		ValidAfter:      uint64(base.Add(30 * time.Second).Unix()),
+		ValidBefore:     uint64(base.Add(16 * time.Hour).Unix()),
+		Permissions: ssh.Permissions{
+			CriticalOptions: map[string]string{"source-address": "10.0.0.0/16"},
+			Extensions:      map[string]string{"permit-pty": "", "permit-user-rc": ""},
+		},
+	}
+	require.Equal(t, []string{
+		"- principals: internal.example.com, 10.0.0.1",
+		"+ principals: internal.example.com",
+		"- valid before: 2020-11-02T00:00:00Z",
+		"+ valid before: 2020-11-01T16:00:00Z",
+		"- critical option force-command=/bin/true",
+		"- critical option source-address=10.0.0.0/8",
+		"+ critical option source-address=10.0.0.0/16",
+		"+ extension permit-user-rc",
+	}, certificateChanges(old, cert, base))
+
+	// The start of the validity is compared with the requested one
+	require.Equal(t, []string{
+		"- valid after: 2020-11-01T00:00:00Z",
+		"+ valid after: 2020-11-01T00:05:00Z",
+	}, certificateChanges(old, &ssh.Certificate{
+		CertType:        old.CertType,
+		KeyId:           old.KeyId,
+		ValidPrincipals: old.ValidPrincipals,
+		ValidAfter:      uint64(base.Add(5 * time.Minute).Unix()),
+		ValidBefore:     old.ValidBefore,
+		Permissions:     old.Permissions,
+	}, base))
+
+	old.ValidBefore = ssh.CertTimeInfinity
+	cert = &ssh.Certificate{
+		CertType:        ssh.UserCert,
+		KeyId:           "jane@example.com",
+		ValidPrincipals: old.ValidPrincipals,
+		ValidAfter:      uint64(base.Add(time.Hour).Unix()),
+		ValidBefore:     ssh.CertTimeInfinity,
+		Permissions:     old.Permissions,
+	}
+	require.Equal(t, []string{
+		"- key id: internal.example.com",
+		"+ key id: jane@example.com",
+		"- type: host",
+		"+ type: user",
+	}, certificateChanges(old, cert, time.Time{}))
+}
@@ -0,0 +1,444 @@
+package ssh
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/ca"
+	"github.com/smallstep/cli/crypto/pemutil"
+	"github.com/smallstep/cli/crypto/sshutil"
+	"github.com/smallstep/cli/errs"
+	"github.com/smallstep/cli/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+// CAClient is the interface of the CA client used to sign SSH certificates.
+// It is implemented by the clients returned by cautils.
+type CAClient interface {
+	Version() (*api.VersionResponse, error)
+	SSHSign(req *api.SSHSignRequest) (*api.SSHSignResponse, error)
+}
+
+// FileWriter is the interface used to write the files created by sign.
+type FileWriter interface {
+	WriteFile(filename string, data []byte, perm os.FileMode) error
+}
+
+// AgentClient is the interface used to add the signed certificates to the SSH
+// agent. It is implemented by sshutil.Agent.
+type AgentClient interface {
+	AddCertificate(subject string, cert *ssh.Certificate, priv interface{}) error
+}
+
+// fileWriter is the default FileWriter. It uses utils.WriteFile, so it asks
+// before overwriting a file unless --force is used.
+type fileWriter struct{}
+
+// WriteFile implements the FileWriter interface.
+func (fileWriter) WriteFile(filename string, data []byte, perm os.FileMode) error {
+	return utils.WriteFile(filename, data, perm)
+}
+
+// SignOptions are the options used to sign an SSH certificate.
+type SignOptions struct {
+	// Subject is the key id of the certificate and the comment of the files.
+	Subject string
+	// KeyID is the key id requested to the CA, if empty Subject is used.
+	KeyID string
+	// StrictKeyID makes sign fail, before writing any file, if the CA does
+	// not use the requested key id.
+	StrictKeyID bool
+	Token       string
+	CertType    string
+	Principals  []string
+	ValidAfter  provisioner.TimeDuration
+	ValidBefore provisioner.TimeDuration
+	// TemplateData is the data sent to the CA, the extensions are set here.
+	TemplateData json.RawMessage
+	// Extensions are the extensions that the certificate must have. If nil the
+	// extensions are not checked.
+	Extensions map[string]string
+	// HostID is the value of --host-id, it is only used if the CA requires an
+	// identity certificate for a host.
+	HostID  string
+	AddUser bool
+	// AddUserPrincipal is the user created by the add user certificate, it
+	// must be the first principal of the certificate. If empty the principal
+	// is derived from Subject.
+	AddUserPrincipal string
+	// AddUserBase is the base name of the add user files, if empty
+	// "<BaseName>-provisioner" is used.
+	AddUserBase string
+	// PublicKey is the key to sign. If nil a new key pair is generated and it
+	// is written in KeyFile and PubFile.
+	PublicKey ssh.PublicKey
+	// PrivateKey is the private key of PublicKey. If not nil the certificate
+	// is added to the agent.
+	PrivateKey interface{}
+	// WritePublicKey indicates if PubFile must be written when PublicKey is
+	// set.
+	WritePublicKey bool
+	// WritePrivateKey indicates if KeyFile and PubFile must be written when
+	// PublicKey and PrivateKey are set.
+	WritePrivateKey bool
+	// Comment is the comment of the certificate in the agent, if empty
+	// Subject is used.
+	Comment string
+	// KeyPassword returns the password used to encrypt a generated private
+	// key. If nil the private key is not encrypted.
+	KeyPassword func() ([]byte, error)
+	// BaseName is the name used for the files of the add user certificate if
+	// AddUserBase is not set, and for the split certificates.
+	BaseName string
+	KeyFile  string
+	PubFile  string
+	CrtFile  string
+	// Logger writes the request, the response of the CA and the files
+	// written, if nil nothing is logged.
+	Logger *Logger
+}
+
+// Result is the result of signing an SSH certificate.
+type Result struct {
+	Certificate        *ssh.Certificate
+	AddUserCertificate *ssh.Certificate
+	// AddUserKey is the private key of the add user certificate.
+	AddUserKey interface{}
+	// IdentityCertificate and IdentityKey are the x509 identity that must be
+	// written if the CA requires client authentication.
+	IdentityCertificate []api.Certificate
+	IdentityKey         crypto.PrivateKey
+	// Agent is true if the certificate was added to the agent, if not and the
+	// agent was used, AgentError contains the error.
+	Agent      bool
+	AgentError error
+	// RequestedKeyID is the key id sent to the CA, the key id of the
+	// certificate might be different if the CA rewrites it.
+	RequestedKeyID string
+}
+
+// RequireIdentity returns true if the x509 identity certificate must be
+// written.
+func (r *Result) RequireIdentity() bool {
+	return r.IdentityKey != nil
+}
+
+// sign signs a new SSH certificate using the given client and writes the key
+// pair, certificate and add user files with fs. If agent is not nil and the
+// private key is known, user certificates are also added to the agent. sign
+// does not interact with the user, everything that requires it must be done
+// before calling it.
+func sign(opts SignOptions, client CAClient, fs FileWriter, agent AgentClient) (*Result, error) {
+	log := opts.Logger
+	fs = logFileWriter(fs, log)
+
+	version, err := client.Version()
+	if err != nil {
+		log.Debugf("sign", "error getting the CA version: %v", err)
+		return nil, err
+	}
+	log.Debugf("sign", "CA version %s, client authentication required: %t", version.Version, version.RequireClientAuthentication)
+
+	// Generate identity certificate (x509) if necessary
+	res := new(Result)
+	var identityCSR api.CertificateRequest
+	if version.RequireClientAuthentication {
+		csr, key, err := createIdentityRequest(opts.Subject, opts.CertType == provisioner.SSHHostCert, opts.HostID)
+		if err != nil {
+			return nil, err
+		}
+		identityCSR = *csr
+		res.IdentityKey = key
+	}
+
+	sshPub, priv := opts.PublicKey, opts.PrivateKey
+	if sshPub == nil {
+		if sshPub, priv, err = generateSSHKeyPair(); err != nil {
+			return nil, err
+		}
+	}
+
+	var sshAuPub ssh.PublicKey
+	var sshAuPubBytes []byte
+	var auPriv interface{}
+	if opts.AddUser {
+		if sshAuPub, auPriv, err = generateSSHKeyPair(); err != nil {
+			return nil, err
+		}
+		sshAuPubBytes = sshAuPub.Marshal()
+	}
+
+	keyID := opts.KeyID
+	if keyID == "" {
+		keyID = opts.Subject
+	}
+	res.RequestedKeyID = keyID
+
+	req := &api.SSHSignRequest{
+		PublicKey:        sshPub.Marshal(),
+		OTT:              opts.Token,
+		Principals:       opts.Principals,
+		CertType:         opts.CertType,
+		KeyID:            keyID,
+		ValidAfter:       opts.ValidAfter,
+		ValidBefore:      opts.ValidBefore,
+		AddUserPublicKey: sshAuPubBytes,
+		IdentityCSR:      identityCSR,
+		TemplateData:     opts.TemplateData,
+	}
+	log.Debugf("sign", "requesting %s certificate: key %s %s, key id %q, principals [%s], valid after %q, valid before %q, add user %t, identity CSR %t, template data %d bytes",
+		req.CertType, sshPub.Type(), ssh.FingerprintSHA256(sshPub), req.KeyID, strings.Join(req.Principals, ", "),
+		formatTimeDuration(req.ValidAfter, "now"), formatTimeDuration(req.ValidBefore, "provisioner default"), opts.AddUser, identityCSR.CertificateRequest != nil, len(req.TemplateData))
+	log.TraceJSON("sign", "request", req)
+	resp, err := client.SSHSign(req)
+	if err != nil {
+		logSignError(log, err)
+		if sshutil.IsSecurityKey(sshPub) {
+			return nil, errors.Wrapf(err, "error signing %s key: the CA might not support security key certificates", sshPub.Type())
+		}
+		return nil, err
+	}
+	if err := sshutil.CheckCertificateKey(resp.Certificate.Certificate, sshPub); err != nil {
+		return nil, err
+	}
+	if opts.StrictKeyID && resp.Certificate.KeyId != keyID {
+		return nil, errors.Errorf("the CA rewrote the requested key id '%s' to '%s'", keyID, resp.Certificate.KeyId)
+	}
+	if opts.Extensions != nil {
+		if err := checkExtensions(resp.Certificate.Certificate, opts.Extensions); err != nil {
+			return nil, err
+		}
+	}
+	res.Certificate = resp.Certificate.Certificate
+	res.IdentityCertificate = resp.IdentityCertificate
+	log.TraceJSON("sign", "response", resp)
+	logCertificate(log, "certificate", res.Certificate)
+	if resp.AddUserCertificate != nil {
+		logCertificate(log, "add user certificate", resp.AddUserCertificate.Certificate)
+	}
+
+	// Write files
+	switch {
+	case opts.PublicKey == nil || opts.WritePrivateKey:
+		// Private key (with password if KeyPassword is set)
+		var password []byte
+		if opts.KeyPassword != nil {
+			if password, err = opts.KeyPassword(); err != nil {
+				return nil, err
+			}
+		}
+		if err := writePrivateKey(fs, opts.KeyFile, priv, password); err != nil {
+			return nil, err
+		}
+		if err := fs.WriteFile(opts.PubFile, marshalPublicKey(sshPub, opts.Subject), 0644); err != nil {
+			return nil, err
+		}
+	case opts.WritePublicKey:
+		if err := fs.WriteFile(opts.PubFile, marshalPublicKey(sshPub, opts.Subject), 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	// Write certificate
+	if err := fs.WriteFile(opts.CrtFile, marshalPublicKey(resp.Certificate, opts.Subject), 0644); err != nil {
+		return nil, err
+	}
+
+	// Write Add User keys and certs
+	if opts.AddUser && resp.AddUserCertificate != nil {
+		res.AddUserCertificate = resp.AddUserCertificate.Certificate
+		res.AddUserKey = auPriv
+		id := opts.addUserID(res.AddUserCertificate)
+		keyFile, pubFile, crtFile := opts.AddUserFiles()
+		if err := writePrivateKey(fs, keyFile, auPriv, nil); err != nil {
+			return nil, err
+		}
+		if err := fs.WriteFile(pubFile, marshalPublicKey(sshAuPub, id), 0644); err != nil {
+			return nil, err
+		}
+		if err := fs.WriteFile(crtFile, marshalPublicKey(resp.AddUserCertificate, id), 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	// Add user certificates to the agent
+	if agent != nil && priv != nil && opts.CertType == provisioner.SSHUserCert {
+		comment := opts.Comment
+		if comment == "" {
+			comment = opts.Subject
+		}
+		if err := agent.AddCertificate(comment, res.Certificate, priv); err != nil {
+			log.Debugf("agent", "error adding the certificate with comment %q: %v", comment, err)
+			res.AgentError = err
+		} else {
+			log.Debugf("agent", "added the certificate with comment %q", comment)
+			res.Agent = true
+		}
+	}
+
+	return res, nil
+}
+
+// AddUserFiles returns the files of the private key, public key and
+// certificate of the add user certificate.
+func (o SignOptions) AddUserFiles() (keyFile, pubFile, crtFile string) {
+	base := o.AddUserBase
+	if base == "" {
+		base = o.BaseName + "-provisioner"
+	}
+	return base, base + ".pub", base + "-cert.pub"
+}
+
+// addUserID returns the comment of the add user files,
+// "<principal>-<login>", where login is the user of the add user certificate,
+// "provisioner" by default.
+func (o SignOptions) addUserID(cert *ssh.Certificate) string {
+	principal := o.AddUserPrincipal
+	if principal == "" {
+		principal = provisioner.SanitizeSSHUserPrincipal(o.Subject)
+	}
+	return principal + "-" + addUserLogin(cert)
+}
+
+// addUserLogin returns the user of the given add user certificate, the CA sets
+// it in the configuration and it is "provisioner" by default.
+func addUserLogin(cert *ssh.Certificate) string {
+	if cert != nil && len(cert.ValidPrincipals) > 0 {
+		return cert.ValidPrincipals[0]
+	}
+	return "provisioner"
+}
+
+// signPrincipals signs one certificate for each principal in opts, all of them
+// for the same key. The first certificate uses opts.Token, and newToken returns
+// the token of the others. If the key pair is generated it is written only
+// once, and each certificate is written in the file returned by
+// splitCertificateFile. On error it returns the certificates already signed.
+func signPrincipals(opts SignOptions, client CAClient, newToken func(principal string) (string, error), fs FileWriter, agent AgentClient) ([]*Result, error) {
+	if opts.PublicKey == nil {
+		pub, priv, err := generateSSHKeyPair()
+		if err != nil {
+			return nil, err
+		}
+		opts.PublicKey, opts.PrivateKey, opts.WritePrivateKey = pub, priv, true
+	}
+
+	results := make([]*Result, 0, len(opts.Principals))
+	for i, principal := range opts.Principals {
+		o := opts
+		o.Principals = []string{principal}
+		o.CrtFile = splitCertificateFile(opts.BaseName, principal)
+		o.Comment = fmt.Sprintf("%s (%s)", opts.Subject, principal)
+		if i > 0 {
+			token, err := newToken(principal)
+			if err != nil {
+				return results, err
+			}
+			o.Token = token
+			o.WritePrivateKey, o.WritePublicKey = false, false
+		}
+		res, err := sign(o, client, fs, agent)
+		if err != nil {
+			return results, errors.Wrapf(err, "error signing the certificate for %s", principal)
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// splitCertificateFile returns the name of the certificate for the given
+// principal, "<baseName>-cert.<principal>.pub".
+func splitCertificateFile(baseName, principal string) string {
+	return baseName + "-cert." + principal + ".pub"
+}
+
+// writePrivateKey writes the given private key in the OpenSSH format. The key
+// is encrypted if a password is given.
+func writePrivateKey(fs FileWriter, filename string, priv interface{}, password []byte) error {
+	opts := []pemutil.Options{
+		pemutil.WithOpenSSH(true),
+	}
+	if password != nil {
+		opts = append(opts, pemutil.WithPassword(password))
+	}
+	block, err := pemutil.Serialize(priv, opts...)
+	if err != nil {
+		return err
+	}
+	return fs.WriteFile(filename, pem.EncodeToMemory(block), 0600)
+}
+
+// createIdentityRequest creates the CSR for the x509 identity certificate. The
+// CSR of a host contains its host ID as the first URI.
+func createIdentityRequest(subject string, isHost bool, hostID string) (*api.CertificateRequest, crypto.PrivateKey, error) {
+	csr, key, err := ca.CreateIdentityRequest(subject)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !isHost {
+		return csr, key, nil
+	}
+
+	// All host identity certs need a URI SAN to work with our ssh API.
+	var u = uuid.Nil
+	switch hostID {
+	case "":
+		// If there is an old identity cert lying around, by default use the host ID so that running
+		// this command twice doesn't clobber your old host ID.
+		u, err = readExistingUUID()
+		if err != nil {
+			u, err = uuid.NewRandom()
+			if err != nil {
+				return nil, nil, errs.Wrap(err, "Unable to generate a host-id.")
+			}
+		}
+	case "machine":
+		u, err = deriveMachineID()
+		if err != nil {
+			return nil, nil, errs.Wrap(err, "Unable to derive a host-id. Make sure /etc/machine-id exists.")
+		}
+	default:
+		u, err = uuid.Parse(hostID)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "error parsing host-id %s", hostID)
+		}
+	}
+	uri, err := url.Parse(u.URN())
+	if err != nil {
+		return nil, nil, errs.Wrap(err, "failed parsing uuid urn")
+	}
+
+	template := &x509.CertificateRequest{
+		Subject:        csr.Subject,
+		DNSNames:       csr.DNSNames,
+		IPAddresses:    csr.IPAddresses,
+		EmailAddresses: csr.EmailAddresses,
+		// Prepend the generated uri. There is code that expects the
+		// uuid URI to be the first one.
+		URIs: append([]*url.URL{uri}, csr.URIs...),
+	}
+	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, nil, errs.Wrap(err, "failed creating certificate request")
+	}
+	newCSR, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		return nil, nil, errs.Wrap(err, "failed parsing certificate request bytes")
+	}
+	if err := newCSR.CheckSignature(); err != nil {
+		return nil, nil, errs.Wrap(err, "failed signature check on new csr")
+	}
+	csr.CertificateRequest = newCSR
+	return csr, key, nil
+}
@@ -0,0 +1,694 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/cli/crypto/pemutil"
+	"github.com/smallstep/cli/errs"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+// zeroReader makes the certificates signed by the fake CA deterministic, the
+// nonce is all zeros and ed25519 signatures do not use randomness.
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+type fakeCAClient struct {
+	signer   ssh.Signer
+	version  *api.VersionResponse
+	err      error
+	key      ssh.PublicKey
+	keyID    string
+	requests []*api.SSHSignRequest
+	// addUserLogin is the principal of the add user certificates, the CA
+	// uses "provisioner" by default.
+	addUserLogin string
+	// skew is the difference between the clock of the CA and the local one,
+	// if set the default validity is one hour starting at the CA time.
+	skew time.Duration
+}
+
+func newFakeCAClient(t *testing.T) *fakeCAClient {
+	signer, err := ssh.NewSignerFromKey(ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize)))
+	require.NoError(t, err)
+	return &fakeCAClient{
+		signer:  signer,
+		version: &api.VersionResponse{Version: "0.15.14"},
+	}
+}
+
+func (c *fakeCAClient) Version() (*api.VersionResponse, error) {
+	return c.version, nil
+}
+
+func (c *fakeCAClient) newCertificate(key ssh.PublicKey, req *api.SSHSignRequest) (*api.SSHCertificate, error) {
+	validAfter, validBefore := req.ValidAfter, req.ValidBefore
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          1234,
+		KeyId:           req.KeyID,
+		ValidPrincipals: req.Principals,
+		ValidAfter:      uint64(validAfter.Time().Unix()),
+		ValidBefore:     uint64(validBefore.Time().Unix()),
+	}
+	if c.skew != 0 {
+		base := time.Now().Add(c.skew)
+		cert.ValidAfter, cert.ValidBefore = uint64(base.Unix()), uint64(base.Add(time.Hour).Unix())
+		if !validAfter.IsZero() {
+			cert.ValidAfter = uint64(validAfter.RelativeTime(base).Unix())
+		}
+		if !validBefore.IsZero() {
+			cert.ValidBefore = uint64(validBefore.RelativeTime(base).Unix())
+		}
+	}
+	if req.CertType == provisioner.SSHHostCert {
+		cert.CertType = ssh.HostCert
+	} else {
+		cert.CertType = ssh.UserCert
+		cert.Extensions = map[string]string{
+			"permit-X11-forwarding":   "",
+			"permit-agent-forwarding": "",
+			"permit-port-forwarding":  "",
+			"permit-pty":              "",
+			"permit-user-rc":          "",
+		}
+	}
+	if err := cert.SignCert(zeroReader{}, c.signer); err != nil {
+		return nil, err
+	}
+	return &api.SSHCertificate{Certificate: cert}, nil
+}
+
+func (c *fakeCAClient) SSHSign(req *api.SSHSignRequest) (*api.SSHSignResponse, error) {
+	c.requests = append(c.requests, req)
+	if c.err != nil {
+		return nil, c.err
+	}
+	key, err := ssh.ParsePublicKey(req.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if c.key != nil {
+		key = c.key
+	}
+	if c.keyID != "" {
+		r := *req
+		r.KeyID = c.keyID
+		req = &r
+	}
+	cert, err := c.newCertificate(key, req)
+	if err != nil {
+		return nil, err
+	}
+	resp := &api.SSHSignResponse{Certificate: *cert}
+	if req.AddUserPublicKey != nil {
+		auKey, err := ssh.ParsePublicKey(req.AddUserPublicKey)
+		if err != nil {
+			return nil, err
+		}
+		login := c.addUserLogin
+		if login == "" {
+			login = "provisioner"
+		}
+		if resp.AddUserCertificate, err = c.newCertificate(auKey, &api.SSHSignRequest{
+			KeyID:       req.Principals[0] + "-" + login,
+			Principals:  []string{login},
+			ValidAfter:  req.ValidAfter,
+			ValidBefore: req.ValidBefore,
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+type memFile struct {
+	data []byte
+	perm os.FileMode
+}
+
+type memFS struct {
+	files map[string]memFile
+	err   error
+}
+
+func (fs *memFS) WriteFile(filename string, data []byte, perm os.FileMode) error {
+	if fs.err != nil {
+		return fs.err
+	}
+	if fs.files == nil {
+		fs.files = make(map[string]memFile)
+	}
+	fs.files[filename] = memFile{data, perm}
+	return nil
+}
+
+type fakeAgent struct {
+	subject  string
+	cert     *ssh.Certificate
+	priv     interface{}
+	err      error
+	subjects []string
+}
+
+func (a *fakeAgent) AddCertificate(subject string, cert *ssh.Certificate, priv interface{}) error {
+	if a.err != nil {
+		return a.err
+	}
+	a.subject, a.cert, a.priv = subject, cert, priv
+	a.subjects = append(a.subjects, subject)
+	return nil
+}
+
+func mustReadIdentity(t *testing.T) (interface{}, ssh.PublicKey) {
+	priv, err := pemutil.Read("testdata/id_ed25519")
+	require.NoError(t, err)
+	b, err := ioutil.ReadFile("testdata/id_ed25519.pub")
+	require.NoError(t, err)
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	require.NoError(t, err)
+	return priv, pub
+}
+
+func newSignOptions(certType string) SignOptions {
+	validAfter := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	return SignOptions{
+		Subject:     "jane@example.com",
+		Token:       "the-token",
+		CertType:    certType,
+		Principals:  []string{"jane", "jane@example.com"},
+		ValidAfter:  provisioner.NewTimeDuration(validAfter),
+		ValidBefore: provisioner.NewTimeDuration(validAfter.Add(16 * time.Hour)),
+		BaseName:    "id_ed25519",
+		KeyFile:     "id_ed25519",
+		PubFile:     "id_ed25519.pub",
+		CrtFile:     "id_ed25519-cert.pub",
+	}
+}
+
+func TestSign_golden(t *testing.T) {
+	priv, pub := mustReadIdentity(t)
+
+	tests := []struct {
+		name  string
+		opts  func() SignOptions
+		files []string
+	}{
+		{"sign-user", func() SignOptions {
+			o := newSignOptions(provisioner.SSHUserCert)
+			o.PublicKey = pub
+			return o
+		}, []string{"id_ed25519-cert.pub"}},
+		{"sign-host", func() SignOptions {
+			o := newSignOptions(provisioner.SSHHostCert)
+			o.Subject = "internal.example.com"
+			o.Principals = []string{"internal.example.com"}
+			o.PublicKey = pub
+			return o
+		}, []string{"id_ed25519-cert.pub"}},
+		{"identity", func() SignOptions {
+			o := newSignOptions(provisioner.SSHUserCert)
+			o.PublicKey, o.PrivateKey, o.WritePublicKey = pub, priv, true
+			return o
+		}, []string{"id_ed25519.pub", "id_ed25519-cert.pub"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := new(memFS)
+			res, err := sign(tt.opts(), newFakeCAClient(t), fs, nil)
+			require.NoError(t, err)
+			require.False(t, res.Agent)
+			require.NoError(t, res.AgentError)
+			require.Len(t, fs.files, len(tt.files))
+			for _, name := range tt.files {
+				f, ok := fs.files[name]
+				require.True(t, ok, "file %s was not written", name)
+				require.Equal(t, os.FileMode(0644), f.perm)
+				golden := filepath.Join("testdata", "golden", tt.name+"-"+name)
+				if *updateGolden {
+					require.NoError(t, ioutil.WriteFile(golden, f.data, 0644))
+				}
+				want, err := ioutil.ReadFile(golden)
+				require.NoError(t, err)
+				require.Equal(t, string(want), string(f.data))
+			}
+		})
+	}
+}
+
+func TestSign(t *testing.T) {
+	client := newFakeCAClient(t)
+	agent := new(fakeAgent)
+	fs := new(memFS)
+	opts := newSignOptions(provisioner.SSHUserCert)
+	opts.AddUser = true
+	opts.KeyPassword = func() ([]byte, error) {
+		return []byte("password"), nil
+	}
+	res, err := sign(opts, client, fs, agent)
+	require.NoError(t, err)
+	require.False(t, res.RequireIdentity())
+
+	// Request
+	require.Len(t, client.requests, 1)
+	req := client.requests[0]
+	require.Equal(t, "the-token", req.OTT)
+	require.Equal(t, "jane@example.com", req.KeyID)
+	require.Equal(t, provisioner.SSHUserCert, req.CertType)
+	require.Equal(t, []string{"jane", "jane@example.com"}, req.Principals)
+	require.NotEmpty(t, req.AddUserPublicKey)
+
+	// Generated key is encrypted
+	require.Len(t, fs.files, 6)
+	require.Equal(t, os.FileMode(0600), fs.files["id_ed25519"].perm)
+	_, err = pemutil.ParseKey(fs.files["id_ed25519"].data)
+	require.Error(t, err)
+	priv, err := pemutil.ParseKey(fs.files["id_ed25519"].data, pemutil.WithPassword([]byte("password")))
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+	pub, comment, _, _, err := ssh.ParseAuthorizedKey(fs.files["id_ed25519.pub"].data)
+	require.NoError(t, err)
+	require.Equal(t, "jane@example.com", comment)
+	require.Equal(t, signer.PublicKey().Marshal(), pub.Marshal())
+	require.Equal(t, pub.Marshal(), res.Certificate.Key.Marshal())
+	require.Equal(t, marshalPublicKey(res.Certificate, "jane@example.com"), fs.files["id_ed25519-cert.pub"].data)
+
+	// Add user files are not encrypted
+	require.NotNil(t, res.AddUserCertificate)
+	require.Equal(t, os.FileMode(0600), fs.files["id_ed25519-provisioner"].perm)
+	_, err = pemutil.ParseKey(fs.files["id_ed25519-provisioner"].data)
+	require.NoError(t, err)
+	require.Equal(t, marshalPublicKey(res.AddUserCertificate.Key, "jane-provisioner"), fs.files["id_ed25519-provisioner.pub"].data)
+	require.Equal(t, marshalPublicKey(res.AddUserCertificate, "jane-provisioner"), fs.files["id_ed25519-provisioner-cert.pub"].data)
+
+	// Agent
+	require.True(t, res.Agent)
+	require.Equal(t, "jane@example.com", agent.subject)
+	require.Equal(t, res.Certificate, agent.cert)
+	require.Equal(t, priv, agent.priv)
+
+	// Without password
+	fs = new(memFS)
+	opts = newSignOptions(provisioner.SSHUserCert)
+	_, err = sign(opts, client, fs, nil)
+	require.NoError(t, err)
+	require.Len(t, fs.files, 3)
+	_, err = pemutil.ParseKey(fs.files["id_ed25519"].data)
+	require.NoError(t, err)
+
+	// Host certificates are never added to the agent
+	agent = new(fakeAgent)
+	res, err = sign(newSignOptions(provisioner.SSHHostCert), client, new(memFS), agent)
+	require.NoError(t, err)
+	require.False(t, res.Agent)
+	require.Nil(t, agent.cert)
+
+	// Public keys without private key are not added to the agent
+	_, sshPub := mustReadIdentity(t)
+	opts = newSignOptions(provisioner.SSHUserCert)
+	opts.PublicKey = sshPub
+	res, err = sign(opts, client, new(memFS), agent)
+	require.NoError(t, err)
+	require.False(t, res.Agent)
+	require.Nil(t, agent.cert)
+
+	// Agent errors are returned in the result
+	agent.err = errors.New("agent error")
+	res, err = sign(newSignOptions(provisioner.SSHUserCert), client, new(memFS), agent)
+	require.NoError(t, err)
+	require.False(t, res.Agent)
+	require.EqualError(t, res.AgentError, "agent error")
+}
+
+func TestSign_addUserOptions(t *testing.T) {
+	client := newFakeCAClient(t)
+	client.addUserLogin = "admin"
+	fs := new(memFS)
+	opts := newSignOptions(provisioner.SSHUserCert)
+	opts.AddUser = true
+	opts.AddUserPrincipal = "jdoe"
+	opts.AddUserBase = "acme/jdoe-admin"
+	opts.Principals = []string{"jdoe"}
+	res, err := sign(opts, client, fs, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"jdoe"}, client.requests[0].Principals)
+	require.Equal(t, []string{"admin"}, res.AddUserCertificate.ValidPrincipals)
+
+	keyFile, pubFile, crtFile := opts.AddUserFiles()
+	require.Equal(t, []string{"acme/jdoe-admin", "acme/jdoe-admin.pub", "acme/jdoe-admin-cert.pub"}, []string{keyFile, pubFile, crtFile})
+	require.Len(t, fs.files, 6)
+	require.Contains(t, fs.files, keyFile)
+	require.Equal(t, marshalPublicKey(res.AddUserCertificate.Key, "jdoe-admin"), fs.files[pubFile].data)
+	require.Equal(t, marshalPublicKey(res.AddUserCertificate, "jdoe-admin"), fs.files[crtFile].data)
+
+	// Default names
+	opts.AddUserPrincipal, opts.AddUserBase = "", ""
+	keyFile, pubFile, crtFile = opts.AddUserFiles()
+	require.Equal(t, []string{"id_ed25519-provisioner", "id_ed25519-provisioner.pub", "id_ed25519-provisioner-cert.pub"}, []string{keyFile, pubFile, crtFile})
+	require.Equal(t, "jane-provisioner", opts.addUserID(nil))
+}
+
+func TestSign_keyID(t *testing.T) {
+	client := newFakeCAClient(t)
+	opts := newSignOptions(provisioner.SSHHostCert)
+	opts.KeyID = "host-1234"
+	opts.StrictKeyID = true
+	res, err := sign(opts, client, new(memFS), nil)
+	require.NoError(t, err)
+	require.Equal(t, "host-1234", client.requests[0].KeyID)
+	require.Equal(t, "host-1234", res.RequestedKeyID)
+	require.Equal(t, "host-1234", res.Certificate.KeyId)
+
+	// Without --strict the rewritten key id is only reported
+	client.keyID = "internal.example.com"
+	fs := new(memFS)
+	opts.StrictKeyID = false
+	res, err = sign(opts, client, fs, nil)
+	require.NoError(t, err)
+	require.Equal(t, "host-1234", res.RequestedKeyID)
+	require.Equal(t, "internal.example.com", res.Certificate.KeyId)
+	require.Len(t, fs.files, 3)
+
+	// With --strict no file is written
+	fs = new(memFS)
+	opts.StrictKeyID = true
+	_, err = sign(opts, client, fs, nil)
+	require.Error(t, err)
+	require.Empty(t, fs.files)
+}
+
+func TestSign_clockSkew(t *testing.T) {
+	// The clock of the CA is ahead
+	client := newFakeCAClient(t)
+	client.skew = 5 * time.Minute
+	opts := newSignOptions(provisioner.SSHUserCert)
+	opts.ValidAfter, opts.ValidBefore = provisioner.TimeDuration{}, provisioner.TimeDuration{}
+	res, err := sign(opts, client, new(memFS), nil)
+	require.NoError(t, err)
+	warnings := checkClockSkew(res.Certificate, time.Now(), time.Minute)
+	require.Len(t, warnings, 1)
+	require.Contains(t, warnings[0], "the local clock might be behind the CA")
+	require.Empty(t, checkClockSkew(res.Certificate, time.Now(), 10*time.Minute))
+
+	// The backdate is sent as a duration relative to the CA time
+	validAfter, _, err := parseCertificateValidity(newCertificateContext(t, "--backdate", "10m", "jane@example.com", "id_ed25519"))
+	require.NoError(t, err)
+	opts.ValidAfter = validAfter
+	res, err = sign(opts, client, new(memFS), nil)
+	require.NoError(t, err)
+	b, err := client.requests[1].ValidAfter.MarshalJSON()
+	require.NoError(t, err)
+	require.Equal(t, `"-10m0s"`, string(b))
+	require.Empty(t, checkClockSkew(res.Certificate, time.Now(), time.Minute))
+
+	// The clock of the CA is behind
+	client.skew = -2 * time.Hour
+	opts.ValidAfter = provisioner.TimeDuration{}
+	res, err = sign(opts, client, new(memFS), nil)
+	require.NoError(t, err)
+	warnings = checkClockSkew(res.Certificate, time.Now(), time.Minute)
+	require.Len(t, warnings, 1)
+	require.Contains(t, warnings[0], "the local clock might be ahead of the CA")
+}
+
+func TestSignPrincipals(t *testing.T) {
+	client := newFakeCAClient(t)
+	opts := newSignOptions(provisioner.SSHUserCert)
+	opts.Principals = []string{"acme", "globex"}
+	opts.Token = "token-acme"
+	var tokens []string
+	newToken := func(principal string) (string, error) {
+		tokens = append(tokens, principal)
+		return "token-" + principal, nil
+	}
+
+	fs := new(memFS)
+	agent := new(fakeAgent)
+	results, err := signPrincipals(opts, client, newToken, fs, agent)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.Equal(t, []string{"globex"}, tokens)
+
+	// One request per principal, all of them for the same key
+	require.Len(t, client.requests, 2)
+	for i, p := range opts.Principals {
+		require.Equal(t, []string{p}, client.requests[i].Principals)
+		require.Equal(t, "token-"+p, client.requests[i].OTT)
+		require.Equal(t, client.requests[0].PublicKey, client.requests[i].PublicKey)
+		require.Equal(t, []string{p}, results[i].Certificate.ValidPrincipals)
+	}
+
+	// The key pair is written once, and each certificate in its own file
+	require.Len(t, fs.files, 4)
+	require.Contains(t, fs.files, "id_ed25519")
+	require.Contains(t, fs.files, "id_ed25519.pub")
+	require.NotContains(t, fs.files, "id_ed25519-cert.pub")
+	for i, p := range opts.Principals {
+		f, ok := fs.files["id_ed25519-cert."+p+".pub"]
+		require.True(t, ok)
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(f.data)
+		require.NoError(t, err)
+		cert := pub.(*ssh.Certificate)
+		require.Equal(t, results[i].Certificate.Serial, cert.Serial)
+		require.Equal(t, []string{p}, cert.ValidPrincipals)
+	}
+	require.Equal(t, []string{"jane@example.com (acme)", "jane@example.com (globex)"}, agent.subjects)
+
+	// The signed certificates are returned on errors
+	client.requests = nil
+	tokens = nil
+	results, err = signPrincipals(opts, client, func(principal string) (string, error) {
+		return "", errors.New("token failed")
+	}, new(memFS), nil)
+	require.EqualError(t, err, "token failed")
+	require.Len(t, results, 1)
+	require.Len(t, client.requests, 1)
+}
+
+func TestSign_identity(t *testing.T) {
+	client := newFakeCAClient(t)
+	client.version.RequireClientAuthentication = true
+
+	res, err := sign(newSignOptions(provisioner.SSHUserCert), client, new(memFS), nil)
+	require.NoError(t, err)
+	require.True(t, res.RequireIdentity())
+	require.NotNil(t, client.requests[0].IdentityCSR.CertificateRequest)
+
+	opts := newSignOptions(provisioner.SSHHostCert)
+	opts.HostID = "1e6b4d3e-5b2e-4c2a-9d4f-6d0f6a4b2c11"
+	res, err = sign(opts, client, new(memFS), nil)
+	require.NoError(t, err)
+	require.True(t, res.RequireIdentity())
+	csr := client.requests[1].IdentityCSR.CertificateRequest
+	require.NotEmpty(t, csr.URIs)
+	require.Equal(t, "urn:uuid:"+opts.HostID, csr.URIs[0].String())
+}
+
+func TestSign_errors(t *testing.T) {
+	_, otherPub := mustReadIdentity(t)
+
+	tests := []struct {
+		name    string
+		client  func() *fakeCAClient
+		opts    func() SignOptions
+		fs      *memFS
+		wantErr string
+	}{
+		{"fail/sign", func() *fakeCAClient {
+			c := newFakeCAClient(t)
+			c.err = errors.New("forbidden")
+			return c
+		}, func() SignOptions { return newSignOptions(provisioner.SSHUserCert) }, new(memFS), "forbidden"},
+		{"fail/key", func() *fakeCAClient {
+			c := newFakeCAClient(t)
+			c.key = otherPub
+			return c
+		}, func() SignOptions { return newSignOptions(provisioner.SSHUserCert) }, new(memFS), "does not match"},
+		{"fail/strict-key-id", func() *fakeCAClient {
+			c := newFakeCAClient(t)
+			c.keyID = "jane"
+			return c
+		}, func() SignOptions {
+			o := newSignOptions(provisioner.SSHUserCert)
+			o.StrictKeyID = true
+			return o
+		}, new(memFS), "the CA rewrote the requested key id 'jane@example.com' to 'jane'"},
+		{"fail/extensions", func() *fakeCAClient { return newFakeCAClient(t) }, func() SignOptions {
+			o := newSignOptions(provisioner.SSHUserCert)
+			o.Extensions = map[string]string{"permit-pty": ""}
+			return o
+		}, new(memFS), "permit-agent-forwarding"},
+		{"fail/password", func() *fakeCAClient { return newFakeCAClient(t) }, func() SignOptions {
+			o := newSignOptions(provisioner.SSHUserCert)
+			o.KeyPassword = func() ([]byte, error) { return nil, errors.New("password error") }
+			return o
+		}, new(memFS), "password error"},
+		{"fail/write", func() *fakeCAClient { return newFakeCAClient(t) }, func() SignOptions {
+			return newSignOptions(provisioner.SSHUserCert)
+		}, &memFS{err: errors.New("write error")}, "write error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := sign(tt.opts(), tt.client(), tt.fs, nil)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func newCertificateContext(t *testing.T, args ...string) *cli.Context {
+	cmd := certificateCommand()
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	for _, f := range cmd.Flags {
+		f.Apply(set)
+	}
+	require.NoError(t, set.Parse(args))
+	ctx := cli.NewContext(&cli.App{Name: "step"}, set, nil)
+	ctx.Command = cmd
+	return ctx
+}
+
+func TestValidateCertificateFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{"ok/user", []string{"jane@example.com", "id_ecdsa"}, ""},
+		{"ok/host", []string{"--host", "--host-id", "machine", "internal.example.com", "id_ecdsa"}, ""},
+		{"ok/host-id", []string{"--host", "--host-id", "1e6b4d3e-5b2e-4c2a-9d4f-6d0f6a4b2c11", "internal.example.com", "id_ecdsa"}, ""},
+		{"ok/add-user", []string{"--add-user", "--principal", "jane", "jane@example.com", "id_ecdsa"}, ""},
+		{"ok/token", []string{"--token", "the-token", "jane@example.com", "id_ecdsa"}, ""},
+		{"ok/identity", []string{"--identity", "id_ecdsa", "jane@example.com"}, ""},
+		{"ok/no-password", []string{"--no-password", "--insecure", "jane@example.com", "id_ecdsa"}, ""},
+		{"ok/outputs", []string{"--key-out", "/run/id_ecdsa", "--pub-out", "/etc/id_ecdsa.pub", "--crt-out", "/etc/id_ecdsa-cert.pub", "jane@example.com", "id_ecdsa"}, ""},
+		{"ok/sign-crt-out", []string{"--sign", "--crt-out", "/etc/id_ecdsa-cert.pub", "jane@example.com", "id_ecdsa.pub"}, ""},
+		{"ok/identity-outputs", []string{"--identity", "id_ecdsa", "--pub-out", "/etc/id_ecdsa.pub", "--crt-out", "/etc/id_ecdsa-cert.pub", "jane@example.com"}, ""},
+		{"ok/kms", []string{"--host", "--kms", "pkcs11:id=%01", "--crt-out", "/etc/ssh/ssh_host_ecdsa_key-cert.pub", "internal.example.com", "ssh_host_ecdsa_key"}, ""},
+		{"ok/ssh-config", []string{"--ssh-config", "~/.ssh/config", "--host-pattern", "*.example.com", "jane@example.com", "id_ecdsa"}, ""},
+		{"ok/remove-ssh-config", []string{"--remove-ssh-config", "--ssh-config", "~/.ssh/config", "--host-pattern", "*.example.com"}, ""},
+		{"fail/ssh-config", []string{"--ssh-config", "~/.ssh/config", "jane@example.com", "id_ecdsa"}, "flag '--ssh-config' requires the '--host-pattern' flag"},
+		{"fail/host-pattern", []string{"--host-pattern", "*.example.com", "jane@example.com", "id_ecdsa"}, "flag '--host-pattern' requires the '--ssh-config' flag"},
+		{"fail/remove-ssh-config", []string{"--remove-ssh-config", "--host-pattern", "*.example.com"}, "flag '--host-pattern' requires the '--ssh-config' flag"},
+		{"fail/remove-ssh-config-args", []string{"--remove-ssh-config", "--ssh-config", "~/.ssh/config", "--host-pattern", "*.example.com", "jane@example.com"}, "too many positional arguments"},
+		{"fail/ssh-config-host", []string{"--host", "--ssh-config", "~/.ssh/config", "--host-pattern", "*.example.com", "internal.example.com", "id_ecdsa"}, "flag '--ssh-config' is incompatible with '--host'"},
+		{"ok/backdate", []string{"--backdate", "5m", "--ttl", "1h", "jane@example.com", "id_ecdsa"}, ""},
+		{"fail/backdate-not-before", []string{"--backdate", "5m", "--not-before", "-1m", "jane@example.com", "id_ecdsa"}, "flag '--backdate' is incompatible with '--not-before'"},
+		{"fail/backdate-negative", []string{"--backdate", "-5m", "jane@example.com", "id_ecdsa"}, "must be a positive duration"},
+		{"ok/add-user-principal", []string{"--add-user", "--add-user-principal", "jdoe", "--add-user-out", "jdoe-admin", "jane@example.com", "id_ecdsa"}, ""},
+		{"ok/add-user-principal-same", []string{"--add-user", "--add-user-principal", "jdoe", "--principal", "jdoe", "jane@example.com", "id_ecdsa"}, ""},
+		{"fail/add-user-principal", []string{"--add-user-principal", "jdoe", "jane@example.com", "id_ecdsa"}, "flag '--add-user-principal' requires the '--add-user' flag"},
+		{"fail/add-user-out", []string{"--add-user-out", "jdoe-admin", "jane@example.com", "id_ecdsa"}, "flag '--add-user-out' requires the '--add-user' flag"},
+		{"fail/add-user-principal-principals", []string{"--add-user", "--add-user-principal", "jdoe", "--principal", "jane", "jane@example.com", "id_ecdsa"}, "flag '--add-user' is incompatible with more than one principal"},
+		{"ok/split-principals", []string{"--split-principals", "--principal", "acme", "--principal", "globex", "jane@example.com", "id_ecdsa"}, ""},
+		{"fail/split-principals", []string{"--split-principals", "jane@example.com", "id_ecdsa"}, "flag '--split-principals' requires the '--principal' flag"},
+		{"fail/split-principals-token", []string{"--split-principals", "--principal", "acme", "--token", "the-token", "jane@example.com", "id_ecdsa"}, "flag '--split-principals' is incompatible with '--token'"},
+		{"fail/split-principals-crt-out", []string{"--split-principals", "--principal", "acme", "--crt-out", "acme.pub", "jane@example.com", "id_ecdsa"}, "flag '--split-principals' is incompatible with '--crt-out'"},
+		{"fail/split-principals-path", []string{"--split-principals", "--principal", "../acme", "jane@example.com", "id_ecdsa"}, "principals used with '--split-principals' cannot contain path separators"},
+		{"ok/principals-from-host", []string{"--host", "--principals-from-host", "--exclude-principal", "localhost", "internal.example.com", "id_ecdsa"}, ""},
+		{"fail/args", []string{"jane@example.com"}, "not enough positional arguments"},
+		{"fail/identity-args", []string{"--identity", "id_ecdsa", "jane@example.com", "id_ecdsa"}, "too many positional arguments"},
+		{"fail/host-add-user", []string{"--host", "--add-user", "internal.example.com", "id_ecdsa"}, "flag '--host' is incompatible with '--add-user'"},
+		{"fail/host-id", []string{"--host-id", "machine", "jane@example.com", "id_ecdsa"}, "flag '--host-id' requires the '--host' flag"},
+		{"fail/host-id-value", []string{"--host", "--host-id", "foo", "internal.example.com", "id_ecdsa"}, "invalid value 'foo' for flag '--host-id'"},
+		{"fail/add-user-principals", []string{"--add-user", "--principal", "jane", "--principal", "john", "jane@example.com", "id_ecdsa"}, "flag '--add-user' is incompatible with more than one principal"},
+		{"fail/token-password-file", []string{"--token", "the-token", "--provisioner-password-file", "prov.pass", "jane@example.com", "id_ecdsa"}, "flag '--token' is incompatible with '--provisioner-password-file'"},
+		{"fail/token-password-stdin", []string{"--token", "the-token", "--provisioner-password-stdin", "jane@example.com", "id_ecdsa"}, "flag '--token' is incompatible with '--provisioner-password-stdin'"},
+		{"fail/no-password", []string{"--no-password", "jane@example.com", "id_ecdsa"}, "requires the '--insecure' flag"},
+		{"fail/no-password-file", []string{"--no-password", "--insecure", "--password-file", "key.pass", "jane@example.com", "id_ecdsa"}, "flag '--no-password' is incompatible with '--password-file'"},
+		{"fail/principals-from-host", []string{"--principals-from-host", "jane@example.com", "id_ecdsa"}, "flag '--principals-from-host' requires the '--host' flag"},
+		{"fail/exclude-principal", []string{"--host", "--exclude-principal", "localhost", "internal.example.com", "id_ecdsa"}, "flag '--exclude-principal' requires the '--principals-from-host' flag"},
+		{"fail/identity-sign", []string{"--identity", "id_ecdsa", "--sign", "jane@example.com"}, "flag '--identity' is incompatible with '--sign'"},
+		{"fail/identity-private-key", []string{"--identity", "id_ecdsa", "--private-key", "id_ecdsa", "jane@example.com"}, "flag '--identity' is incompatible with '--private-key'"},
+		{"fail/identity-no-password", []string{"--identity", "id_ecdsa", "--no-password", "--insecure", "jane@example.com"}, "flag '--identity' is incompatible with '--no-password'"},
+		{"fail/host-extensions", []string{"--host", "--no-pty", "internal.example.com", "id_ecdsa"}, "flag '--no-pty' is incompatible with '--host'"},
+		{"fail/sign-key-out", []string{"--sign", "--key-out", "/tmp/id_ecdsa", "jane@example.com", "id_ecdsa.pub"}, "flag '--sign' is incompatible with '--key-out'"},
+		{"fail/sign-pub-out", []string{"--sign", "--pub-out", "/tmp/id_ecdsa.pub", "jane@example.com", "id_ecdsa.pub"}, "flag '--sign' is incompatible with '--pub-out'"},
+		{"fail/identity-key-out", []string{"--identity", "id_ecdsa", "--key-out", "/tmp/id_ecdsa", "jane@example.com"}, "flag '--identity' is incompatible with '--key-out'"},
+		{"fail/kms-sign", []string{"--kms", "pkcs11:id=%01", "--sign", "jane@example.com", "id_ecdsa.pub"}, "flag '--kms' is incompatible with '--sign'"},
+		{"fail/kms-identity", []string{"--kms", "pkcs11:id=%01", "--identity", "id_ecdsa", "jane@example.com"}, "flag '--kms' is incompatible with '--identity'"},
+		{"fail/kms-private-key", []string{"--kms", "pkcs11:id=%01", "--private-key", "id_ecdsa", "jane@example.com", "id_ecdsa"}, "flag '--kms' is incompatible with '--private-key'"},
+		{"fail/kms-key-out", []string{"--kms", "pkcs11:id=%01", "--key-out", "/tmp/id_ecdsa", "jane@example.com", "id_ecdsa"}, "flag '--kms' is incompatible with '--key-out'"},
+		{"fail/kms-pub-out", []string{"--kms", "pkcs11:id=%01", "--pub-out", "/tmp/id_ecdsa.pub", "jane@example.com", "id_ecdsa"}, "flag '--kms' is incompatible with '--pub-out'"},
+		{"fail/kms-add-user", []string{"--kms", "pkcs11:id=%01", "--add-user", "jane@example.com", "id_ecdsa"}, "flag '--kms' is incompatible with '--add-user'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateCertificateFlags(newCertificateContext(t, tt.args...))
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.wantErr)
+				require.Equal(t, errs.UsageError, errs.GetClass(err))
+			}
+		})
+	}
+}
+
+func TestCertificateFiles(t *testing.T) {
+	tests := []struct {
+		name                             string
+		args                             []string
+		baseName, keyOut, pubOut, crtOut string
+	}{
+		{"default", []string{"jane@example.com", "id_ecdsa"}, "id_ecdsa", "id_ecdsa", "id_ecdsa.pub", "id_ecdsa-cert.pub"},
+		{"key-out", []string{"--key-out", "/run/id_ecdsa", "jane@example.com", "id_ecdsa"}, "/run/id_ecdsa", "/run/id_ecdsa", "id_ecdsa.pub", "id_ecdsa-cert.pub"},
+		{"pub-out", []string{"--pub-out", "/etc/id.pub", "jane@example.com", "id_ecdsa"}, "id_ecdsa", "id_ecdsa", "/etc/id.pub", "id_ecdsa-cert.pub"},
+		{"crt-out", []string{"--crt-out", "/etc/id-cert.pub", "jane@example.com", "id_ecdsa"}, "id_ecdsa", "id_ecdsa", "id_ecdsa.pub", "/etc/id-cert.pub"},
+		{"sign", []string{"--sign", "jane@example.com", "id_ecdsa.pub"}, "id_ecdsa", "id_ecdsa.pub", "id_ecdsa.pub", "id_ecdsa-cert.pub"},
+		{"sign/crt-out", []string{"--sign", "--crt-out", "/etc/id-cert.pub", "jane@example.com", "id_ecdsa.pub"}, "id_ecdsa", "id_ecdsa.pub", "id_ecdsa.pub", "/etc/id-cert.pub"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := newCertificateContext(t, tt.args...)
+			baseName, keyOut, pubOut, crtOut := certificateFiles(ctx, ctx.Args().Get(1))
+			require.Equal(t, tt.baseName, baseName)
+			require.Equal(t, tt.keyOut, keyOut)
+			require.Equal(t, tt.pubOut, pubOut)
+			require.Equal(t, tt.crtOut, crtOut)
+		})
+	}
+}
+
+func TestCreateOutputDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "step-ssh")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "id_ecdsa")
+	require.NoError(t, ioutil.WriteFile(file, []byte("not a directory"), 0600))
+	missing := filepath.Join(dir, "run", "ssh", "id_ecdsa")
+
+	require.NoError(t, createOutputDirs(newCertificateContext(t), file))
+	require.EqualError(t, createOutputDirs(newCertificateContext(t), filepath.Join(file, "id_ecdsa")),
+		"cannot write "+filepath.Join(file, "id_ecdsa")+": "+file+" is not a directory")
+	require.EqualError(t, createOutputDirs(newCertificateContext(t), missing),
+		"cannot write "+missing+": directory "+filepath.Dir(missing)+" does not exist, use '--force' to create it")
+
+	require.NoError(t, createOutputDirs(newCertificateContext(t, "--force"), missing))
+	fi, err := os.Stat(filepath.Dir(missing))
+	require.NoError(t, err)
+	require.True(t, fi.IsDir())
+}
@@ -75,6 +75,11 @@ List all the hosts you have access to:
 $ step ssh hosts
 '''
 
+Install a new host certificate in a remote server:
+'''
+$ step ssh install --force internal.example.com
+'''
+
 Login into one host:
 '''
 $ ssh internal.example.com
@@ -92,8 +97,10 @@ $ ssh internal.example.com
 			checkHostCommand(),
 			hostsCommand(),
 			renewCommand(),
+			resignCommand(),
 			revokeCommand(),
 			rekeyCommand(),
+			installCommand(),
 		},
 	}
 
@@ -110,6 +117,20 @@ var (
 		use the contents of the token to determine the principals.`,
 	}
 
+	sshPrincipalsFromHostFlag = cli.BoolFlag{
+		Name: "principals-from-host",
+		Usage: `Add the hostname, the fully qualified domain names and the IP addresses of
+the current host as principals of a host certificate. Loopback and IPv6
+link-local addresses are always excluded. The list of principals will be
+confirmed unless the **--force** flag is used.`,
+	}
+
+	sshExcludePrincipalFlag = cli.StringSliceFlag{
+		Name: "exclude-principal",
+		Usage: `Remove the specified principal from the ones found using
+**--principals-from-host**. This flag can be used multiple times.`,
+	}
+
 	sshHostFlag = cli.BoolFlag{
 		Name:  "host",
 		Usage: `Create a host certificate instead of a user certificate.`,
@@ -126,9 +147,22 @@ var (
 		Usage: `Sign the public key passed as an argument instead of creating one.`,
 	}
 
+	sshIdentityFlag = cli.StringFlag{
+		Name: "identity",
+		Usage: `Create a certificate for the existing private key in the given <key-file>, in
+PEM or OpenSSH format. The private key will be decrypted using the password in
+**--password-file** or asking for it. Only the certificate and, if it does not
+exist, the public key will be written. The command will fail if the existing
+public key does not match the private key.`,
+		// Avoid reading the identity from defaults.json, it is used with a
+		// different meaning in other commands.
+		EnvVar: command.IgnoreEnvVar,
+	}
+
 	sshPasswordFileFlag = cli.StringFlag{
-		Name:  "password-file",
-		Usage: `The path to the <file> containing the password to encrypt the private key.`,
+		Name: "password-file",
+		Usage: `The path to the <file> containing the password to encrypt the private key, or
+to decrypt it if the **--identity** flag is used.`,
 	}
 
 	sshProvisionerPasswordFlag = cli.StringFlag{
@@ -142,6 +176,15 @@ var (
 		Usage: `Create a user provisioner certificate used to create a new user.`,
 	}
 
+	sshAgentSocketFlag = cli.StringFlag{
+		Name: "agent-socket",
+		Usage: `The <path> of the unix socket or Windows named pipe used to connect to the SSH
+agent. It also supports agents listening on a TCP address using the format
+tcp://<host:port>. It overrides the SSH_AUTH_SOCK environment variable. On
+Windows, if the flag is not set, the OpenSSH agent named pipe is used before
+SSH_AUTH_SOCK.`,
+	}
+
 	sshPrivateKeyFlag = cli.StringFlag{
 		Name: "private-key",
 		Usage: `When signing an existing public key, use this flag to specify the corresponding
@@ -230,6 +273,66 @@ func loginOnUnauthorized(ctx *cli.Context) (ca.RetryFunc, error) {
 	}, nil
 }
 
+// dialAgent connects to the SSH agent using the socket in the --agent-socket
+// flag if present or the default mechanism of the platform.
+func dialAgent(ctx *cli.Context) (*sshutil.Agent, error) {
+	return sshutil.DialAgentSocket(ctx.String("agent-socket"))
+}
+
+// getUserCAKeys returns the keys used by the CA to sign user certificates. It
+// returns nil if the CA does not have them.
+func getUserCAKeys(ctx *cli.Context) ([]ssh.PublicKey, error) {
+	client, err := cautils.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := client.SSHRoots()
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting the ssh user CA keys")
+	}
+	if len(roots.UserKeys) == 0 {
+		return nil, nil
+	}
+	userKeys := make([]ssh.PublicKey, len(roots.UserKeys))
+	for i, uk := range roots.UserKeys {
+		userKeys[i] = uk.PublicKey
+	}
+	return userKeys, nil
+}
+
+// generateSSHKeyPair generates a new key pair using the default key type and
+// returns the SSH public key and the private key.
+func generateSSHKeyPair() (ssh.PublicKey, interface{}, error) {
+	pub, priv, err := keys.GenerateDefaultKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error creating public key")
+	}
+	return sshPub, priv, nil
+}
+
+// addCertificateToAgent adds the certificate and private key to the agent and
+// prints the result with the given name. It returns whether the certificate
+// was added.
+func addCertificateToAgent(agent *sshutil.Agent, name, subject string, cert *ssh.Certificate, priv interface{}) bool {
+	err := agent.AddCertificate(subject, cert, priv)
+	printAgentResult(name, err)
+	return err == nil
+}
+
+// printAgentResult prints the result of adding a certificate to the agent with
+// the given name.
+func printAgentResult(name string, err error) {
+	if err != nil {
+		ui.Printf(`{{ "%s" | red }} {{ "%s:" | bold }} %v`+"\n", ui.IconBad, name, err)
+	} else {
+		ui.PrintSelected(name, "yes")
+	}
+}
+
 // tokenHasEmail returns if the token payload has an email address. This is
 // mainly used on OIDC token.
 func tokenHasEmail(s string) (string, bool) {
@@ -0,0 +1,184 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/smallstep/cli/errs"
+	"github.com/smallstep/cli/utils"
+)
+
+// sshConfigMarker is the prefix of the lines surrounding the blocks managed
+// by step in the ssh client configuration.
+const sshConfigMarker = "step ssh certificate"
+
+// sshConfigIdentity contains the files used in the Host block of an ssh client
+// configuration.
+type sshConfigIdentity struct {
+	HostPattern     string
+	IdentityFile    string
+	CertificateFile string
+	// AddUserKey is the private key of the add user certificate, if set a
+	// ProxyCommand using the add user certificate is added. The certificate
+	// is "<AddUserKey>-cert.pub".
+	AddUserKey string
+	// AddUserLogin is the user of the add user certificate, if empty
+	// "provisioner" is used.
+	AddUserLogin string
+}
+
+// Block returns the Host block for the identity, without the markers.
+func (i sshConfigIdentity) Block() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Host %s\n", i.HostPattern)
+	if i.IdentityFile != "" {
+		fmt.Fprintf(&buf, "\tIdentityFile %s\n", quoteSSHConfig(i.IdentityFile))
+	}
+	fmt.Fprintf(&buf, "\tCertificateFile %s\n", quoteSSHConfig(i.CertificateFile))
+	if i.AddUserKey != "" {
+		login := i.AddUserLogin
+		if login == "" {
+			login = "provisioner"
+		}
+		// The inner ssh reads the same configuration and matches the same
+		// Host pattern, ProxyCommand=none avoids running it in a loop.
+		fmt.Fprintf(&buf, "\tProxyCommand ssh -i %s -o CertificateFile=%s -o IdentitiesOnly=yes -o ProxyCommand=none -p %%p %s@%%h\n",
+			quoteSSHConfig(i.AddUserKey), quoteSSHConfig(i.AddUserKey+"-cert.pub"), login)
+	}
+	return buf.Bytes()
+}
+
+// quoteSSHConfig quotes the given path if it contains spaces.
+func quoteSSHConfig(s string) string {
+	if strings.ContainsAny(s, " \t") {
+		return `"` + s + `"`
+	}
+	return s
+}
+
+func sshConfigMarkers(pattern string) (string, string) {
+	return "# BEGIN " + sshConfigMarker + " " + pattern, "# END " + sshConfigMarker + " " + pattern
+}
+
+// findSSHConfigBlock returns the offsets of the managed block for the given
+// pattern, including the markers. It returns -1 if the block is not found.
+func findSSHConfigBlock(data []byte, pattern string) (int, int) {
+	begin, end := sshConfigMarkers(pattern)
+	var start, offset int
+	inBlock := false
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		s := strings.TrimSpace(string(line))
+		switch {
+		case !inBlock && s == begin:
+			start, inBlock = offset, true
+		case inBlock && s == end:
+			return start, offset + len(line)
+		}
+		offset += len(line)
+	}
+	return -1, -1
+}
+
+// updateSSHConfigBlock replaces the managed block for the given pattern with
+// the given block, or appends it if it does not exist.
+func updateSSHConfigBlock(data []byte, pattern string, block []byte) []byte {
+	begin, end := sshConfigMarkers(pattern)
+	var buf bytes.Buffer
+	buf.WriteString(begin + "\n")
+	buf.Write(block)
+	buf.WriteString(end + "\n")
+
+	start, stop := findSSHConfigBlock(data, pattern)
+	if start < 0 {
+		out := append([]byte{}, data...)
+		if len(out) > 0 && !bytes.HasSuffix(out, []byte("\n")) {
+			out = append(out, '\n')
+		}
+		if len(out) > 0 {
+			out = append(out, '\n')
+		}
+		return append(out, buf.Bytes()...)
+	}
+	out := append([]byte{}, data[:start]...)
+	out = append(out, buf.Bytes()...)
+	return append(out, data[stop:]...)
+}
+
+// removeSSHConfigBlock removes the managed block for the given pattern. It
+// returns false if the block does not exist.
+func removeSSHConfigBlock(data []byte, pattern string) ([]byte, bool) {
+	start, stop := findSSHConfigBlock(data, pattern)
+	if start < 0 {
+		return data, false
+	}
+	// Remove the empty line added before the block
+	if start > 1 && data[start-1] == '\n' && data[start-2] == '\n' {
+		start--
+	}
+	out := append([]byte{}, data[:start]...)
+	return append(out, data[stop:]...), true
+}
+
+// readSSHConfig returns the contents and permissions of the given ssh client
+// configuration. A missing file is empty with 0600 permissions. The group and
+// world write permissions are always removed, ssh refuses to use the file
+// with them.
+func readSSHConfig(filename string) ([]byte, os.FileMode, bool, error) {
+	st, err := os.Stat(filename)
+	switch {
+	case os.IsNotExist(err):
+		return nil, 0600, false, nil
+	case err != nil:
+		return nil, 0, false, errs.FileError(err, filename)
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, 0, false, errs.FileError(err, filename)
+	}
+	return b, st.Mode().Perm() &^ 0022, true, nil
+}
+
+// writeSSHConfig writes the new contents of the ssh client configuration. If
+// the file existed, the previous contents are kept in "<filename>.bak".
+func writeSSHConfig(filename string, old, data []byte, perm os.FileMode, exists bool) error {
+	if exists {
+		if err := utils.WriteFileAtomic(filename+".bak", old, 0600); err != nil {
+			return err
+		}
+	} else if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return errs.FileError(err, filepath.Dir(filename))
+	}
+	return utils.WriteFileAtomic(filename, data, perm)
+}
+
+// addSSHConfig adds or updates the Host block for the given identity in the
+// ssh client configuration.
+func addSSHConfig(filename string, id sshConfigIdentity) error {
+	b, perm, exists, err := readSSHConfig(filename)
+	if err != nil {
+		return err
+	}
+	data := updateSSHConfigBlock(b, id.HostPattern, id.Block())
+	if exists && bytes.Equal(b, data) {
+		return nil
+	}
+	return writeSSHConfig(filename, b, data, perm, exists)
+}
+
+// removeSSHConfig removes the Host block for the given pattern from the ssh
+// client configuration. It returns false if the block does not exist.
+func removeSSHConfig(filename, pattern string) (bool, error) {
+	b, perm, exists, err := readSSHConfig(filename)
+	if err != nil || !exists {
+		return false, err
+	}
+	data, ok := removeSSHConfigBlock(b, pattern)
+	if !ok {
+		return false, nil
+	}
+	return true, writeSSHConfig(filename, b, data, perm, exists)
+}
@@ -0,0 +1,116 @@
+package ssh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSHConfigIdentity_Block(t *testing.T) {
+	id := sshConfigIdentity{
+		HostPattern:     "*.example.com",
+		IdentityFile:    "/home/jane/.ssh/id_ecdsa",
+		CertificateFile: "/home/jane/.ssh/id_ecdsa-cert.pub",
+	}
+	require.Equal(t, "Host *.example.com\n\tIdentityFile /home/jane/.ssh/id_ecdsa\n\tCertificateFile /home/jane/.ssh/id_ecdsa-cert.pub\n", string(id.Block()))
+
+	id.IdentityFile = ""
+	id.CertificateFile = "/home/jane/My Keys/id_ecdsa-cert.pub"
+	id.AddUserKey = "/home/jane/.ssh/id_ecdsa-provisioner"
+	require.Equal(t, "Host *.example.com\n\tCertificateFile \"/home/jane/My Keys/id_ecdsa-cert.pub\"\n"+
+		"\tProxyCommand ssh -i /home/jane/.ssh/id_ecdsa-provisioner -o CertificateFile=/home/jane/.ssh/id_ecdsa-provisioner-cert.pub -o IdentitiesOnly=yes -o ProxyCommand=none -p %p provisioner@%h\n", string(id.Block()))
+
+	// The inner ssh must not run the ProxyCommand again
+	require.Contains(t, string(id.Block()), " -o ProxyCommand=none ")
+
+	id.AddUserKey = "/home/jane/.ssh/acme-admin"
+	id.AddUserLogin = "admin"
+	require.Equal(t, "Host *.example.com\n\tCertificateFile \"/home/jane/My Keys/id_ecdsa-cert.pub\"\n"+
+		"\tProxyCommand ssh -i /home/jane/.ssh/acme-admin -o CertificateFile=/home/jane/.ssh/acme-admin-cert.pub -o IdentitiesOnly=yes -o ProxyCommand=none -p %p admin@%h\n", string(id.Block()))
+}
+
+func TestUpdateSSHConfigBlock(t *testing.T) {
+	block := []byte("Host *.example.com\n\tCertificateFile id_ecdsa-cert.pub\n")
+	managed := "# BEGIN step ssh certificate *.example.com\nHost *.example.com\n\tCertificateFile id_ecdsa-cert.pub\n# END step ssh certificate *.example.com\n"
+
+	// Empty file
+	got := updateSSHConfigBlock(nil, "*.example.com", block)
+	require.Equal(t, managed, string(got))
+
+	// Append
+	config := "Host bastion\n\tUser jane"
+	got = updateSSHConfigBlock([]byte(config), "*.example.com", block)
+	require.Equal(t, config+"\n\n"+managed, string(got))
+
+	// Update in place
+	updated := updateSSHConfigBlock(got, "*.example.com", []byte("Host *.example.com\n\tCertificateFile other-cert.pub\n"))
+	require.Equal(t, config+"\n\n# BEGIN step ssh certificate *.example.com\nHost *.example.com\n\tCertificateFile other-cert.pub\n# END step ssh certificate *.example.com\n", string(updated))
+	require.Equal(t, string(got), string(updateSSHConfigBlock(got, "*.example.com", block)))
+
+	// Other patterns are not modified
+	other := updateSSHConfigBlock(got, "*.internal", []byte("Host *.internal\n"))
+	require.Equal(t, string(got)+"\n# BEGIN step ssh certificate *.internal\nHost *.internal\n# END step ssh certificate *.internal\n", string(other))
+
+	// Remove
+	removed, ok := removeSSHConfigBlock(other, "*.internal")
+	require.True(t, ok)
+	require.Equal(t, string(got), string(removed))
+	removed, ok = removeSSHConfigBlock(removed, "*.example.com")
+	require.True(t, ok)
+	require.Equal(t, config+"\n", string(removed))
+	_, ok = removeSSHConfigBlock(removed, "*.example.com")
+	require.False(t, ok)
+}
+
+func TestAddSSHConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "step-ssh-config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, ".ssh", "config")
+	id := sshConfigIdentity{
+		HostPattern:     "*.example.com",
+		IdentityFile:    filepath.Join(dir, "id_ecdsa"),
+		CertificateFile: filepath.Join(dir, "id_ecdsa-cert.pub"),
+	}
+
+	// New file without backup
+	require.NoError(t, addSSHConfig(filename, id))
+	b, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	require.Contains(t, string(b), "\tIdentityFile "+id.IdentityFile+"\n")
+	_, err = os.Stat(filename + ".bak")
+	require.True(t, os.IsNotExist(err))
+
+	// Existing file with insecure permissions
+	require.NoError(t, ioutil.WriteFile(filename, []byte("Host bastion\n"), 0666))
+	require.NoError(t, os.Chmod(filename, 0666))
+	require.NoError(t, addSSHConfig(filename, id))
+	b, err = ioutil.ReadFile(filename + ".bak")
+	require.NoError(t, err)
+	require.Equal(t, "Host bastion\n", string(b))
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(filename)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0644), fi.Mode().Perm())
+	}
+
+	// Remove the block
+	ok, err := removeSSHConfig(filename, "*.example.com")
+	require.NoError(t, err)
+	require.True(t, ok)
+	b, err = ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, "Host bastion\n", string(b))
+
+	ok, err = removeSSHConfig(filename, "*.example.com")
+	require.NoError(t, err)
+	require.False(t, ok)
+	ok, err = removeSSHConfig(filepath.Join(dir, "missing"), "*.example.com")
+	require.NoError(t, err)
+	require.False(t, ok)
+}
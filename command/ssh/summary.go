@@ -0,0 +1,153 @@
+package ssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/cli/ui"
+	"golang.org/x/crypto/ssh"
+)
+
+// certificateSummary contains the properties of an issued certificate. It is
+// always created from the certificate returned by the CA, so any change made
+// by the CA to the requested values is visible.
+type certificateSummary struct {
+	KeyID           string            `json:"keyID"`
+	RequestedKeyID  string            `json:"requestedKeyID,omitempty"`
+	Serial          uint64            `json:"serial,string"`
+	Type            string            `json:"type"`
+	Principals      []string          `json:"principals"`
+	ValidAfter      time.Time         `json:"validAfter"`
+	ValidBefore     *time.Time        `json:"validBefore"`
+	CriticalOptions map[string]string `json:"criticalOptions"`
+	Extensions      map[string]string `json:"extensions"`
+	Files           map[string]string `json:"files,omitempty"`
+	now             time.Time
+}
+
+// newCertificateSummary creates a certificateSummary for the given certificate.
+func newCertificateSummary(cert *ssh.Certificate) *certificateSummary {
+	var certType string
+	switch cert.CertType {
+	case ssh.UserCert:
+		certType = "user"
+	case ssh.HostCert:
+		certType = "host"
+	default:
+		certType = "unknown"
+	}
+
+	s := &certificateSummary{
+		KeyID:           cert.KeyId,
+		Serial:          cert.Serial,
+		Type:            certType,
+		Principals:      cert.ValidPrincipals,
+		ValidAfter:      time.Unix(int64(cert.ValidAfter), 0),
+		CriticalOptions: cert.CriticalOptions,
+		Extensions:      cert.Extensions,
+		now:             time.Now(),
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		t := time.Unix(int64(cert.ValidBefore), 0)
+		s.ValidBefore = &t
+	}
+	if s.Principals == nil {
+		s.Principals = []string{}
+	}
+	if s.CriticalOptions == nil {
+		s.CriticalOptions = map[string]string{}
+	}
+	if s.Extensions == nil {
+		s.Extensions = map[string]string{}
+	}
+	return s
+}
+
+// SetRequestedKeyID sets the key id sent to the CA if it was rewritten by it.
+func (s *certificateSummary) SetRequestedKeyID(keyID string) {
+	if keyID != s.KeyID {
+		s.RequestedKeyID = keyID
+	}
+}
+
+// AddFile adds an output file to the summary.
+func (s *certificateSummary) AddFile(name, filename string) {
+	if s.Files == nil {
+		s.Files = make(map[string]string)
+	}
+	s.Files[name] = filename
+}
+
+// Remaining returns a human version of the time until the certificate
+// expires.
+func (s *certificateSummary) Remaining() string {
+	switch {
+	case s.ValidBefore == nil:
+		return "forever"
+	case !s.ValidBefore.After(s.now):
+		return "expired"
+	case s.ValidAfter.After(s.now):
+		return fmt.Sprintf("not yet valid, starts in %s", s.ValidAfter.Sub(s.now).Round(time.Second))
+	default:
+		return fmt.Sprintf("expires in %s", s.ValidBefore.Sub(s.now).Round(time.Second))
+	}
+}
+
+// Print prints the summary using the ui package.
+func (s *certificateSummary) Print() {
+	if s.RequestedKeyID != "" {
+		ui.PrintSelected("Key ID", fmt.Sprintf("%s (requested %s)", s.KeyID, s.RequestedKeyID))
+	} else {
+		ui.PrintSelected("Key ID", s.KeyID)
+	}
+	ui.PrintSelected("Serial", fmt.Sprintf("%d", s.Serial))
+	ui.PrintSelected("Type", s.Type)
+	ui.PrintSelected("Principals", formatList(s.Principals))
+	ui.PrintSelected("Valid After", s.ValidAfter.Local().Format(time.RFC3339))
+	if s.ValidBefore == nil {
+		ui.PrintSelected("Valid Before", "forever")
+	} else {
+		ui.PrintSelected("Valid Before", fmt.Sprintf("%s (%s)", s.ValidBefore.Local().Format(time.RFC3339), s.Remaining()))
+	}
+	ui.PrintSelected("Critical Options", formatMap(s.CriticalOptions))
+	ui.PrintSelected("Extensions", formatMap(s.Extensions))
+}
+
+// printJSON prints the given value as indented JSON in the standard output.
+func printJSON(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "error marshaling summary")
+	}
+	fmt.Fprintln(os.Stdout, string(b))
+	return nil
+}
+
+func formatList(values []string) string {
+	if len(values) == 0 {
+		return "(none)"
+	}
+	return strings.Join(values, ", ")
+}
+
+func formatMap(m map[string]string) string {
+	if len(m) == 0 {
+		return "(none)"
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		if v := m[k]; v != "" {
+			keys[i] = k + "=" + v
+		}
+	}
+	return strings.Join(keys, ", ")
+}
@@ -0,0 +1,86 @@
+package ssh
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCertificateSummary(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	cert := &ssh.Certificate{
+		Serial:          1234,
+		CertType:        ssh.UserCert,
+		KeyId:           "jane@example.com",
+		ValidPrincipals: []string{"jane", "jane@example.com"},
+		ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(now.Add(2 * time.Hour).Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: map[string]string{
+				"permit-pty":              "",
+				"permit-agent-forwarding": "",
+			},
+		},
+	}
+
+	s := newCertificateSummary(cert)
+	s.now = now
+	s.AddFile("certificate", "id_ecdsa-cert.pub")
+	require.Equal(t, "jane@example.com", s.KeyID)
+	require.Equal(t, uint64(1234), s.Serial)
+	require.Equal(t, "user", s.Type)
+	require.Equal(t, []string{"jane", "jane@example.com"}, s.Principals)
+	require.Equal(t, now.Add(-time.Minute), s.ValidAfter)
+	require.Equal(t, now.Add(2*time.Hour), *s.ValidBefore)
+	require.Equal(t, "expires in 2h0m0s", s.Remaining())
+	require.Equal(t, "permit-agent-forwarding, permit-pty", formatMap(s.Extensions))
+	require.Equal(t, "(none)", formatMap(s.CriticalOptions))
+
+	b, err := json.Marshal(s)
+	require.NoError(t, err)
+	var m map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &m))
+	require.Equal(t, "1234", m["serial"])
+	require.Equal(t, "user", m["type"])
+	require.Equal(t, map[string]interface{}{"certificate": "id_ecdsa-cert.pub"}, m["files"])
+	require.Equal(t, map[string]interface{}{}, m["criticalOptions"])
+	require.NotContains(t, m, "requestedKeyID")
+
+	// Key id rewritten by the CA
+	s.SetRequestedKeyID("jane@example.com")
+	require.Empty(t, s.RequestedKeyID)
+	s.SetRequestedKeyID("jane")
+	b, err = json.Marshal(s)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(b, &m))
+	require.Equal(t, "jane", m["requestedKeyID"])
+	require.Equal(t, "jane@example.com", m["keyID"])
+
+	// Host certificate valid forever
+	s = newCertificateSummary(&ssh.Certificate{
+		CertType:    ssh.HostCert,
+		ValidBefore: ssh.CertTimeInfinity,
+	})
+	require.Equal(t, "host", s.Type)
+	require.Nil(t, s.ValidBefore)
+	require.Equal(t, "forever", s.Remaining())
+	require.Equal(t, []string{}, s.Principals)
+
+	// Expired and not yet valid certificates
+	s = newCertificateSummary(&ssh.Certificate{
+		ValidAfter:  uint64(now.Add(-2 * time.Hour).Unix()),
+		ValidBefore: uint64(now.Add(-time.Hour).Unix()),
+	})
+	s.now = now
+	require.Equal(t, "unknown", s.Type)
+	require.Equal(t, "expired", s.Remaining())
+	s = newCertificateSummary(&ssh.Certificate{
+		ValidAfter:  uint64(now.Add(time.Hour).Unix()),
+		ValidBefore: uint64(now.Add(2 * time.Hour).Unix()),
+	})
+	s.now = now
+	require.Equal(t, "not yet valid, starts in 1h0m0s", s.Remaining())
+}
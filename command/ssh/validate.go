@@ -0,0 +1,208 @@
+package ssh
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/cli/errs"
+	"github.com/smallstep/cli/ui"
+	"golang.org/x/crypto/ssh"
+)
+
+// stdinIsTerminal returns true if the standard input is a terminal, the
+// confirmation of a certificate request is skipped if it is not.
+var stdinIsTerminal = ui.IsTerminal
+
+// errWildcardPrincipal is the error returned for host principals with
+// wildcards. OpenSSH compares host principals literally, so a principal like
+// "*.example.com" only matches a host with that name.
+var errWildcardPrincipal = errors.New("OpenSSH does not expand wildcards in host principals")
+
+// normalizeHostPrincipal checks that the given principal is a hostname or an IP
+// address and returns it in the form used by ssh to compare it. IP addresses
+// are returned verbatim, hostnames are lowercased and the trailing dot of a
+// fully qualified name is removed. Principals with the wildcards '*' or '?' are
+// an error unless insecure is true.
+func normalizeHostPrincipal(p string, insecure bool) (string, error) {
+	if net.ParseIP(p) != nil {
+		return p, nil
+	}
+	// Names like "10.0.0.256" are not hostnames, top level domains are never
+	// numeric.
+	name := strings.ToLower(strings.TrimSuffix(p, "."))
+	if strings.Contains(p, ":") || isNumeric(name[strings.LastIndex(name, ".")+1:]) {
+		return "", errors.Errorf("principal '%s' is not a valid IP address", p)
+	}
+	if name == "" || len(name) > 253 {
+		return "", errors.Errorf("principal '%s' is not a valid hostname", p)
+	}
+	hasWildcards := strings.ContainsAny(name, "*?")
+	for _, label := range strings.Split(name, ".") {
+		if hasWildcards {
+			label = wildcardReplacer.Replace(label)
+		}
+		if !isHostnameLabel(label) {
+			return "", errors.Errorf("principal '%s' is not a valid hostname or IP address", p)
+		}
+	}
+	if hasWildcards && !insecure {
+		return "", errors.Wrapf(errWildcardPrincipal, "principal '%s' is not valid", p)
+	}
+	return name, nil
+}
+
+// isNumeric returns true if s is not empty and it only contains digits.
+func isNumeric(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// wildcardReplacer replaces the wildcards of a label with a valid character.
+var wildcardReplacer = strings.NewReplacer("*", "x", "?", "x")
+
+// isHostnameLabel returns true if s is a valid label of a hostname. It allows
+// underscores, used in some internal names.
+func isHostnameLabel(s string) bool {
+	if s == "" || len(s) > 63 || s[0] == '-' || s[len(s)-1] == '-' {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validateUserPrincipal checks that the given principal is a POSIX user name,
+// using the portable filename character set and not starting with a hyphen.
+// Principals with the format user@domain are also allowed, the domain must be
+// a valid hostname.
+func validateUserPrincipal(p string) error {
+	name := p
+	if i := strings.LastIndex(p, "@"); i >= 0 {
+		domain := p[i+1:]
+		for _, label := range strings.Split(domain, ".") {
+			if !isHostnameLabel(label) {
+				return errors.Errorf("principal '%s' is not a valid user name", p)
+			}
+		}
+		name = p[:i]
+	}
+	if name == "" || name[0] == '-' {
+		return errors.Errorf("principal '%s' is not a valid user name", p)
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '_', c == '-':
+		default:
+			return errors.Errorf("principal '%s' is not a valid user name", p)
+		}
+	}
+	return nil
+}
+
+// normalizePrincipals validates the given principals before a token is
+// generated and returns the list used in the token and the sign request. Host
+// principals are normalized with normalizeHostPrincipal and they are always an
+// error if they are not valid, wildcards are only a warning if insecure is
+// true. Invalid user principals are only a warning if insecure is true, and
+// they are returned unchanged.
+func normalizePrincipals(principals []string, isHost, insecure bool) ([]string, error) {
+	result := make([]string, 0, len(principals))
+	for _, p := range principals {
+		if isHost {
+			name, err := normalizeHostPrincipal(p, insecure)
+			switch {
+			case errors.Cause(err) == errWildcardPrincipal:
+				return nil, errs.NewClassError(errs.UsageError, errors.Wrap(err, "use '--insecure' to allow it"))
+			case err != nil:
+				return nil, errs.NewClassError(errs.UsageError, err)
+			}
+			if strings.ContainsAny(name, "*?") {
+				ui.Printf(`{{ "%s" | yellow }} {{ "Principals:" | bold }} principal '%s' has wildcards, %s`+"\n", ui.IconWarn, p, errWildcardPrincipal)
+			}
+			result = append(result, name)
+			continue
+		}
+		if err := validateUserPrincipal(p); err != nil {
+			if !insecure {
+				return nil, errs.NewClassError(errs.UsageError, errors.Wrap(err, "use '--insecure' to allow it"))
+			}
+			ui.Printf(`{{ "%s" | yellow }} {{ "Principals:" | bold }} %v`+"\n", ui.IconWarn, err)
+		}
+		result = append(result, p)
+	}
+	return result, nil
+}
+
+// confirmSignRequest prints the values that will be requested to the CA and
+// asks the user to confirm them. It returns an error if they are not
+// accepted.
+func confirmSignRequest(opts SignOptions) error {
+	certType := "user"
+	if opts.CertType == provisioner.SSHHostCert {
+		certType = "host"
+	}
+	ui.PrintSelected("Subject", opts.Subject)
+	ui.PrintSelected("Type", certType)
+	ui.PrintSelected("Principals", formatList(opts.Principals))
+	ui.PrintSelected("Valid After", formatTimeDuration(opts.ValidAfter, "now"))
+	ui.PrintSelected("Valid Before", formatTimeDuration(opts.ValidBefore, "provisioner default"))
+	ok, err := ui.PromptYesNo("Would you like to request this certificate? [y/n]")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("certificate request not accepted: use '--principal', '--not-before' or '--not-after' to change it")
+	}
+	return nil
+}
+
+// formatTimeDuration returns the local time of t, or def if t is not set. The
+// argument is a copy, so a relative duration is not fixed to the current time
+// in the original value.
+func formatTimeDuration(t provisioner.TimeDuration, def string) string {
+	if t.IsZero() {
+		return def
+	}
+	return t.Time().Local().Format(time.RFC3339)
+}
+
+// checkClockSkew compares the validity of a certificate issued by the CA with
+// the local clock. It returns a warning if the certificate is not valid yet, or
+// it has already expired, by more than the given tolerance. The CA uses its own
+// clock for the default validity, so this usually means that the clocks differ.
+func checkClockSkew(cert *ssh.Certificate, now time.Time, tolerance time.Duration) []string {
+	var warnings []string
+	validAfter := time.Unix(int64(cert.ValidAfter), 0)
+	if d := validAfter.Sub(now); d > tolerance {
+		warnings = append(warnings, fmt.Sprintf("the certificate is not valid until %s, %s from now; "+
+			"the local clock might be behind the CA, use '--backdate' to request a certificate that is valid now",
+			validAfter.Local().Format(time.RFC3339), d.Round(time.Second)))
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		validBefore := time.Unix(int64(cert.ValidBefore), 0)
+		if d := now.Sub(validBefore); d > tolerance {
+			warnings = append(warnings, fmt.Sprintf("the certificate expired at %s, %s ago; "+
+				"the local clock might be ahead of the CA",
+				validBefore.Local().Format(time.RFC3339), d.Round(time.Second)))
+		}
+	}
+	return warnings
+}
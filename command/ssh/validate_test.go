@@ -0,0 +1,139 @@
+package ssh
+
+import (
+	"testing"
+	"time"
+
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/cli/errs"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestNormalizeHostPrincipal(t *testing.T) {
+	tests := []struct {
+		principal string
+		insecure  bool
+		want      string
+		wantErr   string
+	}{
+		{"internal.example.com", false, "internal.example.com", ""},
+		{"host_1.internal", false, "host_1.internal", ""},
+		{"Web01.Example.COM", false, "web01.example.com", ""},
+		{"web01.example.com.", false, "web01.example.com", ""},
+		{"Web01.Example.COM.", false, "web01.example.com", ""},
+		{"10.0.0.1", false, "10.0.0.1", ""},
+		{"2001:db8::1", false, "2001:db8::1", ""},
+		{"2001:DB8::1", false, "2001:DB8::1", ""},
+		{"::ffff:10.0.0.1", false, "::ffff:10.0.0.1", ""},
+		{"*.example.com", true, "*.example.com", ""},
+		{"Web??.Example.com", true, "web??.example.com", ""},
+		{"*.example.com", false, "", "principal '*.example.com' is not valid: OpenSSH does not expand wildcards in host principals"},
+		{"web?.example.com", false, "", "principal 'web?.example.com' is not valid: OpenSSH does not expand wildcards in host principals"},
+		{"*", false, "", "principal '*' is not valid: OpenSSH does not expand wildcards in host principals"},
+		{"", false, "", "principal '' is not a valid hostname"},
+		{".", false, "", "principal '.' is not a valid hostname"},
+		{"internal example.com", false, "", "principal 'internal example.com' is not a valid hostname or IP address"},
+		{"internal..example.com", false, "", "principal 'internal..example.com' is not a valid hostname or IP address"},
+		{"internal.example.com..", false, "", "principal 'internal.example.com..' is not a valid hostname or IP address"},
+		{"-internal.example.com", false, "", "principal '-internal.example.com' is not a valid hostname or IP address"},
+		{"*.exa mple.com", true, "", "principal '*.exa mple.com' is not a valid hostname or IP address"},
+		{"10.0.0.256", false, "", "principal '10.0.0.256' is not a valid IP address"},
+		{"10.0.0.1.", false, "", "principal '10.0.0.1.' is not a valid IP address"},
+		{"10.example.com", false, "10.example.com", ""},
+		{"2001:db8::g", false, "", "principal '2001:db8::g' is not a valid IP address"},
+		{"[2001:db8::1]", false, "", "principal '[2001:db8::1]' is not a valid IP address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.principal, func(t *testing.T) {
+			got, err := normalizeHostPrincipal(tt.principal, tt.insecure)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestValidateUserPrincipal(t *testing.T) {
+	for _, p := range []string{"jane", "jane.doe", "_svc-deploy", "Jane", "jane@example.com"} {
+		require.NoError(t, validateUserPrincipal(p), p)
+	}
+	for _, p := range []string{"", "-jane", "jane doe", "jane:x", "jane@", "@example.com", "jane@exa mple.com", "jäne"} {
+		require.Error(t, validateUserPrincipal(p), p)
+	}
+}
+
+func TestNormalizePrincipals(t *testing.T) {
+	got, err := normalizePrincipals([]string{"Internal.Example.com.", "Internal", "10.0.0.1", "2001:db8::1"}, true, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"internal.example.com", "internal", "10.0.0.1", "2001:db8::1"}, got)
+
+	// User principals are not modified
+	got, err = normalizePrincipals([]string{"Jane", "jane@example.com"}, false, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"Jane", "jane@example.com"}, got)
+
+	_, err = normalizePrincipals([]string{"internal example.com"}, true, true)
+	require.Error(t, err)
+	require.Equal(t, errs.UsageError, errs.GetClass(err))
+
+	_, err = normalizePrincipals([]string{"internal.example.com", "*.example.com"}, true, false)
+	require.EqualError(t, err, "use '--insecure' to allow it: principal '*.example.com' is not valid: OpenSSH does not expand wildcards in host principals")
+	require.Equal(t, errs.UsageError, errs.GetClass(err))
+	got, err = normalizePrincipals([]string{"*.Example.com"}, true, true)
+	require.NoError(t, err)
+	require.Equal(t, []string{"*.example.com"}, got)
+
+	_, err = normalizePrincipals([]string{"jane doe"}, false, false)
+	require.EqualError(t, err, "use '--insecure' to allow it: principal 'jane doe' is not a valid user name")
+	require.Equal(t, errs.UsageError, errs.GetClass(err))
+	got, err = normalizePrincipals([]string{"jane doe"}, false, true)
+	require.NoError(t, err)
+	require.Equal(t, []string{"jane doe"}, got)
+}
+
+func TestFormatTimeDuration(t *testing.T) {
+	require.Equal(t, "now", formatTimeDuration(provisioner.TimeDuration{}, "now"))
+
+	notBefore := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	require.Equal(t, notBefore.Local().Format(time.RFC3339), formatTimeDuration(provisioner.NewTimeDuration(notBefore), "now"))
+
+	// Relative values are not fixed in the original
+	d, err := provisioner.ParseTimeDuration("1h")
+	require.NoError(t, err)
+	require.NotEqual(t, "now", formatTimeDuration(d, "now"))
+	require.Equal(t, time.Time{}, d.RelativeTime(time.Time{}).Add(-time.Hour))
+}
+
+func TestCheckClockSkew(t *testing.T) {
+	now := time.Now()
+	unix := func(d time.Duration) uint64 {
+		return uint64(now.Add(d).Unix())
+	}
+	tests := []struct {
+		name        string
+		validAfter  uint64
+		validBefore uint64
+		want        []string
+	}{
+		{"ok", unix(0), unix(time.Hour), nil},
+		{"ok/tolerance", unix(50 * time.Second), unix(time.Hour), nil},
+		{"ok/forever", unix(0), ssh.CertTimeInfinity, nil},
+		{"ok/expired-tolerance", unix(-time.Hour), unix(-50 * time.Second), nil},
+		{"fail/not-yet-valid", unix(5 * time.Minute), unix(time.Hour), []string{"not valid until"}},
+		{"fail/expired", unix(-2 * time.Hour), unix(-time.Hour), []string{"expired at"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert := &ssh.Certificate{ValidAfter: tt.validAfter, ValidBefore: tt.validBefore}
+			got := checkClockSkew(cert, now, time.Minute)
+			require.Len(t, got, len(tt.want))
+			for i := range tt.want {
+				require.Contains(t, got[i], tt.want[i])
+			}
+		})
+	}
+}
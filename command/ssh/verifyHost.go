@@ -0,0 +1,224 @@
+package ssh
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/cli/crypto/sshutil"
+	"github.com/smallstep/cli/errs"
+	"github.com/smallstep/cli/ui"
+	"github.com/smallstep/cli/utils"
+	"github.com/smallstep/cli/utils/cautils"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
+)
+
+// errHostKeyCaptured is used to stop the SSH handshake once the host key has
+// been received.
+var errHostKeyCaptured = errors.New("host key captured")
+
+// errNoHostCertificate is returned if the server presents a plain host key.
+var errNoHostCertificate = errors.New("the server presented a host key without a certificate")
+
+// hostKeyAlgorithms are the host key algorithms offered to the server: the
+// certificates first, so the server presents them if it has one.
+var hostKeyAlgorithms = []string{
+	ssh.CertAlgoED25519v01, ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01,
+	ssh.CertAlgoECDSA521v01, ssh.CertAlgoRSAv01,
+	ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA521, ssh.KeyAlgoRSA,
+}
+
+// hostCheck is the result of one of the checks of a host certificate.
+type hostCheck struct {
+	Name    string
+	Message string
+	Err     error
+}
+
+func verifyHostAction(ctx *cli.Context) error {
+	host, addr, err := splitHostPort(ctx.Args().First())
+	if err != nil {
+		return errs.NewClassError(errs.UsageError, errors.Wrap(err, "invalid positional argument <hostname[:port]>"))
+	}
+
+	caKeys, err := getHostCAKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	key, err := dialHostKey(addr, hostKeyAlgorithms, ctx.Duration("timeout"))
+	if err != nil {
+		return err
+	}
+
+	checks, err := verifyHostCertificate(key, host, caKeys, time.Now())
+	for _, c := range checks {
+		if c.Err != nil {
+			ui.Printf(`{{ "%s" | red }} {{ "%s:" | bold }} %v`+"\n", ui.IconBad, c.Name, c.Err)
+		} else {
+			ui.Printf(`{{ "%s" | green }} {{ "%s:" | bold }} %s`+"\n", ui.IconGood, c.Name, c.Message)
+		}
+	}
+	if ctx.Bool("verbose") {
+		fmt.Println(err == nil)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "host %s failed verification", addr)
+	}
+	return nil
+}
+
+// splitHostPort returns the hostname and the address with the port of the
+// given hostname[:port] string.
+func splitHostPort(s string) (string, string, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		// No port
+		host, port = s, "22"
+		if ip := net.ParseIP(s); ip == nil && strings.Contains(s, ":") {
+			return "", "", errors.Errorf("%s is not a valid hostname", s)
+		}
+	}
+	if host == "" {
+		return "", "", errors.New("hostname cannot be empty")
+	}
+	return host, net.JoinHostPort(host, port), nil
+}
+
+// getHostCAKeys returns the host CA keys in the --ca-key file or the ones
+// retrieved from the CA.
+func getHostCAKeys(ctx *cli.Context) ([]ssh.PublicKey, error) {
+	if filename := ctx.String("ca-key"); filename != "" {
+		b, err := utils.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := sshutil.ParseAuthorizedKeys(b)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing %s", filename)
+		}
+		return keys, nil
+	}
+
+	client, err := cautils.NewClient(ctx)
+	if err != nil {
+		return nil, contactAdminErr(errors.Wrap(err, "error generating ca client"))
+	}
+	roots, err := client.SSHRoots()
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting the ssh host CA keys")
+	}
+	if len(roots.HostKeys) == 0 {
+		return nil, errors.New("the CA does not have any ssh host CA key")
+	}
+	keys := make([]ssh.PublicKey, len(roots.HostKeys))
+	for i, k := range roots.HostKeys {
+		keys[i] = k.PublicKey
+	}
+	return keys, nil
+}
+
+// dialHostKey connects to the SSH server at the given address offering the
+// given host key algorithms, and returns the host key or certificate presented
+// by it. It does not authenticate. The timeout applies to the connection and the
+// SSH handshake, so a server that stalls after accepting the connection does
+// not block it.
+func dialHostKey(addr string, algorithms []string, timeout time.Duration) (ssh.PublicKey, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error connecting to %s", addr)
+	}
+	defer conn.Close()
+	if timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, errors.Wrapf(err, "error connecting to %s", addr)
+		}
+	}
+
+	var hostKey ssh.PublicKey
+	_, _, _, err = ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+		User:              "step",
+		HostKeyAlgorithms: algorithms,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+			return errHostKeyCaptured
+		},
+	})
+	if hostKey != nil {
+		return hostKey, nil
+	}
+	if err == nil {
+		err = errors.New("the server did not present a host key")
+	}
+	return nil, errors.Wrapf(err, "error connecting to %s", addr)
+}
+
+// verifyHostCertificate checks that the given key is a host certificate signed
+// by one of the given CA keys, valid at the given time and with the hostname as
+// a principal. It returns the result of each check and an error if any of them
+// fails.
+func verifyHostCertificate(key ssh.PublicKey, hostname string, caKeys []ssh.PublicKey, now time.Time) ([]hostCheck, error) {
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return []hostCheck{
+			{Name: "Certificate", Err: errors.Errorf("%s (%s)", errNoHostCertificate, ssh.FingerprintSHA256(key))},
+		}, errNoHostCertificate
+	}
+	if cert.CertType != ssh.HostCert {
+		return []hostCheck{
+			{Name: "Certificate", Err: errors.New("the server presented a user certificate")},
+		}, errors.New("the server presented a user certificate")
+	}
+
+	checks := []hostCheck{
+		{Name: "Certificate", Message: fmt.Sprintf("%s %s", cert.Type(), ssh.FingerprintSHA256(cert.Key))},
+	}
+
+	// Signature
+	switch {
+	case !sshutil.IsSignedBy(cert, caKeys):
+		checks = append(checks, hostCheck{Name: "Signed by CA", Err: errors.Errorf("signing key %s is not a host CA key", ssh.FingerprintSHA256(cert.SignatureKey))})
+	case sshutil.CheckSignature(cert) != nil:
+		checks = append(checks, hostCheck{Name: "Signed by CA", Err: errors.New("invalid certificate signature")})
+	default:
+		checks = append(checks, hostCheck{Name: "Signed by CA", Message: ssh.FingerprintSHA256(cert.SignatureKey)})
+	}
+
+	// Validity
+	s := newCertificateSummary(cert)
+	s.now = now
+	if s.ValidAfter.After(now) || (s.ValidBefore != nil && !s.ValidBefore.After(now)) {
+		checks = append(checks, hostCheck{Name: "Validity", Err: errors.New(s.Remaining())})
+	} else {
+		checks = append(checks, hostCheck{Name: "Validity", Message: s.Remaining()})
+	}
+
+	// Principals
+	var found bool
+	for _, p := range cert.ValidPrincipals {
+		if p == hostname {
+			found = true
+			break
+		}
+	}
+	if found {
+		checks = append(checks, hostCheck{Name: "Principal", Message: hostname})
+	} else {
+		checks = append(checks, hostCheck{Name: "Principal", Err: errors.Errorf("%s is not in %s", hostname, formatList(cert.ValidPrincipals))})
+	}
+
+	var failed int
+	for _, c := range checks {
+		if c.Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return checks, errors.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return checks, nil
+}
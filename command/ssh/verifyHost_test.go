@@ -0,0 +1,187 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func mustHostSigner(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+	return signer
+}
+
+func mustHostCertificate(t *testing.T, key ssh.PublicKey, ca ssh.Signer, certType uint32, principals []string, validAfter, validBefore time.Time) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          1234,
+		CertType:        certType,
+		KeyId:           "internal.example.com",
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(validAfter.Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	require.NoError(t, cert.SignCert(rand.Reader, ca))
+	return cert
+}
+
+func TestVerifyHostCertificate(t *testing.T) {
+	now := time.Now()
+	ca := mustHostSigner(t)
+	key := mustHostSigner(t).PublicKey()
+	caKeys := []ssh.PublicKey{mustHostSigner(t).PublicKey(), ca.PublicKey()}
+	principals := []string{"internal", "internal.example.com"}
+	valid := mustHostCertificate(t, key, ca, ssh.HostCert, principals, now.Add(-time.Hour), now.Add(time.Hour))
+	tampered := mustHostCertificate(t, key, ca, ssh.HostCert, principals, now.Add(-time.Hour), now.Add(time.Hour))
+	tampered.ValidPrincipals = append(tampered.ValidPrincipals, "other.example.com")
+
+	tests := []struct {
+		name     string
+		key      ssh.PublicKey
+		hostname string
+		failed   []string
+		wantErr  error
+	}{
+		{"ok", valid, "internal.example.com", nil, nil},
+		{"fail/plain-key", key, "internal.example.com", []string{"Certificate"}, errNoHostCertificate},
+		{"fail/user-cert", mustHostCertificate(t, key, ca, ssh.UserCert, principals, now.Add(-time.Hour), now.Add(time.Hour)), "internal.example.com", []string{"Certificate"}, nil},
+		{"fail/other-ca", mustHostCertificate(t, key, mustHostSigner(t), ssh.HostCert, principals, now.Add(-time.Hour), now.Add(time.Hour)), "internal.example.com", []string{"Signed by CA"}, nil},
+		{"fail/signature", tampered, "internal.example.com", []string{"Signed by CA"}, nil},
+		{"fail/expired", mustHostCertificate(t, key, ca, ssh.HostCert, principals, now.Add(-2*time.Hour), now.Add(-time.Hour)), "internal.example.com", []string{"Validity"}, nil},
+		{"fail/not-yet-valid", mustHostCertificate(t, key, ca, ssh.HostCert, principals, now.Add(time.Hour), now.Add(2*time.Hour)), "internal.example.com", []string{"Validity"}, nil},
+		{"fail/principal", valid, "other.example.com", []string{"Principal"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checks, err := verifyHostCertificate(tt.key, tt.hostname, caKeys, now)
+			var failed []string
+			for _, c := range checks {
+				if c.Err != nil {
+					failed = append(failed, c.Name)
+				}
+			}
+			require.Equal(t, tt.failed, failed)
+			if tt.failed == nil {
+				require.NoError(t, err)
+				require.Len(t, checks, 4)
+			} else {
+				require.Error(t, err)
+			}
+			if tt.wantErr != nil {
+				require.Equal(t, tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestSplitHostPort(t *testing.T) {
+	tests := []struct {
+		in, host, addr string
+		wantErr        bool
+	}{
+		{"internal.example.com", "internal.example.com", "internal.example.com:22", false},
+		{"internal.example.com:2222", "internal.example.com", "internal.example.com:2222", false},
+		{"10.0.0.1", "10.0.0.1", "10.0.0.1:22", false},
+		{"2001:db8::1", "2001:db8::1", "[2001:db8::1]:22", false},
+		{"[2001:db8::1]:2222", "2001:db8::1", "[2001:db8::1]:2222", false},
+		{"foo:bar:zar", "", "", true},
+		{":22", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			host, addr, err := splitHostPort(tt.in)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.host, host)
+			require.Equal(t, tt.addr, addr)
+		})
+	}
+}
+
+// serveHostKey starts an SSH server that presents the given host key and
+// returns its address.
+func serveHostKey(t *testing.T, hostKeys ...ssh.Signer) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	for _, k := range hostKeys {
+		config.AddHostKey(k)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				ssh.NewServerConn(conn, config)
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func TestDialHostKey(t *testing.T) {
+	now := time.Now()
+	ca := mustHostSigner(t)
+	hostKey := mustHostSigner(t)
+	cert := mustHostCertificate(t, hostKey.PublicKey(), ca, ssh.HostCert, []string{"127.0.0.1"}, now.Add(-time.Hour), now.Add(time.Hour))
+	certSigner, err := ssh.NewCertSigner(cert, hostKey)
+	require.NoError(t, err)
+
+	// Server with a host certificate
+	addr, closer := serveHostKey(t, certSigner)
+	defer closer()
+	key, err := dialHostKey(addr, hostKeyAlgorithms, 5*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, cert.Marshal(), key.Marshal())
+	_, err = verifyHostCertificate(key, "127.0.0.1", []ssh.PublicKey{ca.PublicKey()}, now)
+	require.NoError(t, err)
+
+	// Server with a plain host key
+	addr, closer = serveHostKey(t, hostKey)
+	defer closer()
+	key, err = dialHostKey(addr, hostKeyAlgorithms, 5*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, hostKey.PublicKey().Marshal(), key.Marshal())
+	_, err = verifyHostCertificate(key, "127.0.0.1", []ssh.PublicKey{ca.PublicKey()}, now)
+	require.Equal(t, errNoHostCertificate, err)
+
+	// Server not available
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr = l.Addr().String()
+	l.Close()
+	_, err = dialHostKey(addr, hostKeyAlgorithms, 5*time.Second)
+	require.Error(t, err)
+
+	// Server that accepts the connection and stalls the handshake
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	start := time.Now()
+	_, err = dialHostKey(l.Addr().String(), hostKeyAlgorithms, 100*time.Millisecond)
+	require.Error(t, err)
+	require.True(t, time.Since(start) < 5*time.Second)
+}
@@ -0,0 +1,143 @@
+// Package completion implements the shell completion of the step commands.
+//
+// The completion scripts run the command being typed with the flag
+// --generate-bash-completion, and the BashComplete function of the command
+// prints the suggestions. If a command prints nothing, the scripts complete
+// file names.
+package completion
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Supported shells.
+const (
+	Bash = "bash"
+	Zsh  = "zsh"
+	Fish = "fish"
+)
+
+// completionFlag is the flag added by urfave/cli to the arguments when the
+// shell asks for completions.
+const completionFlag = "--generate-bash-completion"
+
+// The scripts are the same as the files in the autocomplete directory of the
+// repository.
+const bashScript = `#! /bin/bash
+
+: ${PROG:=$(basename ${BASH_SOURCE})}
+
+_cli_bash_autocomplete() {
+	local cur opts base
+	COMPREPLY=()
+	cur="${COMP_WORDS[COMP_CWORD]}"
+	opts=$( ${COMP_WORDS[@]:0:$COMP_CWORD} --generate-bash-completion )
+	if [ -n "${opts}" ];
+	then
+		COMPREPLY=( $(compgen -W "${opts}" -- ${cur}) )
+	else
+		_filedir
+	fi
+	return 0
+}
+
+complete -F _cli_bash_autocomplete $PROG
+
+unset PROG
+`
+
+const zshScript = `#compdef step
+
+function _step {
+  local -a opts
+  opts=("${(@f)$(_CLI_ZSH_AUTOCOMPLETE_HACK=1 ${words[@]:0:#words[@]-1} --generate-bash-completion)}")
+  if [[ "${opts}" != "" ]]; then
+    _describe -t step-commands 'values' opts
+  else
+    _path_files
+  fi
+}
+
+_step "$@"
+`
+
+const fishScript = `function __step_complete
+    set -l tokens (commandline -opc)
+    env _STEP_FISH_AUTOCOMPLETE=1 $tokens --generate-bash-completion 2>/dev/null
+end
+
+complete -c step -a '(__step_complete)'
+`
+
+// Script returns the completion script for the given shell.
+func Script(shell string) (string, error) {
+	switch shell {
+	case Bash:
+		return bashScript, nil
+	case Zsh:
+		return zshScript, nil
+	case Fish:
+		return fishScript, nil
+	default:
+		return "", errors.Errorf("unsupported shell '%s': use bash, zsh or fish", shell)
+	}
+}
+
+// currentShell returns the shell asking for completions. The zsh script uses
+// the variable defined by urfave/cli.
+func currentShell() string {
+	switch {
+	case os.Getenv("_CLI_ZSH_AUTOCOMPLETE_HACK") == "1":
+		return Zsh
+	case os.Getenv("_STEP_FISH_AUTOCOMPLETE") == "1":
+		return Fish
+	default:
+		return Bash
+	}
+}
+
+// PreviousArg returns the argument before the one being completed, the scripts
+// do not pass the argument being typed. It returns an empty string if args is
+// not a completion request.
+func PreviousArg(args []string) string {
+	if n := len(args); n > 2 && args[n-1] == completionFlag {
+		return args[n-2]
+	}
+	return ""
+}
+
+// Suggestion is a completion value with an optional description.
+type Suggestion struct {
+	Value       string
+	Description string
+}
+
+// Print prints the suggestions in the format of the current shell. Bash only
+// uses the values, zsh and fish also show the descriptions.
+func Print(w io.Writer, suggestions ...Suggestion) {
+	shell := currentShell()
+	for _, s := range suggestions {
+		switch {
+		case s.Description == "" || shell == Bash:
+			fmt.Fprintln(w, s.Value)
+		case shell == Zsh:
+			fmt.Fprintf(w, "%s:%s\n", strings.Replace(s.Value, ":", `\:`, -1), s.Description)
+		default:
+			fmt.Fprintf(w, "%s\t%s\n", s.Value, s.Description)
+		}
+	}
+}
+
+// Values returns the suggestions for the given values.
+func Values(values ...string) []Suggestion {
+	suggestions := make([]Suggestion, len(values))
+	for i, v := range values {
+		suggestions[i] = Suggestion{Value: v}
+	}
+	return suggestions
+}
@@ -0,0 +1,58 @@
+package completion
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScript(t *testing.T) {
+	for _, shell := range []string{Bash, Zsh, Fish} {
+		s, err := Script(shell)
+		require.NoError(t, err)
+		require.Contains(t, s, "--generate-bash-completion")
+	}
+	_, err := Script("ksh")
+	require.EqualError(t, err, "unsupported shell 'ksh': use bash, zsh or fish")
+}
+
+func TestPreviousArg(t *testing.T) {
+	require.Equal(t, "--provisioner", PreviousArg([]string{"step", "ssh", "certificate", "--provisioner", "--generate-bash-completion"}))
+	require.Equal(t, "certificate", PreviousArg([]string{"step", "ssh", "certificate", "--generate-bash-completion"}))
+	require.Equal(t, "", PreviousArg([]string{"step", "ssh", "certificate", "--provisioner"}))
+	require.Equal(t, "", PreviousArg([]string{"step", "--generate-bash-completion"}))
+}
+
+func TestPrint(t *testing.T) {
+	suggestions := []Suggestion{
+		{Value: "admin", Description: "JWK"},
+		{Value: "pkcs11:"},
+		{Value: "softkms:path=", Description: "a key in a PEM file"},
+	}
+	tests := []struct {
+		name string
+		env  string
+		want string
+	}{
+		{"bash", "", "admin\npkcs11:\nsoftkms:path=\n"},
+		{"zsh", "_CLI_ZSH_AUTOCOMPLETE_HACK", "admin:JWK\npkcs11:\nsoftkms\\:path=:a key in a PEM file\n"},
+		{"fish", "_STEP_FISH_AUTOCOMPLETE", "admin\tJWK\npkcs11:\nsoftkms:path=\ta key in a PEM file\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				os.Setenv(tt.env, "1")
+				defer os.Unsetenv(tt.env)
+			}
+			var buf bytes.Buffer
+			Print(&buf, suggestions...)
+			require.Equal(t, tt.want, buf.String())
+		})
+	}
+
+	var buf bytes.Buffer
+	Print(&buf, Values("a", "b")...)
+	require.Equal(t, "a\nb\n", buf.String())
+}
@@ -0,0 +1,71 @@
+package kms
+
+import (
+	"context"
+	"crypto"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/kms/apiv1"
+	"github.com/smallstep/certificates/kms/uri"
+)
+
+// KeyManager is the interface implemented by the key managers used to keep
+// private keys outside of the file system, like a PKCS #11 module.
+type KeyManager = apiv1.KeyManager
+
+// newFunc is the constructor of a KeyManager for the given uri.
+type newFunc func(ctx context.Context, rawuri string) (KeyManager, error)
+
+// registry contains the available key managers by scheme. The ones that
+// require cgo or a build tag register themselves in their init function.
+var registry = map[string]newFunc{}
+
+func register(scheme string, fn newFunc) {
+	registry[scheme] = fn
+}
+
+// New returns the KeyManager for the scheme of the given uri, e.g.
+// "pkcs11:module-path=/usr/lib/softhsm/libsofthsm2.so;token=smallstep".
+func New(ctx context.Context, rawuri string) (KeyManager, error) {
+	u, err := uri.Parse(rawuri)
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := registry[strings.ToLower(u.Scheme)]
+	if !ok {
+		return nil, errors.Errorf("unsupported kms type '%s'", u.Scheme)
+	}
+	return fn(ctx, rawuri)
+}
+
+// ErrKeyNotFound is the cause of the errors returned by GetPublicKey if the
+// key does not exist.
+var ErrKeyNotFound = errors.New("key not found")
+
+// IsKeyNotFound returns true if the cause of the given error is
+// ErrKeyNotFound.
+func IsKeyNotFound(err error) bool {
+	return errors.Cause(err) == ErrKeyNotFound
+}
+
+// GetOrCreateKey returns the public key with the given name. If the key does
+// not exist, a new key with the default type is created in the KMS. Any other
+// error, like a wrong PIN, is returned, so keys are never created by mistake.
+func GetOrCreateKey(km KeyManager, name string) (crypto.PublicKey, error) {
+	pub, err := km.GetPublicKey(&apiv1.GetPublicKeyRequest{Name: name})
+	switch {
+	case err == nil:
+		return pub, nil
+	case !IsKeyNotFound(err):
+		return nil, errors.Wrapf(err, "error getting key %s", name)
+	}
+	resp, err := km.CreateKey(&apiv1.CreateKeyRequest{
+		Name:               name,
+		SignatureAlgorithm: apiv1.ECDSAWithSHA256,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating key %s", name)
+	}
+	return resp.PublicKey, nil
+}
@@ -0,0 +1,99 @@
+package kms
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/kms/apiv1"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeKeyManager struct {
+	KeyManager
+	err     error
+	created bool
+}
+
+func (k *fakeKeyManager) GetPublicKey(req *apiv1.GetPublicKeyRequest) (crypto.PublicKey, error) {
+	return nil, k.err
+}
+
+func (k *fakeKeyManager) CreateKey(req *apiv1.CreateKeyRequest) (*apiv1.CreateKeyResponse, error) {
+	k.created = true
+	return nil, errors.New("create failed")
+}
+
+func TestNew(t *testing.T) {
+	km, err := New(context.Background(), "softkms:path=/tmp/key.pem")
+	require.NoError(t, err)
+	require.IsType(t, &softKMS{}, km)
+
+	_, err = New(context.Background(), "foo:id=%01")
+	require.EqualError(t, err, "unsupported kms type 'foo'")
+
+	_, err = New(context.Background(), "/tmp/key.pem")
+	require.Error(t, err)
+}
+
+func TestGetOrCreateKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kms")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	name := "softkms:path=" + filepath.Join(dir, "key.pem")
+	km, err := New(context.Background(), name)
+	require.NoError(t, err)
+	defer km.Close()
+
+	// The first call creates the key, the second one reads it
+	pub, err := GetOrCreateKey(km, name)
+	require.NoError(t, err)
+	require.IsType(t, &ecdsa.PublicKey{}, pub)
+
+	got, err := GetOrCreateKey(km, name)
+	require.NoError(t, err)
+	require.Equal(t, pub, got)
+
+	fi, err := os.Stat(filepath.Join(dir, "key.pem"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	signer, err := km.CreateSigner(&apiv1.CreateSignerRequest{SigningKey: name})
+	require.NoError(t, err)
+	require.Equal(t, pub, signer.Public())
+
+	// The key cannot be created in a missing directory
+	name = "softkms:path=" + filepath.Join(dir, "missing", "key.pem")
+	_, err = GetOrCreateKey(km, name)
+	require.Error(t, err)
+
+	_, err = GetOrCreateKey(km, "softkms:id=%01")
+	require.Error(t, err)
+
+	// An invalid key is not replaced
+	path := filepath.Join(dir, "invalid.pem")
+	require.NoError(t, ioutil.WriteFile(path, []byte("not a key"), 0600))
+	_, err = GetOrCreateKey(km, "softkms:path="+path)
+	require.Error(t, err)
+	require.False(t, IsKeyNotFound(err))
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "not a key", string(b))
+
+	// Only missing keys are created
+	fake := &fakeKeyManager{err: errors.New("CKR_PIN_INCORRECT")}
+	_, err = GetOrCreateKey(fake, "pkcs11:id=1000")
+	require.EqualError(t, err, "error getting key pkcs11:id=1000: CKR_PIN_INCORRECT")
+	require.False(t, fake.created)
+
+	fake = &fakeKeyManager{err: errors.Wrap(ErrKeyNotFound, "key with uri pkcs11:id=1000 not found")}
+	_, err = GetOrCreateKey(fake, "pkcs11:id=1000")
+	require.Error(t, err)
+	require.True(t, fake.created)
+}
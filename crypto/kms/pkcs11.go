@@ -0,0 +1,54 @@
+// +build pkcs11
+
+package kms
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/kms/apiv1"
+	"github.com/smallstep/certificates/kms/pkcs11"
+	"github.com/smallstep/certificates/kms/uri"
+	"github.com/smallstep/cli/ui"
+)
+
+func init() {
+	register("pkcs11", func(ctx context.Context, rawuri string) (KeyManager, error) {
+		opts := apiv1.Options{
+			Type: string(apiv1.PKCS11),
+			URI:  rawuri,
+		}
+		// Ask for the PIN if it's not in the uri
+		if u, err := uri.ParseWithScheme("pkcs11", rawuri); err == nil && u.Pin() == "" {
+			pin, err := ui.PromptPassword("Please enter the PIN of the PKCS #11 token", ui.WithValidateNotEmpty())
+			if err != nil {
+				return nil, err
+			}
+			opts.Pin = string(pin)
+		}
+		km, err := pkcs11.New(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &pkcs11KMS{KeyManager: km}, nil
+	})
+}
+
+// pkcs11KMS is the PKCS #11 KeyManager, GetPublicKey returns an error with
+// ErrKeyNotFound as the cause if the key does not exist.
+type pkcs11KMS struct {
+	KeyManager
+}
+
+// GetPublicKey implements the KeyManager interface.
+func (k *pkcs11KMS) GetPublicKey(req *apiv1.GetPublicKeyRequest) (crypto.PublicKey, error) {
+	pub, err := k.KeyManager.GetPublicKey(req)
+	// The PKCS #11 KeyManager does not have a specific error for a missing
+	// key, other errors, like a locked token, must not be confused with it.
+	if err != nil && errors.Cause(err).Error() == fmt.Sprintf("key with uri %s not found", req.Name) {
+		return nil, errors.Wrap(ErrKeyNotFound, err.Error())
+	}
+	return pub, err
+}
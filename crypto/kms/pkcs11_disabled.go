@@ -0,0 +1,18 @@
+// +build !pkcs11
+
+package kms
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	register("pkcs11", func(ctx context.Context, rawuri string) (KeyManager, error) {
+		name := filepath.Base(os.Args[0])
+		return nil, errors.Errorf("unsupported kms type 'pkcs11': %s is compiled without the pkcs11 build tag", name)
+	})
+}
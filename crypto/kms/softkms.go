@@ -0,0 +1,145 @@
+package kms
+
+import (
+	"context"
+	"crypto"
+	"encoding/pem"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/kms/apiv1"
+	"github.com/smallstep/certificates/kms/uri"
+	"github.com/smallstep/cli/crypto/keys"
+	"github.com/smallstep/cli/crypto/pemutil"
+	"github.com/smallstep/cli/errs"
+)
+
+func init() {
+	register("softkms", func(ctx context.Context, rawuri string) (KeyManager, error) {
+		return &softKMS{}, nil
+	})
+}
+
+// softKMS is a KeyManager that keeps unencrypted keys in PEM files, the key
+// names are uris like "softkms:path=/path/to/key.pem". It is not meant to
+// protect keys, only to test the commands using a KMS without a token.
+type softKMS struct{}
+
+func softKMSPath(name string) (string, error) {
+	u, err := uri.ParseWithScheme("softkms", name)
+	if err != nil {
+		return "", err
+	}
+	path := u.Get("path")
+	if path == "" {
+		return "", errors.Errorf("error parsing %s: path is missing", name)
+	}
+	return path, nil
+}
+
+func (k *softKMS) readSigner(name string) (crypto.Signer, error) {
+	path, err := softKMSPath(name)
+	if err != nil {
+		return nil, err
+	}
+	v, err := pemutil.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := v.(crypto.Signer)
+	if !ok {
+		return nil, errors.Errorf("error reading %s: %T is not a private key", path, v)
+	}
+	return signer, nil
+}
+
+// GetPublicKey returns the public key of the private key in the file. If the
+// file does not exist the cause of the error is ErrKeyNotFound.
+func (k *softKMS) GetPublicKey(req *apiv1.GetPublicKeyRequest) (crypto.PublicKey, error) {
+	path, err := softKMSPath(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, errors.Wrapf(ErrKeyNotFound, "error reading %s", path)
+	}
+	signer, err := k.readSigner(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	return signer.Public(), nil
+}
+
+// CreateKey generates a new private key and writes it to the file. It fails
+// if the file already exists.
+func (k *softKMS) CreateKey(req *apiv1.CreateKeyRequest) (*apiv1.CreateKeyResponse, error) {
+	path, err := softKMSPath(req.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	var kty, crv string
+	var size int
+	switch req.SignatureAlgorithm {
+	case apiv1.UnspecifiedSignAlgorithm, apiv1.ECDSAWithSHA256:
+		kty, crv = "EC", "P-256"
+	case apiv1.ECDSAWithSHA384:
+		kty, crv = "EC", "P-384"
+	case apiv1.ECDSAWithSHA512:
+		kty, crv = "EC", "P-521"
+	case apiv1.PureEd25519:
+		kty, crv = "OKP", "Ed25519"
+	case apiv1.SHA256WithRSA, apiv1.SHA384WithRSA, apiv1.SHA512WithRSA:
+		kty, size = "RSA", req.Bits
+		if size == 0 {
+			size = keys.DefaultKeySize
+		}
+	default:
+		return nil, errors.Errorf("softkms does not support signature algorithm '%s'", req.SignatureAlgorithm)
+	}
+
+	priv, err := keys.GenerateKey(kty, crv, size)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, errors.Errorf("softkms createKey result is not a crypto.Signer: type %T", priv)
+	}
+	block, err := pemutil.Serialize(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, errs.FileError(err, path)
+	}
+	if err := pem.Encode(f, block); err != nil {
+		f.Close()
+		return nil, errs.FileError(err, path)
+	}
+	if err := f.Close(); err != nil {
+		return nil, errs.FileError(err, path)
+	}
+
+	return &apiv1.CreateKeyResponse{
+		Name:       req.Name,
+		PublicKey:  signer.Public(),
+		PrivateKey: priv,
+		CreateSignerRequest: apiv1.CreateSignerRequest{
+			SigningKey: req.Name,
+		},
+	}, nil
+}
+
+// CreateSigner returns the private key in the file with the name of the
+// signing key.
+func (k *softKMS) CreateSigner(req *apiv1.CreateSignerRequest) (crypto.Signer, error) {
+	return k.readSigner(req.SigningKey)
+}
+
+// Close implements the KeyManager interface.
+func (k *softKMS) Close() error {
+	return nil
+}
@@ -3,7 +3,9 @@ package sshutil
 import (
 	"bytes"
 	"net"
+	"os"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -70,6 +72,10 @@ func WithRemoveExpiredCerts(t time.Time) AgentOption {
 // ErrNotFound is the error returned if a something is not found.
 var ErrNotFound = errors.New("not found")
 
+// ErrAgentNotRunning is the error returned by DialAgent on Windows if
+// SSH_AUTH_SOCK is not set and the OpenSSH agent is not running.
+var ErrAgentNotRunning = errors.New("ssh-agent is not running")
+
 // Agent represents a client to an ssh.Agent.
 type Agent struct {
 	agent.ExtendedAgent
@@ -77,9 +83,45 @@ type Agent struct {
 }
 
 // DialAgent returns an ssh.Agent client. It uses the SSH_AUTH_SOCK to connect
-// to the agent.
+// to the agent. On Windows, the OpenSSH agent named pipe is used if it exists,
+// and SSH_AUTH_SOCK otherwise.
 func DialAgent() (*Agent, error) {
-	return dialAgent()
+	return dialAgent(os.Getenv("SSH_AUTH_SOCK"), true)
+}
+
+// DialAgentSocket returns an ssh.Agent client connected to the given socket
+// instead of the one in SSH_AUTH_SOCK. The socket can be the path to a unix
+// socket, a Windows named pipe like `\\.\pipe\openssh-ssh-agent`, or a TCP
+// address with the format tcp://host:port. If socket is empty it behaves like
+// DialAgent.
+func DialAgentSocket(socket string) (*Agent, error) {
+	if socket == "" {
+		return DialAgent()
+	}
+	return dialAgent(socket, false)
+}
+
+// tcpSocketPrefix is the prefix used to identify an agent listening in a TCP
+// address.
+const tcpSocketPrefix = "tcp://"
+
+// newAgent returns a new Agent using the given connection.
+func newAgent(conn net.Conn) *Agent {
+	return &Agent{
+		ExtendedAgent: agent.NewClient(conn),
+		Conn:          conn,
+	}
+}
+
+// dialTCPAgent connects to an agent listening in the given tcp://host:port
+// address.
+func dialTCPAgent(socket string) (*Agent, error) {
+	addr := strings.TrimPrefix(socket, tcpSocketPrefix)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error connecting with ssh-agent using tcp address %s", addr)
+	}
+	return newAgent(conn), nil
 }
 
 // Close closes the connection to the agent.
@@ -0,0 +1,67 @@
+package sshutil
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// serveAgent starts a fake agent in the given listener, the agent will have
+// one key with the comment "fake-key". The agent stops when the listener is
+// closed.
+func serveAgent(t *testing.T, l net.Listener) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	keyring := agent.NewKeyring()
+	require.NoError(t, keyring.Add(agent.AddedKey{
+		PrivateKey: priv,
+		Comment:    "fake-key",
+	}))
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+}
+
+// assertAgent checks that the given agent is connected to the fake agent.
+func assertAgent(t *testing.T, a *Agent) {
+	t.Helper()
+	defer a.Close()
+	keys, err := a.ListKeys()
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	require.Equal(t, "fake-key", keys[0].Comment)
+}
+
+func TestDialAgentSocket_tcp(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	serveAgent(t, l)
+
+	a, err := DialAgentSocket("tcp://" + l.Addr().String())
+	require.NoError(t, err)
+	assertAgent(t, a)
+
+	// Closed listener
+	l2, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l2.Addr().String()
+	l2.Close()
+	_, err = DialAgentSocket("tcp://" + addr)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "using tcp address "+addr)
+}
@@ -4,22 +4,24 @@ package sshutil
 
 import (
 	"net"
-	"os"
+	"strings"
 
 	"github.com/pkg/errors"
-	"golang.org/x/crypto/ssh/agent"
 )
 
-// dialAgent returns an ssh.Agent client. It uses the SSH_AUTH_SOCK to connect
-// to the agent.
-func dialAgent() (*Agent, error) {
-	socket := os.Getenv("SSH_AUTH_SOCK")
+// dialAgent returns an ssh.Agent client. It connects to the given unix socket
+// or TCP address. The fallback parameter is only used on Windows.
+func dialAgent(socket string, fallback bool) (*Agent, error) {
+	switch {
+	case socket == "":
+		return nil, errors.New("error connecting with ssh-agent: SSH_AUTH_SOCK is not set")
+	case strings.HasPrefix(socket, tcpSocketPrefix):
+		return dialTCPAgent(socket)
+	}
+
 	conn, err := net.Dial("unix", socket)
 	if err != nil {
-		return nil, errors.Wrap(err, "error connecting with ssh-agent")
+		return nil, errors.Wrapf(err, "error connecting with ssh-agent using unix socket %s", socket)
 	}
-	return &Agent{
-		ExtendedAgent: agent.NewClient(conn),
-		Conn:          conn,
-	}, nil
+	return newAgent(conn), nil
 }
@@ -0,0 +1,49 @@
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package sshutil
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialAgent_unix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshutil-agent")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	defer l.Close()
+	serveAgent(t, l)
+
+	// Using SSH_AUTH_SOCK
+	defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+	require.NoError(t, os.Setenv("SSH_AUTH_SOCK", socket))
+	a, err := DialAgent()
+	require.NoError(t, err)
+	assertAgent(t, a)
+
+	// Using an explicit socket
+	require.NoError(t, os.Setenv("SSH_AUTH_SOCK", filepath.Join(dir, "missing.sock")))
+	a, err = DialAgentSocket(socket)
+	require.NoError(t, err)
+	assertAgent(t, a)
+
+	// Missing socket
+	_, err = DialAgent()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "using unix socket "+filepath.Join(dir, "missing.sock"))
+
+	// No SSH_AUTH_SOCK
+	require.NoError(t, os.Unsetenv("SSH_AUTH_SOCK"))
+	_, err = DialAgent()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "SSH_AUTH_SOCK is not set")
+}
@@ -4,32 +4,54 @@ import (
 	"context"
 	"net"
 	"os"
+	"strings"
 
 	"github.com/Microsoft/go-winio"
 	"github.com/pkg/errors"
-	"golang.org/x/crypto/ssh/agent"
 )
 
-// dialAgent returns an ssh.Agent client. It uses the SSH_AUTH_SOCK to connect
-// to the agent.
-func dialAgent() (*Agent, error) {
-	// Attempt unix sockets for environments like cygwin.
-	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
-		if conn, err := net.Dial("unix", socket); err == nil {
-			return &Agent{
-				ExtendedAgent: agent.NewClient(conn),
-				Conn:          conn,
-			}, nil
+// openSSHAgentPipe is the named pipe used by the Windows OpenSSH agent.
+var openSSHAgentPipe = `\\.\pipe\openssh-ssh-agent`
+
+// dialAgent returns an ssh.Agent client. It connects to the given named pipe,
+// TCP address or unix socket. If fallback is true, it will first try to
+// connect to the Windows OpenSSH agent, and it returns ErrAgentNotRunning if
+// the named pipe does not exist and the socket is not set.
+func dialAgent(socket string, fallback bool) (*Agent, error) {
+	switch {
+	case strings.HasPrefix(socket, tcpSocketPrefix):
+		return dialTCPAgent(socket)
+	case strings.HasPrefix(socket, `\\.\pipe\`):
+		return dialPipeAgent(socket)
+	}
+
+	// Windows OpenSSH agent, a missing pipe means that the service is not
+	// running.
+	if fallback {
+		a, err := dialPipeAgent(openSSHAgentPipe)
+		switch {
+		case err == nil:
+			return a, nil
+		case !os.IsNotExist(errors.Cause(err)):
+			return nil, err
+		case socket == "":
+			return nil, ErrAgentNotRunning
 		}
 	}
 
-	// Windows OpenSSH agent
-	conn, err := winio.DialPipeContext(context.Background(), `\\.\\pipe\\openssh-ssh-agent`)
+	// Attempt unix sockets for environments like cygwin.
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error connecting with ssh-agent using unix socket %s", socket)
+	}
+	return newAgent(conn), nil
+}
+
+// dialPipeAgent connects to an agent listening in the given named pipe.
+func dialPipeAgent(pipe string) (*Agent, error) {
+	conn, err := winio.DialPipeContext(context.Background(), pipe)
 	if err != nil {
-		return nil, errors.Wrap(err, "error connecting with ssh-agent")
+		return nil, errors.Wrapf(err, "error connecting with ssh-agent using named pipe %s", pipe)
 	}
-	return &Agent{
-		ExtendedAgent: agent.NewClient(conn),
-		Conn:          conn,
-	}, nil
+	return newAgent(conn), nil
 }
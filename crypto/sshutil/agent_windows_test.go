@@ -0,0 +1,56 @@
+package sshutil
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/Microsoft/go-winio"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialAgentSocket_pipe(t *testing.T) {
+	pipe := fmt.Sprintf(`\\.\pipe\step-sshutil-test-%d`, os.Getpid())
+	l, err := winio.ListenPipe(pipe, nil)
+	require.NoError(t, err)
+	defer l.Close()
+	serveAgent(t, l)
+
+	a, err := DialAgentSocket(pipe)
+	require.NoError(t, err)
+	assertAgent(t, a)
+
+	// Missing pipe
+	_, err = DialAgentSocket(pipe + "-missing")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "using named pipe "+pipe+"-missing")
+}
+
+func TestDialAgent_pipe(t *testing.T) {
+	pipe := fmt.Sprintf(`\\.\pipe\step-sshutil-openssh-%d`, os.Getpid())
+	l, err := winio.ListenPipe(pipe, nil)
+	require.NoError(t, err)
+	defer l.Close()
+	serveAgent(t, l)
+
+	defer func(p string) { openSSHAgentPipe = p }(openSSHAgentPipe)
+	defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+
+	// The named pipe is used before SSH_AUTH_SOCK
+	openSSHAgentPipe = pipe
+	require.NoError(t, os.Setenv("SSH_AUTH_SOCK", `C:\missing\agent.sock`))
+	a, err := DialAgent()
+	require.NoError(t, err)
+	assertAgent(t, a)
+
+	// Missing pipe and socket
+	openSSHAgentPipe = pipe + "-missing"
+	_, err = DialAgent()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `using unix socket C:\missing\agent.sock`)
+
+	// No agent
+	require.NoError(t, os.Unsetenv("SSH_AUTH_SOCK"))
+	_, err = DialAgent()
+	require.Equal(t, ErrAgentNotRunning, err)
+}
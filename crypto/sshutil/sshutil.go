@@ -1,6 +1,7 @@
 package sshutil
 
 import (
+	"bytes"
 	"crypto"
 	//nolint
 	"crypto/dsa"
@@ -8,9 +9,11 @@ import (
 	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 	"math/big"
+	"strings"
 
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/ssh"
@@ -63,9 +66,39 @@ func PublicKey(key ssh.PublicKey) (crypto.PublicKey, error) {
 	}
 }
 
+// FingerprintEncoding defines the supported encodings of an SSH key
+// fingerprint.
+type FingerprintEncoding int
+
+const (
+	// SHA256Fingerprint is the base64 encoding of the SHA-256 of the key
+	// prefixed by "SHA256:", the default format used by ssh-keygen.
+	SHA256Fingerprint FingerprintEncoding = iota
+	// MD5Fingerprint is the legacy colon-separated hex encoding of the MD5 of
+	// the key prefixed by "MD5:".
+	MD5Fingerprint
+	// EmojiFingerprint encodes each byte of the SHA-256 of the key as an
+	// emoji. It is a step specific format to compare fingerprints visually, it
+	// does not match any ssh-keygen format and no other tool produces it.
+	EmojiFingerprint
+)
+
 // Fingerprint returns the key size, fingerprint, comment and algorithm of a
-// public key.
+// public key. If the key is a certificate, the fingerprint of the certificate
+// is used.
 func Fingerprint(in []byte) (string, error) {
+	return formatFingerprint(in, SHA256Fingerprint, false)
+}
+
+// FormatFingerprint returns the key size, fingerprint, comment and algorithm
+// of a public key, using the given encoding for the fingerprint. Unlike
+// Fingerprint, if the key is a certificate, the fingerprint of the certified
+// key is used.
+func FormatFingerprint(in []byte, encoding FingerprintEncoding) (string, error) {
+	return formatFingerprint(in, encoding, true)
+}
+
+func formatFingerprint(in []byte, encoding FingerprintEncoding, certifiedKey bool) (string, error) {
 	key, comment, _, _, err := ssh.ParseAuthorizedKey(in)
 	if err != nil {
 		return "", errors.Wrap(err, "error parsing public key")
@@ -80,7 +113,134 @@ func Fingerprint(in []byte) (string, error) {
 		return "", errors.Wrap(err, "error determining key type and size")
 	}
 
-	return fmt.Sprintf("%d %s %s (%s)", size, ssh.FingerprintSHA256(key), comment, typ), nil
+	if cert, ok := key.(*ssh.Certificate); ok && certifiedKey {
+		key = cert.Key
+	}
+
+	return fmt.Sprintf("%d %s %s (%s)", size, EncodedFingerprint(key, encoding), comment, typ), nil
+}
+
+// FormatKeyFingerprint returns the key size, fingerprint and algorithm of the
+// given key, using the given encoding. It is useful to print the fingerprint
+// of keys without a comment, like the signature key of a certificate.
+func FormatKeyFingerprint(key ssh.PublicKey, encoding FingerprintEncoding) (string, error) {
+	typ, size, err := publicKeyTypeAndSize(key)
+	if err != nil {
+		return "", errors.Wrap(err, "error determining key type and size")
+	}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+	return fmt.Sprintf("%d %s (%s)", size, EncodedFingerprint(key, encoding), typ), nil
+}
+
+// EncodedFingerprint returns the fingerprint of the given key using the given
+// encoding.
+func EncodedFingerprint(key ssh.PublicKey, encoding FingerprintEncoding) string {
+	switch encoding {
+	case MD5Fingerprint:
+		return "MD5:" + ssh.FingerprintLegacyMD5(key)
+	case EmojiFingerprint:
+		sum := sha256.Sum256(key.Marshal())
+		var sb strings.Builder
+		for _, b := range sum {
+			// Emojis in the "Miscellaneous Symbols and Pictographs" block
+			// U+1F400..U+1F4FF, they are all assigned and none of them is a
+			// modifier.
+			sb.WriteRune(rune(0x1F400 + int(b)))
+		}
+		return sb.String()
+	default:
+		return ssh.FingerprintSHA256(key)
+	}
+}
+
+// ParseAuthorizedKeys parses a file in the authorized_keys format and returns
+// all the keys in it. Empty lines, comments, options and invalid lines are
+// ignored.
+func ParseAuthorizedKeys(in []byte) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	for {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(in)
+		if err != nil {
+			break
+		}
+		keys = append(keys, key)
+		in = rest
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("error parsing authorized keys: no keys found")
+	}
+	return keys, nil
+}
+
+// IsSignedBy returns true if the signature key of the given certificate is one
+// of the given keys.
+func IsSignedBy(cert *ssh.Certificate, keys []ssh.PublicKey) bool {
+	if cert.SignatureKey == nil {
+		return false
+	}
+	b := cert.SignatureKey.Marshal()
+	for _, k := range keys {
+		if bytes.Equal(b, k.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckSignature verifies the signature of the given certificate using its
+// signature key.
+func CheckSignature(cert *ssh.Certificate) error {
+	if cert.SignatureKey == nil || cert.Signature == nil {
+		return errors.New("certificate is not signed")
+	}
+	// The signed data is the certificate without the signature, the last field
+	// as a length-prefixed string.
+	b := cert.Marshal()
+	n := 4 + len(ssh.Marshal(cert.Signature))
+	if len(b) < n {
+		return errors.New("certificate is invalid")
+	}
+	if err := cert.SignatureKey.Verify(b[:len(b)-n], cert.Signature); err != nil {
+		return errors.Wrap(err, "error verifying certificate signature")
+	}
+	return nil
+}
+
+// IsSecurityKey returns true if the given key, or the key of the given
+// certificate, is a FIDO/U2F security key, with the types
+// sk-ecdsa-sha2-nistp256@openssh.com or sk-ssh-ed25519@openssh.com. The private
+// part of these keys lives on the hardware token.
+func IsSecurityKey(key ssh.PublicKey) bool {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+	switch key.Type() {
+	case ssh.KeyAlgoSKECDSA256, ssh.KeyAlgoSKED25519:
+		return true
+	default:
+		return false
+	}
+}
+
+// CheckCertificateKey verifies that the given certificate is for the given
+// public key, and that, as a consequence, its type is the certificate variant
+// of the key type.
+func CheckCertificateKey(cert *ssh.Certificate, key ssh.PublicKey) error {
+	switch {
+	case cert.Key == nil:
+		return errors.New("certificate does not have a public key")
+	case cert.Key.Type() != key.Type():
+		if IsSecurityKey(key) {
+			return errors.Errorf("certificate type %s does not match the key type %s: the CA does not support security key certificates", cert.Type(), key.Type())
+		}
+		return errors.Errorf("certificate type %s does not match the key type %s", cert.Type(), key.Type())
+	case !bytes.Equal(cert.Key.Marshal(), key.Marshal()):
+		return errors.New("certificate public key does not match the requested key")
+	default:
+		return nil
+	}
 }
 
 func publicKeyTypeAndSize(key ssh.PublicKey) (string, int, error) {
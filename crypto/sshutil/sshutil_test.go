@@ -0,0 +1,200 @@
+package sshutil
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func mustSigner(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+	return signer
+}
+
+func mustCertificate(t *testing.T, key ssh.PublicKey, ca ssh.Signer) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          1234,
+		CertType:        ssh.UserCert,
+		KeyId:           "jane@example.com",
+		ValidPrincipals: []string{"jane"},
+		ValidAfter:      0,
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	require.NoError(t, cert.SignCert(rand.Reader, ca))
+	return cert
+}
+
+func TestFormatFingerprint(t *testing.T) {
+	key := mustSigner(t).PublicKey()
+	cert := mustCertificate(t, key, mustSigner(t))
+
+	pub := ssh.MarshalAuthorizedKey(key)
+	crt := ssh.MarshalAuthorizedKey(cert)
+	crt = append(crt[:len(crt)-1], []byte(" jane@example.com\n")...)
+
+	tests := []struct {
+		name     string
+		in       []byte
+		encoding FingerprintEncoding
+		want     string
+		wantErr  bool
+	}{
+		{"ok/sha256", pub, SHA256Fingerprint, "256 " + ssh.FingerprintSHA256(key) + " no comment (ED25519)", false},
+		{"ok/md5", pub, MD5Fingerprint, "256 MD5:" + ssh.FingerprintLegacyMD5(key) + " no comment (ED25519)", false},
+		{"ok/cert", crt, SHA256Fingerprint, "256 " + ssh.FingerprintSHA256(key) + " jane@example.com (ED25519-CERT)", false},
+		{"fail/parse", []byte("foo"), SHA256Fingerprint, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FormatFingerprint(tt.in, tt.encoding)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("FormatFingerprint() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("FormatFingerprint() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	key := mustSigner(t).PublicKey()
+	cert := mustCertificate(t, key, mustSigner(t))
+
+	got, err := Fingerprint(ssh.MarshalAuthorizedKey(key))
+	require.NoError(t, err)
+	require.Equal(t, "256 "+ssh.FingerprintSHA256(key)+" no comment (ED25519)", got)
+
+	// The fingerprint of the certificate is used, like in step ssh list
+	got, err = Fingerprint(ssh.MarshalAuthorizedKey(cert))
+	require.NoError(t, err)
+	require.Equal(t, "256 "+ssh.FingerprintSHA256(cert)+" no comment (ED25519-CERT)", got)
+
+	_, err = Fingerprint([]byte("foo"))
+	require.Error(t, err)
+}
+
+func TestEncodedFingerprint(t *testing.T) {
+	key := mustSigner(t).PublicKey()
+	require.True(t, strings.HasPrefix(EncodedFingerprint(key, SHA256Fingerprint), "SHA256:"))
+	require.True(t, strings.HasPrefix(EncodedFingerprint(key, MD5Fingerprint), "MD5:"))
+
+	emoji := EncodedFingerprint(key, EmojiFingerprint)
+	require.Equal(t, 32, utf8.RuneCountInString(emoji))
+	require.Equal(t, emoji, EncodedFingerprint(key, EmojiFingerprint))
+}
+
+func TestParseAuthorizedKeys(t *testing.T) {
+	k1 := mustSigner(t).PublicKey()
+	k2 := mustSigner(t).PublicKey()
+
+	var in []byte
+	in = append(in, []byte("# user ca keys\n\n")...)
+	in = append(in, ssh.MarshalAuthorizedKey(k1)...)
+	in = append(in, []byte("cert-authority ")...)
+	in = append(in, ssh.MarshalAuthorizedKey(k2)...)
+
+	keys, err := ParseAuthorizedKeys(in)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	require.Equal(t, k1.Marshal(), keys[0].Marshal())
+	require.Equal(t, k2.Marshal(), keys[1].Marshal())
+
+	_, err = ParseAuthorizedKeys([]byte("# no keys\n"))
+	require.Error(t, err)
+}
+
+func TestIsSignedBy(t *testing.T) {
+	ca := mustSigner(t)
+	other := mustSigner(t)
+	cert := mustCertificate(t, mustSigner(t).PublicKey(), ca)
+
+	require.True(t, IsSignedBy(cert, []ssh.PublicKey{other.PublicKey(), ca.PublicKey()}))
+	require.False(t, IsSignedBy(cert, []ssh.PublicKey{other.PublicKey()}))
+	require.False(t, IsSignedBy(cert, nil))
+	require.False(t, IsSignedBy(&ssh.Certificate{}, []ssh.PublicKey{ca.PublicKey()}))
+}
+
+func mustReadPublicKey(t *testing.T, filename string) (ssh.PublicKey, []byte) {
+	b, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	key, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	require.NoError(t, err)
+	return key, b
+}
+
+func TestSecurityKeys(t *testing.T) {
+	tests := []struct {
+		filename string
+		keyType  string
+		certType string
+		typ      string
+	}{
+		{"testdata/id_ecdsa_sk.pub", ssh.KeyAlgoSKECDSA256, ssh.CertAlgoSKECDSA256v01, "SK-ECDSA"},
+		{"testdata/id_ed25519_sk.pub", ssh.KeyAlgoSKED25519, ssh.CertAlgoSKED25519v01, "SK-ED25519"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.keyType, func(t *testing.T) {
+			key, b := mustReadPublicKey(t, tt.filename)
+			require.Equal(t, tt.keyType, key.Type())
+			require.True(t, IsSecurityKey(key))
+
+			// Marshal round trip
+			require.Equal(t, b, append(bytes.TrimSpace(ssh.MarshalAuthorizedKey(key)), []byte(" jane@yubikey\n")...))
+			parsed, err := ssh.ParsePublicKey(key.Marshal())
+			require.NoError(t, err)
+			require.Equal(t, key.Marshal(), parsed.Marshal())
+
+			_, err = PublicKey(key)
+			require.NoError(t, err)
+			s, err := FormatFingerprint(b, SHA256Fingerprint)
+			require.NoError(t, err)
+			require.Equal(t, "256 "+ssh.FingerprintSHA256(key)+" jane@yubikey ("+tt.typ+")", s)
+
+			// Certificates for security keys
+			cert := mustCertificate(t, key, mustSigner(t))
+			require.Equal(t, tt.certType, cert.Type())
+			require.True(t, IsSecurityKey(cert))
+			require.NoError(t, CheckCertificateKey(cert, key))
+			parsedCert, err := ParseCertificate(cert.Marshal())
+			require.NoError(t, err)
+			require.Equal(t, cert.Marshal(), parsedCert.Marshal())
+
+			// CA without sk support
+			other := mustCertificate(t, mustSigner(t).PublicKey(), mustSigner(t))
+			err = CheckCertificateKey(other, key)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), "the CA does not support security key certificates")
+		})
+	}
+
+	require.False(t, IsSecurityKey(mustSigner(t).PublicKey()))
+}
+
+func TestCheckCertificateKey(t *testing.T) {
+	key := mustSigner(t).PublicKey()
+	require.NoError(t, CheckCertificateKey(mustCertificate(t, key, mustSigner(t)), key))
+	require.Error(t, CheckCertificateKey(mustCertificate(t, mustSigner(t).PublicKey(), mustSigner(t)), key))
+	require.Error(t, CheckCertificateKey(&ssh.Certificate{}, key))
+}
+
+func TestCheckSignature(t *testing.T) {
+	cert := mustCertificate(t, mustSigner(t).PublicKey(), mustSigner(t))
+	require.NoError(t, CheckSignature(cert))
+
+	cert.KeyId = "john@example.com"
+	require.Error(t, CheckSignature(cert))
+	require.Error(t, CheckSignature(&ssh.Certificate{}))
+}
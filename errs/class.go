@@ -0,0 +1,207 @@
+package errs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// ErrorClass is the class of a command failure. Its value is the exit code
+// used by the command, and it is stable so scripts can depend on it.
+type ErrorClass int
+
+const (
+	// UnknownError is the class of the errors without a more specific class.
+	UnknownError ErrorClass = 1
+	// UsageError is the class of the errors in the positional arguments or
+	// flags of a command.
+	UsageError ErrorClass = 3
+	// TokenError is the class of the errors generating a token or
+	// authenticating with a provisioner.
+	TokenError ErrorClass = 4
+	// CARejectedError is the class of the errors returned by the CA with a 4xx
+	// status code.
+	CARejectedError ErrorClass = 5
+	// CAUnavailableError is the class of the network errors and the errors
+	// returned by the CA with a 5xx status code.
+	CAUnavailableError ErrorClass = 6
+	// FileSystemError is the class of the errors reading or writing local
+	// files.
+	FileSystemError ErrorClass = 7
+)
+
+// String returns the name of the error class.
+func (c ErrorClass) String() string {
+	switch c {
+	case UsageError:
+		return "usage"
+	case TokenError:
+		return "token"
+	case CARejectedError:
+		return "ca-rejected"
+	case CAUnavailableError:
+		return "ca-unavailable"
+	case FileSystemError:
+		return "filesystem"
+	default:
+		return "unknown"
+	}
+}
+
+// ClassError is an error with a class. It implements the cli.ExitCoder
+// interface using the class as the exit code.
+//
+// ClassError does not implement the errors.Cause interface, this way the class
+// is kept when the error is wrapped using Wrap.
+type ClassError struct {
+	Class ErrorClass
+	Err   error
+}
+
+// NewClassError returns a new ClassError with the given class and error. It
+// returns nil if the error is nil.
+func NewClassError(class ErrorClass, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ClassError{Class: class, Err: err}
+}
+
+// Error implements the error interface.
+func (e *ClassError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the wrapped error.
+func (e *ClassError) Unwrap() error {
+	return e.Err
+}
+
+// ExitCode implements the cli.ExitCoder interface.
+func (e *ClassError) ExitCode() int {
+	return int(e.Class)
+}
+
+// Format implements the fmt.Formatter interface, it prints the stack trace of
+// the wrapped error with %+v.
+func (e *ClassError) Format(f fmt.State, c rune) {
+	if c == 'v' && f.Flag('+') {
+		fmt.Fprintf(f, "%+v", e.Err)
+		return
+	}
+	io.WriteString(f, e.Error())
+}
+
+// Classify returns the given error with the given class if the error does not
+// already have one.
+func Classify(err error, class ErrorClass) error {
+	if err == nil || class == UnknownError || GetClass(err) != UnknownError {
+		return err
+	}
+	return NewClassError(class, err)
+}
+
+// WithClass returns the given error as a ClassError if a class can be found
+// in the chain of errors. Otherwise it returns the same error.
+func WithClass(err error) error {
+	if _, ok := err.(*ClassError); ok || err == nil {
+		return err
+	}
+	if class := GetClass(err); class != UnknownError {
+		return NewClassError(class, err)
+	}
+	return err
+}
+
+// GetClass returns the class of the first error in the chain of errors with
+// one. Errors with a StatusCode method, like the ones returned by the CA, are
+// classified using the status code, network errors are CAUnavailableError and
+// os.PathError and os.LinkError are FileSystemError.
+func GetClass(err error) ErrorClass {
+	for err != nil {
+		switch e := err.(type) {
+		case *ClassError:
+			return e.Class
+		case interface{ StatusCode() int }:
+			switch code := e.StatusCode(); {
+			case code >= 500:
+				return CAUnavailableError
+			case code >= 400:
+				return CARejectedError
+			}
+		case net.Error:
+			return CAUnavailableError
+		case *os.PathError, *os.LinkError:
+			return FileSystemError
+		}
+		err = unwrap(err)
+	}
+	return UnknownError
+}
+
+// ExitCode returns the exit code for the given error. Errors without a class
+// use the code of the first cli.ExitCoder in the chain or 1.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if class := GetClass(err); class != UnknownError {
+		return int(class)
+	}
+	for e := err; e != nil; e = unwrap(e) {
+		if ec, ok := e.(cli.ExitCoder); ok {
+			return ec.ExitCode()
+		}
+	}
+	return int(UnknownError)
+}
+
+// MarshalError returns the JSON representation of the given error and message,
+// with the exit code, the class and the message. The message is not HTML
+// escaped, flag placeholders like <file> are kept.
+func MarshalError(err error, message string) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(struct {
+		Code    int    `json:"code"`
+		Class   string `json:"class"`
+		Message string `json:"message"`
+	}{ExitCode(err), GetClass(err).String(), message}); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// unwrap returns the next error in the chain of errors, or nil.
+func unwrap(err error) error {
+	switch e := err.(type) {
+	case interface{ Unwrap() error }:
+		return e.Unwrap()
+	case interface{ Cause() error }:
+		return e.Cause()
+	default:
+		return nil
+	}
+}
+
+// usageErrorf returns a new UsageError with the given format and arguments.
+func usageErrorf(format string, args ...interface{}) error {
+	return &ClassError{Class: UsageError, Err: errors.Errorf(format, args...)}
+}
+
+// usageError returns the given error as a UsageError.
+func usageError(err error) error {
+	return &ClassError{Class: UsageError, Err: err}
+}
+
+// fileErrorf returns a new FileSystemError with the given format and arguments.
+func fileErrorf(format string, args ...interface{}) error {
+	return &ClassError{Class: FileSystemError, Err: errors.Errorf(format, args...)}
+}
@@ -0,0 +1,117 @@
+package errs
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli"
+)
+
+type statusError int
+
+func (e statusError) Error() string   { return fmt.Sprintf("status %d", int(e)) }
+func (e statusError) StatusCode() int { return int(e) }
+
+func TestErrorClassCodes(t *testing.T) {
+	// These values are documented and must not change.
+	tests := []struct {
+		class ErrorClass
+		code  int
+		name  string
+	}{
+		{UnknownError, 1, "unknown"},
+		{UsageError, 3, "usage"},
+		{TokenError, 4, "token"},
+		{CARejectedError, 5, "ca-rejected"},
+		{CAUnavailableError, 6, "ca-unavailable"},
+		{FileSystemError, 7, "filesystem"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.code, int(tt.class))
+			require.Equal(t, tt.name, tt.class.String())
+		})
+	}
+}
+
+func TestGetClass(t *testing.T) {
+	ctx := cli.NewContext(&cli.App{Name: "step"}, flag.NewFlagSet("test", flag.ContinueOnError), nil)
+	ctx.Command = cli.Command{Name: "test"}
+	_, pathErr := os.Open("im-fairly-certain-this-file-doesnt-exist")
+	netErr := &url.Error{Op: "Post", URL: "https://ca.smallstep.com/ssh/sign", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}
+
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{"nil", nil, UnknownError},
+		{"unknown", errors.New("an error"), UnknownError},
+		{"usage/flag", IncompatibleFlagWithFlag(ctx, "foo", "bar"), UsageError},
+		{"usage/args", TooManyArguments(ctx), UsageError},
+		{"usage/invalid", InvalidFlagValue(ctx, "foo", "bar", "zar"), UsageError},
+		{"token", NewClassError(TokenError, errors.New("an error")), TokenError},
+		{"ca-rejected", statusError(401), CARejectedError},
+		{"ca-unavailable/status", statusError(503), CAUnavailableError},
+		{"ca-unavailable/network", netErr, CAUnavailableError},
+		{"filesystem/path", pathErr, FileSystemError},
+		{"filesystem/file", FileError(pathErr, "myfile"), FileSystemError},
+		{"wrapped/pkg", errors.Wrap(errors.Wrap(statusError(403), "foo"), "bar"), CARejectedError},
+		{"wrapped/fmt", fmt.Errorf("foo: %w", TooFewArguments(ctx)), UsageError},
+		{"wrapped/errs", Wrap(FileError(pathErr, "myfile"), "foo"), FileSystemError},
+		{"classify/keep", Classify(statusError(500), TokenError), CAUnavailableError},
+		{"classify/set", Classify(errors.New("an error"), TokenError), TokenError},
+		{"status/ok", statusError(200), UnknownError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, GetClass(tt.err))
+			if tt.err != nil {
+				require.Equal(t, int(tt.want), ExitCode(WithClass(tt.err)))
+			}
+		})
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	require.Equal(t, 0, ExitCode(nil))
+	require.Equal(t, 1, ExitCode(errors.New("an error")))
+	require.Equal(t, 3, ExitCode(errors.Wrap(usageErrorf("an error"), "foo")))
+	require.Equal(t, 42, ExitCode(errors.Wrap(cli.NewExitError("an error", 42), "foo")))
+
+	err := WithClass(errors.Wrap(statusError(401), "foo"))
+	ce, ok := err.(*ClassError)
+	require.True(t, ok)
+	require.Equal(t, 5, ce.ExitCode())
+	require.Equal(t, "foo: status 401", ce.Error())
+
+	err = errors.New("an error")
+	require.Equal(t, err, WithClass(err))
+	require.Equal(t, err, Classify(err, UnknownError))
+	require.Nil(t, WithClass(nil))
+}
+
+func TestMarshalError(t *testing.T) {
+	b, err := MarshalError(NewClassError(CARejectedError, errors.New("an error")), "a message")
+	require.NoError(t, err)
+
+	var m map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &m))
+	require.Equal(t, map[string]interface{}{
+		"code":    float64(5),
+		"class":   "ca-rejected",
+		"message": "a message",
+	}, m)
+
+	// Placeholders are not escaped
+	b, err = MarshalError(errors.New("missing <file>"), "missing <file> & <dir>")
+	require.NoError(t, err)
+	require.Equal(t, `{"code":1,"class":"unknown","message":"missing <file> & <dir>"}`, string(b))
+}
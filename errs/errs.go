@@ -23,32 +23,34 @@ func NewExitError(err error, exitCode int) error {
 // Wrap returns a new error wrapped by the given error with the given message.
 // If the given error implements the errors.Cause interface, the base error is
 // used. If the given error is wrapped by a package name, the error wrapped
-// will be the string after the last colon.
+// will be the string after the last colon. The class of the given error, if
+// any, is kept.
 func Wrap(err error, format string, args ...interface{}) error {
 	if err == nil {
 		return nil
 	}
+	class := GetClass(err)
 	cause := errors.Cause(err)
 	if cause == err {
 		str := err.Error()
 		if i := strings.LastIndexByte(str, ':'); i >= 0 {
 			str = strings.TrimSpace(str[i:])
-			return errors.Wrapf(fmt.Errorf(str), format, args...)
+			return Classify(errors.Wrapf(fmt.Errorf(str), format, args...), class)
 		}
 	}
-	return errors.Wrapf(cause, format, args...)
+	return Classify(errors.Wrapf(cause, format, args...), class)
 }
 
 // InsecureCommand returns an error with a message saying that the current
 // command requires the insecure flag.
 func InsecureCommand(ctx *cli.Context) error {
-	return errors.Errorf("'%s %s' requires the '--insecure' flag", ctx.App.Name, ctx.Command.Name)
+	return usageErrorf("'%s %s' requires the '--insecure' flag", ctx.App.Name, ctx.Command.Name)
 }
 
 // EqualArguments returns an error saying that the given positional arguments
 // cannot be equal.
 func EqualArguments(ctx *cli.Context, arg1, arg2 string) error {
-	return errors.Errorf("positional arguments <%s> and <%s> cannot be equal in '%s'", arg1, arg2, usage(ctx))
+	return usageErrorf("positional arguments <%s> and <%s> cannot be equal in '%s'", arg1, arg2, usage(ctx))
 }
 
 // MissingArguments returns an error with a missing arguments message for the
@@ -56,15 +58,15 @@ func EqualArguments(ctx *cli.Context, arg1, arg2 string) error {
 func MissingArguments(ctx *cli.Context, argNames ...string) error {
 	switch len(argNames) {
 	case 0:
-		return errors.Errorf("missing positional arguments in '%s'", usage(ctx))
+		return usageErrorf("missing positional arguments in '%s'", usage(ctx))
 	case 1:
-		return errors.Errorf("missing positional argument <%s> in '%s'", argNames[0], usage(ctx))
+		return usageErrorf("missing positional argument <%s> in '%s'", argNames[0], usage(ctx))
 	default:
 		args := make([]string, len(argNames))
 		for i, name := range argNames {
 			args[i] = "<" + name + ">"
 		}
-		return errors.Errorf("missing positional argument %s in '%s'", strings.Join(args, " "), usage(ctx))
+		return usageErrorf("missing positional argument %s in '%s'", strings.Join(args, " "), usage(ctx))
 	}
 }
 
@@ -100,25 +102,25 @@ func MinMaxNumberOfArguments(ctx *cli.Context, min, max int) error {
 
 // TooFewArguments returns an error with a few arguments were provided message.
 func TooFewArguments(ctx *cli.Context) error {
-	return errors.Errorf("not enough positional arguments were provided in '%s'", usage(ctx))
+	return usageErrorf("not enough positional arguments were provided in '%s'", usage(ctx))
 }
 
 // TooManyArguments returns an error with a too many arguments were provided
 // message.
 func TooManyArguments(ctx *cli.Context) error {
-	return errors.Errorf("too many positional arguments were provided in '%s'", usage(ctx))
+	return usageErrorf("too many positional arguments were provided in '%s'", usage(ctx))
 }
 
 // InsecureArgument returns an error with the given argument requiring the
 // --insecure flag.
 func InsecureArgument(ctx *cli.Context, name string) error {
-	return errors.Errorf("positional argument <%s> requires the '--insecure' flag", name)
+	return usageErrorf("positional argument <%s> requires the '--insecure' flag", name)
 }
 
 // FlagValueInsecure returns an error with the given flag and value requiring
 // the --insecure flag.
 func FlagValueInsecure(ctx *cli.Context, flag string, value string) error {
-	return errors.Errorf("flag '--%s %s' requires the '--insecure' flag", flag, value)
+	return usageErrorf("flag '--%s %s' requires the '--insecure' flag", flag, value)
 }
 
 // InvalidFlagValue returns an error with the given value being missing or
@@ -133,10 +135,10 @@ func InvalidFlagValue(ctx *cli.Context, flag string, value string, options strin
 	}
 
 	if len(options) == 0 {
-		return errors.New(format)
+		return usageError(errors.New(format))
 	}
 
-	return errors.New(format + "; options are " + options)
+	return usageError(errors.New(format + "; options are " + options))
 }
 
 // InvalidFlagValueMsg returns an error with the given value being missing or
@@ -151,29 +153,29 @@ func InvalidFlagValueMsg(ctx *cli.Context, flag string, value string, msg string
 	}
 
 	if len(msg) == 0 {
-		return errors.New(format)
+		return usageError(errors.New(format))
 	}
 
-	return errors.New(format + "; " + msg)
+	return usageError(errors.New(format + "; " + msg))
 }
 
 // IncompatibleFlag returns an error with the flag being incompatible with the
 // given value.
 func IncompatibleFlag(ctx *cli.Context, flag string, value string) error {
-	return errors.Errorf("flag '--%s' is incompatible with '%s'", flag, value)
+	return usageErrorf("flag '--%s' is incompatible with '%s'", flag, value)
 }
 
 // IncompatibleFlagWithFlag returns an error with the flag being incompatible with the
 // given value.
 func IncompatibleFlagWithFlag(ctx *cli.Context, flag string, withFlag string) error {
-	return errors.Errorf("flag '--%s' is incompatible with '--%s'", flag, withFlag)
+	return usageErrorf("flag '--%s' is incompatible with '--%s'", flag, withFlag)
 }
 
 // IncompatibleFlagValue returns an error with the flag being incompatible with the
 // given value.
 func IncompatibleFlagValue(ctx *cli.Context, flag, incompatibleWith,
 	incompatibleWithValue string) error {
-	return errors.Errorf("flag '--%s' is incompatible with flag '--%s %s'",
+	return usageErrorf("flag '--%s' is incompatible with flag '--%s %s'",
 		flag, incompatibleWith, incompatibleWithValue)
 }
 
@@ -181,7 +183,7 @@ func IncompatibleFlagValue(ctx *cli.Context, flag, incompatibleWith,
 // given value.
 func IncompatibleFlagValues(ctx *cli.Context, flag, value, incompatibleWith,
 	incompatibleWithValue string) error {
-	return errors.Errorf("flag '--%s %s' is incompatible with flag '--%s %s'",
+	return usageErrorf("flag '--%s %s' is incompatible with flag '--%s %s'",
 		flag, value, incompatibleWith, incompatibleWithValue)
 }
 
@@ -194,61 +196,61 @@ func IncompatibleFlagValueWithFlagValue(ctx *cli.Context, flag string, value str
 		flag, value, withFlag, withValue)
 
 	if len(options) == 0 {
-		return errors.New(format)
+		return usageError(errors.New(format))
 	}
 
-	return errors.Errorf("%s\n\n  Option(s): --%s %s", format, withFlag, options)
+	return usageErrorf("%s\n\n  Option(s): --%s %s", format, withFlag, options)
 }
 
 // RequiredFlag returns an error with the required flag message.
 func RequiredFlag(ctx *cli.Context, flag string) error {
-	return errors.Errorf("'%s %s' requires the '--%s' flag", ctx.App.HelpName,
+	return usageErrorf("'%s %s' requires the '--%s' flag", ctx.App.HelpName,
 		ctx.Command.Name, flag)
 }
 
 // RequiredWithFlag returns an error with the required flag message with another flag.
 func RequiredWithFlag(ctx *cli.Context, flag, required string) error {
-	return errors.Errorf("flag '--%s' requires the '--%s' flag", flag, required)
+	return usageErrorf("flag '--%s' requires the '--%s' flag", flag, required)
 }
 
 // RequiredWithFlagValue returns an error with the required flag message.
 func RequiredWithFlagValue(ctx *cli.Context, flag, value, required string) error {
-	return errors.Errorf("'--%s %s' requires the '--%s' flag", flag, value, required)
+	return usageErrorf("'--%s %s' requires the '--%s' flag", flag, value, required)
 }
 
 // RequiredWithProvisionerTypeFlag returns an error with the required flag message.
 func RequiredWithProvisionerTypeFlag(ctx *cli.Context, provisionerType, required string) error {
-	return errors.Errorf("provisioner type '%s' requires the '--%s' flag", provisionerType, required)
+	return usageErrorf("provisioner type '%s' requires the '--%s' flag", provisionerType, required)
 }
 
 // RequiredInsecureFlag returns an error with the given flag requiring the
 // insecure flag message.
 func RequiredInsecureFlag(ctx *cli.Context, flag string) error {
-	return errors.Errorf("flag '--%s' requires the '--insecure' flag", flag)
+	return usageErrorf("flag '--%s' requires the '--insecure' flag", flag)
 }
 
 // RequiredSubtleFlag returns an error with the given flag requiring the
 // subtle flag message..
 func RequiredSubtleFlag(ctx *cli.Context, flag string) error {
-	return errors.Errorf("flag '--%s' requires the '--subtle' flag", flag)
+	return usageErrorf("flag '--%s' requires the '--subtle' flag", flag)
 }
 
 // RequiredUnlessInsecureFlag returns an error with the required flag message unless
 // the insecure flag is used.
 func RequiredUnlessInsecureFlag(ctx *cli.Context, flag string) error {
-	return errors.Errorf("flag '--%s' is required unless the '--insecure' flag is provided", flag)
+	return usageErrorf("flag '--%s' is required unless the '--insecure' flag is provided", flag)
 }
 
 // RequiredUnlessFlag returns an error with the required flag message unless
 // the specified flag is used.
 func RequiredUnlessFlag(ctx *cli.Context, flag, unlessFlag string) error {
-	return errors.Errorf("flag '--%s' is required unless the '--%s' flag is provided", flag, unlessFlag)
+	return usageErrorf("flag '--%s' is required unless the '--%s' flag is provided", flag, unlessFlag)
 }
 
 // RequiredUnlessSubtleFlag returns an error with the required flag message unless
 // the subtle flag is used.
 func RequiredUnlessSubtleFlag(ctx *cli.Context, flag string) error {
-	return errors.Errorf("flag '--%s' is required unless the '--subtle' flag is provided", flag)
+	return usageErrorf("flag '--%s' is required unless the '--subtle' flag is provided", flag)
 }
 
 // RequiredOrFlag returns an error with a list of flags being required messages.
@@ -257,7 +259,7 @@ func RequiredOrFlag(ctx *cli.Context, flags ...string) error {
 	for i, flag := range flags {
 		params[i] = "--" + flag
 	}
-	return errors.Errorf("one of flag %s is required", strings.Join(params, " or "))
+	return usageErrorf("one of flag %s is required", strings.Join(params, " or "))
 }
 
 // RequiredWithOrFlag returns an error with a list of flags at least one of which
@@ -267,31 +269,31 @@ func RequiredWithOrFlag(ctx *cli.Context, withFlag string, flags ...string) erro
 	for i := 0; i < len(flags); i++ {
 		params[i] = "--" + flags[i]
 	}
-	return errors.Errorf("one of flag %s is required with flag --%s", strings.Join(params, " or "), withFlag)
+	return usageErrorf("one of flag %s is required with flag --%s", strings.Join(params, " or "), withFlag)
 }
 
 // MinSizeFlag returns an error with a greater or equal message message for
 // the given flag and size.
 func MinSizeFlag(ctx *cli.Context, flag string, size string) error {
-	return errors.Errorf("flag '--%s' must be greater or equal than %s", flag, size)
+	return usageErrorf("flag '--%s' must be greater or equal than %s", flag, size)
 }
 
 // MinSizeInsecureFlag returns an error with a requiring --insecure flag
 // message with the given flag an size.
 func MinSizeInsecureFlag(ctx *cli.Context, flag, size string) error {
-	return errors.Errorf("flag '--%s' requires at least %s unless '--insecure' flag is provided", flag, size)
+	return usageErrorf("flag '--%s' requires at least %s unless '--insecure' flag is provided", flag, size)
 }
 
 // MutuallyExclusiveFlags returns an error with mutually exclusive message for
 // the given flags.
 func MutuallyExclusiveFlags(ctx *cli.Context, flag1, flag2 string) error {
-	return errors.Errorf("flag '--%s' and flag '--%s' are mutually exclusive", flag1, flag2)
+	return usageErrorf("flag '--%s' and flag '--%s' are mutually exclusive", flag1, flag2)
 }
 
 // UnsupportedFlag returns an error with a message saying that the given flag is
 // not yet supported.
 func UnsupportedFlag(ctx *cli.Context, flag string) error {
-	return errors.Errorf("flag '--%s' is not yet supported", flag)
+	return usageErrorf("flag '--%s' is not yet supported", flag)
 }
 
 // usage returns the command usage text if set or a default usage string.
@@ -311,13 +313,13 @@ func FileError(err error, filename string) error {
 	}
 	switch e := err.(type) {
 	case *os.PathError:
-		return errors.Errorf("%s %s failed: %v", e.Op, e.Path, e.Err)
+		return fileErrorf("%s %s failed: %v", e.Op, e.Path, e.Err)
 	case *os.LinkError:
-		return errors.Errorf("%s %s %s failed: %v", e.Op, e.Old, e.New, e.Err)
+		return fileErrorf("%s %s %s failed: %v", e.Op, e.Old, e.New, e.Err)
 	case *os.SyscallError:
-		return errors.Errorf("%s failed: %v", e.Syscall, e.Err)
+		return fileErrorf("%s failed: %v", e.Syscall, e.Err)
 	default:
-		return Wrap(err, "unexpected error on %s", filename)
+		return NewClassError(FileSystemError, Wrap(err, "unexpected error on %s", filename))
 	}
 }
 
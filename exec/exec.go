@@ -124,6 +124,12 @@ func OpenInBrowser(url string, browser string) error {
 	return errors.WithStack(cmd.Start())
 }
 
+// IsBrowserDisabled returns true if the BROWSER environment variable is set to
+// "none", the convention used to disable opening web browsers.
+func IsBrowserDisabled() bool {
+	return strings.EqualFold(os.Getenv("BROWSER"), "none")
+}
+
 // Step executes step with the given commands and returns the standard output.
 func Step(args ...string) ([]byte, error) {
 	var stdout bytes.Buffer
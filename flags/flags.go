@@ -4,12 +4,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/cli/command"
 	"github.com/smallstep/cli/config"
 	"github.com/smallstep/cli/errs"
 	"github.com/smallstep/cli/utils"
@@ -125,7 +129,7 @@ certificate.`,
 used it is expected to be in RFC 3339 format. If a <duration> is used, it is a
 sequence of decimal numbers, each with optional fraction and a unit suffix, such
 as "300ms", "-1.5h" or "2h45m". Valid time units are "ns", "us" (or "µs"), "ms",
-"s", "m", "h".`,
+"s", "m", "h", "d".`,
 	}
 
 	// NotAfter is a cli.Flag used to pass the end period of the certificate
@@ -136,7 +140,16 @@ as "300ms", "-1.5h" or "2h45m". Valid time units are "ns", "us" (or "µs"), "ms"
 used it is expected to be in RFC 3339 format. If a <duration> is used, it is a
 sequence of decimal numbers, each with optional fraction and a unit suffix, such
 as "300ms", "-1.5h" or "2h45m". Valid time units are "ns", "us" (or "µs"), "ms",
-"s", "m", "h".`,
+"s", "m", "h", "d".`,
+	}
+
+	// TTL is a cli.Flag used to pass the lifetime of a certificate relative to
+	// the current time.
+	TTL = cli.StringFlag{
+		Name: "ttl",
+		Usage: `The <duration> for which the certificate will be valid, starting now. It is a
+shorthand for **--not-after**=<duration> and cannot be used in conjunction with
+it. Valid time units are "ns", "us" (or "µs"), "ms", "s", "m", "h", "d".`,
 	}
 
 	// Provisioner is a cli.Flag used to pass the CA provisioner to use.
@@ -153,6 +166,16 @@ as "300ms", "-1.5h" or "2h45m". Valid time units are "ns", "us" (or "µs"), "ms"
 generating key.`,
 	}
 
+	// ProvisionerPasswordStdin is a cli.Flag used to read the password to
+	// decrypt the generating key from STDIN.
+	ProvisionerPasswordStdin = cli.BoolFlag{
+		Name: "provisioner-password-stdin",
+		Usage: `Read the password to decrypt the one-time token generating key from the first
+line of STDIN. The password can also be set using the STEP_PROVISIONER_PASSWORD
+environment variable. The order of precedence is **--provisioner-password-file**,
+**--provisioner-password-stdin**, STEP_PROVISIONER_PASSWORD and asking for it.`,
+	}
+
 	// ProvisionerPasswordFileWithAlias is a cli.Flag that allows multiple
 	// alias flag names for the ProvisionerPasswordFile.
 	ProvisionerPasswordFileWithAlias = cli.StringFlag{
@@ -167,12 +190,43 @@ generating key.`,
 		Usage: "<URI> of the targeted Step Certificate Authority.",
 	}
 
+	// CaTimeout is a cli.Flag used to set the timeout of the requests to the
+	// CA.
+	CaTimeout = cli.DurationFlag{
+		Name: "ca-timeout",
+		Usage: `The maximum <duration> of each request to the CA, e.g. "10s" or "1m". By
+default there is no timeout.`,
+	}
+
+	// CaRetries is a cli.Flag used to set the number of times a request to the
+	// CA is retried.
+	CaRetries = cli.IntFlag{
+		Name: "ca-retries",
+		Usage: `The number of times a request to the CA is retried, using an exponential
+backoff, if it fails with a connection error, a timeout or a 5xx response.
+Requests rejected by the CA with a 4xx response, and requests with a one-time
+token that time out, are never retried. Defaults to 0.`,
+	}
+
 	// Root is a cli.Flag used to pass the path of the root certificate to use.
 	Root = cli.StringFlag{
 		Name:  "root",
 		Usage: "The path to the PEM <file> used as the root certificate authority.",
 	}
 
+	// Fingerprint is a cli.Flag used to pin the root certificate of the CA
+	// instead of using a root file.
+	Fingerprint = cli.StringFlag{
+		Name: "fingerprint",
+		Usage: `The SHA-256 <fingerprint> of the root certificate of the CA. The root
+certificate will be downloaded from the CA using an untrusted connection and
+verified using the fingerprint, it will be used instead of **--root** and it
+will not be stored.`,
+		// Avoid reading the fingerprint from defaults.json, it is written by
+		// step ca bootstrap with the root file.
+		EnvVar: command.IgnoreEnvVar,
+	}
+
 	// Offline is a cli.Flag used to activate the offline flow.
 	Offline = cli.BoolFlag{
 		Name: "offline",
@@ -245,6 +299,15 @@ be stored in the 'sshpop' header.`,
 the **--team** option. If the url contains <\<\>> placeholders, they are replaced with the team ID.`,
 	}
 
+	// Console is a cli.Flag used to complete the OAuth flows without opening a
+	// browser.
+	Console = cli.BoolFlag{
+		Name: "console",
+		Usage: `Complete the flow while remaining inside the terminal. The verification URL
+will be printed and the authorization code will be asked. This is the default
+if the BROWSER environment variable is set to "none".`,
+	}
+
 	// RedirectURL is a cli.Flag used to pass the OAuth redirect URL.
 	RedirectURL = cli.StringFlag{
 		Name:  "redirect-url",
@@ -288,7 +351,7 @@ func ParseTimeOrDuration(s string) (time.Time, bool) {
 
 	var t time.Time
 	if err := t.UnmarshalText([]byte(s)); err != nil {
-		d, err := time.ParseDuration(s)
+		d, err := ParseDuration(s)
 		if err != nil {
 			return time.Time{}, false
 		}
@@ -297,17 +360,110 @@ func ParseTimeOrDuration(s string) (time.Time, bool) {
 	return t, true
 }
 
-// ParseTimeDuration parses the not-before and not-after flags as a timeDuration
+// ParseDuration parses a duration string like time.ParseDuration does, but it
+// also accepts the unit "d" for days, e.g. "7d" or "1d12h". A day is always
+// considered 24 hours.
+func ParseDuration(s string) (time.Duration, error) {
+	i := strings.IndexByte(s, 'd')
+	if i == -1 {
+		return time.ParseDuration(s)
+	}
+
+	// Split the days from the rest of the duration, the sign goes with the
+	// days.
+	days, rest := s[:i], s[i+1:]
+	neg := strings.HasPrefix(days, "-")
+	days = strings.TrimLeft(days, "+-")
+	if days == "" || strings.Trim(days, "0123456789.") != "" {
+		return 0, errors.Errorf("time: invalid duration %q", s)
+	}
+	n, err := strconv.ParseFloat(days, 64)
+	if err != nil {
+		return 0, errors.Errorf("time: invalid duration %q", s)
+	}
+	d := time.Duration(n * float64(24*time.Hour))
+	if rest != "" {
+		if strings.HasPrefix(rest, "-") || strings.HasPrefix(rest, "+") {
+			return 0, errors.Errorf("time: invalid duration %q", s)
+		}
+		r, err := time.ParseDuration(rest)
+		if err != nil {
+			return 0, errors.Errorf("time: invalid duration %q", s)
+		}
+		d += r
+	}
+	if neg {
+		d = -d
+	}
+	return d, nil
+}
+
+// parseTimeDuration returns a new api.TimeDuration parsing the RFC 3339 time
+// or duration string. Durations support the "d" unit.
+func parseTimeDuration(s string) (api.TimeDuration, error) {
+	if td, err := api.ParseTimeDuration(s); err == nil {
+		return td, nil
+	}
+	var td api.TimeDuration
+	d, err := ParseDuration(s)
+	if err != nil {
+		return td, err
+	}
+	td.SetDuration(d)
+	return td, nil
+}
+
+// ParseTimeDuration parses the not-before and not-after flags as a
+// timeDuration. If the command defines the ttl flag, it will be used as a
+// not-after duration relative to the current time.
+//
+// It returns an error if the not-after is not after the not-before, using the
+// current time if the not-before is not set.
 func ParseTimeDuration(ctx *cli.Context) (notBefore api.TimeDuration, notAfter api.TimeDuration, err error) {
 	var zero api.TimeDuration
-	notBefore, err = api.ParseTimeDuration(ctx.String("not-before"))
+	notBefore, err = parseTimeDuration(ctx.String("not-before"))
 	if err != nil {
 		return zero, zero, errs.InvalidFlagValue(ctx, "not-before", ctx.String("not-before"), "")
 	}
-	notAfter, err = api.ParseTimeDuration(ctx.String("not-after"))
+	notAfter, err = parseTimeDuration(ctx.String("not-after"))
 	if err != nil {
 		return zero, zero, errs.InvalidFlagValue(ctx, "not-after", ctx.String("not-after"), "")
 	}
+
+	notAfterFlag := "not-after"
+	if ttl := ctx.String("ttl"); ttl != "" {
+		if ctx.String("not-after") != "" {
+			return zero, zero, errs.IncompatibleFlagWithFlag(ctx, "ttl", "not-after")
+		}
+		d, err := ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return zero, zero, errs.InvalidFlagValueMsg(ctx, "ttl", ttl, "must be a positive duration")
+		}
+		notAfter.SetDuration(d)
+		notAfterFlag = "ttl"
+	}
+
+	if notAfter.IsZero() {
+		return
+	}
+
+	// Compare copies, RelativeTime caches the time if a duration is used.
+	now := time.Now()
+	nb, na := notBefore, notAfter
+	nbTime, naTime := nb.RelativeTime(now), na.RelativeTime(now)
+	if notBefore.IsZero() {
+		nbTime = now.UTC()
+	}
+	if !naTime.After(nbTime) {
+		if notBefore.IsZero() {
+			return zero, zero, errs.InvalidFlagValueMsg(ctx, notAfterFlag, ctx.String(notAfterFlag),
+				fmt.Sprintf("not-after %s is not after the current time %s",
+					naTime.Format(time.RFC3339), nbTime.Format(time.RFC3339)))
+		}
+		return zero, zero, errs.InvalidFlagValueMsg(ctx, notAfterFlag, ctx.String(notAfterFlag),
+			fmt.Sprintf("not-after %s is not after not-before %s",
+				naTime.Format(time.RFC3339), nbTime.Format(time.RFC3339)))
+	}
 	return
 }
 
@@ -349,6 +505,60 @@ func ParseTemplateData(ctx *cli.Context) (json.RawMessage, error) {
 	return json.Marshal(data)
 }
 
+// ProvisionerPasswordEnv is the environment variable with the password to
+// decrypt the one-time token generating key.
+const ProvisionerPasswordEnv = "STEP_PROVISIONER_PASSWORD"
+
+// provisionerPasswordStdin caches the password read from STDIN, as it can only
+// be read once.
+var provisionerPasswordStdin struct {
+	sync.Once
+	password []byte
+	err      error
+}
+
+// ParseProvisionerPassword returns the password to decrypt the one-time token
+// generating key. The password is read from the file in
+// --provisioner-password-file, from the first line of STDIN if
+// --provisioner-password-stdin is used, or from the STEP_PROVISIONER_PASSWORD
+// environment variable, in that order. It returns nil if none of them is set
+// and the password must be asked.
+func ParseProvisionerPassword(ctx *cli.Context) ([]byte, error) {
+	switch {
+	case ctx.String("provisioner-password-file") != "":
+		return utils.ReadPasswordFromFile(ctx.String("provisioner-password-file"))
+	case ctx.Bool("provisioner-password-stdin"):
+		provisionerPasswordStdin.Do(func() {
+			provisionerPasswordStdin.password, provisionerPasswordStdin.err = utils.ReadPasswordFromStdin()
+		})
+		return provisionerPasswordStdin.password, provisionerPasswordStdin.err
+	case os.Getenv(ProvisionerPasswordEnv) != "":
+		return []byte(os.Getenv(ProvisionerPasswordEnv)), nil
+	default:
+		return nil, nil
+	}
+}
+
+// ExpandPathFlags replaces the value of each of the given flags, if set, with
+// the path returned by utils.ExpandPath. A leading "~" or "~user" and the
+// environment variables are expanded and the path is made absolute.
+func ExpandPathFlags(ctx *cli.Context, names ...string) error {
+	for _, name := range names {
+		v := ctx.String(name)
+		if v == "" {
+			continue
+		}
+		path, err := utils.ExpandPath(v)
+		if err != nil {
+			return errs.InvalidFlagValueMsg(ctx, name, v, err.Error())
+		}
+		if err := ctx.Set(name, path); err != nil {
+			return errors.Wrapf(err, "error setting flag '--%s'", name)
+		}
+	}
+	return nil
+}
+
 // ParseCaURL gets and parses the ca-url from the command context.
 //  - Require non-empty value.
 //  - Prepend an 'https' scheme if the URL does not have a scheme.
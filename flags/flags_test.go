@@ -4,9 +4,14 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/api"
 	"github.com/urfave/cli"
 )
 
@@ -97,3 +102,160 @@ func Test_parseCaURL(t *testing.T) {
 		})
 	}
 }
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"ok/minutes", "30m", 30 * time.Minute, false},
+		{"ok/hours", "16h", 16 * time.Hour, false},
+		{"ok/days", "7d", 7 * 24 * time.Hour, false},
+		{"ok/fraction-days", "1.5d", 36 * time.Hour, false},
+		{"ok/days-hours", "1d12h", 36 * time.Hour, false},
+		{"ok/negative-days", "-1d2h", -26 * time.Hour, false},
+		{"fail/empty-days", "d", 0, true},
+		{"fail/bad-days", "xd", 0, true},
+		{"fail/days-after-hours", "1h2d", 0, true},
+		{"fail/bad-rest", "1d2x", 0, true},
+		{"fail/signed-rest", "1d-2h", 0, true},
+		{"fail/no-unit", "10", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseDuration(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseDuration() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ParseDuration() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTimeDuration(t *testing.T) {
+	newContext := func(notBefore, notAfter, ttl string) *cli.Context {
+		app := &cli.App{}
+		set := flag.NewFlagSet("contrive", 0)
+		_ = set.String("not-before", "", "")
+		_ = set.String("not-after", "", "")
+		_ = set.String("ttl", "", "")
+		ctx := cli.NewContext(app, set, nil)
+		ctx.Set("not-before", notBefore)
+		ctx.Set("not-after", notAfter)
+		ctx.Set("ttl", ttl)
+		return ctx
+	}
+
+	now := time.Now().UTC()
+	rfc := func(t time.Time) string {
+		return t.Format(time.RFC3339)
+	}
+	duration := func(d time.Duration) api.TimeDuration {
+		var td api.TimeDuration
+		td.SetDuration(d)
+		return td
+	}
+
+	type test struct {
+		name                  string
+		notBefore, notAfter   string
+		ttl                   string
+		wantBefore, wantAfter api.TimeDuration
+		err                   error
+	}
+	tests := []test{
+		{name: "ok/empty"},
+		{name: "ok/durations", notBefore: "1h", notAfter: "2h", wantBefore: duration(time.Hour), wantAfter: duration(2 * time.Hour)},
+		{name: "ok/days", notAfter: "7d", wantAfter: duration(7 * 24 * time.Hour)},
+		{name: "ok/ttl", ttl: "16h", wantAfter: duration(16 * time.Hour)},
+		{name: "ok/ttl-days", ttl: "2d", wantAfter: duration(48 * time.Hour)},
+		{name: "ok/times", notBefore: rfc(now), notAfter: rfc(now.Add(time.Hour)),
+			wantBefore: api.NewTimeDuration(now.Truncate(time.Second)), wantAfter: api.NewTimeDuration(now.Add(time.Hour).Truncate(time.Second))},
+		{name: "fail/not-before", notBefore: "foo", err: errors.New("invalid value 'foo' for flag '--not-before'")},
+		{name: "fail/not-after", notAfter: "foo", err: errors.New("invalid value 'foo' for flag '--not-after'")},
+		{name: "fail/ttl-and-not-after", notAfter: "1h", ttl: "1h", err: errors.New("flag '--ttl' is incompatible with '--not-after'")},
+		{name: "fail/ttl-negative", ttl: "-1h", err: errors.New("invalid value '-1h' for flag '--ttl'; must be a positive duration")},
+		{name: "fail/ttl-time", ttl: rfc(now), err: errors.New("invalid value '" + rfc(now) + "' for flag '--ttl'; must be a positive duration")},
+		{name: "fail/order", notBefore: "2h", notAfter: "1h", err: errors.New("invalid value '1h' for flag '--not-after'; not-after ")},
+		{name: "fail/order-times", notBefore: rfc(now.Add(time.Hour)), notAfter: rfc(now),
+			err: fmt.Errorf("invalid value '%s' for flag '--not-after'; not-after %s is not after not-before %s", rfc(now), rfc(now), rfc(now.Add(time.Hour)))},
+		{name: "fail/order-ttl", notBefore: "2h", ttl: "1h", err: errors.New("invalid value '1h' for flag '--ttl'; not-after ")},
+		{name: "fail/past", notAfter: "-1h", err: errors.New("invalid value '-1h' for flag '--not-after'; not-after ")},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := newContext(tc.notBefore, tc.notAfter, tc.ttl)
+			notBefore, notAfter, err := ParseTimeDuration(ctx)
+			if err != nil && assert.NotNil(t, tc.err, fmt.Sprintf("expected no error but got <%s>", err)) {
+				assert.HasPrefix(t, err.Error(), tc.err.Error())
+			} else if assert.Nil(t, tc.err, fmt.Sprintf("expected error <%s> but got nil", tc.err)) {
+				assert.True(t, tc.wantBefore.Equal(&notBefore), fmt.Sprintf("unexpected not-before %v", notBefore))
+				assert.True(t, tc.wantAfter.Equal(&notAfter), fmt.Sprintf("unexpected not-after %v", notAfter))
+			}
+		})
+	}
+}
+
+func TestParseProvisionerPassword(t *testing.T) {
+	f, err := ioutil.TempFile("", "step-provisioner-password")
+	assert.FatalError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("password-in-file\n")
+	assert.FatalError(t, err)
+	assert.FatalError(t, f.Close())
+
+	newContext := func(passwordFile string) *cli.Context {
+		set := flag.NewFlagSet("contrive", 0)
+		_ = set.String("provisioner-password-file", passwordFile, "")
+		_ = set.Bool("provisioner-password-stdin", false, "")
+		return cli.NewContext(&cli.App{}, set, nil)
+	}
+
+	oldEnv, hasEnv := os.LookupEnv(ProvisionerPasswordEnv)
+	defer func() {
+		if hasEnv {
+			os.Setenv(ProvisionerPasswordEnv, oldEnv)
+		} else {
+			os.Unsetenv(ProvisionerPasswordEnv)
+		}
+	}()
+
+	// Ask for the password
+	os.Unsetenv(ProvisionerPasswordEnv)
+	password, err := ParseProvisionerPassword(newContext(""))
+	assert.NoError(t, err)
+	assert.Nil(t, password)
+
+	// Environment variable
+	os.Setenv(ProvisionerPasswordEnv, "password-in-env")
+	password, err = ParseProvisionerPassword(newContext(""))
+	assert.NoError(t, err)
+	assert.Equals(t, []byte("password-in-env"), password)
+
+	// The file has precedence over the environment variable
+	password, err = ParseProvisionerPassword(newContext(f.Name()))
+	assert.NoError(t, err)
+	assert.Equals(t, []byte("password-in-file"), password)
+
+	_, err = ParseProvisionerPassword(newContext(f.Name() + ".missing"))
+	assert.Error(t, err)
+}
+
+func TestExpandPathFlags(t *testing.T) {
+	wd, err := os.Getwd()
+	assert.FatalError(t, err)
+
+	set := flag.NewFlagSet("contrive", 0)
+	_ = set.String("password-file", "key.pass", "")
+	_ = set.String("root", "", "")
+	ctx := cli.NewContext(&cli.App{}, set, nil)
+
+	assert.NoError(t, ExpandPathFlags(ctx, "password-file", "root", "missing"))
+	assert.Equals(t, filepath.Join(wd, "key.pass"), ctx.String("password-file"))
+	assert.Equals(t, "", ctx.String("root"))
+}
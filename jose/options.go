@@ -10,6 +10,7 @@ type context struct {
 	subtle, insecure bool
 	noDefaults       bool
 	password         []byte
+	passwordPrompter PasswordPrompter
 	uiOptions        []ui.Option
 }
 
@@ -96,6 +97,20 @@ func WithPasswordFile(filename string) Option {
 	}
 }
 
+// PasswordPrompter is the function used to ask for a password, it has the same
+// signature as ui.PromptPassword.
+type PasswordPrompter func(prompt string, opts ...ui.Option) ([]byte, error)
+
+// WithPasswordPrompter sets the function used to ask for the password,
+// ui.PromptPassword by default. It is called with the UI options of the
+// context.
+func WithPasswordPrompter(fn PasswordPrompter) Option {
+	return func(ctx *context) error {
+		ctx.passwordPrompter = fn
+		return nil
+	}
+}
+
 // WithUIOptions adds UI package options to the password prompts.
 func WithUIOptions(opts ...ui.Option) Option {
 	return func(ctx *context) error {
@@ -49,9 +49,13 @@ func Decrypt(prompt string, data []byte, opts ...Option) ([]byte, error) {
 
 	// Decrypt flow
 	var pass []byte
+	prompter := ctx.passwordPrompter
+	if prompter == nil {
+		prompter = ui.PromptPassword
+	}
 	for i := 0; i < MaxDecryptTries; i++ {
 		if len(ctx.password) == 0 {
-			pass, err = ui.PromptPassword(prompt, ctx.uiOptions...)
+			pass, err = prompter(prompt, ctx.uiOptions...)
 			if err != nil {
 				return nil, err
 			}
@@ -8,10 +8,12 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/base64"
+	"encoding/json"
 	"strings"
 	"testing"
 
 	"github.com/smallstep/assert"
+	"github.com/smallstep/cli/ui"
 )
 
 const (
@@ -226,3 +228,31 @@ func TestGuessJWKAlgorithm(t *testing.T) {
 		assert.Equals(t, tc.expected, tc.jwk.Algorithm)
 	}
 }
+
+func TestDecryptPasswordPrompter(t *testing.T) {
+	_, jwe, err := GenerateDefaultKeyPair([]byte("password"))
+	assert.FatalError(t, err)
+	data, err := jwe.CompactSerialize()
+	assert.FatalError(t, err)
+
+	var prompts []string
+	passwords := [][]byte{[]byte("wrong"), []byte("password")}
+	prompter := func(prompt string, opts ...ui.Option) ([]byte, error) {
+		prompts = append(prompts, prompt)
+		pass := passwords[0]
+		passwords = passwords[1:]
+		return pass, nil
+	}
+	b, err := Decrypt("Please enter the password", []byte(data), WithPasswordPrompter(prompter))
+	assert.FatalError(t, err)
+	assert.Equals(t, []string{"Please enter the password", "Please enter the password"}, prompts)
+	jwk := new(JSONWebKey)
+	assert.FatalError(t, json.Unmarshal(b, jwk))
+	assert.False(t, jwk.IsPublic())
+
+	// The password has precedence
+	prompts = nil
+	_, err = Decrypt("Please enter the password", []byte(data), WithPassword([]byte("password")), WithPasswordPrompter(prompter))
+	assert.FatalError(t, err)
+	assert.Len(t, 0, prompts)
+}
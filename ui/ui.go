@@ -261,6 +261,11 @@ func Select(label string, items interface{}, opts ...Option) (int, string, error
 	return n, s, nil
 }
 
+// IsTerminal returns true if the standard input is a terminal.
+func IsTerminal() bool {
+	return readline.IsTerminal(int(os.Stdin.Fd()))
+}
+
 func preparePromptTerminal() (func(), error) {
 	nothing := func() {}
 	if !readline.DefaultIsTerminal() {
@@ -31,8 +31,10 @@ import (
 
 // CertificateFlow manages the flow to retrieve a new certificate.
 type CertificateFlow struct {
-	offlineCA *OfflineCA
-	offline   bool
+	offlineCA   *OfflineCA
+	offline     bool
+	fingerprint string
+	pinnedRoot  string
 }
 
 // sharedContext is used to share information between commands.
@@ -57,20 +59,75 @@ func NewCertificateFlow(ctx *cli.Context) (*CertificateFlow, error) {
 		}
 	}
 
+	// Download the root certificate pinned with --fingerprint, this is done
+	// before generating any token.
+	var pinnedRoot string
+	fingerprint := ctx.String("fingerprint")
+	if fingerprint != "" {
+		switch {
+		case offline:
+			return nil, errs.IncompatibleFlagWithFlag(ctx, "fingerprint", "offline")
+		case ctx.String("root") != "":
+			return nil, errs.IncompatibleFlagWithFlag(ctx, "fingerprint", "root")
+		}
+		caURL, err := flags.ParseCaURL(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if pinnedRoot, err = downloadRoot(caURL, fingerprint); err != nil {
+			return nil, err
+		}
+	}
+
 	return &CertificateFlow{
-		offlineCA: offlineClient,
-		offline:   offline,
+		offlineCA:   offlineClient,
+		offline:     offline,
+		fingerprint: fingerprint,
+		pinnedRoot:  pinnedRoot,
 	}, nil
 }
 
-// GetClient returns the client used to send requests to the CA.
+// Close removes the root certificate downloaded using --fingerprint.
+func (f *CertificateFlow) Close() error {
+	if f.pinnedRoot == "" {
+		return nil
+	}
+	return os.Remove(f.pinnedRoot)
+}
+
+// root returns the root certificate pinned with --fingerprint or the one in
+// the --root flag.
+func (f *CertificateFlow) root(ctx *cli.Context) string {
+	if f.pinnedRoot != "" {
+		return f.pinnedRoot
+	}
+	return ctx.String("root")
+}
+
+// RootError adds the root certificate or the fingerprint used to the given
+// error if it is an error verifying the certificate of the CA. This makes
+// possible to distinguish a fingerprint mismatch from an expired root.
+func (f *CertificateFlow) RootError(ctx *cli.Context, err error) error {
+	if f.offline || err == nil {
+		return err
+	}
+	root := f.root(ctx)
+	if root == "" {
+		root = pki.GetRootCAPath()
+	}
+	return rootError(err, root, f.fingerprint)
+}
+
+// GetClient returns the client used to send requests to the CA. The requests
+// to an online CA are retried using the flags `ca-retries` and `ca-timeout` if
+// present.
 func (f *CertificateFlow) GetClient(ctx *cli.Context, tok string, options ...ca.ClientOption) (CaClient, error) {
 	if f.offline {
 		return f.offlineCA, nil
 	}
 
 	// Create online client
-	root := ctx.String("root")
+	root := f.root(ctx)
 	caURL, err := flags.ParseCaURLIfExists(ctx)
 	if err != nil {
 		return nil, err
@@ -81,11 +138,12 @@ func (f *CertificateFlow) GetClient(ctx *cli.Context, tok string, options ...ca.
 		return nil, errors.Wrap(err, "error parsing flag '--token'")
 	}
 	// Prepare client for bootstrap or provisioning tokens
+	var rootOption ca.ClientOption
 	if len(jwt.Payload.SHA) > 0 && len(jwt.Payload.Audience) > 0 && strings.HasPrefix(strings.ToLower(jwt.Payload.Audience[0]), "http") {
 		if len(caURL) == 0 {
 			caURL = jwt.Payload.Audience[0]
 		}
-		options = append(options, ca.WithRootSHA256(jwt.Payload.SHA))
+		rootOption = ca.WithRootSHA256(jwt.Payload.SHA)
 	} else {
 		if len(caURL) == 0 {
 			return nil, errs.RequiredFlag(ctx, "ca-url")
@@ -96,11 +154,19 @@ func (f *CertificateFlow) GetClient(ctx *cli.Context, tok string, options ...ca.
 				return nil, errs.RequiredFlag(ctx, "root")
 			}
 		}
-		options = append(options, ca.WithRootFile(root))
+		rootOption = ca.WithRootFile(root)
+	}
+	if rootOption, err = withTimeout(ctx, caURL, rootOption); err != nil {
+		return nil, err
 	}
+	options = append(options, rootOption)
 
 	ui.PrintSelected("CA", caURL)
-	return ca.NewClient(caURL, options...)
+	client, err := ca.NewClient(caURL, options...)
+	if err != nil {
+		return nil, err
+	}
+	return WithRetries(ctx, client)
 }
 
 // GenerateToken generates a token for immediate use (therefore only default
@@ -119,7 +185,7 @@ func (f *CertificateFlow) GenerateToken(ctx *cli.Context, subject string, sans [
 		return "", errs.RequiredUnlessFlag(ctx, "ca-url", "token")
 	}
 
-	root := ctx.String("root")
+	root := f.root(ctx)
 	if len(root) == 0 {
 		root = pki.GetRootCAPath()
 		if _, err := os.Stat(root); err != nil {
@@ -138,10 +204,11 @@ func (f *CertificateFlow) GenerateToken(ctx *cli.Context, subject string, sans [
 }
 
 // GenerateSSHToken generates a token used to authorize the sign of an SSH
-// certificate.
-func (f *CertificateFlow) GenerateSSHToken(ctx *cli.Context, subject string, typ int, principals []string, validAfter, validBefore provisioner.TimeDuration) (string, error) {
+// certificate. The options can be used to set the password of the provisioner
+// instead of reading it from the flags.
+func (f *CertificateFlow) GenerateSSHToken(ctx *cli.Context, subject string, typ int, principals []string, validAfter, validBefore provisioner.TimeDuration, opts ...TokenOption) (string, error) {
 	if f.offline {
-		return f.offlineCA.GenerateToken(ctx, typ, subject, principals, time.Time{}, time.Time{}, validAfter, validBefore)
+		return f.offlineCA.GenerateToken(ctx, typ, subject, principals, time.Time{}, time.Time{}, validAfter, validBefore, opts...)
 	}
 
 	// Use online CA to get the provisioners and generate the token
@@ -152,7 +219,7 @@ func (f *CertificateFlow) GenerateSSHToken(ctx *cli.Context, subject string, typ
 		return "", errs.RequiredUnlessFlag(ctx, "ca-url", "token")
 	}
 
-	root := ctx.String("root")
+	root := f.root(ctx)
 	if len(root) == 0 {
 		root = pki.GetRootCAPath()
 		if _, err := os.Stat(root); err != nil {
@@ -167,7 +234,7 @@ func (f *CertificateFlow) GenerateSSHToken(ctx *cli.Context, subject string, typ
 		}
 	}
 
-	return NewTokenFlow(ctx, typ, subject, principals, caURL, root, time.Time{}, time.Time{}, validAfter, validBefore)
+	return NewTokenFlow(ctx, typ, subject, principals, caURL, root, time.Time{}, time.Time{}, validAfter, validBefore, opts...)
 }
 
 // GenerateIdentityToken generates a token using only an OIDC provisioner.
@@ -176,7 +243,7 @@ func (f *CertificateFlow) GenerateIdentityToken(ctx *cli.Context) (string, error
 	if err != nil {
 		return "", err
 	}
-	root := ctx.String("root")
+	root := f.root(ctx)
 	if len(root) == 0 {
 		root = pki.GetRootCAPath()
 		if _, err := os.Stat(root); err != nil {
@@ -34,7 +34,8 @@ type CaClient interface {
 }
 
 // NewClient returns a client of an online or offline CA. Requires the flags
-// `offline`, `ca-config`, `ca-url`, and `root`.
+// `offline`, `ca-config`, `ca-url`, and `root`. The requests to an online CA
+// are retried using the flags `ca-retries` and `ca-timeout` if present.
 func NewClient(ctx *cli.Context, opts ...ca.ClientOption) (CaClient, error) {
 	if ctx.Bool("offline") {
 		caConfig := ctx.String("ca-config")
@@ -55,6 +56,14 @@ func NewClient(ctx *cli.Context, opts ...ca.ClientOption) (CaClient, error) {
 			return nil, errs.RequiredFlag(ctx, "root")
 		}
 	}
-	opts = append([]ca.ClientOption{ca.WithRootFile(root)}, opts...)
-	return ca.NewClient(caURL, opts...)
+	rootOption, err := withTimeout(ctx, caURL, ca.WithRootFile(root))
+	if err != nil {
+		return nil, err
+	}
+	opts = append([]ca.ClientOption{rootOption}, opts...)
+	client, err := ca.NewClient(caURL, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return WithRetries(ctx, client)
 }
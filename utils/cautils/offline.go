@@ -462,18 +462,12 @@ func (c *OfflineCA) SSHBastion(req *api.SSHBastionRequest) (*api.SSHBastionRespo
 }
 
 // GenerateToken creates the token used by the authority to authorize requests.
-func (c *OfflineCA) GenerateToken(ctx *cli.Context, tokType int, subject string, sans []string, notBefore, notAfter time.Time, certNotBefore, certNotAfter provisioner.TimeDuration) (string, error) {
+func (c *OfflineCA) GenerateToken(ctx *cli.Context, tokType int, subject string, sans []string, notBefore, notAfter time.Time, certNotBefore, certNotAfter provisioner.TimeDuration, opts ...TokenOption) (string, error) {
 	// Use ca.json configuration for the root and audience
 	root := c.Root()
 	audience := c.Audience(tokType)
 
 	// Get provisioner to use
-	provisioners := c.Provisioners()
-	p, err := provisionerPrompt(ctx, provisioners)
-	if err != nil {
-		return "", err
-	}
-
 	tokAttrs := tokenAttrs{
 		subject:       subject,
 		root:          root,
@@ -485,6 +479,13 @@ func (c *OfflineCA) GenerateToken(ctx *cli.Context, tokType int, subject string,
 		certNotBefore: certNotBefore,
 		certNotAfter:  certNotAfter,
 	}
+	tokAttrs.apply(opts)
+
+	provisioners := c.Provisioners()
+	p, err := tokAttrs.cache.provisionerPrompt(ctx, provisioners)
+	if err != nil {
+		return "", err
+	}
 
 	switch p := p.(type) {
 	case *provisioner.OIDC: // Run step oauth.
@@ -0,0 +1,130 @@
+package cautils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/pki"
+	"github.com/smallstep/cli/config"
+)
+
+// ProvisionerCacheTTL is the time the list of provisioners in the cache is used
+// before asking the CA again.
+const ProvisionerCacheTTL = 10 * time.Minute
+
+var (
+	// getProvisioners is the function used to get the provisioners of a CA,
+	// it is replaced in the tests.
+	getProvisioners = pki.GetProvisioners
+	// provisionerCacheDir returns the directory of the cache files.
+	provisionerCacheDir = func() string {
+		return filepath.Join(config.StepPath(), "cache", "provisioners")
+	}
+)
+
+// CachedProvisioner is the information of a provisioner kept in the cache.
+type CachedProvisioner struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type provisionerCache struct {
+	CaURL        string              `json:"caURL"`
+	Provisioners []CachedProvisioner `json:"provisioners"`
+}
+
+// provisionerCacheFile returns the file of the cache for the given CA.
+func provisionerCacheFile(caURL string) string {
+	sum := sha256.Sum256([]byte(caURL))
+	return filepath.Join(provisionerCacheDir(), hex.EncodeToString(sum[:8])+".json")
+}
+
+// GetCachedProvisioners returns the names and types of the provisioners of the
+// CA at caURL. The response of the CA is kept in $STEPPATH/cache for
+// ProvisionerCacheTTL, so commands like the shell completion do not connect to
+// the CA every time. If the CA cannot be reached the cache is used even if it
+// has expired.
+func GetCachedProvisioners(caURL, root string, timeout time.Duration) ([]CachedProvisioner, error) {
+	filename := provisionerCacheFile(caURL)
+	cached, cacheErr := readProvisionerCache(filename, caURL)
+	if cacheErr == nil {
+		if st, err := os.Stat(filename); err == nil && time.Since(st.ModTime()) < ProvisionerCacheTTL {
+			return cached, nil
+		}
+	}
+
+	provisioners, err := getProvisionersWithTimeout(caURL, root, timeout)
+	if err != nil {
+		if cacheErr == nil {
+			return cached, nil
+		}
+		return nil, err
+	}
+
+	ret := make([]CachedProvisioner, 0, len(provisioners))
+	for _, p := range provisioners {
+		ret = append(ret, CachedProvisioner{
+			Name: p.GetName(),
+			Type: p.GetType().String(),
+		})
+	}
+	// The cache is optional, a failure writing it is not an error
+	_ = writeProvisionerCache(filename, &provisionerCache{
+		CaURL:        caURL,
+		Provisioners: ret,
+	})
+	return ret, nil
+}
+
+// getProvisionersWithTimeout gets the provisioners of the CA, or returns an
+// error if it does not respond before the timeout.
+func getProvisionersWithTimeout(caURL, root string, timeout time.Duration) (provisioner.List, error) {
+	type result struct {
+		provisioners provisioner.List
+		err          error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		provisioners, err := getProvisioners(caURL, root)
+		ch <- result{provisioners, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.provisioners, r.err
+	case <-time.After(timeout):
+		return nil, errors.Errorf("error getting the provisioners of %s: timeout after %s", caURL, timeout)
+	}
+}
+
+func readProvisionerCache(filename, caURL string) ([]CachedProvisioner, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var cache provisionerCache
+	if err := json.Unmarshal(b, &cache); err != nil {
+		return nil, errors.Wrapf(err, "error parsing %s", filename)
+	}
+	if cache.CaURL != caURL {
+		return nil, errors.Errorf("error reading %s: the cache is not for %s", filename, caURL)
+	}
+	return cache.Provisioners, nil
+}
+
+func writeProvisionerCache(filename string, cache *provisionerCache) error {
+	b, err := json.Marshal(cache)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling the provisioner cache")
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return errors.Wrapf(err, "error creating %s", filepath.Dir(filename))
+	}
+	return errors.Wrapf(ioutil.WriteFile(filename, b, 0600), "error writing %s", filename)
+}
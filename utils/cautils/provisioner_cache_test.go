@@ -0,0 +1,75 @@
+package cautils
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetCachedProvisioners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "step-provisioner-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	oldDir, oldGet := provisionerCacheDir, getProvisioners
+	defer func() {
+		provisionerCacheDir, getProvisioners = oldDir, oldGet
+	}()
+	provisionerCacheDir = func() string { return dir }
+
+	var calls int
+	var getErr error
+	getProvisioners = func(caURL, root string) (provisioner.List, error) {
+		calls++
+		if getErr != nil {
+			return nil, getErr
+		}
+		return provisioner.List{
+			&provisioner.JWK{Name: "admin", Type: "JWK"},
+			&provisioner.OIDC{Name: "Google", Type: "OIDC"},
+		}, nil
+	}
+	want := []CachedProvisioner{{"admin", "JWK"}, {"Google", "OIDC"}}
+
+	// The first call fills the cache
+	got, err := GetCachedProvisioners("https://ca.example.com", "root_ca.crt", time.Second)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+	require.Equal(t, 1, calls)
+	st, err := os.Stat(provisionerCacheFile("https://ca.example.com"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), st.Mode().Perm())
+
+	got, err = GetCachedProvisioners("https://ca.example.com", "root_ca.crt", time.Second)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+	require.Equal(t, 1, calls)
+
+	// An expired cache is used if the CA cannot be reached
+	old := time.Now().Add(-2 * ProvisionerCacheTTL)
+	require.NoError(t, os.Chtimes(provisionerCacheFile("https://ca.example.com"), old, old))
+	getErr = errors.New("connection refused")
+	got, err = GetCachedProvisioners("https://ca.example.com", "root_ca.crt", time.Second)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+	require.Equal(t, 2, calls)
+
+	// Without a cache the error is returned
+	_, err = GetCachedProvisioners("https://other.example.com", "root_ca.crt", time.Second)
+	require.EqualError(t, err, "connection refused")
+
+	// A CA that does not respond
+	done := make(chan struct{})
+	defer close(done)
+	getProvisioners = func(caURL, root string) (provisioner.List, error) {
+		<-done
+		return nil, nil
+	}
+	_, err = GetCachedProvisioners("https://slow.example.com", "root_ca.crt", 10*time.Millisecond)
+	require.EqualError(t, err, "error getting the provisioners of https://slow.example.com: timeout after 10ms")
+}
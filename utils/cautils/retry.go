@@ -0,0 +1,364 @@
+package cautils
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/ca"
+	"github.com/smallstep/cli/errs"
+	"github.com/urfave/cli"
+)
+
+const (
+	// retryBackoff is the wait before the first retry, it is doubled after
+	// every attempt.
+	retryBackoff = 500 * time.Millisecond
+	// retryMaxBackoff is the maximum wait between two attempts.
+	retryMaxBackoff = 30 * time.Second
+)
+
+// caTimeout returns the value of the flag `ca-timeout`.
+func caTimeout(ctx *cli.Context) (time.Duration, error) {
+	timeout := ctx.Duration("ca-timeout")
+	if timeout < 0 {
+		return 0, errs.InvalidFlagValue(ctx, "ca-timeout", ctx.String("ca-timeout"), "")
+	}
+	return timeout, nil
+}
+
+// WithRetries returns a client that retries the requests to the CA using the
+// flag `ca-retries`, and that times out the requests sent with a custom
+// transport, like Renew, using the flag `ca-timeout`. It returns the same
+// client if none of them is set. The timeout of the other requests is set in
+// the transport of the client, see withTimeout.
+func WithRetries(ctx *cli.Context, client CaClient) (CaClient, error) {
+	retries := ctx.Int("ca-retries")
+	if retries < 0 {
+		return nil, errs.InvalidFlagValue(ctx, "ca-retries", ctx.String("ca-retries"), "")
+	}
+	timeout, err := caTimeout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if retries == 0 && timeout == 0 {
+		return client, nil
+	}
+	return newRetryClient(client, retries, timeout), nil
+}
+
+// withTimeout replaces the option that sets the root certificates of a client
+// of the CA with a transport that trusts the same roots, and that cancels the
+// requests that take longer than the flag `ca-timeout`. It returns the same
+// option if the flag is not set.
+func withTimeout(ctx *cli.Context, caURL string, root ca.ClientOption) (ca.ClientOption, error) {
+	timeout, err := caTimeout(ctx)
+	if err != nil || timeout == 0 {
+		return root, err
+	}
+	client, err := ca.NewClient(caURL, root)
+	if err != nil {
+		return nil, err
+	}
+	tr := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{
+			RootCAs:                  client.GetRootCAs(),
+			PreferServerCipherSuites: true,
+		},
+	}
+	return ca.WithTransport(newTimeoutTransport(tr, timeout)), nil
+}
+
+// timeoutTransport is an http.RoundTripper that cancels the requests that do
+// not complete in the given time, including the read of the response body.
+type timeoutTransport struct {
+	http.RoundTripper
+	timeout time.Duration
+}
+
+func newTimeoutTransport(tr http.RoundTripper, timeout time.Duration) *timeoutTransport {
+	return &timeoutTransport{
+		RoundTripper: tr,
+		timeout:      timeout,
+	}
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	resp, err := t.RoundTripper.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, timeoutError(t.timeout)
+		}
+		return nil, err
+	}
+	resp.Body = &timeoutBody{
+		ReadCloser: resp.Body,
+		ctx:        ctx,
+		cancel:     cancel,
+		timeout:    t.timeout,
+	}
+	return resp, nil
+}
+
+// timeoutBody is the body of a response sent through a timeoutTransport. It
+// releases the context of the request when it is closed.
+type timeoutBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timeout time.Duration
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && b.ctx.Err() == context.DeadlineExceeded {
+		return n, timeoutError(b.timeout)
+	}
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// retryClient is a CaClient that retries the requests that fail with a
+// connection error, a timeout or a 5xx response. Requests rejected with a 4xx
+// response are never retried, as they might have consumed a one-time token.
+// The same request, and therefore the same token, is sent on every attempt, so
+// a request with a one-time token that times out is not retried either: the CA
+// might have received it and used the token.
+type retryClient struct {
+	CaClient
+	retries int
+	timeout time.Duration
+	sleep   func(time.Duration)
+}
+
+func newRetryClient(client CaClient, retries int, timeout time.Duration) *retryClient {
+	return &retryClient{
+		CaClient: client,
+		retries:  retries,
+		timeout:  timeout,
+		sleep:    time.Sleep,
+	}
+}
+
+// do calls fn until it succeeds, it returns a non retryable error or the
+// number of retries is reached. If ott is not empty, fn sends that one-time
+// token and timeouts are not retried. A final failure after more than one
+// attempt reports the number of attempts.
+func (c *retryClient) do(ott string, fn func() (interface{}, error)) (interface{}, error) {
+	for attempt := 1; ; attempt++ {
+		v, err := fn()
+		if err == nil {
+			return v, nil
+		}
+		if ott != "" && isTimeout(err) {
+			err = errors.Wrap(err, "the request is not retried as the CA might have used the one-time token")
+		} else if attempt <= c.retries && isRetryable(err) {
+			c.sleep(backoff(attempt))
+			continue
+		}
+		if attempt > 1 {
+			return nil, errors.Wrapf(err, "the request to the CA failed after %d attempts", attempt)
+		}
+		return nil, err
+	}
+}
+
+// transport returns the given transport with the configured timeout. A nil
+// transport means the transport of the client, and it is not changed.
+func (c *retryClient) transport(tr http.RoundTripper) http.RoundTripper {
+	if tr == nil || c.timeout == 0 {
+		return tr
+	}
+	return newTimeoutTransport(tr, c.timeout)
+}
+
+// backoff returns the time to wait after the given attempt. It doubles on
+// every attempt, up to retryMaxBackoff, with a random jitter of up to half of
+// the wait.
+func backoff(attempt int) time.Duration {
+	d := retryMaxBackoff
+	if attempt < 32 {
+		if b := retryBackoff << uint(attempt-1); b > 0 && b < d {
+			d = b
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// isRetryable returns true if the error is a connection error or a 5xx
+// response. Errors verifying the certificate of the CA are not retried.
+func isRetryable(err error) bool {
+	if _, ok := verificationError(err); ok {
+		return false
+	}
+	return errs.GetClass(err) == errs.CAUnavailableError
+}
+
+// isTimeout returns true if the error, or any of its causes, is a timeout.
+func isTimeout(err error) bool {
+	for err != nil {
+		if e, ok := err.(interface{ Timeout() bool }); ok && e.Timeout() {
+			return true
+		}
+		switch e := err.(type) {
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		case interface{ Cause() error }:
+			err = e.Cause()
+		default:
+			err = nil
+		}
+	}
+	return false
+}
+
+// timeoutError is the error returned when a request to the CA times out. It
+// implements net.Error, so it is classified as errs.CAUnavailableError.
+type timeoutError time.Duration
+
+func (e timeoutError) Error() string {
+	return fmt.Sprintf("the request to the CA timed out after %s", time.Duration(e))
+}
+
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
+// Sign implements the CaClient interface.
+func (c *retryClient) Sign(req *api.SignRequest) (*api.SignResponse, error) {
+	v, err := c.do(req.OTT, func() (interface{}, error) { return c.CaClient.Sign(req) })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*api.SignResponse), nil
+}
+
+// Renew implements the CaClient interface.
+func (c *retryClient) Renew(tr http.RoundTripper) (*api.SignResponse, error) {
+	v, err := c.do("", func() (interface{}, error) { return c.CaClient.Renew(c.transport(tr)) })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*api.SignResponse), nil
+}
+
+// Revoke implements the CaClient interface.
+func (c *retryClient) Revoke(req *api.RevokeRequest, tr http.RoundTripper) (*api.RevokeResponse, error) {
+	v, err := c.do(req.OTT, func() (interface{}, error) { return c.CaClient.Revoke(req, c.transport(tr)) })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*api.RevokeResponse), nil
+}
+
+// SSHSign implements the CaClient interface.
+func (c *retryClient) SSHSign(req *api.SSHSignRequest) (*api.SSHSignResponse, error) {
+	v, err := c.do(req.OTT, func() (interface{}, error) { return c.CaClient.SSHSign(req) })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*api.SSHSignResponse), nil
+}
+
+// SSHRenew implements the CaClient interface.
+func (c *retryClient) SSHRenew(req *api.SSHRenewRequest) (*api.SSHRenewResponse, error) {
+	v, err := c.do(req.OTT, func() (interface{}, error) { return c.CaClient.SSHRenew(req) })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*api.SSHRenewResponse), nil
+}
+
+// SSHRekey implements the CaClient interface.
+func (c *retryClient) SSHRekey(req *api.SSHRekeyRequest) (*api.SSHRekeyResponse, error) {
+	v, err := c.do(req.OTT, func() (interface{}, error) { return c.CaClient.SSHRekey(req) })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*api.SSHRekeyResponse), nil
+}
+
+// SSHRevoke implements the CaClient interface.
+func (c *retryClient) SSHRevoke(req *api.SSHRevokeRequest) (*api.SSHRevokeResponse, error) {
+	v, err := c.do(req.OTT, func() (interface{}, error) { return c.CaClient.SSHRevoke(req) })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*api.SSHRevokeResponse), nil
+}
+
+// SSHRoots implements the CaClient interface.
+func (c *retryClient) SSHRoots() (*api.SSHRootsResponse, error) {
+	v, err := c.do("", func() (interface{}, error) { return c.CaClient.SSHRoots() })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*api.SSHRootsResponse), nil
+}
+
+// SSHFederation implements the CaClient interface.
+func (c *retryClient) SSHFederation() (*api.SSHRootsResponse, error) {
+	v, err := c.do("", func() (interface{}, error) { return c.CaClient.SSHFederation() })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*api.SSHRootsResponse), nil
+}
+
+// SSHConfig implements the CaClient interface.
+func (c *retryClient) SSHConfig(req *api.SSHConfigRequest) (*api.SSHConfigResponse, error) {
+	v, err := c.do("", func() (interface{}, error) { return c.CaClient.SSHConfig(req) })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*api.SSHConfigResponse), nil
+}
+
+// SSHCheckHost implements the CaClient interface.
+func (c *retryClient) SSHCheckHost(principal string, token string) (*api.SSHCheckPrincipalResponse, error) {
+	v, err := c.do(token, func() (interface{}, error) { return c.CaClient.SSHCheckHost(principal, token) })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*api.SSHCheckPrincipalResponse), nil
+}
+
+// SSHGetHosts implements the CaClient interface.
+func (c *retryClient) SSHGetHosts() (*api.SSHGetHostsResponse, error) {
+	v, err := c.do("", func() (interface{}, error) { return c.CaClient.SSHGetHosts() })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*api.SSHGetHostsResponse), nil
+}
+
+// SSHBastion implements the CaClient interface.
+func (c *retryClient) SSHBastion(req *api.SSHBastionRequest) (*api.SSHBastionResponse, error) {
+	v, err := c.do("", func() (interface{}, error) { return c.CaClient.SSHBastion(req) })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*api.SSHBastionResponse), nil
+}
+
+// Version implements the CaClient interface.
+func (c *retryClient) Version() (*api.VersionResponse, error) {
+	v, err := c.do("", func() (interface{}, error) { return c.CaClient.Version() })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*api.VersionResponse), nil
+}
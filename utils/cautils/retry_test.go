@@ -0,0 +1,154 @@
+package cautils
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/errs"
+	clierrs "github.com/smallstep/cli/errs"
+	"github.com/stretchr/testify/require"
+)
+
+// sequenceClient is a CaClient that returns the given errors in order, and
+// succeeds after them.
+type sequenceClient struct {
+	CaClient
+	errs     []error
+	requests []*api.SSHSignRequest
+	versions int
+}
+
+func (c *sequenceClient) SSHSign(req *api.SSHSignRequest) (*api.SSHSignResponse, error) {
+	c.requests = append(c.requests, req)
+	if n := len(c.requests); n <= len(c.errs) {
+		return nil, c.errs[n-1]
+	}
+	return &api.SSHSignResponse{}, nil
+}
+
+func (c *sequenceClient) Version() (*api.VersionResponse, error) {
+	c.versions++
+	if c.versions <= len(c.errs) {
+		return nil, c.errs[c.versions-1]
+	}
+	return &api.VersionResponse{}, nil
+}
+
+func TestRetryClient(t *testing.T) {
+	netErr := errors.Wrap(&url.Error{Op: "Post", URL: "https://ca.smallstep.com/ssh/sign", Err: &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}}, "client POST https://ca.smallstep.com/ssh/sign failed")
+	unavailable := errs.NewErr(http.StatusServiceUnavailable, errors.New("service unavailable"))
+	unauthorized := errs.NewErr(http.StatusUnauthorized, errors.New("token already used"))
+	timeout := errs.Wrap(http.StatusInternalServerError, &url.Error{Op: "Post", URL: "https://ca.smallstep.com/ssh/sign", Err: timeoutError(10 * time.Millisecond)}, "client POST https://ca.smallstep.com/ssh/sign failed")
+
+	tests := []struct {
+		name     string
+		errs     []error
+		retries  int
+		attempts int
+		wantErr  string
+	}{
+		{"ok", nil, 3, 1, ""},
+		{"ok/connection", []error{netErr, netErr}, 3, 3, ""},
+		{"ok/5xx", []error{unavailable}, 3, 2, ""},
+		{"fail/4xx", []error{unauthorized}, 3, 1, "token already used"},
+		{"fail/5xx-then-4xx", []error{unavailable, unauthorized}, 3, 2, "the request to the CA failed after 2 attempts: token already used"},
+		{"fail/retries", []error{unavailable, unavailable, unavailable}, 2, 3, "the request to the CA failed after 3 attempts: service unavailable"},
+		{"fail/no-retries", []error{netErr}, 0, 1, netErr.Error()},
+		{"fail/timeout", []error{timeout}, 3, 1, "the request is not retried as the CA might have used the one-time token: " + timeout.Error()},
+		{"fail/5xx-then-timeout", []error{unavailable, timeout}, 3, 2, "the request to the CA failed after 2 attempts: the request is not retried as the CA might have used the one-time token: " + timeout.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &sequenceClient{errs: tt.errs}
+			var waits []time.Duration
+			client := newRetryClient(fake, tt.retries, 0)
+			client.sleep = func(d time.Duration) { waits = append(waits, d) }
+
+			req := &api.SSHSignRequest{OTT: "the-token"}
+			_, err := client.SSHSign(req)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				require.Equal(t, tt.wantErr, err.Error())
+			} else {
+				require.NoError(t, err)
+			}
+
+			require.Len(t, fake.requests, tt.attempts)
+			require.Len(t, waits, tt.attempts-1)
+			for _, r := range fake.requests {
+				require.True(t, r == req)
+			}
+		})
+	}
+}
+
+func TestRetryClient_timeoutWithoutToken(t *testing.T) {
+	timeout := &url.Error{Op: "Get", URL: "https://ca.smallstep.com/version", Err: timeoutError(10 * time.Millisecond)}
+	fake := &sequenceClient{errs: []error{timeout, timeout}}
+	client := newRetryClient(fake, 3, 0)
+	client.sleep = func(time.Duration) {}
+	_, err := client.Version()
+	require.NoError(t, err)
+	require.Equal(t, 3, fake.versions)
+}
+
+func TestTimeoutTransport(t *testing.T) {
+	cancelled := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-r.Context().Done()
+			close(cancelled)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: newTimeoutTransport(http.DefaultTransport, 50*time.Millisecond)}
+	resp, err := client.Get(srv.URL + "/fast")
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, "ok", string(b))
+
+	// The request is cancelled, the server does not keep processing it
+	_, err = client.Get(srv.URL + "/slow")
+	require.Error(t, err)
+	require.True(t, isTimeout(err))
+	require.Equal(t, clierrs.CAUnavailableError, clierrs.GetClass(err))
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request was not cancelled")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt, want := range map[int]time.Duration{
+		1:  500 * time.Millisecond,
+		2:  time.Second,
+		3:  2 * time.Second,
+		7:  retryMaxBackoff,
+		64: retryMaxBackoff,
+	} {
+		d := backoff(attempt)
+		require.True(t, d >= want/2 && d <= want, "backoff(%d) = %s", attempt, d)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	require.True(t, isRetryable(timeoutError(time.Second)))
+	require.True(t, isRetryable(errs.NewErr(http.StatusBadGateway, errors.New("bad gateway"))))
+	require.False(t, isRetryable(errs.NewErr(http.StatusForbidden, errors.New("forbidden"))))
+	require.False(t, isRetryable(errors.New("error reading response")))
+	require.False(t, isRetryable(&url.Error{Op: "Get", URL: "https://ca.smallstep.com/version", Err: x509.UnknownAuthorityError{}}))
+}
@@ -0,0 +1,96 @@
+package cautils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/ca"
+)
+
+// downloadRoot downloads the root certificate of the CA in caURL using an
+// untrusted connection, verifies it using the given fingerprint and writes it
+// to a temporary file. It returns the name of the file.
+func downloadRoot(caURL, fingerprint string) (string, error) {
+	// The root is verified using the fingerprint.
+	tr := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	client, err := ca.NewClient(caURL, ca.WithTransport(tr))
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Root(fingerprint)
+	if err != nil {
+		// The CA responds with a 404 if it does not have a root with the
+		// fingerprint, and the client fails with a 400 if the root returned
+		// does not match it.
+		if code := statusCode(err); code == http.StatusNotFound || code == http.StatusBadRequest {
+			return "", errors.Errorf("the root certificate of %s does not match the fingerprint %s", caURL, fingerprint)
+		}
+		return "", errors.Wrap(err, "error downloading root certificate")
+	}
+
+	f, err := ioutil.TempFile("", "step-root-*.crt")
+	if err != nil {
+		return "", errors.Wrap(err, "error creating temporary file")
+	}
+	defer f.Close()
+	if err := pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: resp.RootPEM.Raw}); err != nil {
+		os.Remove(f.Name())
+		return "", errors.Wrapf(err, "error writing %s", f.Name())
+	}
+	return f.Name(), nil
+}
+
+// rootError returns the given error with the root certificate or fingerprint
+// used if it is an error verifying the certificate of the CA.
+func rootError(err error, root, fingerprint string) error {
+	verr, ok := verificationError(err)
+	if !ok {
+		return err
+	}
+	var msg string
+	if fingerprint != "" {
+		msg = "the certificate of the CA could not be verified using the root certificate with the fingerprint " + fingerprint
+	} else {
+		msg = "the certificate of the CA could not be verified using the root certificate in " + root
+	}
+	if e, ok := verr.(x509.CertificateInvalidError); ok && e.Reason == x509.Expired {
+		msg += ", a certificate has expired or is not yet valid"
+	}
+	return errors.Wrap(err, msg)
+}
+
+// verificationError returns the first error in the chain of errors that is an
+// error verifying an x509 certificate.
+func verificationError(err error) (error, bool) {
+	for err != nil {
+		switch err.(type) {
+		case x509.UnknownAuthorityError, x509.CertificateInvalidError, x509.HostnameError:
+			return err, true
+		}
+		switch e := err.(type) {
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		case interface{ Cause() error }:
+			err = e.Cause()
+		default:
+			err = nil
+		}
+	}
+	return nil, false
+}
+
+// statusCode returns the status code of an error returned by the CA, or 0.
+func statusCode(err error) int {
+	if e, ok := err.(interface{ StatusCode() int }); ok {
+		return e.StatusCode()
+	}
+	return 0
+}
@@ -0,0 +1,122 @@
+package cautils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/ca"
+	"github.com/stretchr/testify/require"
+)
+
+func mustSelfSigned(t *testing.T) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Other Root CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	b, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(b)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestDownloadRoot(t *testing.T) {
+	// The CA only has the root with fingerprint, and a misbehaving CA returns
+	// it for the wrong fingerprint
+	var fingerprint string
+	wrong := "d9d0978692f1c7cc791f5c343ce98771900721405e834cd27b9502cc719f5097"
+	srv := httptest.NewUnstartedServer(nil)
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/root/" + fingerprint, "/root/" + wrong:
+			json.NewEncoder(w).Encode(api.RootResponse{
+				RootPEM: api.NewCertificate(srv.Certificate()),
+			})
+		case "/health":
+			w.Write([]byte(`{"status":"ok"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"status":404,"message":"Not Found"}`))
+		}
+	})
+	srv.StartTLS()
+	defer srv.Close()
+
+	sum := sha256.Sum256(srv.Certificate().Raw)
+	fingerprint = hex.EncodeToString(sum[:])
+
+	root, err := downloadRoot(srv.URL, fingerprint)
+	require.NoError(t, err)
+	defer os.Remove(root)
+	b, err := ioutil.ReadFile(root)
+	require.NoError(t, err)
+	block, _ := pem.Decode(b)
+	require.NotNil(t, block)
+	require.Equal(t, srv.Certificate().Raw, block.Bytes)
+
+	// The pinned root is used to verify the CA
+	client, err := ca.NewClient(srv.URL, ca.WithRootFile(root))
+	require.NoError(t, err)
+	_, err = client.Health()
+	require.NoError(t, err)
+
+	// Fingerprint mismatch, the CA does not have the root
+	unknown := "2a0e37b6e5d1d1d3b9c1fd3b2fd8c4c89ddf6d1e6b8b0fa64e84e3cf552ef1ab"
+	_, err = downloadRoot(srv.URL, unknown)
+	require.EqualError(t, err, "the root certificate of "+srv.URL+" does not match the fingerprint "+unknown)
+
+	// Fingerprint mismatch, the CA returns another root
+	_, err = downloadRoot(srv.URL, wrong)
+	require.EqualError(t, err, "the root certificate of "+srv.URL+" does not match the fingerprint "+wrong)
+}
+
+func TestRootError(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer srv.Close()
+
+	// Use a root that does not sign the certificate of the server
+	dir, err := ioutil.TempDir("", "step-root")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root_ca.crt")
+	require.NoError(t, ioutil.WriteFile(root, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: mustSelfSigned(t).Raw}), 0600))
+
+	client, err := ca.NewClient(srv.URL, ca.WithRootFile(root))
+	require.NoError(t, err)
+	_, err = client.Health()
+	require.Error(t, err)
+
+	err1 := rootError(err, root, "")
+	require.Contains(t, err1.Error(), "the certificate of the CA could not be verified using the root certificate in "+root)
+	err2 := rootError(err, "/tmp/step-root-1234.crt", "d9d0978692f1c7cc791f5c343ce98771900721405e834cd27b9502cc719f5097")
+	require.Contains(t, err2.Error(), "the root certificate with the fingerprint d9d0978692f1c7cc791f5c343ce98771900721405e834cd27b9502cc719f5097")
+
+	// Other errors are not modified
+	err = os.ErrNotExist
+	require.Equal(t, err, rootError(err, root, ""))
+}
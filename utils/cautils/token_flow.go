@@ -84,7 +84,7 @@ func (e *ErrACMEToken) Error() string {
 }
 
 // NewTokenFlow implements the common flow used to generate a token
-func NewTokenFlow(ctx *cli.Context, tokType int, subject string, sans []string, caURL, root string, notBefore, notAfter time.Time, certNotBefore, certNotAfter provisioner.TimeDuration) (string, error) {
+func NewTokenFlow(ctx *cli.Context, tokType int, subject string, sans []string, caURL, root string, notBefore, notAfter time.Time, certNotBefore, certNotAfter provisioner.TimeDuration, opts ...TokenOption) (string, error) {
 	// Get audience from ca-url
 	audience, err := parseAudience(ctx, tokType)
 	if err != nil {
@@ -95,10 +95,6 @@ func NewTokenFlow(ctx *cli.Context, tokType int, subject string, sans []string,
 	if err != nil {
 		return "", err
 	}
-	p, err := provisionerPrompt(ctx, provisioners)
-	if err != nil {
-		return "", err
-	}
 
 	tokAttrs := tokenAttrs{
 		subject:       subject,
@@ -111,6 +107,12 @@ func NewTokenFlow(ctx *cli.Context, tokType int, subject string, sans []string,
 		certNotBefore: certNotBefore,
 		certNotAfter:  certNotAfter,
 	}
+	tokAttrs.apply(opts)
+
+	p, err := tokAttrs.cache.provisionerPrompt(ctx, provisioners)
+	if err != nil {
+		return "", err
+	}
 
 	switch p := p.(type) {
 	case *provisioner.JWK: // Get the step standard JWT.
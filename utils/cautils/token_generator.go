@@ -15,6 +15,7 @@ import (
 	"github.com/smallstep/cli/crypto/randutil"
 	"github.com/smallstep/cli/errs"
 	"github.com/smallstep/cli/exec"
+	"github.com/smallstep/cli/flags"
 	"github.com/smallstep/cli/jose"
 	"github.com/smallstep/cli/token"
 	"github.com/smallstep/cli/token/provision"
@@ -118,7 +119,7 @@ func generateOIDCToken(ctx *cli.Context, p *provisioner.OIDC) (string, error) {
 	args := []string{"oauth", "--oidc", "--bare",
 		"--provider", p.ConfigurationEndpoint,
 		"--client-id", p.ClientID, "--client-secret", p.ClientSecret}
-	if ctx.Bool("console") {
+	if ctx.Bool("console") || exec.IsBrowserDisabled() {
 		args = append(args, "--console")
 	}
 	if p.ListenAddress != "" {
@@ -126,7 +127,9 @@ func generateOIDCToken(ctx *cli.Context, p *provisioner.OIDC) (string, error) {
 	}
 	out, err := exec.Step(args...)
 	if err != nil {
-		return "", err
+		return "", errors.Wrapf(err, "error getting a token from the OIDC provisioner '%s'; "+
+			"check that the identity provider at %s is reachable, or use the '--console' flag "+
+			"to complete the flow visiting the printed URL in any browser", p.Name, p.ConfigurationEndpoint)
 	}
 	return strings.TrimSpace(string(out)), nil
 }
@@ -141,6 +144,106 @@ type tokenAttrs struct {
 	sans                        []string
 	notBefore, notAfter         time.Time
 	certNotBefore, certNotAfter provisioner.TimeDuration
+	password                    []byte
+	passwordSet                 bool
+	cache                       *TokenCache
+}
+
+// TokenOption is the type of the options used to modify the generation of a
+// token.
+type TokenOption func(*tokenAttrs)
+
+// WithProvisionerPassword sets the password used to decrypt the key that signs
+// the token, the JWK provisioner key or the X5C and SSHPOP keys. With this
+// option the flag --password-file is never read, so commands can use it for
+// other purposes. If the password is nil it will be asked.
+func WithProvisionerPassword(password []byte) TokenOption {
+	return func(a *tokenAttrs) {
+		a.password = password
+		a.passwordSet = true
+	}
+}
+
+// WithTokenCache sets the cache used to reuse the provisioner and the password
+// of its key between tokens.
+func WithTokenCache(c *TokenCache) TokenOption {
+	return func(a *tokenAttrs) {
+		a.cache = c
+	}
+}
+
+// TokenCache keeps the provisioner selected and the password used to decrypt
+// its key, so commands generating several tokens only prompt once. The zero
+// value is ready to use.
+type TokenCache struct {
+	provisioner provisioner.Interface
+	password    []byte
+	// promptPassword is used to ask for the password, ui.PromptPassword if
+	// nil.
+	promptPassword jose.PasswordPrompter
+}
+
+// provisionerPrompt selects the provisioner using the flags or prompting the
+// user. With a cache the provisioner is only selected the first time.
+func (c *TokenCache) provisionerPrompt(ctx *cli.Context, provisioners provisioner.List) (provisioner.Interface, error) {
+	if c == nil {
+		return provisionerPrompt(ctx, provisioners)
+	}
+	if c.provisioner == nil {
+		p, err := provisionerPrompt(ctx, provisioners)
+		if err != nil {
+			return nil, err
+		}
+		c.provisioner = p
+	}
+	return c.provisioner, nil
+}
+
+// decrypt decrypts the key of a JWK provisioner using jose.Decrypt, the
+// password is only asked the first time.
+func (c *TokenCache) decrypt(prompt string, data []byte, opts ...jose.Option) ([]byte, error) {
+	if c.password != nil {
+		return jose.Decrypt(prompt, data, append(opts, jose.WithPassword(c.password))...)
+	}
+	promptPassword := c.promptPassword
+	if promptPassword == nil {
+		promptPassword = ui.PromptPassword
+	}
+	// The last password prompted is the one that decrypts the key.
+	var password []byte
+	data, err := jose.Decrypt(prompt, data, append(opts, jose.WithPasswordPrompter(func(s string, uiOpts ...ui.Option) ([]byte, error) {
+		pass, err := promptPassword(s, uiOpts...)
+		password = pass
+		return pass, err
+	}))...)
+	if err != nil {
+		return nil, err
+	}
+	c.password = password
+	return data, nil
+}
+
+// apply applies the given options to the token attributes.
+func (a *tokenAttrs) apply(opts []TokenOption) {
+	for _, fn := range opts {
+		fn(a)
+	}
+}
+
+// passwordOptions returns the options used to decrypt the key that signs the
+// token. It uses the password set with WithProvisionerPassword, or the file in
+// --password-file if the option was not used.
+func passwordOptions(ctx *cli.Context, tokAttrs tokenAttrs) []jose.Option {
+	switch {
+	case tokAttrs.passwordSet && tokAttrs.password != nil:
+		return []jose.Option{jose.WithPassword(tokAttrs.password)}
+	case tokAttrs.passwordSet:
+		return nil
+	case ctx.String("password-file") != "":
+		return []jose.Option{jose.WithPasswordFile(ctx.String("password-file"))}
+	default:
+		return nil
+	}
 }
 
 func generateK8sSAToken(ctx *cli.Context, p *provisioner.K8sSA) (string, error) {
@@ -166,10 +269,7 @@ func generateX5CToken(ctx *cli.Context, p *provisioner.X5C, tokType int, tokAttr
 	}
 
 	// Get private key from given key file
-	var opts []jose.Option
-	if passwordFile := ctx.String("password-file"); len(passwordFile) != 0 {
-		opts = append(opts, jose.WithPasswordFile(passwordFile))
-	}
+	opts := passwordOptions(ctx, tokAttrs)
 	jwk, err := jose.ParseKey(x5cKeyFile, opts...)
 	if err != nil {
 		return "", err
@@ -204,10 +304,7 @@ func generateSSHPOPToken(ctx *cli.Context, p *provisioner.SSHPOP, tokType int, t
 	}
 
 	// Get private key from given key file
-	var opts []jose.Option
-	if passwordFile := ctx.String("password-file"); len(passwordFile) != 0 {
-		opts = append(opts, jose.WithPasswordFile(passwordFile))
-	}
+	opts := passwordOptions(ctx, tokAttrs)
 	jwk, err := jose.ParseKey(sshPOPKeyFile, opts...)
 	if err != nil {
 		return "", err
@@ -235,12 +332,20 @@ func generateSSHPOPToken(ctx *cli.Context, p *provisioner.SSHPOP, tokType int, t
 //    a) Offline-mode: load the JWK directly from the provisioner in the CA-config.
 //    b) Online-mode: get the provisioner private key from the CA.
 func loadJWK(ctx *cli.Context, p *provisioner.JWK, tokAttrs tokenAttrs) (jwk *jose.JSONWebKey, kid string, err error) {
-	var opts []jose.Option
-	switch {
-	case ctx.String("provisioner-password-file") != "":
-		opts = append(opts, jose.WithPasswordFile(ctx.String("provisioner-password-file")))
-	case ctx.String("password-file") != "":
-		opts = append(opts, jose.WithPasswordFile(ctx.String("password-file")))
+	if !tokAttrs.passwordSet {
+		password, err := flags.ParseProvisionerPassword(ctx)
+		if err != nil {
+			return nil, "", err
+		}
+		if password != nil {
+			WithProvisionerPassword(password)(&tokAttrs)
+		}
+	}
+	opts := passwordOptions(ctx, tokAttrs)
+	// The cache is only used if the password is prompted
+	decrypt := jose.Decrypt
+	if tokAttrs.cache != nil && len(opts) == 0 {
+		decrypt = tokAttrs.cache.decrypt
 	}
 
 	if keyFile := ctx.String("key"); len(keyFile) == 0 {
@@ -268,7 +373,7 @@ func loadJWK(ctx *cli.Context, p *provisioner.JWK, tokAttrs tokenAttrs) (jwk *jo
 			ui.WithPromptTemplates(ui.PromptTemplates()),
 		))
 
-		decrypted, err := jose.Decrypt("Please enter the password to decrypt the provisioner key", []byte(encryptedKey), opts...)
+		decrypted, err := decrypt("Please enter the password to decrypt the provisioner key", []byte(encryptedKey), opts...)
 		if err != nil {
 			return nil, "", err
 		}
@@ -0,0 +1,51 @@
+package cautils
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/cli/jose"
+	"github.com/smallstep/cli/ui"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenCache_decrypt(t *testing.T) {
+	_, jwe, err := jose.GenerateDefaultKeyPair([]byte("password"))
+	require.NoError(t, err)
+	data, err := jwe.CompactSerialize()
+	require.NoError(t, err)
+
+	var prompts int
+	passwords := [][]byte{[]byte("wrong"), []byte("password")}
+	c := &TokenCache{promptPassword: func(prompt string, opts ...ui.Option) ([]byte, error) {
+		prompts++
+		if len(passwords) == 0 {
+			return nil, errors.New("no more passwords")
+		}
+		pass := passwords[0]
+		passwords = passwords[1:]
+		return pass, nil
+	}}
+
+	// The password is only asked the first time
+	want, err := jose.Decrypt("", []byte(data), jose.WithPassword([]byte("password")))
+	require.NoError(t, err)
+	got, err := c.decrypt("Please enter the password", []byte(data))
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+	require.Equal(t, 2, prompts)
+	require.Equal(t, []byte("password"), c.password)
+
+	got, err = c.decrypt("Please enter the password", []byte(data))
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+	require.Equal(t, 2, prompts)
+
+	// The errors are the ones of jose.Decrypt, and nothing is cached
+	c = &TokenCache{promptPassword: func(prompt string, opts ...ui.Option) ([]byte, error) {
+		return []byte("wrong"), nil
+	}}
+	_, err = c.decrypt("Please enter the password", []byte(data))
+	require.EqualError(t, err, "failed to decrypt JWK: invalid password")
+	require.Nil(t, c.password)
+}
@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/cli/config"
+	"github.com/smallstep/cli/errs"
+	"github.com/smallstep/cli/utils/sysutils"
+)
+
+// ErrLocked is the cause of the error returned by Lock if the lock is held
+// by another process after the timeout.
+var ErrLocked = errors.New("another step process is writing these files")
+
+var (
+	// lockPollInterval is the time between two attempts to acquire a lock.
+	lockPollInterval = 50 * time.Millisecond
+	// lockDir returns the directory with the lock files.
+	lockDir = func() string {
+		return filepath.Join(config.StepPath(), "locks")
+	}
+)
+
+// FileLock is an advisory lock acquired with Lock.
+type FileLock struct {
+	f *os.File
+}
+
+// Lock acquires an exclusive advisory lock for the files with the given base
+// name, waiting up to the given timeout. The lock is a file in
+// $STEPPATH/locks named after the absolute path of name, so it works with the
+// processes using the same STEPPATH. It is an flock on Unix and a LockFileEx
+// on Windows, and it is released if the process dies.
+func Lock(name string, timeout time.Duration) (*FileLock, error) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error locking %s", name)
+	}
+	dir := lockDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errs.FileError(err, dir)
+	}
+	sum := sha256.Sum256([]byte(abs))
+	filename := filepath.Join(dir, hex.EncodeToString(sum[:16])+".lock")
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errs.FileError(err, filename)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := sysutils.FileLock(int(f.Fd()))
+		switch {
+		case err == nil:
+			return &FileLock{f: f}, nil
+		case err != syscall.EWOULDBLOCK:
+			f.Close()
+			return nil, errors.Wrapf(err, "error locking %s", name)
+		case !time.Now().Before(deadline):
+			f.Close()
+			return nil, errors.Wrapf(ErrLocked, "error locking %s after %s", name, timeout)
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// Unlock releases the lock.
+func (l *FileLock) Unlock() error {
+	err := sysutils.FileUnlock(int(l.f.Fd()))
+	if err1 := l.f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func withLockDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "step-lock")
+	require.NoError(t, err)
+	old := lockDir
+	lockDir = func() string { return filepath.Join(dir, "locks") }
+	return func() {
+		lockDir = old
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLock(t *testing.T) {
+	defer withLockDir(t)()
+
+	l, err := Lock("id_ecdsa", time.Second)
+	require.NoError(t, err)
+
+	// Other names are not locked
+	other, err := Lock("id_ed25519", 0)
+	require.NoError(t, err)
+	require.NoError(t, other.Unlock())
+
+	// The same name, relative or absolute, is locked
+	abs, err := filepath.Abs("id_ecdsa")
+	require.NoError(t, err)
+	_, err = Lock(abs, 100*time.Millisecond)
+	require.Error(t, err)
+	require.Equal(t, ErrLocked, errors.Cause(err))
+	require.Contains(t, err.Error(), "another step process is writing these files")
+
+	require.NoError(t, l.Unlock())
+	l, err = Lock(abs, 0)
+	require.NoError(t, err)
+	require.NoError(t, l.Unlock())
+}
+
+func TestLock_concurrent(t *testing.T) {
+	defer withLockDir(t)()
+
+	dir, err := ioutil.TempDir("", "step-lock-files")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "id_ecdsa")
+
+	// Each writer writes the key and the certificate with its own contents.
+	// With the lock they never interleave, the files always have the contents
+	// of the same writer.
+	write := func(id string) error {
+		l, err := Lock(base, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		defer l.Unlock()
+		if err := ioutil.WriteFile(base, []byte(id), 0600); err != nil {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+		return ioutil.WriteFile(base+"-cert.pub", []byte(id), 0600)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, id := range []string{"first", "second"} {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			errs[i] = write(id)
+		}(i, id)
+	}
+	wg.Wait()
+	require.NoError(t, errs[0])
+	require.NoError(t, errs[1])
+	key, err := ioutil.ReadFile(base)
+	require.NoError(t, err)
+	cert, err := ioutil.ReadFile(base + "-cert.pub")
+	require.NoError(t, err)
+	require.Equal(t, string(key), string(cert))
+
+	// A writer waiting less than the holder fails
+	l, err := Lock(base, 0)
+	require.NoError(t, err)
+	done := make(chan error)
+	go func() {
+		_, err := Lock(base, 100*time.Millisecond)
+		done <- err
+	}()
+	err = <-done
+	require.Error(t, err)
+	require.Equal(t, ErrLocked, errors.Cause(err))
+	require.NoError(t, l.Unlock())
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// userHomeDir returns the home directory of the current user.
+	userHomeDir = os.UserHomeDir
+	// lookupHomeDir returns the home directory of the given user.
+	lookupHomeDir = func(name string) (string, error) {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		return u.HomeDir, nil
+	}
+)
+
+// ExpandPath expands a leading "~" or "~user" and the environment variables
+// in the given path, and returns it as a clean absolute path. The empty string
+// and the hyphen used for STDIN are returned unchanged.
+func ExpandPath(path string) (string, error) {
+	if path == "" || path == stdinFilename {
+		return path, nil
+	}
+
+	// The home directory is expanded before the variables, like a shell does.
+	if strings.HasPrefix(path, "~") {
+		i := 1
+		for i < len(path) && !os.IsPathSeparator(path[i]) {
+			i++
+		}
+		var home string
+		var err error
+		if name := path[1:i]; name == "" {
+			if home, err = userHomeDir(); err != nil {
+				return "", errors.Wrapf(err, "error expanding %s", path)
+			}
+		} else if home, err = lookupHomeDir(name); err != nil {
+			return "", errors.Wrapf(err, "error expanding %s", path)
+		}
+		path = home + path[i:]
+	}
+
+	abs, err := filepath.Abs(os.ExpandEnv(path))
+	if err != nil {
+		return "", errors.Wrapf(err, "error expanding %s", path)
+	}
+	return abs, nil
+}
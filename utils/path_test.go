@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandPath(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+
+	// Use fixed home directories
+	home, janeHome := filepath.Join(wd, "home", "me"), filepath.Join(wd, "home", "jane")
+	oldUserHomeDir, oldLookupHomeDir := userHomeDir, lookupHomeDir
+	defer func() {
+		userHomeDir, lookupHomeDir = oldUserHomeDir, oldLookupHomeDir
+	}()
+	userHomeDir = func() (string, error) { return home, nil }
+	lookupHomeDir = func(name string) (string, error) {
+		if name == "jane" {
+			return janeHome, nil
+		}
+		return "", errors.Errorf("user: unknown user %s", name)
+	}
+
+	oldVar, hasVar := os.LookupEnv("STEP_TEST_SSH_DIR")
+	defer func() {
+		if hasVar {
+			os.Setenv("STEP_TEST_SSH_DIR", oldVar)
+		} else {
+			os.Unsetenv("STEP_TEST_SSH_DIR")
+		}
+	}()
+	sshDir := filepath.Join(wd, "ssh")
+	os.Setenv("STEP_TEST_SSH_DIR", sshDir)
+
+	type test struct {
+		name    string
+		path    string
+		want    string
+		wantErr bool
+	}
+	tests := []test{
+		{"empty", "", "", false},
+		{"stdin", "-", "-", false},
+		{"home", "~", home, false},
+		{"home/file", "~/.ssh/id_ecdsa", filepath.Join(home, ".ssh", "id_ecdsa"), false},
+		{"user", "~jane", janeHome, false},
+		{"user/file", "~jane/.ssh/id_ecdsa", filepath.Join(janeHome, ".ssh", "id_ecdsa"), false},
+		{"var", "$STEP_TEST_SSH_DIR/id_ecdsa", filepath.Join(sshDir, "id_ecdsa"), false},
+		{"var/braces", "${STEP_TEST_SSH_DIR}/id_ecdsa", filepath.Join(sshDir, "id_ecdsa"), false},
+		{"home-var", "~/$STEP_TEST_SSH_DIR", filepath.Join(home, sshDir), false},
+		{"relative", "id_ecdsa", filepath.Join(wd, "id_ecdsa"), false},
+		{"relative/dir", "./keys/../id_ecdsa", filepath.Join(wd, "id_ecdsa"), false},
+		{"absolute", sshDir, sshDir, false},
+		{"tilde-inside", "keys/~/id_ecdsa", filepath.Join(wd, "keys", "~", "id_ecdsa"), false},
+		{"fail/user", "~john/.ssh/id_ecdsa", "", true},
+	}
+	if runtime.GOOS == "windows" {
+		tests = append(tests,
+			test{"windows/home", `~\.ssh\id_ecdsa`, filepath.Join(home, ".ssh", "id_ecdsa"), false},
+			test{"windows/user", `~jane\.ssh\id_ecdsa`, filepath.Join(janeHome, ".ssh", "id_ecdsa"), false},
+			test{"windows/var", `$STEP_TEST_SSH_DIR\id_ecdsa`, filepath.Join(sshDir, "id_ecdsa"), false},
+			test{"windows/relative", `keys\id_ecdsa`, filepath.Join(wd, "keys", "id_ecdsa"), false},
+		)
+	} else {
+		// A backslash is not a separator, it is part of the user name
+		tests = append(tests,
+			test{"unix/backslash", `~jane\.ssh`, "", true},
+			test{"unix/backslash-relative", `keys\id_ecdsa`, filepath.Join(wd, `keys\id_ecdsa`), false},
+		)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ExpandPath(tt.path)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -69,6 +69,30 @@ func ReadStringPasswordFromFile(filename string) (string, error) {
 	return string(b), nil
 }
 
+// ReadPasswordFromStdin reads exactly one line from STDIN and returns it as a
+// password, trimmed at the right. The rest of STDIN is not consumed, so it can
+// be used after reading the password.
+func ReadPasswordFromStdin() ([]byte, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := stdin.Read(b)
+		if n > 0 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading password from STDIN")
+		}
+	}
+	return bytes.TrimRightFunc(line, unicode.IsSpace), nil
+}
+
 // ReadInput from stdin if something is detected or ask the user for an input
 // using the given prompt.
 func ReadInput(prompt string) ([]byte, error) {
@@ -167,6 +167,29 @@ func TestStringReadPasswordFromFile(t *testing.T) {
 	require.Equal(t, "my-password-on-file", s, "expected %s to equal %s", s, content)
 }
 
+func TestReadPasswordFromStdin(t *testing.T) {
+	mockStdin, cleanup := newFile(t, []byte("my-password \nssh-ed25519 AAAA...\n"))
+	defer cleanup()
+	defer setStdin(mockStdin)()
+
+	b, err := ReadPasswordFromStdin()
+	require.NoError(t, err)
+	require.Equal(t, []byte("my-password"), b)
+
+	// The rest of stdin is available
+	b, err = ReadFile(stdinFilename)
+	require.NoError(t, err)
+	require.Equal(t, []byte("ssh-ed25519 AAAA...\n"), b)
+
+	// Last line without new line
+	mockStdin, cleanup = newFile(t, []byte("my-password"))
+	defer cleanup()
+	defer setStdin(mockStdin)()
+	b, err = ReadPasswordFromStdin()
+	require.NoError(t, err)
+	require.Equal(t, []byte("my-password"), b)
+}
+
 func TestReadInput(t *testing.T) {
 
 	type args struct {
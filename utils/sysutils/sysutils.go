@@ -1,6 +1,9 @@
 package sysutils
 
-import "syscall"
+import (
+	"os"
+	"syscall"
+)
 
 func Flock(fd int, how int) error {
 	return flock(fd, how)
@@ -21,3 +24,10 @@ func Kill(pid int, signum syscall.Signal) error {
 func Exec(argv0 string, argv []string, envv []string) error {
 	return exec(argv0, argv, envv)
 }
+
+// WriteFile writes data to the named file like ioutil.WriteFile. On Windows,
+// if perm does not grant access to the group or others, the file gets a
+// protected DACL that only allows access to the current user.
+func WriteFile(name string, data []byte, perm os.FileMode) error {
+	return writeFile(name, data, perm)
+}
@@ -3,6 +3,8 @@
 package sysutils
 
 import (
+	"io/ioutil"
+	"os"
 	"syscall"
 )
 
@@ -25,3 +27,7 @@ func kill(pid int, signum syscall.Signal) error {
 func exec(argv0 string, argv []string, envv []string) error {
 	return syscall.Exec(argv0, argv, envv)
 }
+
+func writeFile(name string, data []byte, perm os.FileMode) error {
+	return ioutil.WriteFile(name, data, perm)
+}
@@ -0,0 +1,45 @@
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package sysutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysutils")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assertFile := func(name string, data []byte, perm os.FileMode) {
+		t.Helper()
+		b, err := ioutil.ReadFile(name)
+		require.NoError(t, err)
+		require.Equal(t, data, b)
+		st, err := os.Stat(name)
+		require.NoError(t, err)
+		require.Equal(t, perm, st.Mode().Perm())
+	}
+
+	defer syscall.Umask(syscall.Umask(0022))
+
+	key := filepath.Join(dir, "key")
+	require.NoError(t, WriteFile(key, []byte("private"), 0600))
+	assertFile(key, []byte("private"), 0600)
+
+	pub := filepath.Join(dir, "key.pub")
+	require.NoError(t, WriteFile(pub, []byte("public"), 0644))
+	assertFile(pub, []byte("public"), 0644)
+
+	// Like ioutil.WriteFile, the permissions of an existing file are kept
+	require.NoError(t, WriteFile(pub, []byte("private"), 0600))
+	assertFile(pub, []byte("private"), 0644)
+
+	require.Error(t, WriteFile(filepath.Join(dir, "missing", "key"), []byte("private"), 0600))
+}
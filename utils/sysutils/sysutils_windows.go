@@ -2,8 +2,10 @@ package sysutils
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"syscall"
+	"unsafe"
 
 	"golang.org/x/sys/windows"
 )
@@ -28,12 +30,20 @@ func flock(fd int, how int) error {
 	return syscall.EWINDOWS
 }
 
+// fileLock locks the whole file using LockFileEx, it returns EWOULDBLOCK if
+// the file is already locked, like flock.
 func fileLock(fd int) error {
-	return nil
+	ol := new(windows.Overlapped)
+	err := windows.LockFileEx(windows.Handle(fd), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, ^uint32(0), ^uint32(0), ol)
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return syscall.EWOULDBLOCK
+	}
+	return err
 }
 
 func fileUnlock(fd int) error {
-	return nil
+	ol := new(windows.Overlapped)
+	return windows.UnlockFileEx(windows.Handle(fd), 0, ^uint32(0), ^uint32(0), ol)
 }
 
 func kill(pid int, signum syscall.Signal) error {
@@ -43,3 +53,60 @@ func kill(pid int, signum syscall.Signal) error {
 func exec(argv0 string, argv []string, envv []string) error {
 	return syscall.EWINDOWS
 }
+
+// writeFile writes the file with an owner-only DACL if perm does not grant
+// access to the group or others. The permissions of the new file are ignored
+// by Windows, and the inherited ACL usually allows other users to read it.
+func writeFile(name string, data []byte, perm os.FileMode) error {
+	if perm&0077 != 0 {
+		return ioutil.WriteFile(name, data, perm)
+	}
+
+	sd, err := ownerSecurityDescriptor()
+	if err != nil {
+		return &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	dacl, _, err := sd.DACL()
+	if err != nil {
+		return &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	path, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	sa := &windows.SecurityAttributes{
+		Length:             uint32(unsafe.Sizeof(windows.SecurityAttributes{})),
+		SecurityDescriptor: sd,
+	}
+	h, err := windows.CreateFile(path, windows.GENERIC_WRITE|windows.WRITE_DAC,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE, sa,
+		windows.CREATE_ALWAYS, windows.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	f := os.NewFile(uintptr(h), name)
+
+	// The security attributes are only used if the file is created.
+	if err := windows.SetSecurityInfo(h, windows.SE_FILE_OBJECT,
+		windows.DACL_SECURITY_INFORMATION|windows.PROTECTED_DACL_SECURITY_INFORMATION,
+		nil, nil, dacl, nil); err != nil {
+		f.Close()
+		return &os.PathError{Op: "chmod", Path: name, Err: err}
+	}
+
+	_, err = f.Write(data)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// ownerSecurityDescriptor returns a security descriptor with a protected DACL
+// that grants full access to the user of the current process.
+func ownerSecurityDescriptor() (*windows.SECURITY_DESCRIPTOR, error) {
+	user, err := windows.GetCurrentProcessToken().GetTokenUser()
+	if err != nil {
+		return nil, err
+	}
+	return windows.SecurityDescriptorFromString("D:P(A;;FA;;;" + user.User.Sid.String() + ")")
+}
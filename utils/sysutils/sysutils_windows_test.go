@@ -0,0 +1,57 @@
+package sysutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/windows"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysutils")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	user, err := windows.GetCurrentProcessToken().GetTokenUser()
+	require.NoError(t, err)
+	ownerACE := "(A;;FA;;;" + user.User.Sid.String() + ")"
+
+	getDACL := func(name string) string {
+		t.Helper()
+		sd, err := windows.GetNamedSecurityInfo(name, windows.SE_FILE_OBJECT, windows.DACL_SECURITY_INFORMATION)
+		require.NoError(t, err)
+		return sd.String()
+	}
+	assertOwnerOnly := func(name string, data []byte) {
+		t.Helper()
+		b, err := ioutil.ReadFile(name)
+		require.NoError(t, err)
+		require.Equal(t, data, b)
+		dacl := getDACL(name)
+		require.True(t, strings.HasPrefix(dacl, "D:P"), dacl)
+		require.Contains(t, dacl, ownerACE)
+		require.Equal(t, 1, strings.Count(dacl, "("), dacl)
+	}
+
+	key := filepath.Join(dir, "key")
+	require.NoError(t, WriteFile(key, []byte("private"), 0600))
+	assertOwnerOnly(key, []byte("private"))
+
+	// The DACL of an existing file is replaced
+	existing := filepath.Join(dir, "existing")
+	require.NoError(t, ioutil.WriteFile(existing, []byte("public"), 0644))
+	require.NotEqual(t, "D:P"+ownerACE, getDACL(existing))
+	require.NoError(t, WriteFile(existing, []byte("private"), 0600))
+	assertOwnerOnly(existing, []byte("private"))
+
+	// Public files use the inherited ACL
+	pub := filepath.Join(dir, "key.pub")
+	require.NoError(t, WriteFile(pub, []byte("public"), 0644))
+	require.False(t, strings.HasPrefix(getDACL(pub), "D:P"))
+
+	require.Error(t, WriteFile(filepath.Join(dir, "missing", "key"), []byte("private"), 0600))
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -14,6 +15,7 @@ import (
 	"github.com/smallstep/cli/command"
 	"github.com/smallstep/cli/errs"
 	"github.com/smallstep/cli/ui"
+	"github.com/smallstep/cli/utils/sysutils"
 )
 
 var (
@@ -35,16 +37,17 @@ var (
 // WriteFile wraps ioutil.WriteFile with a prompt to overwrite a file if
 // the file exists. It returns ErrFileExists if the user picks to not overwrite
 // the file. If force is set to true, the prompt will not be presented and the
-// file if exists will be overwritten.
+// file if exists will be overwritten. On Windows, files with owner-only
+// permissions, like private keys, are only accessible by the current user.
 func WriteFile(filename string, data []byte, perm os.FileMode) error {
 	if command.IsForce() {
-		return ioutil.WriteFile(filename, data, perm)
+		return sysutils.WriteFile(filename, data, perm)
 	}
 
 	st, err := os.Stat(filename)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return ioutil.WriteFile(filename, data, perm)
+			return sysutils.WriteFile(filename, data, perm)
 		}
 		return errors.Wrapf(err, "error reading information for %s", filename)
 	}
@@ -63,7 +66,42 @@ func WriteFile(filename string, data []byte, perm os.FileMode) error {
 		return ErrFileExists
 	}
 
-	return ioutil.WriteFile(filename, data, perm)
+	return sysutils.WriteFile(filename, data, perm)
+}
+
+// WriteFileAtomic writes the given data to a temporary file in the directory
+// of filename and renames it to filename, so readers of filename see the old
+// or the new contents but never a partial write. It does not prompt before
+// overwriting the file.
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := ioutil.TempFile(dir, "."+base+".tmp*")
+	if err != nil {
+		return errs.FileError(err, filename)
+	}
+	tmp := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errs.FileError(err, tmp)
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errs.FileError(err, tmp)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return errs.FileError(err, tmp)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return errs.FileError(err, filename)
+	}
+	return nil
 }
 
 // AppendNewLine appends the given data at the end of the file. If the last
@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "utils-write-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "id_ecdsa-cert.pub")
+	require.NoError(t, WriteFileAtomic(filename, []byte("first"), 0600))
+	require.NoError(t, WriteFileAtomic(filename, []byte("second"), 0644))
+
+	b, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, []byte("second"), b)
+	fi, err := os.Stat(filename)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0644), fi.Mode().Perm())
+
+	// No temporary files are left
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	// The directory must exist
+	require.Error(t, WriteFileAtomic(filepath.Join(dir, "missing", "file"), []byte("data"), 0600))
+}